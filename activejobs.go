@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// activeJobLimits cap the jobs each user and client address has queued or
+// processing at a time, so one client's parallel merges do not starve
+// everyone else; zero means no limit. Jobs of no user or address are not
+// limited.
+type activeJobLimits struct {
+	perUser   int
+	perRemote int
+	// queue accepts jobs past the limits, to wait in the queue until the
+	// client's earlier jobs are done, instead of refusing them
+	queue bool
+	// mu makes counting the active jobs of a client and creating its next
+	// one a single step, so parallel requests cannot all slip under a limit
+	mu sync.Mutex
+}
+
+// loadActiveJobLimits reads MAX_ACTIVE_JOBS_PER_USER,
+// MAX_ACTIVE_JOBS_PER_IP and ACTIVE_JOBS_EXCESS, "reject" or "queue"
+func loadActiveJobLimits() (*activeJobLimits, error) {
+	l := &activeJobLimits{}
+	for _, v := range []struct {
+		name string
+		dst  *int
+	}{{"MAX_ACTIVE_JOBS_PER_USER", &l.perUser}, {"MAX_ACTIVE_JOBS_PER_IP", &l.perRemote}} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", v.name, s)
+		}
+		*v.dst = n
+	}
+	switch v := strings.ToLower(os.Getenv("ACTIVE_JOBS_EXCESS")); v {
+	case "", "reject":
+	case "queue":
+		l.queue = true
+	default:
+		return nil, fmt.Errorf("invalid ACTIVE_JOBS_EXCESS %q: expected reject or queue", v)
+	}
+	return l, nil
+}
+
+// claimLimits are the limits workers claim queued jobs within
+func (l *activeJobLimits) claimLimits() ClaimLimits {
+	return ClaimLimits{PerUser: l.perUser, PerRemote: l.perRemote}
+}
+
+// check returns an error coded TOO_MANY_JOBS when user or remote already
+// has as many active jobs as allowed and excess jobs are refused
+func (l *activeJobLimits) check(jobs JobStore, user, remote string) error {
+	if l.queue || (l.perUser == 0 && l.perRemote == 0) {
+		return nil
+	}
+	if user == "" || l.perUser == 0 {
+		user = ""
+	}
+	if remote == "" || l.perRemote == 0 {
+		remote = ""
+	}
+	if user == "" && remote == "" {
+		return nil
+	}
+	byUser, byRemote, err := jobs.CountActive(user, remote)
+	if err != nil {
+		return fmt.Errorf("error counting active jobs: %v", err)
+	}
+	switch {
+	case user != "" && byUser >= l.perUser:
+		return withCode(CodeTooManyJobs, fmt.Errorf("too many active jobs: %s has %d queued or processing, the limit is %d", user, byUser, l.perUser))
+	case remote != "" && byRemote >= l.perRemote:
+		return withCode(CodeTooManyJobs, fmt.Errorf("too many active jobs: %s has %d queued or processing, the limit is %d", remote, byRemote, l.perRemote))
+	}
+	return nil
+}
+
+// createJob stores a new job unless its client is over its limits. remote
+// is the client address the job came from, if any.
+func (fh *FileHandler) createJob(job *Job, remote string) error {
+	job.Remote = clientIP(remote)
+	fh.activeJobs.mu.Lock()
+	defer fh.activeJobs.mu.Unlock()
+	if err := fh.activeJobs.check(fh.jobs, job.User, job.Remote); err != nil {
+		return err
+	}
+	return fh.jobs.Create(job)
+}
+
+// clientIP strips the port from a client address
+func clientIP(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+// limitActiveJobs wraps a handler queuing jobs so it answers 429 Too Many
+// Requests before receiving the uploads of clients over their limits.
+// Handlers still check the limits as they create the jobs.
+func (fh *FileHandler) limitActiveJobs(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if err := fh.activeJobs.check(fh.jobs, requestUser(r), clientIP(r.RemoteAddr)); err != nil {
+				writeJobCreateError(w, err)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// writeJobCreateError reports a job that could not be created
+func writeJobCreateError(w http.ResponseWriter, err error) {
+	if errorCode(err, "") == CodeTooManyJobs {
+		w.Header().Set("Retry-After", "60")
+		writeError(w, "Job refused: "+err.Error(), CodeTooManyJobs, http.StatusTooManyRequests)
+		return
+	}
+	writeError(w, "Error creating job: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+}
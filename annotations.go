@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// commentAnnotations are the annotation types reviewers add to a document:
+// notes, markup, drawings and stamps. Links and form fields are kept.
+var commentAnnotations = map[string]bool{
+	"Text":           true,
+	"FreeText":       true,
+	"Line":           true,
+	"Square":         true,
+	"Circle":         true,
+	"Polygon":        true,
+	"PolyLine":       true,
+	"Highlight":      true,
+	"Underline":      true,
+	"Squiggly":       true,
+	"StrikeOut":      true,
+	"Stamp":          true,
+	"Caret":          true,
+	"Ink":            true,
+	"Popup":          true,
+	"FileAttachment": true,
+	"Sound":          true,
+	"Redact":         true,
+}
+
+// removeAnnotations writes a copy of the PDF at in without comments and
+// markup annotations to out
+func removeAnnotations(in, out string) error {
+	ctx, err := readContext(in)
+	if err != nil {
+		return fmt.Errorf("error reading PDF: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+
+	for page := 1; page <= ctx.PageCount; page++ {
+		pageDict, _, _, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		annots, err := ctx.DereferenceArray(pageDict["Annots"])
+		if err != nil || len(annots) == 0 {
+			continue
+		}
+
+		var keep types.Array
+		for _, obj := range annots {
+			annot, err := ctx.DereferenceDict(obj)
+			if err != nil || annot == nil {
+				continue
+			}
+			if subtype := annot.NameEntry("Subtype"); subtype != nil && commentAnnotations[*subtype] {
+				continue
+			}
+			keep = append(keep, obj)
+		}
+		if len(keep) > 0 {
+			pageDict["Annots"] = keep
+		} else {
+			pageDict.Delete("Annots")
+		}
+	}
+	return api.WriteContextFile(ctx, out)
+}
+
+// resolveLinks prepares the annotations of the files of a job for merging.
+// Named destinations are replaced by the pages they name, as names from
+// different files collide in the merged document, and annotations stored
+// inline in a page are made separate objects so their page references can be
+// remapped when pages are copied. Files that need no changes are returned
+// as they are.
+func (fh *FileHandler) resolveLinks(jobID string, paths []string) ([]string, error) {
+	result := make([]string, len(paths))
+	for i, path := range paths {
+		result[i] = path
+
+		ctx, err := readContext(path)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := resolveDestinations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			continue
+		}
+
+		out := filepath.Join(fh.scratchDir, fmt.Sprintf("%s_%d_links.pdf", jobID, i))
+		if err := api.WriteContextFile(ctx, out); err != nil {
+			return nil, err
+		}
+		result[i] = out
+	}
+	return result, nil
+}
+
+// resolveDestinations rewrites the links, outline items and open action of
+// a document to explicit destinations, and reports whether anything changed
+func resolveDestinations(ctx *model.Context) (bool, error) {
+	if err := ctx.EnsurePageCount(); err != nil {
+		return false, err
+	}
+	named, err := namedDestinations(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for page := 1; page <= ctx.PageCount; page++ {
+		pageDict, pageRef, _, err := ctx.PageDict(page, false)
+		if err != nil {
+			return false, err
+		}
+		annots, err := ctx.DereferenceArray(pageDict["Annots"])
+		if err != nil || len(annots) == 0 {
+			continue
+		}
+
+		for i, obj := range annots {
+			annot, err := ctx.DereferenceDict(obj)
+			if err != nil || annot == nil {
+				continue
+			}
+			if _, ok := obj.(types.IndirectRef); !ok {
+				annot["P"] = *pageRef
+				ref, err := ctx.IndRefForNewObject(annot)
+				if err != nil {
+					return false, err
+				}
+				annots[i] = *ref
+				changed = true
+			}
+			if resolveTarget(ctx, annot, named) {
+				changed = true
+			}
+		}
+		pageDict["Annots"] = annots
+	}
+
+	// Outline items link to destinations the same way
+	if outlines, err := ctx.DereferenceDict(ctx.RootDict["Outlines"]); err == nil && outlines != nil {
+		seen := map[int]bool{}
+		item := outlines["First"]
+		for item != nil {
+			ref, ok := item.(types.IndirectRef)
+			if !ok || seen[ref.ObjectNumber.Value()] {
+				break
+			}
+			seen[ref.ObjectNumber.Value()] = true
+			d, err := ctx.DereferenceDict(ref)
+			if err != nil || d == nil {
+				break
+			}
+			if resolveTarget(ctx, d, named) {
+				changed = true
+			}
+			// Walk children before siblings
+			if first, ok := d["First"]; ok {
+				item = first
+				continue
+			}
+			item = nextOutlineItem(ctx, d)
+		}
+	}
+
+	if action, err := ctx.DereferenceDict(ctx.RootDict["OpenAction"]); err == nil && action != nil {
+		if resolveTarget(ctx, types.Dict{"A": action}, named) {
+			changed = true
+		}
+	} else if dest, ok := resolveName(ctx, ctx.RootDict["OpenAction"], named); ok {
+		ctx.RootDict["OpenAction"] = dest
+		changed = true
+	}
+	return changed, nil
+}
+
+// nextOutlineItem returns the item following d in the outline, climbing up
+// to the next sibling of a parent when d is the last of its siblings
+func nextOutlineItem(ctx *model.Context, d types.Dict) types.Object {
+	for d != nil {
+		if next, ok := d["Next"]; ok {
+			return next
+		}
+		parent, err := ctx.DereferenceDict(d["Parent"])
+		if err != nil || parent == nil || parent["Parent"] == nil {
+			return nil
+		}
+		d = parent
+	}
+	return nil
+}
+
+// resolveTarget replaces a named destination in the Dest entry or GoTo
+// action of d by the explicit destination
+func resolveTarget(ctx *model.Context, d types.Dict, named map[string]types.Object) bool {
+	if dest, ok := resolveName(ctx, d["Dest"], named); ok {
+		d["Dest"] = dest
+		return true
+	}
+	action, err := ctx.DereferenceDict(d["A"])
+	if err != nil || action == nil {
+		return false
+	}
+	if s := action.NameEntry("S"); s == nil || *s != "GoTo" {
+		return false
+	}
+	if dest, ok := resolveName(ctx, action["D"], named); ok {
+		action["D"] = dest
+		return true
+	}
+	return false
+}
+
+// resolveName returns the explicit destination for a destination name
+func resolveName(ctx *model.Context, o types.Object, named map[string]types.Object) (types.Object, bool) {
+	o, err := ctx.Dereference(o)
+	if err != nil {
+		return nil, false
+	}
+	var name string
+	switch o := o.(type) {
+	case types.Name:
+		name = o.Value()
+	case types.StringLiteral, types.HexLiteral:
+		s, err := types.StringOrHexLiteral(o)
+		if err != nil || s == nil {
+			return nil, false
+		}
+		name = *s
+	default:
+		return nil, false
+	}
+	dest, ok := named[name]
+	return dest, ok
+}
+
+// namedDestinations collects the destinations of the catalog's Dests
+// dictionary and of the Dests name tree
+func namedDestinations(ctx *model.Context) (map[string]types.Object, error) {
+	named := map[string]types.Object{}
+	add := func(name string, o types.Object) {
+		o, err := ctx.Dereference(o)
+		if err != nil {
+			return
+		}
+		// Destinations may be wrapped in a dictionary with a D entry
+		if d, ok := o.(types.Dict); ok {
+			if o, err = ctx.Dereference(d["D"]); err != nil {
+				return
+			}
+		}
+		if a, ok := o.(types.Array); ok {
+			named[name] = a
+		}
+	}
+
+	dests, err := ctx.DereferenceDict(ctx.RootDict["Dests"])
+	if err != nil {
+		return nil, err
+	}
+	for name, o := range dests {
+		add(name, o)
+	}
+
+	names, err := ctx.DereferenceDict(ctx.RootDict["Names"])
+	if err != nil || names == nil {
+		return named, err
+	}
+	var walk func(o types.Object, depth int)
+	walk = func(o types.Object, depth int) {
+		node, err := ctx.DereferenceDict(o)
+		if err != nil || node == nil || depth > 32 {
+			return
+		}
+		kids, _ := ctx.DereferenceArray(node["Kids"])
+		for _, kid := range kids {
+			walk(kid, depth+1)
+		}
+		pairs, _ := ctx.DereferenceArray(node["Names"])
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if s, err := types.StringOrHexLiteral(pairs[i]); err == nil && s != nil {
+				add(*s, pairs[i+1])
+			}
+		}
+	}
+	walk(names["Dests"], 0)
+	return named, nil
+}
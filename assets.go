@@ -0,0 +1,61 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+//go:embed web
+var embeddedWeb embed.FS
+
+// loadWebAssets returns the web interface's templates and static files.
+// Files in dir, laid out like the web directory of the source tree, replace
+// the embedded ones of the same name, so the interface can be themed without
+// rebuilding.
+func loadWebAssets(dir string) (fs.FS, error) {
+	if dir == "" {
+		return embeddedAssets(), nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return overlayFS{os.DirFS(dir), embeddedAssets()}, nil
+}
+
+// embeddedAssets returns the web directory built into the binary
+func embeddedAssets() fs.FS {
+	// Sub only fails for invalid names
+	web, _ := fs.Sub(embeddedWeb, "web")
+	return web
+}
+
+// hasLocalMerge reports whether the static files include the WebAssembly
+// build of the merge, built from ./wasm, and the script that runs it
+func (fh *FileHandler) hasLocalMerge() bool {
+	for _, name := range []string{"static/pdfmg.wasm", "static/wasm_exec.js"} {
+		if _, err := fs.Stat(fh.web, name); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// overlayFS opens files from top, falling back to base for those it lacks
+type overlayFS struct {
+	top, base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.base.Open(name)
+	}
+	return f, err
+}
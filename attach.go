@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// keepSources copies the uploads of a job aside, as conversion removes the
+// originals before they can be attached to the merged PDF. Copies kept by
+// an interrupted run of the job are used once their upload is gone.
+func (fh *FileHandler) keepSources(job *Job) ([]JobFile, error) {
+	var sources []JobFile
+	for i, file := range job.Files {
+		path := fh.sourcePath(job, i)
+		if _, err := os.Stat(file.Path); os.IsNotExist(err) {
+			if _, err := os.Stat(path); err == nil {
+				sources = append(sources, JobFile{Name: file.Name, Path: path})
+				continue
+			}
+		}
+		if err := copyFile(file.Path, path); err != nil {
+			removeSources(sources)
+			return nil, fmt.Errorf("error keeping %s: %v", file.Name, err)
+		}
+		sources = append(sources, JobFile{Name: file.Name, Path: path})
+	}
+	return sources, nil
+}
+
+// sourcePath returns where the i-th upload of a job is kept for attaching
+func (fh *FileHandler) sourcePath(job *Job, i int) string {
+	return filepath.Join(fh.scratchDir, fmt.Sprintf("%s_%d_source%s", job.ID, i, filepath.Ext(job.Files[i].Name)))
+}
+
+func removeSources(sources []JobFile) {
+	for _, s := range sources {
+		os.Remove(s.Path)
+	}
+}
+
+// attachSources embeds files in the PDF at path as attachments named after
+// the original uploads
+func attachSources(path string, files []JobFile, modTime time.Time) error {
+	return transformPDF(path, func(in, out string) error {
+		ctx, err := readContext(in)
+		if err != nil {
+			return fmt.Errorf("error reading PDF: %v", err)
+		}
+
+		// Attachments carried over from the inputs keep their names
+		existing, err := ctx.ListAttachments()
+		if err != nil {
+			return err
+		}
+		taken := map[string]bool{}
+		for _, a := range existing {
+			taken[a.ID] = true
+		}
+
+		for _, file := range files {
+			f, err := os.Open(file.Path)
+			if err != nil {
+				return err
+			}
+			id := attachmentName(file.Name, taken)
+			taken[id] = true
+			a := model.Attachment{Reader: f, ID: id, Desc: "Original of " + file.Name, ModTime: &modTime}
+			err = ctx.AddAttachment(a, false)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("error attaching %s: %v", file.Name, err)
+			}
+		}
+
+		return api.WriteContextFile(ctx, out)
+	})
+}
+
+// attachmentName returns name, numbered like "report (2).docx" when it is
+// already taken
+func attachmentName(name string, taken map[string]bool) string {
+	name = filepath.Base(name)
+	if !taken[name] {
+		return name
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if !taken[candidate] {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// Audited file operations
+const (
+	AuditUpload   = "upload"
+	AuditMerge    = "merge"
+	AuditDownload = "download"
+	AuditExport   = "export"
+	AuditDelete   = "delete"
+)
+
+// AuditEvent is one entry of the audit trail
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	User   string    `json:"user,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+	JobID  string    `json:"jobId,omitempty"`
+	File   string    `json:"file,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// AuditLog is an append-only record of file operations
+type AuditLog interface {
+	Record(e AuditEvent) error
+	// Events returns the events between since and until, oldest first;
+	// zero times leave the range open
+	Events(since, until time.Time) ([]AuditEvent, error)
+}
+
+// openAuditLog opens the audit trail described by AUDIT_LOG: "db" keeps it
+// in the job store, anything else is a JSON lines file
+func openAuditLog(spec string, jobs JobStore) (AuditLog, error) {
+	if spec == "db" {
+		al, ok := jobs.(AuditLog)
+		if !ok {
+			return nil, fmt.Errorf("the job store cannot keep an audit log")
+		}
+		return al, nil
+	}
+	f, err := os.OpenFile(spec, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	f.Close()
+	return &fileAuditLog{path: spec}, nil
+}
+
+// fileAuditLog appends events to a file, one JSON object per line. Lines are
+// written with a single append, so processes can share the file.
+type fileAuditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (l *fileAuditLog) Record(e AuditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (l *fileAuditLog) Events(since, until time.Time) ([]AuditEvent, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("error decoding line %d: %v", n, err)
+		}
+		if inRange(e.Time, since, until) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
+
+func inRange(t, since, until time.Time) bool {
+	return (since.IsZero() || !t.Before(since)) && (until.IsZero() || t.Before(until))
+}
+
+func (s *sqlJobStore) Record(e AuditEvent) error {
+	_, err := s.db.Exec(s.rebind(`INSERT INTO audit_events
+		(time, action, user_name, remote, job_id, file, sha256, size, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		e.Time.UnixMilli(), e.Action, e.User, e.Remote, e.JobID, e.File, e.SHA256, e.Size, e.Detail)
+	return err
+}
+
+func (s *sqlJobStore) Events(since, until time.Time) ([]AuditEvent, error) {
+	query := `SELECT time, action, user_name, remote, job_id, file, sha256, size, detail FROM audit_events WHERE 1 = 1`
+	var args []any
+	if !since.IsZero() {
+		query += ` AND time >= ?`
+		args = append(args, since.UnixMilli())
+	}
+	if !until.IsZero() {
+		query += ` AND time < ?`
+		args = append(args, until.UnixMilli())
+	}
+	rows, err := s.db.Query(s.rebind(query+` ORDER BY time`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		var t int64
+		if err := rows.Scan(&t, &e.Action, &e.User, &e.Remote, &e.JobID, &e.File, &e.SHA256, &e.Size, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.Time = time.UnixMilli(t).UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// audit records e if an audit log is configured. Failures are logged rather
+// than failing the operation.
+func (fh *FileHandler) audit(e AuditEvent) {
+	if fh.auditLog == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if err := fh.auditLog.Record(e); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// auditFile records an operation on the file at path, with its size and,
+// if hash is set, its SHA-256
+func (fh *FileHandler) auditFile(e AuditEvent, path string, hash bool) {
+	if fh.auditLog == nil {
+		return
+	}
+	if e.File == "" {
+		e.File = filepath.Base(path)
+	}
+	if info, err := os.Stat(path); err == nil {
+		e.Size = info.Size()
+	}
+	if hash && e.SHA256 == "" {
+		e.SHA256, _ = fileSHA256(path)
+	}
+	fh.audit(e)
+}
+
+// auditUploads records the uploaded files of a newly created job
+func (fh *FileHandler) auditUploads(job *Job, remote string) {
+	for _, f := range job.Files {
+		fh.auditFile(AuditEvent{Action: AuditUpload, User: job.User, Remote: remote, JobID: job.ID, File: f.Name, SHA256: f.SHA256}, f.Path, false)
+	}
+}
+
+// auditRequestUpload records a file uploaded to an endpoint that processes
+// it straight away and keeps nothing
+func (fh *FileHandler) auditRequestUpload(r *http.Request, fileHeader *multipart.FileHeader, sum, endpoint string) {
+	fh.audit(AuditEvent{Action: AuditUpload, User: requestUser(r), Remote: r.RemoteAddr,
+		File: fileHeader.Filename, SHA256: sum, Size: fileHeader.Size, Detail: endpoint})
+}
+
+// fileSHA256 returns the SHA-256 hex digest of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// grpcRemote returns the address of the client of a gRPC call
+func grpcRemote(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// handleAudit exports the audit trail as JSON or CSV to the users listed in
+// AUDIT_USERS
+func (fh *FileHandler) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+	if fh.auditLog == nil {
+		writeError(w, "Audit log not enabled", CodeNotFound, http.StatusNotFound)
+		return
+	}
+	if user := requestUser(r); user == "" || !slices.Contains(fh.auditUsers, user) {
+		writeError(w, "Forbidden", CodeForbidden, http.StatusForbidden)
+		return
+	}
+
+	var since, until time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := parseAuditTime(v)
+		if err != nil {
+			writeError(w, "Invalid "+p.name+": "+v, CodeInvalidRequest, http.StatusBadRequest)
+			return
+		}
+		*p.t = t
+	}
+
+	events, err := fh.auditLog.Events(since, until)
+	if err != nil {
+		writeError(w, "Error reading audit log: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	if user := r.URL.Query().Get("user"); user != "" {
+		events = slices.DeleteFunc(events, func(e AuditEvent) bool { return e.User != user })
+	}
+	if job := r.URL.Query().Get("job"); job != "" {
+		events = slices.DeleteFunc(events, func(e AuditEvent) bool { return e.JobID != job })
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		if events == nil {
+			events = []AuditEvent{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "action", "user", "remote", "job_id", "file", "sha256", "size", "detail"})
+		for _, e := range events {
+			cw.Write([]string{e.Time.Format(time.RFC3339Nano), e.Action, e.User, e.Remote, e.JobID,
+				e.File, e.SHA256, strconv.FormatInt(e.Size, 10), e.Detail})
+		}
+		cw.Flush()
+	default:
+		writeError(w, "Unsupported format: "+r.URL.Query().Get("format"), CodeInvalidRequest, http.StatusBadRequest)
+	}
+}
+
+// parseAuditTime accepts RFC 3339 times and plain dates, taken as UTC
+func parseAuditTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// MergeBackend is an engine merging PDFs. Engines cope with different kinds
+// of damage, so some malformed files only merge with one of them.
+type MergeBackend interface {
+	// Name is the name MERGE_BACKEND knows the engine by
+	Name() string
+	// Merge merges the PDFs at paths into out, in order
+	Merge(paths []string, out string) error
+}
+
+// pdfcpuBackend merges in process with pdfcpu, the default
+type pdfcpuBackend struct {
+	resources workerResources
+}
+
+func (pdfcpuBackend) Name() string { return "pdfcpu" }
+
+func (b pdfcpuBackend) Merge(paths []string, out string) error {
+	// Long lists are merged in batches on several threads
+	if batch := b.resources.mergeBatch; batch > 0 && len(paths) > batch && b.resources.jobThreads > 1 {
+		return mergeTree(paths, out, batch, b.resources.jobThreads)
+	}
+	return api.MergeCreateFile(paths, out, false, pdfConfig())
+}
+
+// qpdfBackend merges with the qpdf binary, which repairs broken
+// cross-reference tables and streams as it reads
+type qpdfBackend struct {
+	path    string
+	sandbox *sandbox
+}
+
+func (qpdfBackend) Name() string { return "qpdf" }
+
+func (b qpdfBackend) Merge(paths []string, out string) error {
+	args := []string{"--empty", "--pages"}
+	args = append(args, paths...)
+	args = append(args, "--", out)
+	output, err := b.sandbox.run(b.path, args...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// Exit status 3 means the files merged with warnings about what
+		// qpdf repaired
+		if exitErr.ExitCode() == 3 {
+			return nil
+		}
+		return fmt.Errorf("qpdf failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
+
+// mutoolBackend merges with mutool of MuPDF, whose parser is as lenient as
+// the viewers built on it
+type mutoolBackend struct {
+	path    string
+	sandbox *sandbox
+}
+
+func (mutoolBackend) Name() string { return "mutool" }
+
+func (b mutoolBackend) Merge(paths []string, out string) error {
+	args := append([]string{"merge", "-o", out}, paths...)
+	output, err := b.sandbox.run(b.path, args...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("mutool failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
+
+// loadMergeBackends reads MERGE_BACKEND, the engines tried in turn until one
+// merges the files, e.g. "qpdf,pdfcpu", and QPDF_PATH and MUTOOL_PATH, the
+// binaries of the external ones when they are not in PATH. By default
+// merges use pdfcpu alone. The external engines run in sb.
+func loadMergeBackends(resources workerResources, sb *sandbox) ([]MergeBackend, error) {
+	names := splitList(strings.ToLower(os.Getenv("MERGE_BACKEND")))
+	if len(names) == 0 {
+		names = []string{"pdfcpu"}
+	}
+	var backends []MergeBackend
+	for _, name := range names {
+		var b MergeBackend
+		switch name {
+		case "pdfcpu":
+			b = pdfcpuBackend{resources: resources}
+		case "qpdf", "mutool":
+			path := os.Getenv(strings.ToUpper(name) + "_PATH")
+			if path == "" {
+				found, err := exec.LookPath(name)
+				if err != nil {
+					return nil, fmt.Errorf("%s not found in PATH; set %s_PATH", name, strings.ToUpper(name))
+				}
+				path = found
+			}
+			if name == "qpdf" {
+				b = qpdfBackend{path: path, sandbox: sb}
+			} else {
+				b = mutoolBackend{path: path, sandbox: sb}
+			}
+		default:
+			return nil, fmt.Errorf("unknown merge backend %q: expected pdfcpu, qpdf or mutool", name)
+		}
+		for _, other := range backends {
+			if other.Name() == name {
+				return nil, fmt.Errorf("merge backend %s is listed twice", name)
+			}
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+// mergeWith merges the PDFs at paths into out with the first of backends
+// that succeeds, and returns the error of the last when none does. Failed
+// attempts leave no output behind.
+func mergeWith(backends []MergeBackend, paths []string, out string) error {
+	// External engines run in a directory of their own
+	abs := make([]string, len(paths))
+	for i, path := range paths {
+		var err error
+		if abs[i], err = filepath.Abs(path); err != nil {
+			return err
+		}
+	}
+	out, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+
+	for i, b := range backends {
+		err = b.Merge(abs, out)
+		if err == nil {
+			return nil
+		}
+		os.Remove(out)
+		if i+1 < len(backends) {
+			log.Printf("Merging with %s failed, trying %s: %v", b.Name(), backends[i+1].Name(), err)
+		}
+	}
+	if len(backends) > 1 {
+		return fmt.Errorf("%s: %v", backends[len(backends)-1].Name(), err)
+	}
+	return err
+}
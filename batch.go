@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Jobs a batch manifest may define
+const maxBatchJobs = 100
+
+// BatchJob is a merge job of a batch manifest. Files name the uploaded
+// files to merge, in order, and jobs may share them. Options are the form
+// fields of /upload, where overlay, icc_profile and cover_logo name uploaded files
+// too.
+type BatchJob struct {
+	Name    string         `json:"name"`
+	Files   []string       `json:"files"`
+	Options map[string]any `json:"options,omitempty"`
+}
+
+// Upload form fields batch jobs do without, as they are merged unattended
+// from the files of the batch
+var batchUnsupported = []string{"drive_file_ids", "dropbox_links", "dropbox_paths", "destination", "urls", "session", "manifest"}
+
+// batchResult is the outcome of a job of a batch manifest: its ID once
+// queued, or why it was not
+type batchResult struct {
+	Name  string `json:"name,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// handleBatch queues the merge jobs of the manifest sent with their files in
+// one request, and returns the result of each without waiting for them. Jobs
+// with an error are left out while the others are queued, which a 207 Multi
+// Status tells apart from all of them being queued.
+func (fh *FileHandler) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	timestamp := time.Now().Format("20060102_150405")
+	sf, err := fh.spoolForm(w, r, timestamp)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, fmt.Sprintf("Upload too large: the limit is %.0f MB", float64(tooLarge.Limit)/(1<<20)), CodeTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeError(w, "Error parsing form: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	// Uploads no queued job took are removed
+	copies := fh.copies(sf, timestamp)
+	defer func() {
+		for _, f := range sf.files {
+			if !copies.taken[f.path] {
+				os.Remove(f.path)
+			}
+		}
+		for _, f := range sf.options {
+			os.Remove(f.path)
+		}
+	}()
+
+	checksums, err := parseChecksums(r.PostForm["checksums"], len(sf.files))
+	if err != nil {
+		writeError(w, err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	uploads := map[string]spooledFile{}
+	for i, f := range sf.files {
+		if checksums[i] != "" && checksums[i] != f.sha256 {
+			writeError(w, fmt.Sprintf("Checksum mismatch for %s: received SHA-256 %s, expected %s",
+				f.name, f.sha256, checksums[i]), CodeChecksumMismatch, http.StatusBadRequest)
+			return
+		}
+		if _, ok := uploads[f.name]; ok {
+			writeError(w, "Duplicate file name: "+f.name, CodeInvalidRequest, http.StatusBadRequest)
+			return
+		}
+		uploads[f.name] = f
+	}
+
+	var manifest []BatchJob
+	if err := json.Unmarshal([]byte(r.FormValue("manifest")), &manifest); err != nil {
+		writeError(w, "Invalid manifest: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if len(manifest) == 0 {
+		writeError(w, "No jobs in manifest", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if len(manifest) > maxBatchJobs {
+		writeError(w, fmt.Sprintf("Too many jobs in manifest: the limit is %d", maxBatchJobs), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, len(manifest))
+	queued := 0
+	status := http.StatusBadRequest
+	for i, bj := range manifest {
+		results[i].Name = bj.Name
+		job, err := fh.batchJob(bj, uploads)
+		if err != nil {
+			results[i].Error = err.Error()
+			results[i].Code = errorCode(err, CodeInvalidRequest)
+			continue
+		}
+		job.User = requestUser(r)
+		job.RequestID = requestID(r.Context())
+
+		paths := jobPaths(job)
+		for n, path := range paths {
+			if err = copies.take(path); err != nil {
+				paths = paths[:n]
+				break
+			}
+		}
+		if err == nil {
+			err = fh.createJob(job, r.RemoteAddr)
+		}
+		if errorCode(err, "") == CodeTooManyJobs {
+			for _, path := range paths {
+				os.Remove(*path)
+			}
+			results[i].Error = err.Error()
+			results[i].Code = CodeTooManyJobs
+			if status != http.StatusInternalServerError {
+				status = http.StatusTooManyRequests
+			}
+			continue
+		}
+		if err != nil {
+			for _, path := range paths {
+				os.Remove(*path)
+			}
+			log.Printf("Error creating job %d of batch (request %s): %v", i+1, requestID(r.Context()), err)
+			results[i].Error = "Error creating job: " + err.Error()
+			results[i].Code = CodeInternal
+			status = http.StatusInternalServerError
+			continue
+		}
+		fh.auditUploads(job, r.RemoteAddr)
+		results[i].ID = job.ID
+		queued++
+	}
+	switch queued {
+	case len(results):
+		status = http.StatusAccepted
+	case 0:
+	default:
+		status = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// batchJob returns the job a manifest entry defines, with the paths of the
+// uploads it names
+func (fh *FileHandler) batchJob(bj BatchJob, uploads map[string]spooledFile) (*Job, error) {
+	for _, field := range batchUnsupported {
+		if _, ok := bj.Options[field]; ok {
+			return nil, withCode(CodeInvalidOption, fmt.Errorf("%s is not available in batches", field))
+		}
+	}
+	form, err := batchForm(bj.Options)
+	if err != nil {
+		return nil, err
+	}
+	if bj.Name != "" {
+		form.Set("name", bj.Name)
+	}
+	opts, err := parseMergeOptions(&http.Request{Form: form})
+	if err != nil {
+		return nil, withCode(CodeInvalidOption, err)
+	}
+
+	upload := func(name string) (spooledFile, error) {
+		f, ok := uploads[name]
+		if !ok {
+			return f, fmt.Errorf("no uploaded file named %s", name)
+		}
+		return f, nil
+	}
+	if name := form.Get("overlay"); name != "" {
+		f, err := upload(name)
+		if err != nil {
+			return nil, err
+		}
+		opts.Overlay = f.path
+	}
+	if name := form.Get("icc_profile"); name != "" && (opts.CMYK || opts.PDFX != "") {
+		f, err := upload(name)
+		if err != nil {
+			return nil, err
+		}
+		opts.ICCProfile = f.path
+	}
+	if name := form.Get("cover_logo"); name != "" && opts.Cover != nil {
+		f, err := upload(name)
+		if err != nil {
+			return nil, err
+		}
+		opts.Cover.Logo = f.path
+	}
+
+	job := &Job{Name: bj.Name, Options: opts, Status: JobQueued}
+	var size int64
+	for _, name := range bj.Files {
+		f, err := upload(name)
+		if err != nil {
+			return nil, err
+		}
+		job.Files = append(job.Files, JobFile{Name: f.name, Path: f.path, SHA256: f.sha256})
+		size += f.size
+	}
+	if len(job.Files) == 0 {
+		return nil, errors.New("no files")
+	}
+	if opts.Mode == ModeInterleave && len(job.Files) != 2 {
+		return nil, errors.New("Interleaving needs exactly 2 files")
+	}
+	if err := fh.checkOptions(&job.Options, size); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// batchForm turns the options of a manifest entry into form values. Lists
+// repeat a field, as alt_text does, and objects are passed on as JSON, as
+// form_values is.
+func batchForm(options map[string]any) (url.Values, error) {
+	form := url.Values{}
+	var add func(field string, v any) error
+	add = func(field string, v any) error {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			form.Add(field, v)
+		case bool:
+			form.Add(field, strconv.FormatBool(v))
+		case float64:
+			form.Add(field, strconv.FormatFloat(v, 'f', -1, 64))
+		case []any:
+			for _, item := range v {
+				if _, ok := item.([]any); ok {
+					return fmt.Errorf("invalid %s: nested list", field)
+				}
+				if err := add(field, item); err != nil {
+					return err
+				}
+			}
+		case map[string]any:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", field, err)
+			}
+			form.Add(field, string(b))
+		}
+		return nil
+	}
+	for field, v := range options {
+		if err := add(field, v); err != nil {
+			return nil, err
+		}
+	}
+	return form, nil
+}
+
+// jobPaths returns the fields holding the paths of the files of a job
+func jobPaths(job *Job) []*string {
+	var paths []*string
+	for i := range job.Files {
+		paths = append(paths, &job.Files[i].Path)
+	}
+	if job.Options.Overlay != "" {
+		paths = append(paths, &job.Options.Overlay)
+	}
+	if job.Options.ICCProfile != "" {
+		paths = append(paths, &job.Options.ICCProfile)
+	}
+	if job.Options.Cover != nil && job.Options.Cover.Logo != "" {
+		paths = append(paths, &job.Options.Cover.Logo)
+	}
+	return paths
+}
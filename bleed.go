@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Most bleed a full-bleed image may have, in mm
+const maxBleed = 10
+
+// bleedLayout is the page of a full-bleed image: the A4 trim box it is cut
+// to, the bleed box the image fills, and room for cut marks around that
+type bleedLayout struct {
+	page  types.Dim
+	trim  *types.Rectangle
+	bleed *types.Rectangle
+}
+
+// newBleedLayout lays out the page of a full-bleed image, landscape for
+// landscape images, with bleed mm of image beyond the trim box
+func newBleedLayout(landscape bool, bleed int, marks bool) bleedLayout {
+	trim := paperSizes[NormalizeA4]
+	if landscape {
+		trim.Width, trim.Height = trim.Height, trim.Width
+	}
+	b := float64(bleed) * pointsPerMM
+	margin := b
+	if marks {
+		margin += cutMarkSpace
+	}
+	return bleedLayout{
+		page:  types.Dim{Width: trim.Width + 2*margin, Height: trim.Height + 2*margin},
+		trim:  types.NewRectangle(margin, margin, margin+trim.Width, margin+trim.Height),
+		bleed: types.NewRectangle(margin-b, margin-b, margin+trim.Width+b, margin+trim.Height+b),
+	}
+}
+
+// fillBleed cuts img to the proportions of the bleed box, keeping its
+// centre, so it fills the box without being distorted
+func fillBleed(img image.Image, layout bleedLayout) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	ratio := layout.bleed.Width() / layout.bleed.Height()
+	if float64(w)/float64(h) > ratio {
+		w = max(int(float64(h)*ratio+0.5), 1)
+	} else {
+		h = max(int(float64(w)/ratio+0.5), 1)
+	}
+	return imaging.CropCenter(img, w, h)
+}
+
+// markBleed gives the page of the full-bleed image PDF at path its trim
+// and bleed boxes, for printers to trim it by, and cut marks at the
+// corners of the trim box when marks is set
+func markBleed(path string, layout bleedLayout, marks bool) error {
+	return transformPDF(path, func(in, out string) error {
+		ctx, err := readContext(in)
+		if err != nil {
+			return err
+		}
+		pageDict, _, _, err := ctx.PageDict(1, false)
+		if err != nil {
+			return err
+		}
+		pageDict["TrimBox"] = layout.trim.Array()
+		pageDict["BleedBox"] = layout.bleed.Array()
+		if marks {
+			gap := layout.trim.LL.X - layout.bleed.LL.X + cutMarkGap
+			if err := wrapContents(ctx.XRefTable, pageDict, []byte("q\n"), append([]byte("Q\n"), drawCutMarks(layout.trim, gap)...)); err != nil {
+				return err
+			}
+		}
+		return api.WriteContextFile(ctx, out)
+	})
+}
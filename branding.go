@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"regexp"
+)
+
+// Hex, named and rgb()/hsl() colors; nothing that could end the declaration
+var cssColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+|(rgb|hsl)a?\([0-9.,%/ ]+\))$`)
+
+// branding lets deployments put their own name, logo, colors and footer on
+// the web interface
+type branding struct {
+	// Name is the page title; Heading the title shown on the page
+	Name    string
+	Heading string
+	LogoURL string
+	Footer  string
+	// CSS colors of links and buttons, the merge button and the page
+	// background; empty ones keep the stylesheet's. They are checked by
+	// loadBranding, so the template inserts them as they are.
+	PrimaryColor    template.CSS
+	AccentColor     template.CSS
+	BackgroundColor template.CSS
+}
+
+// loadBranding reads BRAND_NAME, BRAND_LOGO_URL, BRAND_FOOTER and the
+// BRAND_PRIMARY_COLOR, BRAND_ACCENT_COLOR and BRAND_BACKGROUND_COLOR colors
+func loadBranding() (branding, error) {
+	b := defaultBranding()
+	if name := os.Getenv("BRAND_NAME"); name != "" {
+		b.Name = name
+		b.Heading = name
+	}
+	b.LogoURL = os.Getenv("BRAND_LOGO_URL")
+	b.Footer = os.Getenv("BRAND_FOOTER")
+	for _, c := range []struct {
+		name string
+		dst  *template.CSS
+	}{
+		{"BRAND_PRIMARY_COLOR", &b.PrimaryColor},
+		{"BRAND_ACCENT_COLOR", &b.AccentColor},
+		{"BRAND_BACKGROUND_COLOR", &b.BackgroundColor},
+	} {
+		v := os.Getenv(c.name)
+		if v != "" && !cssColor.MatchString(v) {
+			return b, fmt.Errorf("invalid %s: %s", c.name, v)
+		}
+		*c.dst = template.CSS(v)
+	}
+	return b, nil
+}
+
+func defaultBranding() branding {
+	return branding{Name: "PDF Merger", Heading: "PDF Merger & Image Converter"}
+}
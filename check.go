@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkProblem is something that keeps a file from being merged, with a
+// message saying what to do about it
+type checkProblem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// checkResult is the pre-flight check of a single file
+type checkResult struct {
+	Name   string `json:"name"`
+	Format string `json:"format,omitempty"`
+	Pages  int    `json:"pages,omitempty"`
+	// Problems fail a merge of the file, warnings and repairs don't
+	Problems []checkProblem `json:"problems,omitempty"`
+	Warnings []string       `json:"warnings,omitempty"`
+	Repairs  []string       `json:"repairs,omitempty"`
+}
+
+// handleCheck checks a single file as it is added, so a file that needs a
+// password, is damaged or has no pages is reported before the whole upload
+// rather than after it
+func (fh *FileHandler) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		writeError(w, "Error parsing form: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		writeError(w, "No file uploaded", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	path := fh.uploadPath(time.Now().Format("20060102_150405"), 0, "check_"+files[0].Filename)
+	defer os.Remove(path)
+	sum, err := saveUpload(files[0], path)
+	if err != nil {
+		writeError(w, "Error saving file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	fh.auditRequestUpload(r, files[0], sum, "check")
+
+	result, err := fh.checkFile(JobFile{Name: files[0].Filename, Path: path}, files[0].Size)
+	if err != nil {
+		writeError(w, "Error checking file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkFile reads as much of file as converting it would, reporting what
+// would fail its merge. Large files are only counted, not read into memory.
+func (fh *FileHandler) checkFile(file JobFile, size int64) (*checkResult, error) {
+	result := &checkResult{Name: file.Name}
+	problem := func(code, msg string) {
+		result.Problems = append(result.Problems, checkProblem{Code: code, Message: msg})
+	}
+
+	if fh.uploads.maxSize > 0 && size > fh.uploads.maxSize {
+		problem(CodeTooLarge, fmt.Sprintf("%s is larger than the %.0f MB an upload may be. Compress it or split it into smaller files.",
+			file.Name, float64(fh.uploads.maxSize)/(1<<20)))
+	}
+
+	large := fh.uploads.largeFileMode(size)
+	report, err := examineUpload(file, large)
+	if err != nil {
+		return nil, err
+	}
+	result.Format = report.Format
+	result.Warnings = report.Warnings
+	result.Repairs = report.Repairs
+
+	switch strings.ToLower(filepath.Ext(file.Name)) {
+	case ".pdf":
+		result.Pages, err = checkPDF(file.Path, large)
+		switch {
+		case err != nil && pdfErrorCode(err) == CodeEncryptedInput:
+			problem(CodeEncryptedInput, file.Name+" needs a password to open. Remove the password in your PDF reader, save a copy and add that instead.")
+		case err != nil:
+			problem(CodeCorruptPDF, file.Name+" is damaged and cannot be read. Open and save it again in your PDF reader, or export it anew from where it came from.")
+		case result.Pages == 0:
+			problem(CodeCorruptPDF, file.Name+" has no pages. Export it again with its pages, or remove it.")
+		}
+	case ".png", ".jpg", ".jpeg":
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		_, _, err = image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			problem(CodeCorruptImage, file.Name+" is damaged or not an image. Save it again as PNG or JPEG and add that instead.")
+			break
+		}
+		result.Pages = 1
+	default:
+		// Files converted by plugins are counted once converted
+		if fh.plugin(file.Name) == nil {
+			problem(CodeUnsupportedFormat, file.Name+" is not a PDF, PNG or JPEG file. Convert it to PDF and add that instead.")
+		}
+	}
+
+	if limit := fh.limits.maxPages; limit > 0 && result.Pages > limit && !fh.limits.truncate {
+		problem(CodeTooManyPages, fmt.Sprintf("%s has %d pages, more than the %d a merge may have. Split it and merge the parts separately.",
+			file.Name, result.Pages, limit))
+	}
+	return result, nil
+}
+
+// checkPDF returns the page count of the PDF at path, read as conversion
+// reads it: counted in place when large, decrypted and validated otherwise
+func checkPDF(path string, large bool) (int, error) {
+	if large {
+		return countPages(path)
+	}
+	ctx, err := readContext(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return 0, err
+	}
+	return ctx.PageCount, nil
+}
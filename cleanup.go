@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// When the API and workers run as separate processes, orphaned files are
+// only removed once they have been left alone this long
+const orphanGrace = 10 * time.Minute
+
+// cleanOrphans removes what a crash leaves behind: files in the uploads and
+// scratch directories that no unfinished job or upload session refers to,
+// and temporary files in the output directory. The converted files and kept
+// sources of unfinished jobs stay for resuming them, and expired upload
+// sessions are removed first. Files changed within grace are kept, as other
+// processes sharing the directories may still be using them.
+func (fh *FileHandler) cleanOrphans(grace time.Duration) error {
+	jobs, err := fh.jobs.List()
+	if err != nil {
+		return fmt.Errorf("error listing jobs: %v", err)
+	}
+	referenced := map[string]bool{}
+	keep := func(path string) {
+		if abs, err := filepath.Abs(path); err == nil {
+			referenced[abs] = true
+		}
+	}
+	for _, job := range jobs {
+		if job.Status != JobQueued && job.Status != JobProcessing {
+			continue
+		}
+		for i, f := range job.Files {
+			keep(f.Path)
+			if f.Converted != "" {
+				keep(f.Converted)
+			}
+			if job.Options.AttachSources {
+				keep(fh.sourcePath(job, i))
+			}
+		}
+		if job.Options.Overlay != "" {
+			keep(job.Options.Overlay)
+		}
+		if job.Options.ICCProfile != "" {
+			keep(job.Options.ICCProfile)
+		}
+		if job.Options.Cover != nil && job.Options.Cover.Logo != "" {
+			keep(job.Options.Cover.Logo)
+		}
+	}
+	if fh.uploadSessions != nil {
+		fh.expireUploadSessions()
+		sessions, err := fh.uploadSessions.ListSessions()
+		if err != nil {
+			return fmt.Errorf("error listing upload sessions: %v", err)
+		}
+		for _, session := range sessions {
+			for _, f := range session.Files {
+				keep(fh.sessionFilePath(session.Token, f))
+			}
+		}
+	}
+
+	cutoff := time.Now().Add(-grace)
+	var count int
+	var size int64
+	remove := func(dir string, orphan func(name string) bool) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.Printf("Error reading %s: %v", dir, err)
+			return
+		}
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			info, err := e.Info()
+			if err != nil || info.ModTime().After(cutoff) || !orphan(path) {
+				continue
+			}
+			n := info.Size()
+			if e.IsDir() {
+				n = dirSize(path)
+			}
+			if err := os.RemoveAll(path); err != nil {
+				log.Printf("Error removing %s: %v", path, err)
+				continue
+			}
+			log.Printf("Removed orphaned %s", path)
+			fh.audit(AuditEvent{Action: AuditDelete, File: e.Name(), Size: n, Detail: "orphaned in " + dir})
+			count++
+			size += n
+		}
+	}
+
+	unreferenced := func(path string) bool {
+		abs, err := filepath.Abs(path)
+		return err == nil && !referenced[abs]
+	}
+	remove(fh.uploadsDir, unreferenced)
+	if fh.scratchDir != fh.uploadsDir {
+		remove(fh.scratchDir, unreferenced)
+	}
+	// Files are rewritten through a .tmp copy next to them
+	remove(fh.outputDir, func(path string) bool {
+		return strings.HasSuffix(path, ".tmp")
+	})
+
+	if count > 0 {
+		log.Printf("Startup cleanup reclaimed %.1f MB in %d files", float64(size)/(1<<20), count)
+	}
+	return nil
+}
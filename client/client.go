@@ -0,0 +1,497 @@
+// Package client is a Go client for the PDF merger HTTP API.
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client calls the HTTP API of a PDF merger server
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, e.g. "http://localhost:8080"
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Error is returned when the server answers with a non-2xx status
+type Error struct {
+	StatusCode int
+	// Code is the stable code of the error, e.g. CORRUPT_PDF or
+	// QUOTA_EXCEEDED; see the Code constants
+	Code    string
+	Message string
+	// RequestID is the X-Request-ID the server answered with, to find the
+	// request in its logs
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("pdfmg: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("pdfmg: %d %s", e.StatusCode, e.Message)
+}
+
+// Codes of the errors of the server, which stay the same as messages change
+const (
+	CodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	CodeInvalidRequest      = "INVALID_REQUEST"
+	CodeInvalidOption       = "INVALID_OPTION"
+	CodeNotAvailable        = "NOT_AVAILABLE"
+	CodeChecksumMismatch    = "CHECKSUM_MISMATCH"
+	CodeTooLarge            = "TOO_LARGE"
+	CodeImportFailed        = "IMPORT_FAILED"
+	CodeUnauthorized        = "UNAUTHORIZED"
+	CodeForbidden           = "FORBIDDEN"
+	CodeNotFound            = "NOT_FOUND"
+	CodeConflict            = "CONFLICT"
+	CodeTooManyJobs         = "TOO_MANY_JOBS"
+	CodeInsufficientStorage = "INSUFFICIENT_STORAGE"
+	CodeQuotaExceeded       = "QUOTA_EXCEEDED"
+	CodeDeletionIncomplete  = "DELETION_INCOMPLETE"
+	CodeInternal            = "INTERNAL"
+	CodeUnsupportedFormat   = "UNSUPPORTED_FORMAT"
+	CodeEncryptedInput      = "ENCRYPTED_INPUT"
+	CodeCorruptPDF          = "CORRUPT_PDF"
+	CodeCorruptImage        = "CORRUPT_IMAGE"
+	CodeConversionFailed    = "CONVERSION_FAILED"
+	CodeTooManyPages        = "TOO_MANY_PAGES"
+	CodeOutputTooLarge      = "OUTPUT_TOO_LARGE"
+	CodeMergeFailed         = "MERGE_FAILED"
+	CodeAborted             = "ABORTED"
+	CodeReleaseVetoed       = "RELEASE_VETOED"
+	CodeReleaseHookFailed   = "RELEASE_HOOK_FAILED"
+)
+
+// File is an input of a merge. Name decides how the file is converted,
+// so it must carry the extension (.pdf, .png, .jpg, .jpeg).
+type File struct {
+	Name   string
+	Reader io.Reader
+	// SHA256 is the optional hex digest of the file; the server refuses the
+	// merge if the bytes it received differ
+	SHA256 string
+}
+
+// MergeResult is the response of a successful merge
+type MergeResult struct {
+	Status      string `json:"status"`
+	JobID       string `json:"jobId"`
+	DownloadURL string `json:"downloadUrl"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	ExportedTo  string `json:"exportedTo"`
+	ExportError string `json:"exportError"`
+	// Untagged names the files without structure tags
+	Untagged []string `json:"untagged"`
+	// PageMap traces the pages of the output to the uploads
+	PageMap []PageRun `json:"pageMap"`
+	// Report tells what the server found in each upload
+	Report []InputReport `json:"report"`
+	// Skipped lists the uploads left out with on_error=skip
+	Skipped []SkippedFile `json:"skipped"`
+	// FailedVolumes lists the volumes that could not be written when Status
+	// is partial; the others are downloadable
+	FailedVolumes []VolumeError `json:"failedVolumes"`
+	// SizeReport is set when the merge optimized images
+	SizeReport *SizeReport `json:"sizeReport"`
+	// ManifestURL and ManifestSignatureURL download the signed manifest
+	// of merges with signed_manifest and its detached CMS signature
+	ManifestURL          string `json:"manifestUrl"`
+	ManifestSignatureURL string `json:"manifestSignatureUrl"`
+}
+
+// SizeReport compares the size of a merged file with its uploads
+type SizeReport struct {
+	InputSize  int64 `json:"inputSize"`
+	OutputSize int64 `json:"outputSize"`
+	// Breakdown is nil for merges that are not a single PDF
+	Breakdown *SizeBreakdown `json:"breakdown"`
+}
+
+// SizeBreakdown divides the bytes of a merged PDF among its images,
+// embedded fonts, page content and the rest
+type SizeBreakdown struct {
+	Images  int64 `json:"images"`
+	Fonts   int64 `json:"fonts"`
+	Content int64 `json:"content"`
+	Other   int64 `json:"other"`
+}
+
+// VolumeError is a volume of a split merge that could not be written
+type VolumeError struct {
+	Volume int    `json:"volume"`
+	Error  string `json:"error"`
+	Code   string `json:"code"`
+}
+
+// SkippedFile is an upload left out of a merge as it failed to convert
+type SkippedFile struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// InputReport tells what the server found in an upload: the media type of
+// its content, the pages it contributes to the output, the damage repaired
+// in reading it, the fonts viewers substitute as it does not embed them,
+// any other warnings and what sanitizing removed from it. Merges that
+// optimize images report the size of the upload and of the PDF it became.
+type InputReport struct {
+	Name             string   `json:"name"`
+	Format           string   `json:"format"`
+	Pages            int      `json:"pages"`
+	Repairs          []string `json:"repairs"`
+	SubstitutedFonts []string `json:"substitutedFonts"`
+	Warnings         []string `json:"warnings"`
+	Sanitized        []string `json:"sanitized"`
+	Size             int64    `json:"size"`
+	ConvertedSize    int64    `json:"convertedSize"`
+}
+
+// PageRun maps consecutive pages of the output, or of a volume of it, to
+// consecutive pages of one upload, starting at SourcePage
+type PageRun struct {
+	Volume     int    `json:"volume"`
+	First      int    `json:"first"`
+	Last       int    `json:"last"`
+	File       string `json:"file"`
+	SourcePage int    `json:"sourcePage"`
+}
+
+// JobStatus is the state of a merge job
+type JobStatus struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Status      string        `json:"status"`
+	Files       []string      `json:"files"`
+	DownloadURL string        `json:"downloadUrl"`
+	Size        int64         `json:"size"`
+	SHA256      string        `json:"sha256"`
+	Progress    *Progress     `json:"progress"`
+	Error       string        `json:"error"`
+	ErrorCode   string        `json:"errorCode"`
+	Untagged    []string      `json:"untagged"`
+	PageMap     []PageRun     `json:"pageMap"`
+	Report      []InputReport `json:"report"`
+	Skipped     []SkippedFile `json:"skipped"`
+	// FailedVolumes lists the volumes that could not be written
+	FailedVolumes []VolumeError `json:"failedVolumes"`
+	SizeReport    *SizeReport   `json:"sizeReport"`
+	// ManifestURL and ManifestSignatureURL are set as in MergeResult
+	ManifestURL          string `json:"manifestUrl"`
+	ManifestSignatureURL string `json:"manifestSignatureUrl"`
+	// RequestID is the X-Request-ID of the request that queued the job
+	RequestID string    `json:"requestId"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Progress tells how far the server has come with a job
+type Progress struct {
+	// Stage is converting, merging, finishing or done
+	Stage          string `json:"stage"`
+	FilesConverted int    `json:"filesConverted"`
+	FilesTotal     int    `json:"filesTotal"`
+	PagesMerged    int    `json:"pagesMerged"`
+	PagesTotal     int    `json:"pagesTotal"`
+	// Resumed counts the times the job was taken up again after the
+	// worker processing it stopped
+	Resumed int `json:"resumed"`
+}
+
+// Merge uploads files in order and waits for the merged result. The files
+// are streamed, so they are never fully buffered in memory.
+func (c *Client) Merge(ctx context.Context, files []File) (*MergeResult, error) {
+	return c.MergeWithOptions(ctx, files, MergeOptions{})
+}
+
+// MergeWithOptions uploads files in order with the options of the merge and
+// waits for the merged result
+func (c *Client) MergeWithOptions(ctx context.Context, files []File, opts MergeOptions) (*MergeResult, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		if err := opts.writeTo(mw); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		for _, f := range files {
+			part, err := mw.CreateFormFile("files", f.Name)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(part, f.Reader); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		for _, f := range files {
+			if err := mw.WriteField("checksums", f.SHA256); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/upload", pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var result MergeResult
+	if err := c.doJSON(req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// BatchJob is a merge job of a batch. Files name the uploaded files to
+// merge, in order; Options are the form fields of an upload, such as
+// "cover": true or "normalize": "A4".
+type BatchJob struct {
+	Name    string         `json:"name,omitempty"`
+	Files   []string       `json:"files"`
+	Options map[string]any `json:"options,omitempty"`
+}
+
+// BatchResult is the outcome of a job of a batch: its ID once queued, or
+// why it was not
+type BatchResult struct {
+	Name  string `json:"name"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// Batch uploads files once for several merge jobs and queues the jobs,
+// returning their results in order without waiting for them. Jobs name the
+// files they merge, and may share them. Jobs with an error are left out
+// while the others are queued; when none is, an *Error is returned.
+func (c *Client) Batch(ctx context.Context, jobs []BatchJob, files []File) ([]BatchResult, error) {
+	manifest, err := json.Marshal(jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		if err := mw.WriteField("manifest", string(manifest)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		for _, f := range files {
+			part, err := mw.CreateFormFile("files", f.Name)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(part, f.Reader); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		for _, f := range files {
+			if err := mw.WriteField("checksums", f.SHA256); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/api/v1/batch", pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var results []BatchResult
+	if err := c.doJSON(req, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// JobStatus returns the current state of the job with the given ID
+func (c *Client) JobStatus(ctx context.Context, id string) (*JobStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/api/v1/jobs/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var status JobStatus
+	if err := c.doJSON(req, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// JobSummary is a job as the job list shows it
+type JobSummary struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	User        string    `json:"user"`
+	Status      string    `json:"status"`
+	Files       int       `json:"files"`
+	DownloadURL string    `json:"downloadUrl"`
+	Size        int64     `json:"size"`
+	Error       string    `json:"error"`
+	ErrorCode   string    `json:"errorCode"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// JobQuery selects the jobs ListJobs returns; zero fields select all
+type JobQuery struct {
+	// Status is queued, processing, done or failed
+	Status string
+	// Since and Until limit when the jobs were created
+	Since time.Time
+	Until time.Time
+	// User names the user whose jobs an admin lists
+	User string
+	// Page counts from 1; PerPage is 50 unless set, and at most 200
+	Page    int
+	PerPage int
+}
+
+// JobList is a page of jobs, newest first
+type JobList struct {
+	Jobs    []JobSummary `json:"jobs"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"perPage"`
+	// NextPage is 0 on the last page
+	NextPage int `json:"nextPage"`
+}
+
+// ListJobs returns a page of the jobs of the user the server
+// authenticated, or of everyone for admins
+func (c *Client) ListJobs(ctx context.Context, q JobQuery) (*JobList, error) {
+	v := url.Values{}
+	if q.Status != "" {
+		v.Set("status", q.Status)
+	}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.User != "" {
+		v.Set("user", q.User)
+	}
+	if q.Page > 0 {
+		v.Set("page", fmt.Sprint(q.Page))
+	}
+	if q.PerPage > 0 {
+		v.Set("per_page", fmt.Sprint(q.PerPage))
+	}
+	u := c.BaseURL + "/api/v1/jobs"
+	if len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var list JobList
+	if err := c.doJSON(req, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// ErrChecksum is returned when a download does not match the checksum the
+// server sent with it
+var ErrChecksum = errors.New("pdfmg: checksum mismatch")
+
+// Download writes the merged PDF with the given filename to w and checks it
+// against the checksum sent along
+func (c *Client) Download(ctx context.Context, filename string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/download/"+url.PathEscape(filename), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+		return err
+	}
+	if want, ok := strings.CutPrefix(resp.Header.Get("X-Checksum"), "sha256="); ok && want != hex.EncodeToString(h.Sum(nil)) {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func (c *Client) doJSON(req *http.Request, v any) error {
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends req and turns error statuses into *Error
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		e := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg)), RequestID: resp.Header.Get("X-Request-ID")}
+		// Errors are JSON objects with a code, batches that queue nothing
+		// arrays of results
+		var body struct {
+			Code  string `json:"code"`
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(msg, &body) == nil && body.Code != "" {
+			e.Code, e.Message = body.Code, body.Error
+		}
+		return nil, e
+	}
+	return resp, nil
+}
@@ -0,0 +1,274 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"strconv"
+)
+
+// MergeOptions are the form fields of a merge, as the Merge Options of the
+// server's README describe them. Zero fields leave the server's defaults.
+type MergeOptions struct {
+	// Name names the job, and titles its cover and XMP metadata
+	Name string
+	// Manifest lays out the files, by name, instead of merging them whole
+	// in upload order
+	Manifest []ManifestEntry
+
+	// Mode is "merge" or "interleave"; ReverseSecond reads the second file
+	// of an interleave back to front
+	Mode          string
+	ReverseSecond bool
+	// OnError is "fail" or "skip"
+	OnError string
+
+	// PageLabels is "keep" or "renumber"; XMP is "first", "drop" or
+	// "synthesize"
+	PageLabels string
+	XMP        string
+	// Lang, PageLayout, Zoom, OpenPage and BookmarksPanel set how viewers
+	// open the output
+	Lang           string
+	PageLayout     string
+	Zoom           string
+	OpenPage       int
+	BookmarksPanel string
+
+	// CMYK and PDFX ("1a" or "4") prepare the output for print, with the
+	// ICC profile of ICCProfile instead of the server's when set
+	CMYK       bool
+	ICCProfile *File
+	PDFX       string
+
+	OCR bool
+	// FormValues fill the form fields of the uploaded PDFs by name
+	FormValues        map[string]any
+	FlattenForms      bool
+	RemoveAnnotations bool
+	Sanitize          bool
+	AttachSources     bool
+
+	ImageDPI        int
+	ImageQuality    int
+	ImageBackground string
+	Deskew          bool
+	AutoCrop        bool
+	SplitTallImages bool
+	SplitOverlap    int
+	FullBleed       bool
+	Bleed           int
+	Enhance         string
+	Brightness      int
+	Contrast        int
+	Sharpen         int
+
+	Crop      string
+	CropFiles string
+	CropPages string
+	Normalize string
+
+	// Overlay is a PDF whose first page is placed on the pages of the
+	// output
+	Overlay         *File
+	OverlayPosition string
+	OverlayPages    string
+
+	NUp      int
+	NUpSheet string
+	CutMarks bool
+
+	StampSource      bool
+	StampPageNumbers bool
+	StampPosition    string
+	QRStamp          string
+	QRPosition       string
+
+	TagImages bool
+	// AltText describes the images of the uploads, in upload order
+	AltText []string
+
+	Cover            bool
+	CoverTitle       string
+	CoverAuthor      string
+	CoverDate        string
+	CoverDescription string
+	CoverLogo        *File
+	// CoverData is a JSON object printed on the cover as a table, a row per
+	// member in order
+	CoverData string
+
+	MaxPagesPerFile int
+	Separators      string
+	SeparatorValue  string
+
+	Sign           bool
+	SignVisible    bool
+	SignReason     string
+	SignedManifest bool
+
+	LargeFiles bool
+	Portfolio  bool
+
+	// URLs are fetched by the server and merged after the uploaded files
+	URLs []string
+	// Destination exports the output to cloud storage, e.g.
+	// "s3://bucket/prefix/"
+	Destination string
+
+	// Extra holds form fields the options above do not cover, such as the
+	// tokens of cloud imports
+	Extra url.Values
+}
+
+// ManifestEntry is a part of the output a manifest lays out
+type ManifestEntry struct {
+	File     string  `json:"file"`
+	Pages    string  `json:"pages,omitempty"`
+	Rotate   int     `json:"rotate,omitempty"`
+	Scale    float64 `json:"scale,omitempty"`
+	Fit      string  `json:"fit,omitempty"`
+	Bookmark string  `json:"bookmark,omitempty"`
+	Position int     `json:"position,omitempty"`
+}
+
+// fields returns the form fields of the options, in order, leaving out
+// those left to the server's defaults
+func (o MergeOptions) fields() ([][2]string, error) {
+	var fields [][2]string
+	str := func(name, v string) {
+		if v != "" {
+			fields = append(fields, [2]string{name, v})
+		}
+	}
+	flag := func(name string, v bool) {
+		if v {
+			fields = append(fields, [2]string{name, "true"})
+		}
+	}
+	num := func(name string, v int) {
+		if v != 0 {
+			fields = append(fields, [2]string{name, strconv.Itoa(v)})
+		}
+	}
+
+	str("name", o.Name)
+	if len(o.Manifest) > 0 {
+		manifest, err := json.Marshal(o.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		str("manifest", string(manifest))
+	}
+	str("mode", o.Mode)
+	flag("reverse_second", o.ReverseSecond)
+	str("on_error", o.OnError)
+	str("page_labels", o.PageLabels)
+	str("xmp", o.XMP)
+	str("lang", o.Lang)
+	str("page_layout", o.PageLayout)
+	str("zoom", o.Zoom)
+	num("open_page", o.OpenPage)
+	str("bookmarks_panel", o.BookmarksPanel)
+	flag("cmyk", o.CMYK)
+	str("pdfx", o.PDFX)
+	flag("ocr", o.OCR)
+	if len(o.FormValues) > 0 {
+		values, err := json.Marshal(o.FormValues)
+		if err != nil {
+			return nil, err
+		}
+		str("form_values", string(values))
+	}
+	flag("flatten_forms", o.FlattenForms)
+	flag("remove_annotations", o.RemoveAnnotations)
+	flag("sanitize", o.Sanitize)
+	flag("attach_sources", o.AttachSources)
+	num("image_dpi", o.ImageDPI)
+	num("image_quality", o.ImageQuality)
+	str("image_background", o.ImageBackground)
+	flag("deskew", o.Deskew)
+	flag("autocrop", o.AutoCrop)
+	flag("split_tall_images", o.SplitTallImages)
+	num("split_overlap", o.SplitOverlap)
+	flag("full_bleed", o.FullBleed)
+	num("bleed", o.Bleed)
+	str("enhance", o.Enhance)
+	num("brightness", o.Brightness)
+	num("contrast", o.Contrast)
+	num("sharpen", o.Sharpen)
+	str("crop", o.Crop)
+	str("crop_files", o.CropFiles)
+	str("crop_pages", o.CropPages)
+	str("normalize", o.Normalize)
+	str("overlay_position", o.OverlayPosition)
+	str("overlay_pages", o.OverlayPages)
+	num("nup", o.NUp)
+	str("nup_sheet", o.NUpSheet)
+	flag("cut_marks", o.CutMarks)
+	flag("stamp_source", o.StampSource)
+	flag("stamp_page_numbers", o.StampPageNumbers)
+	str("stamp_position", o.StampPosition)
+	str("qr_stamp", o.QRStamp)
+	str("qr_position", o.QRPosition)
+	flag("tag_images", o.TagImages)
+	for _, alt := range o.AltText {
+		fields = append(fields, [2]string{"alt_text", alt})
+	}
+	flag("cover", o.Cover)
+	str("cover_title", o.CoverTitle)
+	str("cover_author", o.CoverAuthor)
+	str("cover_date", o.CoverDate)
+	str("cover_description", o.CoverDescription)
+	str("cover_data", o.CoverData)
+	num("max_pages_per_file", o.MaxPagesPerFile)
+	str("separators", o.Separators)
+	str("separator_value", o.SeparatorValue)
+	flag("sign", o.Sign)
+	flag("sign_visible", o.SignVisible)
+	str("sign_reason", o.SignReason)
+	flag("signed_manifest", o.SignedManifest)
+	flag("large_files", o.LargeFiles)
+	flag("portfolio", o.Portfolio)
+	for _, u := range o.URLs {
+		fields = append(fields, [2]string{"urls", u})
+	}
+	str("destination", o.Destination)
+	for name, values := range o.Extra {
+		for _, v := range values {
+			fields = append(fields, [2]string{name, v})
+		}
+	}
+	return fields, nil
+}
+
+// writeTo writes the options to the multipart form of a merge: its fields,
+// then the files of Overlay, ICCProfile and CoverLogo
+func (o MergeOptions) writeTo(mw *multipart.Writer) error {
+	fields, err := o.fields()
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	for _, f := range []struct {
+		field string
+		file  *File
+	}{{"overlay", o.Overlay}, {"icc_profile", o.ICCProfile}, {"cover_logo", o.CoverLogo}} {
+		if f.file == nil {
+			continue
+		}
+		part, err := mw.CreateFormFile(f.field, f.file.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, f.file.Reader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// interleavePDFs merges two PDFs by alternating their pages (A1, B1, A2,
+// B2, ...), the usual way to combine fronts and backs from a single-sided
+// scanner. When reverseSecond is set the second file is read back to front.
+// Leftover pages of the longer file are appended at the end.
+func (fh *FileHandler) interleavePDFs(pdfPaths []string, timestamp string, reverseSecond bool) (string, error) {
+	if len(pdfPaths) != 2 {
+		return "", fmt.Errorf("interleaving needs exactly 2 files, got %d", len(pdfPaths))
+	}
+
+	countA, err := api.PageCountFile(pdfPaths[0])
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", pdfPaths[0], err)
+	}
+	countB, err := api.PageCountFile(pdfPaths[1])
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", pdfPaths[1], err)
+	}
+
+	// Merge A then B, and collect the pages of the result in alternating order
+	outputPath, err := fh.mergePDFs(pdfPaths, timestamp)
+	if err != nil {
+		return "", err
+	}
+
+	err = transformPDF(outputPath, func(in, out string) error {
+		return reorderPages(in, out, interleaveOrder(countA, countB, reverseSecond))
+	})
+	if err != nil {
+		return "", fmt.Errorf("error interleaving pages: %v", err)
+	}
+	return outputPath, nil
+}
+
+// interleaveOrder returns the pages of A followed by B, of countA and countB
+// pages, in alternating order
+func interleaveOrder(countA, countB int, reverseSecond bool) []int {
+	var order []int
+	for i := 0; i < countA || i < countB; i++ {
+		if i < countA {
+			order = append(order, i+1)
+		}
+		if i < countB {
+			b := i + 1
+			if reverseSecond {
+				b = countB - i
+			}
+			order = append(order, countA+b)
+		}
+	}
+	return order
+}
+
+// reorderPages writes the PDF at in with its pages in the given order to
+// out. Unlike copying the pages into a new document, the page objects are
+// kept, so links and annotations referring to them stay valid.
+func reorderPages(in, out string, order []int) error {
+	ctx, err := readContext(in)
+	if err != nil {
+		return err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+
+	refs := make([]types.IndirectRef, ctx.PageCount)
+	pages := make([]types.Dict, ctx.PageCount)
+	for i := range refs {
+		pageDict, ref, inherited, err := ctx.PageDict(i+1, false)
+		if err != nil {
+			return err
+		}
+
+		// Pages end up directly below the root, so they carry the
+		// attributes they inherited from intermediate nodes themselves
+		if _, ok := pageDict["Resources"]; !ok && inherited.Resources != nil {
+			pageDict["Resources"] = inherited.Resources
+		}
+		if _, ok := pageDict["MediaBox"]; !ok && inherited.MediaBox != nil {
+			pageDict["MediaBox"] = inherited.MediaBox.Array()
+		}
+		if _, ok := pageDict["CropBox"]; !ok && inherited.CropBox != nil {
+			pageDict["CropBox"] = inherited.CropBox.Array()
+		}
+		if _, ok := pageDict["Rotate"]; !ok && inherited.Rotate != 0 {
+			pageDict["Rotate"] = types.Integer(inherited.Rotate)
+		}
+		refs[i], pages[i] = *ref, pageDict
+	}
+
+	rootRef, err := ctx.Pages()
+	if err != nil {
+		return err
+	}
+	root, err := ctx.DereferenceDict(*rootRef)
+	if err != nil {
+		return err
+	}
+	kids := types.Array{}
+	for _, page := range order {
+		if page < 1 || page > len(refs) {
+			return fmt.Errorf("page %d out of range", page)
+		}
+		pages[page-1]["Parent"] = *rootRef
+		kids = append(kids, refs[page-1])
+	}
+	root["Kids"] = kids
+	root["Count"] = types.Integer(len(kids))
+	return api.WriteContextFile(ctx, out)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleCollect serves /collect/{token}, the collect URL of an upload
+// session: GET shows a page to send files from, and POST adds the files of
+// a form to the session. Anyone with the URL may send files, without
+// signing in, but only the owner of the session sees them.
+func (fh *FileHandler) handleCollect(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/collect/")
+	if fh.uploadSessions == nil || token == "" || strings.Contains(token, "/") {
+		writeError(w, "Not found", CodeNotFound, http.StatusNotFound)
+		return
+	}
+	session, err := fh.collectingSession(token)
+
+	switch r.Method {
+	case http.MethodGet:
+		// Parsed on every request so edits to overridden templates show at once
+		t, err := template.ParseFS(fh.web, "templates/collect.html")
+		if err != nil {
+			writeError(w, "Template error: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+			return
+		}
+		data := struct {
+			BasePath string
+			Brand    branding
+			Token    string
+			Open     bool
+			Accept   string
+		}{
+			BasePath: fh.basePath,
+			Brand:    fh.brand,
+			Token:    token,
+			Open:     session != nil,
+			Accept:   fh.acceptedExtensions(),
+		}
+		if session == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		t.Execute(w, data)
+	case http.MethodPost:
+		if err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		fh.addSessionFiles(w, r, session, token)
+	default:
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+	}
+}
+
+// collectingSession returns the upload session collecting files under
+// token, unless it expired
+func (fh *FileHandler) collectingSession(token string) (*UploadSession, error) {
+	session, err := fh.uploadSessions.CollectingSession(token)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(session.UpdatedAt) > fh.sessionTTL {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
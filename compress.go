@@ -0,0 +1,147 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// compressibleTypes are the media types of the responses gzipped for
+// clients accepting it: JSON, and the ZIP archives of volumes, which store
+// their PDFs uncompressed. PDFs compress their own streams.
+var compressibleTypes = []string{"application/json", "application/zip"}
+
+// Smallest response gzipped, when its length is known beforehand
+const minCompressSize = 1024
+
+// Suffix of the ETags of gzipped responses, which differ from the file
+const gzipETagSuffix = "-gzip"
+
+// withCompression gzips the responses of compressible types to clients
+// sending Accept-Encoding: gzip. Partial content and HEAD requests are
+// left alone, so ranges and Content-Length are those of the file.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		// Handlers compare the ETags clients revalidate gzipped responses
+		// with to their own
+		if inm := r.Header.Get("If-None-Match"); strings.Contains(inm, gzipETagSuffix+`"`) {
+			r.Header.Set("If-None-Match", strings.ReplaceAll(inm, gzipETagSuffix+`"`, `"`))
+			gw.revalidating = true
+		}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip tells whether the client takes gzipped responses
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(v), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body of a response once its headers
+// show it is worth it
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	// revalidating is set when the client revalidates a gzipped response
+	revalidating bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	switch {
+	case code == http.StatusNotModified && w.revalidating:
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", gzipETag(etag))
+		}
+	case code >= http.StatusOK && code != http.StatusNoContent && code != http.StatusPartialContent && code != http.StatusNotModified && compressible(h):
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		h.Add("Vary", "Accept-Encoding")
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", gzipETag(etag))
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// compressible tells whether a response with header h is gzipped
+func compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if !slices.Contains(compressibleTypes, mediaType) {
+		return false
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n < minCompressSize {
+		return false
+	}
+	return true
+}
+
+// gzipETag marks the ETag of a file as that of its gzipped form
+func gzipETag(etag string) string {
+	if strings.HasSuffix(etag, gzipETagSuffix+`"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + gzipETagSuffix + `"`
+}
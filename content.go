@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// contentOp is one operator of a content stream with its operands
+type contentOp struct {
+	name     string
+	operands []contentObj
+	// raw holds the source bytes of the operands and the operator
+	raw []byte
+}
+
+// contentObj is an operand of a content stream operator
+type contentObj struct {
+	kind  byte // 'n' number, 's' string, '/' name, '[' array, '<' dictionary, 'k' keyword
+	raw   []byte
+	num   float64
+	str   []byte
+	items []contentObj
+}
+
+// contentLexer splits a content stream (or a CMap, which shares its syntax)
+// into operations
+type contentLexer struct {
+	buf []byte
+	pos int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+func (l *contentLexer) skipSpace() {
+	for l.pos < len(l.buf) {
+		c := l.buf[l.pos]
+		if c == '%' {
+			for l.pos < len(l.buf) && l.buf[l.pos] != '\n' && l.buf[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// next returns the next operation, or nil at the end of the stream
+func (l *contentLexer) next() (*contentOp, error) {
+	l.skipSpace()
+	op := &contentOp{}
+	start := l.pos
+	for {
+		l.skipSpace()
+		if l.pos >= len(l.buf) {
+			// Trailing operands without an operator are ignored
+			return nil, nil
+		}
+		obj, keyword, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		if keyword == "" {
+			op.operands = append(op.operands, obj)
+			continue
+		}
+
+		op.name = keyword
+		if keyword == "BI" {
+			if err := l.skipInlineImage(); err != nil {
+				return nil, err
+			}
+		}
+		op.raw = l.buf[start:l.pos]
+		return op, nil
+	}
+}
+
+// object reads an operand, or returns the name of an operator
+func (l *contentLexer) object() (contentObj, string, error) {
+	start := l.pos
+	c := l.buf[l.pos]
+	var obj contentObj
+	switch {
+	case c == '(':
+		str, err := l.literalString()
+		if err != nil {
+			return obj, "", err
+		}
+		obj = contentObj{kind: 's', str: str}
+	case c == '<' && l.pos+1 < len(l.buf) && l.buf[l.pos+1] == '<':
+		l.pos += 2
+		items, err := l.objects(">>")
+		if err != nil {
+			return obj, "", err
+		}
+		obj = contentObj{kind: '<', items: items}
+	case c == '<':
+		end := bytes.IndexByte(l.buf[l.pos:], '>')
+		if end < 0 {
+			return obj, "", errors.New("unterminated hex string")
+		}
+		obj = contentObj{kind: 's', str: decodeHex(l.buf[l.pos+1 : l.pos+end])}
+		l.pos += end + 1
+	case c == '[':
+		l.pos++
+		items, err := l.objects("]")
+		if err != nil {
+			return obj, "", err
+		}
+		obj = contentObj{kind: '[', items: items}
+	case c == '/':
+		l.pos++
+		l.regular()
+		obj = contentObj{kind: '/'}
+	case c == '{' || c == '}' || c == ']' || c == ')' || c == '>':
+		// PostScript procedures in CMaps, or stray delimiters
+		l.pos++
+		return obj, string(c), nil
+	default:
+		word := string(l.regular())
+		if n, err := strconv.ParseFloat(word, 64); err == nil {
+			obj = contentObj{kind: 'n', num: n}
+		} else if word == "true" || word == "false" || word == "null" {
+			obj = contentObj{kind: 'k'}
+		} else {
+			return obj, word, nil
+		}
+	}
+	obj.raw = l.buf[start:l.pos]
+	return obj, "", nil
+}
+
+// objects reads operands up to the closing delimiter of an array or
+// dictionary
+func (l *contentLexer) objects(end string) ([]contentObj, error) {
+	var items []contentObj
+	for {
+		l.skipSpace()
+		if l.pos >= len(l.buf) {
+			return nil, errors.New("unterminated " + end)
+		}
+		if bytes.HasPrefix(l.buf[l.pos:], []byte(end)) {
+			l.pos += len(end)
+			return items, nil
+		}
+		obj, keyword, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		if keyword != "" {
+			return nil, errors.New("unexpected " + keyword + " before " + end)
+		}
+		items = append(items, obj)
+	}
+}
+
+func (l *contentLexer) regular() []byte {
+	start := l.pos
+	for l.pos < len(l.buf) && !isPDFSpace(l.buf[l.pos]) && !isPDFDelimiter(l.buf[l.pos]) {
+		l.pos++
+	}
+	if l.pos == start {
+		// Never stall on an unexpected byte
+		l.pos++
+	}
+	return l.buf[start:l.pos]
+}
+
+func (l *contentLexer) literalString() ([]byte, error) {
+	var str []byte
+	depth := 0
+	for l.pos++; l.pos < len(l.buf); l.pos++ {
+		c := l.buf[l.pos]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				l.pos++
+				return str, nil
+			}
+			depth--
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.buf) {
+				return nil, errors.New("unterminated string")
+			}
+			c = l.buf[l.pos]
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos+1 < len(l.buf) && l.buf[l.pos+1] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					n := 0
+					for i := 0; i < 3 && l.pos < len(l.buf) && l.buf[l.pos] >= '0' && l.buf[l.pos] <= '7'; i++ {
+						n = n*8 + int(l.buf[l.pos]-'0')
+						l.pos++
+					}
+					l.pos--
+					c = byte(n)
+				}
+			}
+		}
+		str = append(str, c)
+	}
+	return nil, errors.New("unterminated string")
+}
+
+// skipInlineImage moves past the dictionary and data of an inline image to
+// the end of its EI operator
+func (l *contentLexer) skipInlineImage() error {
+	id := bytes.Index(l.buf[l.pos:], []byte("ID"))
+	if id < 0 {
+		return errors.New("inline image without data")
+	}
+	// One white-space character separates ID from the data
+	l.pos += id + 3
+	for l.pos < len(l.buf) {
+		ei := bytes.Index(l.buf[l.pos:], []byte("EI"))
+		if ei < 0 {
+			break
+		}
+		l.pos += ei + 2
+		if isPDFSpace(l.buf[l.pos-3]) && (l.pos == len(l.buf) || isPDFSpace(l.buf[l.pos]) || isPDFDelimiter(l.buf[l.pos])) {
+			return nil
+		}
+	}
+	return errors.New("inline image without EI")
+}
+
+func decodeHex(b []byte) []byte {
+	var out []byte
+	var digit byte
+	odd := false
+	for _, c := range b {
+		var v byte
+		switch {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			continue
+		}
+		if odd {
+			out = append(out, digit<<4|v)
+		} else {
+			digit = v
+		}
+		odd = !odd
+	}
+	if odd {
+		out = append(out, digit<<4)
+	}
+	return out
+}
+
+// name returns the value of a name operand
+func (o contentObj) name() string {
+	if o.kind != '/' || len(o.raw) == 0 {
+		return ""
+	}
+	return string(o.raw[1:])
+}
+
+// matrix is a PDF transformation matrix [a b c d e f]
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the transformation m followed by n
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func (m matrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// operandMatrix reads six numeric operands as a matrix
+func operandMatrix(operands []contentObj) (matrix, bool) {
+	var m matrix
+	if len(operands) != 6 {
+		return m, false
+	}
+	for i, o := range operands {
+		if o.kind != 'n' {
+			return m, false
+		}
+		m[i] = o.num
+	}
+	return m, true
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// CoverPage is the metadata printed on a generated cover page
+type CoverPage struct {
+	Title       string `json:"title,omitempty"`
+	Author      string `json:"author,omitempty"`
+	Date        string `json:"date,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Fields are printed as a summary table beneath the date
+	Fields []CoverField `json:"fields,omitempty"`
+	// Logo is the stored path of an optional image shown above the title
+	Logo string `json:"logo,omitempty"`
+}
+
+// CoverField is a labelled value of the summary table of a cover page
+type CoverField struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+const (
+	// maxCoverFields is the most fields of the summary table of a cover
+	maxCoverFields = 50
+	// coverLabelWidth is the width of the labels of the summary table, in mm
+	coverLabelWidth = 50.0
+)
+
+// parseCoverPage reads the cover page fields from the form of r, returning
+// nil when no cover was requested. Summary data implies a cover.
+func parseCoverPage(r *http.Request) (*CoverPage, error) {
+	enabled, err := formBool(r, "cover")
+	if err != nil {
+		return nil, err
+	}
+	data := r.FormValue("cover_data")
+	if !enabled && data == "" {
+		return nil, nil
+	}
+
+	cover := &CoverPage{
+		Title:       r.FormValue("cover_title"),
+		Author:      r.FormValue("cover_author"),
+		Date:        r.FormValue("cover_date"),
+		Description: r.FormValue("cover_description"),
+	}
+	if cover.Title == "" {
+		cover.Title = r.FormValue("name")
+	}
+	if data != "" {
+		if cover.Fields, err = parseCoverData(data); err != nil {
+			return nil, fmt.Errorf("invalid cover_data: %v", err)
+		}
+	}
+	return cover, nil
+}
+
+// parseCoverData reads the summary table of a cover from a JSON object,
+// whose members are its rows in order. Arrays are printed a line per
+// element, nested objects a line per member, and null members are left out.
+func parseCoverData(data string) ([]CoverField, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("expected a JSON object")
+	}
+	var fields []CoverField
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		value, err := coverValue(dec)
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			continue
+		}
+		if len(fields) == maxCoverFields {
+			return nil, fmt.Errorf("more than %d fields", maxCoverFields)
+		}
+		fields = append(fields, CoverField{Label: tok.(string), Value: value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON object")
+	}
+	return fields, nil
+}
+
+// coverValue reads the next JSON value of dec as the text of a field
+func coverValue(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	switch v := tok.(type) {
+	case nil:
+		return "", nil
+	case bool:
+		if v {
+			return "Yes", nil
+		}
+		return "No", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	}
+
+	var lines []string
+	for dec.More() {
+		label := ""
+		if tok == json.Delim('{') {
+			key, err := dec.Token()
+			if err != nil {
+				return "", err
+			}
+			label = key.(string) + ": "
+		}
+		value, err := coverValue(dec)
+		if err != nil {
+			return "", err
+		}
+		if value != "" {
+			lines = append(lines, label+value)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return "", err
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// renderCover writes an A4 page with the cover metadata to out, returning
+// the number of pages written, more than one when the summary table runs
+// over. An empty date defaults to the given time.
+func renderCover(cover *CoverPage, date time.Time, out string) (int, error) {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	text := newFpdfText(pdf)
+	pdf.SetMargins(25, 25, 25)
+	pdf.AddPage()
+
+	y := 70.0
+	if cover.Logo != "" {
+		img, err := imaging.Open(cover.Logo)
+		if err != nil {
+			return 0, fmt.Errorf("error opening logo: %v", err)
+		}
+
+		// Re-encode as 8-bit PNG, the only kind gofpdf reliably reads
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, imaging.Clone(img)); err != nil {
+			return 0, fmt.Errorf("error encoding logo: %v", err)
+		}
+		opts := gofpdf.ImageOptions{ImageType: "PNG"}
+		pdf.RegisterImageOptionsReader("logo", opts, &buf)
+
+		// Fit the logo into a 60x30mm box centred at the top
+		w, h := float64(img.Bounds().Dx()), float64(img.Bounds().Dy())
+		scale := 60 / w
+		if 30/h < scale {
+			scale = 30 / h
+		}
+		pdf.ImageOptions("logo", (210-w*scale)/2, 35, w*scale, h*scale, false, opts, 0, "")
+		y = 35 + h*scale + 20
+	}
+
+	pdf.SetY(y)
+	text.multiCell(0, "B", 24, 11, cover.Title, "C")
+
+	if cover.Author != "" {
+		pdf.Ln(6)
+		text.multiCell(0, "", 14, 7, cover.Author, "C")
+	}
+
+	if cover.Date == "" {
+		cover.Date = date.Format("January 2, 2006")
+	}
+	pdf.Ln(4)
+	text.multiCell(0, "", 12, 6, cover.Date, "C")
+
+	if len(cover.Fields) > 0 {
+		pdf.Ln(12)
+		renderCoverFields(pdf, text, cover.Fields)
+	}
+
+	if cover.Description != "" {
+		pdf.Ln(16)
+		text.multiCell(0, "", 11, 5.5, cover.Description, "L")
+	}
+
+	pages := pdf.PageNo()
+	if err := pdf.OutputFileAndClose(out); err != nil {
+		return 0, fmt.Errorf("error rendering cover page: %v", err)
+	}
+	return pages, nil
+}
+
+// renderCoverFields writes fields as a table of labels beside their values,
+// ruled between rows, starting a page when a row would not fit
+func renderCoverFields(pdf *gofpdf.Fpdf, text *fpdfText, fields []CoverField) {
+	pageWidth, pageHeight := pdf.GetPageSize()
+	left, _, right, bottom := pdf.GetMargins()
+	_, breakMargin := pdf.GetAutoPageBreak()
+	bottom = max(bottom, breakMargin)
+	pdf.SetDrawColor(190, 190, 190)
+	pdf.SetLineWidth(0.2)
+
+	for _, f := range fields {
+		if pdf.GetY()+14 > pageHeight-bottom {
+			pdf.AddPage()
+		}
+		pdf.Line(left, pdf.GetY(), pageWidth-right, pdf.GetY())
+		pdf.Ln(2)
+		top, page := pdf.GetY(), pdf.PageNo()
+
+		text.multiCell(coverLabelWidth-4, "B", 10, 5.5, f.Label, "L")
+		labelBottom := pdf.GetY()
+		pdf.SetXY(left+coverLabelWidth, top)
+		text.multiCell(0, "", 10, 5.5, f.Value, "L")
+		if pdf.PageNo() == page && labelBottom > pdf.GetY() {
+			pdf.SetY(labelBottom)
+		}
+		pdf.Ln(2)
+	}
+	pdf.Line(left, pdf.GetY(), pageWidth-right, pdf.GetY())
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// CropAuto trims the whitespace around the page content
+const CropAuto = "auto"
+
+const pointsPerMM = 72 / 25.4
+
+// Automatic cropping leaves this much space around the content, in points
+const autoCropPadding = 3 * pointsPerMM
+
+// parseCropMargins reads the margins to cut off in mm, given like CSS
+// margins as "all", "vertical,horizontal" or "top,right,bottom,left", and
+// returns them in points
+func parseCropMargins(s string) ([4]float64, error) {
+	var margins [4]float64
+	parts := strings.Split(s, ",")
+	var values []float64
+	for _, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) {
+			return margins, fmt.Errorf("invalid crop margin: %s", p)
+		}
+		values = append(values, v*pointsPerMM)
+	}
+	switch len(values) {
+	case 1:
+		margins = [4]float64{values[0], values[0], values[0], values[0]}
+	case 2:
+		margins = [4]float64{values[0], values[1], values[0], values[1]}
+	case 4:
+		copy(margins[:], values)
+	default:
+		return margins, fmt.Errorf("invalid crop: give 1, 2 or 4 margins, got %d", len(values))
+	}
+	return margins, nil
+}
+
+// cropPDF writes the PDF at in to out with the selected pages cropped,
+// either by margins or to their content
+func cropPDF(in, out, crop, pages string) error {
+	ctx, err := readContext(in)
+	if err != nil {
+		return fmt.Errorf("error reading PDF: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+	var margins [4]float64
+	if crop != CropAuto {
+		if margins, err = parseCropMargins(crop); err != nil {
+			return err
+		}
+	}
+	selected, err := api.PagesForPageSelection(ctx.PageCount, pageSelection(pages), true, false)
+	if err != nil {
+		return err
+	}
+
+	fonts := map[int]*pdfFont{}
+	for page := 1; page <= ctx.PageCount; page++ {
+		if !selected[page] {
+			continue
+		}
+		pageDict, _, inherited, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		box := inherited.MediaBox
+		if inherited.CropBox != nil {
+			box = inherited.CropBox
+		}
+		if box == nil {
+			continue
+		}
+
+		var cropped *types.Rectangle
+		if crop == CropAuto {
+			content, err := contentBox(ctx, fonts, pageDict, inherited)
+			if err != nil {
+				return fmt.Errorf("error reading page %d: %v", page, err)
+			}
+			if content == nil {
+				// Blank pages are left alone
+				continue
+			}
+			cropped = types.NewRectangle(
+				math.Max(box.LL.X, content.LL.X-autoCropPadding), math.Max(box.LL.Y, content.LL.Y-autoCropPadding),
+				math.Min(box.UR.X, content.UR.X+autoCropPadding), math.Min(box.UR.Y, content.UR.Y+autoCropPadding))
+		} else {
+			cropped = insetBox(box, margins, inherited.Rotate)
+		}
+		if cropped.Width() < 1 || cropped.Height() < 1 {
+			return fmt.Errorf("cropping leaves nothing of page %d", page)
+		}
+		pageDict["CropBox"] = cropped.Array()
+	}
+	return api.WriteContextFile(ctx, out)
+}
+
+// insetBox cuts the margins, as seen on the page turned by rotate, off box
+func insetBox(box *types.Rectangle, margins [4]float64, rotate int) *types.Rectangle {
+	// Turning the page clockwise moves its left side to the top, so the
+	// margins are turned back onto the sides of the unrotated box
+	turns := (rotate/90%4 + 4) % 4
+	var m [4]float64
+	for side := range margins {
+		m[(side-turns+4)%4] = margins[side]
+	}
+	top, right, bottom, left := m[0], m[1], m[2], m[3]
+	return types.NewRectangle(box.LL.X+left, box.LL.Y+bottom, box.UR.X-right, box.UR.Y-top)
+}
+
+// contentBox returns the box around what a page draws, or nil for blank
+// pages. Of images only the part that is not white counts, so the borders
+// of scans are trimmed too.
+func contentBox(ctx *model.Context, fonts map[int]*pdfFont, pageDict types.Dict, inherited *model.InheritedPageAttrs) (*types.Rectangle, error) {
+	content, resources, err := pageSource(ctx, pageDict, inherited)
+	if err != nil {
+		return nil, err
+	}
+	r := &redactor{ctx: ctx, fonts: fonts, collect: true}
+	if _, err := r.process(content, resources, identity, 0); err != nil {
+		return nil, err
+	}
+
+	var box *types.Rectangle
+	add := func(b *types.Rectangle) {
+		if box == nil {
+			box = b
+			return
+		}
+		box = unionBox(box, b)
+	}
+	for _, g := range r.glyphs {
+		if strings.TrimSpace(g.text) != "" {
+			add(g.box)
+		}
+	}
+	for _, p := range r.paths {
+		add(p)
+	}
+	for _, img := range r.images {
+		if b := imageInkBox(ctx, img); b != nil {
+			add(b)
+		}
+	}
+	return box, nil
+}
+
+// imageInkBox returns the box around the pixels of an image that are not
+// white, or around the whole image if it cannot be decoded
+func imageInkBox(ctx *model.Context, img placedImage) *types.Rectangle {
+	whole := transformBox(img.ctm, 0, 0, 1, 1)
+	if mask := img.sd.Dict.BooleanEntry("ImageMask"); mask != nil && *mask {
+		return whole
+	}
+	extracted, err := pdfcpu.ExtractImage(ctx, img.sd, false, "", img.objNr, false)
+	if err != nil || extracted == nil || extracted.Reader == nil {
+		return whole
+	}
+	src, _, err := image.Decode(extracted)
+	if err != nil {
+		return whole
+	}
+
+	ink, ok := inkBounds(src)
+	if !ok {
+		return nil
+	}
+
+	// Images fill the unit square, with their first row at the top
+	b := src.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	left, top := float64(ink.Min.X-b.Min.X)/w, float64(ink.Min.Y-b.Min.Y)/h
+	right, bottom := float64(ink.Max.X-b.Min.X)/w, float64(ink.Max.Y-b.Min.Y)/h
+	return transformBox(img.ctm, left, 1-bottom, right, 1-top)
+}
+
+// inkBounds returns the bounds of the pixels of src that are not white, or
+// false if there are none. Transparent pixels count as white.
+func inkBounds(src image.Image) (image.Rectangle, bool) {
+	// Rows and columns count as ink once enough of their pixels are dark,
+	// which ignores dust and noise on scans
+	b := src.Bounds()
+	rows, cols := make([]int, b.Dy()), make([]int, b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := src.At(x, y).RGBA()
+			// Colors are premultiplied, so what shows through is added
+			if (19595*r+38470*g+7471*bl+1<<15)>>24+(0xffff-a)>>8 < 224 {
+				rows[y-b.Min.Y]++
+				cols[x-b.Min.X]++
+			}
+		}
+	}
+	top, bottom := inkRange(rows, b.Dx())
+	left, right := inkRange(cols, b.Dy())
+	if top < 0 || left < 0 {
+		return image.Rectangle{}, false
+	}
+	return image.Rect(b.Min.X+left, b.Min.Y+top, b.Min.X+right+1, b.Min.Y+bottom+1), true
+}
+
+// trimImage cuts the white borders off an image, leaving a little space
+// around what it shows, so small scans such as receipts fill the page
+func trimImage(img image.Image) image.Image {
+	ink, ok := inkBounds(img)
+	if !ok {
+		return img
+	}
+	b := img.Bounds()
+	pad := max(b.Dx(), b.Dy()) / 100
+	ink = image.Rect(ink.Min.X-pad, ink.Min.Y-pad, ink.Max.X+pad, ink.Max.Y+pad).Intersect(b)
+	if ink == b {
+		return img
+	}
+	return imaging.Crop(img, ink)
+}
+
+// inkRange returns the first and last of counts reaching a share of length,
+// or -1 if there is none
+func inkRange(counts []int, length int) (int, int) {
+	threshold := max(1, length/200)
+	first, last := -1, -1
+	for i, n := range counts {
+		if n >= threshold {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	return first, last
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Ciphers key stores are encrypted with, by the names CRYPTO_CIPHERS knows
+// them by
+const (
+	cipherAES128 = "aes-128"
+	cipherAES192 = "aes-192"
+	cipherAES256 = "aes-256"
+	cipher3DES   = "3des"
+)
+
+var allCiphers = []string{cipherAES256, cipherAES192, cipherAES128, cipher3DES}
+
+// Smallest RSA keys FIPS 186-5 signatures are made with
+const fipsMinRSABits = 2048
+
+// cryptoPolicy holds the algorithms and key lengths allowed in the
+// cryptography the server does: decrypting the key store of the signing
+// certificate and signing merged PDFs, always with SHA-256
+type cryptoPolicy struct {
+	// FIPS allows FIPS 140 approved algorithms only: AES, PBKDF2, RSA keys
+	// of 2048 bits or more and the curves P-256, P-384 and P-521
+	fips    bool
+	ciphers []string
+	// Smallest RSA signing keys allowed in bits; 0 for any
+	minRSABits int
+}
+
+// loadCryptoPolicy reads CRYPTO_POLICY, "default" or "fips", and
+// CRYPTO_CIPHERS and CRYPTO_MIN_RSA_BITS, which restrict it further, e.g.
+// to "aes-256" only
+func loadCryptoPolicy() (cryptoPolicy, error) {
+	policy := cryptoPolicy{ciphers: allCiphers}
+	switch v := strings.ToLower(os.Getenv("CRYPTO_POLICY")); v {
+	case "", "default":
+	case "fips":
+		policy = cryptoPolicy{fips: true, ciphers: []string{cipherAES256, cipherAES192, cipherAES128}, minRSABits: fipsMinRSABits}
+	default:
+		return policy, fmt.Errorf("invalid CRYPTO_POLICY %q: expected default or fips", v)
+	}
+
+	if v := os.Getenv("CRYPTO_CIPHERS"); v != "" {
+		var ciphers []string
+		for _, name := range splitList(strings.ToLower(v)) {
+			if !slices.Contains(allCiphers, name) {
+				return policy, fmt.Errorf("unknown cipher %q in CRYPTO_CIPHERS: expected %s", name, strings.Join(allCiphers, ", "))
+			}
+			if !slices.Contains(policy.ciphers, name) {
+				return policy, fmt.Errorf("CRYPTO_CIPHERS allows %s, which is not FIPS approved", name)
+			}
+			ciphers = append(ciphers, name)
+		}
+		if len(ciphers) == 0 {
+			return policy, fmt.Errorf("invalid CRYPTO_CIPHERS: %s", v)
+		}
+		policy.ciphers = ciphers
+	}
+	if v := os.Getenv("CRYPTO_MIN_RSA_BITS"); v != "" {
+		bits, err := strconv.Atoi(v)
+		if err != nil || bits < 0 {
+			return policy, fmt.Errorf("invalid CRYPTO_MIN_RSA_BITS: %s", v)
+		}
+		if policy.fips && bits < fipsMinRSABits {
+			return policy, fmt.Errorf("CRYPTO_MIN_RSA_BITS allows RSA keys under the %d bits FIPS requires", fipsMinRSABits)
+		}
+		policy.minRSABits = bits
+	}
+	return policy, nil
+}
+
+// String describes the policy for the log
+func (p cryptoPolicy) String() string {
+	s := "default"
+	if p.fips {
+		s = "FIPS"
+	}
+	s += ", ciphers " + strings.Join(p.ciphers, ", ")
+	if p.minRSABits > 0 {
+		s += fmt.Sprintf(", RSA keys of %d bits or more", p.minRSABits)
+	}
+	return s
+}
+
+// allowCipher checks that a key store may be encrypted with cipher
+func (p cryptoPolicy) allowCipher(cipher string) error {
+	if !slices.Contains(p.ciphers, cipher) {
+		return fmt.Errorf("the key store is encrypted with %s, which the crypto policy does not allow; re-export it with %s", cipher, p.ciphers[0])
+	}
+	return nil
+}
+
+// allowPKCS12KDF checks that key stores may derive their keys with the
+// PKCS#12 key derivation of the legacy scheme instead of PBKDF2
+func (p cryptoPolicy) allowPKCS12KDF() error {
+	if p.fips {
+		return fmt.Errorf("the key store is encrypted with the legacy PKCS#12 scheme, which is not FIPS approved; re-export it with %s", p.ciphers[0])
+	}
+	return nil
+}
+
+// allowSigningKey checks the type and size of a signing key
+func (p cryptoPolicy) allowSigningKey(key crypto.Signer) error {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if bits := k.N.BitLen(); bits < p.minRSABits {
+			return fmt.Errorf("the %d-bit RSA key is shorter than the %d bits the crypto policy requires", bits, p.minRSABits)
+		}
+	case *ecdsa.PrivateKey:
+		if p.fips && k.Curve != elliptic.P256() && k.Curve != elliptic.P384() && k.Curve != elliptic.P521() {
+			return fmt.Errorf("the ECDSA key on curve %s is not FIPS approved", k.Curve.Params().Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Converted PDFs the dedup cache may hold by default
+const defaultDedupCacheSize = 2 << 30
+
+// dedupLeases holds the cached conversions that running jobs use, by job,
+// so they are not removed before the jobs are done with them
+type dedupLeases struct {
+	mu   sync.Mutex
+	jobs map[string][]string
+}
+
+// acquire leases the conversion at path to a job
+func (l *dedupLeases) acquire(jobID, path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.jobs == nil {
+		l.jobs = map[string][]string{}
+	}
+	l.jobs[jobID] = append(l.jobs[jobID], path)
+}
+
+// release ends the leases of a job
+func (l *dedupLeases) release(jobID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.jobs, jobID)
+}
+
+// remove deletes the conversion at path unless a job holds it, and reports
+// whether it did
+func (l *dedupLeases) remove(path string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, paths := range l.jobs {
+		for _, p := range paths {
+			if p == path {
+				return false
+			}
+		}
+	}
+	return os.Remove(path) == nil
+}
+
+// convertDeduplicated runs convert, which turns file into a PDF, but keeps
+// the result in the cache directory keyed by the upload's SHA-256 and the
+// conversion settings, so identical uploads within the retention window
+// skip the conversion. PDFs are cached only when they are straightened or
+// recognized, as they are used as they are otherwise. The cached PDF is
+// leased to the job until it releases fh.dedupLeases.
+func (fh *FileHandler) convertDeduplicated(jobID string, file JobFile, opts MergeOptions, convert func() (string, error)) (string, error) {
+	ext := strings.ToLower(filepath.Ext(file.Name))
+	ocr := opts.OCR && fh.ocr != nil
+	if ext == ".pdf" && !opts.Deskew && !ocr || file.SHA256 == "" || fh.dedupRetention <= 0 {
+		return convert()
+	}
+
+	key := conversionKey(opts)
+	if ocr {
+		key += "_ocr_" + fh.ocr.lang
+	}
+	cachePath := filepath.Join(fh.cacheDir, file.SHA256+key+".pdf")
+	fh.dedupLeases.acquire(jobID, cachePath)
+	if info, err := os.Stat(cachePath); err == nil {
+		if time.Since(info.ModTime()) < fh.dedupRetention {
+			// Reuse counts as use, so conversions uploaded again and again
+			// stay cached and the least recently used are evicted first
+			now := time.Now()
+			os.Chtimes(cachePath, now, now)
+			os.Remove(file.Path)
+			return cachePath, nil
+		}
+	}
+
+	pdfPath, err := convert()
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(pdfPath, cachePath); err != nil {
+		log.Printf("Error caching converted %s: %v", file.Name, err)
+		return pdfPath, nil
+	}
+	fh.trimDedupCache()
+	return cachePath, nil
+}
+
+// conversionKey tells apart the cached conversions of an upload made with
+// different image settings; the defaults add nothing
+func conversionKey(opts MergeOptions) string {
+	var key string
+	if opts.ImageDPI > 0 {
+		key += fmt.Sprintf("_%ddpi", opts.ImageDPI)
+	}
+	if opts.ImageQuality > 0 {
+		key += fmt.Sprintf("_q%d", opts.ImageQuality)
+	}
+	if opts.ImageBackground != "" && opts.ImageBackground != "#ffffff" {
+		key += "_bg" + opts.ImageBackground[1:]
+	}
+	if opts.Deskew {
+		key += "_deskew"
+	}
+	if opts.AutoCrop {
+		key += "_autocrop"
+	}
+	if enhancesImages(opts) {
+		key += fmt.Sprintf("_%s_b%d_c%d_s%d", opts.Enhance, opts.Brightness, opts.Contrast, opts.Sharpen)
+	}
+	if opts.SplitTallImages {
+		key += fmt.Sprintf("_split%d", opts.SplitOverlap)
+	}
+	if opts.FullBleed {
+		key += fmt.Sprintf("_bleed%d", opts.Bleed)
+		if opts.CutMarks && opts.NUp == 0 {
+			key += "_marks"
+		}
+	}
+	return key
+}
+
+// pruneDedupCache removes converted PDFs not used within the retention
+// window, and the least recently used ones over the size limit
+func (fh *FileHandler) pruneDedupCache() {
+	entries, err := os.ReadDir(fh.cacheDir)
+	if err != nil {
+		log.Printf("Error reading cache directory: %v", err)
+		return
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < fh.dedupRetention {
+			continue
+		}
+		if fh.dedupLeases.remove(filepath.Join(fh.cacheDir, e.Name())) {
+			fh.audit(AuditEvent{Action: AuditDelete, File: e.Name(), Size: info.Size(), Detail: "expired conversion"})
+		}
+	}
+	fh.trimDedupCache()
+}
+
+// trimDedupCache removes the least recently used converted PDFs not leased
+// to a job until the cache fits in its size limit
+func (fh *FileHandler) trimDedupCache() {
+	if fh.dedupMaxSize <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(fh.cacheDir)
+	if err != nil {
+		log.Printf("Error reading cache directory: %v", err)
+		return
+	}
+
+	var infos []os.FileInfo
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		infos = append(infos, info)
+		total += info.Size()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		if total <= fh.dedupMaxSize {
+			break
+		}
+		if fh.dedupLeases.remove(filepath.Join(fh.cacheDir, info.Name())) {
+			total -= info.Size()
+			fh.audit(AuditEvent{Action: AuditDelete, File: info.Name(), Size: info.Size(), Detail: "evicted conversion"})
+		}
+	}
+}
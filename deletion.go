@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// deletedFile is a file removed on a deletion request
+type deletedFile struct {
+	JobID string `json:"jobId,omitempty"`
+	// Session is the token of the upload session of session files
+	Session string `json:"session,omitempty"`
+	// Kind is upload, output, overlay, profile, logo, intermediate,
+	// conversion or session
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+// deletionReceipt confirms what a deletion request removed
+type deletionReceipt struct {
+	ID        string        `json:"receiptId"`
+	User      string        `json:"user,omitempty"`
+	DeletedAt time.Time     `json:"deletedAt"`
+	Jobs      []string      `json:"jobs"`
+	Sessions  []string      `json:"sessions"`
+	Files     []deletedFile `json:"files"`
+	// Verified is set once the files and job records were checked to be gone
+	Verified bool     `json:"verified"`
+	Errors   []string `json:"errors,omitempty"`
+	// Code is DELETION_INCOMPLETE once anything could not be removed
+	Code string `json:"code,omitempty"`
+}
+
+func newDeletionReceipt(user string) *deletionReceipt {
+	return &deletionReceipt{
+		ID:        randomHex(8),
+		User:      user,
+		DeletedAt: time.Now().UTC(),
+		Jobs:      []string{},
+		Sessions:  []string{},
+		Files:     []deletedFile{},
+		Verified:  true,
+	}
+}
+
+func (rc *deletionReceipt) fail(err error) {
+	rc.Verified = false
+	rc.Code = CodeDeletionIncomplete
+	rc.Errors = append(rc.Errors, err.Error())
+}
+
+// deleteJobData removes the files of a job and then its record. Outputs
+// and cached conversions still referred to by one of others are kept, as
+// are conversions leased to a running job. The job must have been marked
+// as deleting.
+func (fh *FileHandler) deleteJobData(job *Job, others []*Job, rc *deletionReceipt) {
+	type candidate struct {
+		path, kind, name, sha256 string
+	}
+	var files []candidate
+	for _, f := range job.Files {
+		files = append(files, candidate{f.Path, "upload", f.Name, f.SHA256})
+		if f.SHA256 != "" && !sharedUpload(job, f.SHA256, others) {
+			matches, _ := filepath.Glob(filepath.Join(fh.cacheDir, f.SHA256+"*.pdf"))
+			for _, m := range matches {
+				files = append(files, candidate{m, "conversion", filepath.Base(m), ""})
+			}
+		}
+		// Conversions taken from the dedup cache are among those above
+		if f.Converted != "" && filepath.Dir(f.Converted) != filepath.Clean(fh.cacheDir) {
+			files = append(files, candidate{f.Converted, "intermediate", filepath.Base(f.Converted), ""})
+		}
+	}
+	if job.Options.Overlay != "" {
+		files = append(files, candidate{job.Options.Overlay, "overlay", filepath.Base(job.Options.Overlay), ""})
+	}
+	if job.Options.ICCProfile != "" {
+		files = append(files, candidate{job.Options.ICCProfile, "profile", filepath.Base(job.Options.ICCProfile), ""})
+	}
+	if job.Options.Cover != nil && job.Options.Cover.Logo != "" {
+		files = append(files, candidate{job.Options.Cover.Logo, "logo", filepath.Base(job.Options.Cover.Logo), ""})
+	}
+	if job.OutputPath != "" && !sharedOutput(job, others) {
+		files = append(files, candidate{job.OutputPath, "output", filepath.Base(job.OutputPath), ""})
+		for _, suffix := range []string{manifestSuffix, manifestSignatureSuffix} {
+			files = append(files, candidate{job.OutputPath + suffix, "manifest", filepath.Base(job.OutputPath) + suffix, ""})
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(fh.scratchDir, job.ID+"_*"))
+	for _, m := range matches {
+		files = append(files, candidate{m, "intermediate", filepath.Base(m), ""})
+	}
+
+	for _, c := range files {
+		info, err := os.Stat(c.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			rc.fail(err)
+			continue
+		}
+		if c.sha256 == "" {
+			c.sha256, _ = fileSHA256(c.path)
+		}
+		if c.kind == "conversion" {
+			// Jobs uploading the same file since may hold it
+			if !fh.dedupLeases.remove(c.path) {
+				continue
+			}
+		} else if err := os.Remove(c.path); err != nil {
+			rc.fail(err)
+			continue
+		}
+		if _, err := os.Stat(c.path); !os.IsNotExist(err) {
+			rc.fail(fmt.Errorf("%s still exists after removal", c.name))
+			continue
+		}
+		rc.Files = append(rc.Files, deletedFile{JobID: job.ID, Kind: c.kind, Name: c.name, SHA256: c.sha256, Size: info.Size()})
+		fh.audit(AuditEvent{Action: AuditDelete, User: rc.User, JobID: job.ID, File: c.name, SHA256: c.sha256,
+			Size: info.Size(), Detail: "deletion request " + rc.ID})
+	}
+
+	if err := fh.jobs.Delete(job.ID); err != nil {
+		rc.fail(fmt.Errorf("error deleting job %s: %v", job.ID, err))
+		return
+	}
+	if _, err := fh.jobs.Get(job.ID); !errors.Is(err, ErrJobNotFound) {
+		rc.fail(fmt.Errorf("job %s still exists after removal", job.ID))
+		return
+	}
+	rc.Jobs = append(rc.Jobs, job.ID)
+}
+
+// deleteSessionData removes an upload session and its files
+func (fh *FileHandler) deleteSessionData(session *UploadSession, rc *deletionReceipt) {
+	var files []SessionFile
+	for _, f := range session.Files {
+		if _, err := os.Stat(fh.sessionFilePath(session.Token, f)); err == nil {
+			files = append(files, f)
+		}
+	}
+	if err := fh.removeUploadSession(session); err != nil {
+		rc.fail(err)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(fh.sessionFilePath(session.Token, f)); !os.IsNotExist(err) {
+			rc.fail(fmt.Errorf("%s still exists after removal", f.Name))
+			continue
+		}
+		rc.Files = append(rc.Files, deletedFile{Session: session.Token, Kind: "session", Name: f.Name, SHA256: f.SHA256, Size: f.Size})
+		fh.audit(AuditEvent{Action: AuditDelete, User: rc.User, File: f.Name, SHA256: f.SHA256,
+			Size: f.Size, Detail: "deletion request " + rc.ID})
+	}
+	if _, err := fh.uploadSessions.GetSession(session.Token); !errors.Is(err, ErrSessionNotFound) {
+		rc.fail(fmt.Errorf("upload session %s still exists after removal", session.Token))
+		return
+	}
+	rc.Sessions = append(rc.Sessions, session.Token)
+}
+
+// sharedOutput reports whether another job has the same output file, as
+// jobs created within the same second do
+func sharedOutput(job *Job, others []*Job) bool {
+	for _, other := range others {
+		if other.ID != job.ID && other.OutputPath == job.OutputPath {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedUpload reports whether another job has an upload with the given
+// SHA-256, whose conversions it shares in the dedup cache
+func sharedUpload(job *Job, sha256 string, others []*Job) bool {
+	for _, other := range others {
+		if other.ID == job.ID {
+			continue
+		}
+		for _, f := range other.Files {
+			if f.SHA256 == sha256 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// markDeleting marks jobs as deleting, so no worker claims them while their
+// data is removed. When one cannot be marked, it restores the jobs marked
+// before it, writes the error and returns false.
+func (fh *FileHandler) markDeleting(w http.ResponseWriter, jobs []*Job) bool {
+	for i, job := range jobs {
+		err := fh.jobs.MarkDeleting(job.ID)
+		if err == nil {
+			continue
+		}
+		for _, marked := range jobs[:i] {
+			if err := fh.jobs.Update(marked); err != nil {
+				log.Printf("Error restoring job %s: %v", marked.ID, err)
+			}
+		}
+		switch {
+		case errors.Is(err, ErrJobProcessing):
+			writeError(w, "Job "+job.ID+" is being processed; retry once it has finished", CodeConflict, http.StatusConflict)
+		case errors.Is(err, ErrJobNotFound):
+			writeError(w, "Job "+job.ID+" not found", CodeNotFound, http.StatusNotFound)
+		default:
+			writeError(w, "Error updating job: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		}
+		return false
+	}
+	return true
+}
+
+// handleDeleteJobData serves DELETE /api/v1/jobs/{id}/data
+func (fh *FileHandler) handleDeleteJobData(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodDelete {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := fh.jobs.Get(id)
+	if errors.Is(err, ErrJobNotFound) {
+		writeError(w, "Job not found", CodeNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, "Error loading job: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	user := requestUser(r)
+	if !fh.mayAccess(job, user) {
+		writeError(w, "Forbidden", CodeForbidden, http.StatusForbidden)
+		return
+	}
+	jobs, err := fh.jobs.List()
+	if err != nil {
+		writeError(w, "Error listing jobs: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	if !fh.markDeleting(w, []*Job{job}) {
+		return
+	}
+
+	rc := newDeletionReceipt(user)
+	fh.deleteJobData(job, jobs, rc)
+	writeReceipt(w, rc)
+}
+
+// handleDeleteUserData serves DELETE /api/v1/data, which removes the data of
+// every job and upload session of the requesting user
+func (fh *FileHandler) handleDeleteUserData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, "No user specified", CodeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	jobs, err := fh.jobs.List()
+	if err != nil {
+		writeError(w, "Error listing jobs: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	var own, others []*Job
+	for _, job := range jobs {
+		if job.User != user {
+			others = append(others, job)
+			continue
+		}
+		own = append(own, job)
+	}
+
+	var sessions []*UploadSession
+	if fh.uploadSessions != nil {
+		all, err := fh.uploadSessions.ListSessions()
+		if err != nil {
+			writeError(w, "Error listing upload sessions: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+			return
+		}
+		for _, session := range all {
+			if session.User == user {
+				sessions = append(sessions, session)
+			}
+		}
+	}
+
+	if !fh.markDeleting(w, own) {
+		return
+	}
+
+	rc := newDeletionReceipt(user)
+	for _, job := range own {
+		fh.deleteJobData(job, others, rc)
+	}
+	for _, session := range sessions {
+		fh.deleteSessionData(session, rc)
+	}
+	writeReceipt(w, rc)
+}
+
+// writeReceipt sends the receipt, with an error status if not everything
+// could be removed
+func writeReceipt(w http.ResponseWriter, rc *deletionReceipt) {
+	w.Header().Set("Content-Type", "application/json")
+	if !rc.Verified {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(rc)
+}
+
+// jobDataID returns the job ID of a /api/v1/jobs/{id}/data path
+func jobDataID(path string) (string, bool) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(path, "/api/v1/jobs/"), "/data")
+	return id, ok && id != "" && !strings.Contains(id, "/")
+}
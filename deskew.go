@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Text lines are searched for in a copy of the image scaled down to fit
+// this many pixels
+const deskewSampleSize = 1200
+
+// Ink is this much darker than the paper around it, out of 255
+const inkContrast = 40
+
+// Scans are straightened when tilted by up to this many degrees
+const maxSkew = 15
+
+// Smaller tilts than this, in degrees, are left alone
+const minSkew = 0.1
+
+// Text lines project onto at least this many times fewer rows than ink
+// spread evenly would, which tells text apart from photos
+const minLineScore = 1.6
+
+// straightenAngle returns the angle in degrees, counter-clockwise, that
+// turns the text lines of a scan level and upright, or false if the image
+// shows no text lines
+func straightenAngle(img image.Image) (float64, bool) {
+	small := imaging.Grayscale(imaging.Fit(img, deskewSampleSize, deskewSampleSize, imaging.Box))
+	xs, ys := inkPixels(small, imaging.Blur(small, 6))
+	if len(xs) < 100 {
+		return 0, false
+	}
+
+	// Lines running down the page belong to a scan turned by a quarter
+	var tilt, score float64
+	for _, base := range []float64{0, 90} {
+		if a, s := lineAngle(xs, ys, base); s > score {
+			tilt, score = a, s
+		}
+	}
+	if score < minLineScore {
+		return 0, false
+	}
+
+	angle := -tilt
+	if math.Abs(angle-math.Round(angle/90)*90) < minSkew {
+		angle = math.Round(angle/90) * 90
+	}
+	// Level lines may still be upside down
+	if upsideDown(imaging.Rotate(small, angle, color.White)) {
+		angle += 180
+	}
+	return math.Remainder(angle, 360), true
+}
+
+// inkPixels returns the coordinates of the pixels of a grayscale image that
+// are clearly darker than their surroundings, given blurred, sampled down to
+// a number that keeps the search quick. Comparing with the surroundings
+// finds the strokes of text on shaded paper without the dark table a phone
+// scan was taken on.
+func inkPixels(img, blurred *image.NRGBA) ([]float64, []float64) {
+	var xs, ys []float64
+	b := img.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		row, around := img.Pix[y*img.Stride:], blurred.Pix[y*blurred.Stride:]
+		for x := 0; x < b.Dx(); x++ {
+			if int(row[x*4])+inkContrast < int(around[x*4]) {
+				xs = append(xs, float64(x))
+				ys = append(ys, float64(y))
+			}
+		}
+	}
+	if step := len(xs) / 200000; step > 1 {
+		for i := 0; i*step < len(xs); i++ {
+			xs[i], ys[i] = xs[i*step], ys[i*step]
+		}
+		xs, ys = xs[:len(xs)/step], ys[:len(ys)/step]
+	}
+	return xs, ys
+}
+
+// lineAngle returns the angle in degrees, counter-clockwise and near base,
+// along which the ink pixels line up best, with how well they do
+func lineAngle(xs, ys []float64, base float64) (float64, float64) {
+	best, score := base, 0.0
+	search := func(from, to, step float64) {
+		for a := from; a <= to+step/2; a += step {
+			if s := lineScore(xs, ys, a); s > score {
+				best, score = a, s
+			}
+		}
+	}
+	search(base-maxSkew, base+maxSkew, 0.5)
+	search(best-0.5, best+0.5, 0.05)
+	return best, score
+}
+
+// lineScore projects the ink pixels across lines running at angle and
+// returns how much more they bunch up than ink spread evenly would
+func lineScore(xs, ys []float64, angle float64) float64 {
+	// Image rows run downwards, so lines rising to the right have a
+	// normal of (sin, cos)
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	d := make([]float64, len(xs))
+	for i := range xs {
+		d[i] = xs[i]*sin + ys[i]*cos
+		lo, hi = math.Min(lo, d[i]), math.Max(hi, d[i])
+	}
+	bins := make([]float64, int(hi-lo)+1)
+	for _, v := range d {
+		bins[int(v-lo)]++
+	}
+	var sum float64
+	for _, n := range bins {
+		sum += n * n
+	}
+	n := float64(len(xs))
+	return sum * float64(len(bins)) / (n * n)
+}
+
+// upsideDown reports whether the level text lines of a grayscale image are
+// upside down. Latin script has more ascenders and capitals reaching above
+// the middle of a line than descenders reaching below it.
+func upsideDown(img *image.NRGBA) bool {
+	b := img.Bounds()
+	rows := make([]int, b.Dy())
+	_, ys := inkPixels(img, imaging.Blur(img, 6))
+	for _, y := range ys {
+		rows[int(y)]++
+	}
+
+	// Rows crossed only by page edges or specks lie between lines. The
+	// fullest rows are left out of the measure, as they may be the top and
+	// bottom edges of the page.
+	sorted := slices.Clone(rows)
+	slices.Sort(sorted)
+	noise := max(1, sorted[len(sorted)*98/100]/10)
+	var above, below int
+	for start := 0; start < len(rows); {
+		if rows[start] <= noise {
+			start++
+			continue
+		}
+		end := start
+		peak := 0
+		for end < len(rows) && rows[end] > noise {
+			peak = max(peak, rows[end])
+			end++
+		}
+		// The middle of a line is where its ink is densest
+		first, last := -1, -1
+		for y := start; y < end; y++ {
+			if rows[y]*2 >= peak {
+				if first < 0 {
+					first = y
+				}
+				last = y
+			}
+		}
+		for y := start; y < first; y++ {
+			above += rows[y]
+		}
+		for y := last + 1; y < end; y++ {
+			below += rows[y]
+		}
+		start = end
+	}
+	return below*4 > above*5
+}
+
+// rotateImage turns img counter-clockwise by angle degrees, keeping its
+// size, or swapping width and height for quarter turns, and filling the
+// uncovered corners with bg
+func rotateImage(img image.Image, angle float64, bg color.Color) image.Image {
+	if angle == 0 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if int(math.Round(angle/90))%2 != 0 {
+		w, h = h, w
+	}
+	return imaging.CropCenter(imaging.Rotate(img, angle, bg), w, h)
+}
+
+// straightenPDF writes the PDF at in to out with its scanned pages, those
+// showing an image and no text, straightened. Quarter turns rotate the
+// page; smaller tilts are taken out of the image itself.
+func straightenPDF(in, out string) error {
+	ctx, err := readContext(in)
+	if err != nil {
+		return fmt.Errorf("error reading PDF: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+
+	fonts := map[int]*pdfFont{}
+	straightened := map[int]bool{}
+	for page := 1; page <= ctx.PageCount; page++ {
+		pageDict, _, inherited, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		content, resources, err := pageSource(ctx, pageDict, inherited)
+		if err != nil {
+			return fmt.Errorf("error reading page %d: %v", page, err)
+		}
+		r := &redactor{ctx: ctx, fonts: fonts, collect: true}
+		if _, err := r.process(content, resources, identity, 0); err != nil {
+			return fmt.Errorf("error reading page %d: %v", page, err)
+		}
+		if hasText(r.glyphs) {
+			continue
+		}
+		scan, ok := largestImage(r.images)
+		if !ok || straightened[scan.objNr] {
+			continue
+		}
+		straightened[scan.objNr] = true
+
+		extracted, err := pdfcpu.ExtractImage(ctx, scan.sd, false, "", scan.objNr, false)
+		if err != nil || extracted == nil || extracted.Reader == nil {
+			continue
+		}
+		src, _, err := image.Decode(extracted)
+		if err != nil {
+			continue
+		}
+		angle, ok := straightenAngle(src)
+		if !ok {
+			continue
+		}
+
+		turns := int(math.Round(angle / 90))
+		if skew := angle - float64(turns)*90; skew != 0 {
+			if err := replaceImage(ctx, scan, rotateImage(src, skew, color.White)); err != nil {
+				return fmt.Errorf("error straightening page %d: %v", page, err)
+			}
+		}
+		// The angle is measured on the unrotated page; pages turn clockwise
+		pageDict["Rotate"] = types.Integer(((-turns%4 + 4) % 4) * 90)
+	}
+	return api.WriteContextFile(ctx, out)
+}
+
+// hasText reports whether any of the glyphs shows more than whitespace
+func hasText(glyphs []glyph) bool {
+	for _, g := range glyphs {
+		if strings.TrimSpace(g.text) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// largestImage returns the image covering most of a page, if it is drawn
+// upright; scans drawn turned or mirrored are left alone
+func largestImage(images []placedImage) (placedImage, bool) {
+	var largest placedImage
+	var area float64
+	for _, img := range images {
+		box := transformBox(img.ctm, 0, 0, 1, 1)
+		if a := box.Width() * box.Height(); a > area {
+			largest, area = img, a
+		}
+	}
+	m := largest.ctm
+	if area == 0 || m[1] != 0 || m[2] != 0 || m[0] <= 0 || m[3] <= 0 {
+		return largest, false
+	}
+	if mask := largest.sd.Dict.BooleanEntry("ImageMask"); mask != nil && *mask {
+		return largest, false
+	}
+	// Soft masks would no longer line up with the turned image
+	if _, ok := largest.sd.Dict["SMask"]; ok {
+		return largest, false
+	}
+	return largest, true
+}
+
+// replaceImage swaps the image object of img for the pixels of src, kept as
+// JPEG if it was one
+func replaceImage(ctx *model.Context, img placedImage, src image.Image) error {
+	var buf bytes.Buffer
+	var err error
+	if filter := img.sd.FilterPipeline; len(filter) > 0 && filter[len(filter)-1].Name == "DCTDecode" {
+		err = jpeg.Encode(&buf, src, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, src)
+	}
+	if err != nil {
+		return err
+	}
+	sd, _, _, err := model.CreateImageStreamDict(ctx.XRefTable, &buf, false, false)
+	if err != nil {
+		return err
+	}
+	entry, ok := ctx.FindTableEntryLight(img.objNr)
+	if !ok {
+		return fmt.Errorf("missing image object %d", img.objNr)
+	}
+	entry.Object = *sd
+	return nil
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Page statuses of a comparison
+const (
+	PageUnchanged = "unchanged"
+	PageChanged   = "changed"
+	PageAdded     = "added"
+	PageRemoved   = "removed"
+)
+
+// Comparisons of pages with more differing words than this in both PDFs
+// report all of them as changed
+const maxDiffCells = 4 << 20
+
+// pageDiff is the comparison of a page of the old PDF with the page at the
+// same position in the new one
+type pageDiff struct {
+	Page   int    `json:"page"`
+	Status string `json:"status"`
+	// Added and Removed list the changed runs of words
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// GraphicsChanged is set when the images or drawings differ
+	GraphicsChanged bool `json:"graphicsChanged,omitempty"`
+
+	removedWords, addedWords []int
+}
+
+// diffResult is the summary of a comparison
+type diffResult struct {
+	OldPages     int        `json:"oldPages"`
+	NewPages     int        `json:"newPages"`
+	ChangedPages []int      `json:"changedPages"`
+	Pages        []pageDiff `json:"pages"`
+}
+
+// pageText is what a page is compared by
+type pageText struct {
+	glyphs   []glyph
+	words    []word
+	graphics []byte
+}
+
+// word is a run of glyphs between spaces
+type word struct {
+	text   string
+	glyphs []int
+}
+
+// handleDiff compares two uploaded PDFs page by page and returns a summary
+// of the changed pages, or with output=pdf the pages of both side by side
+// with the changes highlighted
+func (fh *FileHandler) handleDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		writeError(w, "Error parsing form: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	oldFiles, newFiles := r.MultipartForm.File["old"], r.MultipartForm.File["new"]
+	if len(oldFiles) == 0 || len(newFiles) == 0 {
+		writeError(w, "Upload the old and the new PDF", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	output := r.FormValue("output")
+	switch output {
+	case "", "json", "pdf":
+	default:
+		writeError(w, "Invalid output: "+output, CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	timestamp := time.Now().Format("20060102_150405")
+	paths := make([]string, 2)
+	for i, fileHeader := range []*multipart.FileHeader{oldFiles[0], newFiles[0]} {
+		paths[i] = fh.uploadPath(timestamp, i, "diff_"+fileHeader.Filename)
+		defer os.Remove(paths[i])
+		sum, err := saveUpload(fileHeader, paths[i])
+		if err != nil {
+			writeError(w, "Error saving file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+			return
+		}
+		fh.auditRequestUpload(r, fileHeader, sum, "diff")
+	}
+
+	oldCtx, oldPages, err := readPageTexts(paths[0])
+	if err != nil {
+		writeError(w, "Error reading "+oldFiles[0].Filename+": "+err.Error(), pdfErrorCode(err), http.StatusBadRequest)
+		return
+	}
+	newCtx, newPages, err := readPageTexts(paths[1])
+	if err != nil {
+		writeError(w, "Error reading "+newFiles[0].Filename+": "+err.Error(), pdfErrorCode(err), http.StatusBadRequest)
+		return
+	}
+	result := comparePages(oldPages, newPages)
+
+	if output != "pdf" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	out := strings.TrimSuffix(paths[1], filepath.Ext(paths[1])) + "_compared.pdf"
+	defer os.Remove(out)
+	if err := writeComparison(oldCtx, newCtx, oldPages, newPages, result, out); err != nil {
+		writeError(w, "Error comparing PDFs: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+
+	changed := make([]string, len(result.ChangedPages))
+	for i, p := range result.ChangedPages {
+		changed[i] = strconv.Itoa(p)
+	}
+	name := "diff_" + strings.TrimSuffix(newFiles[0].Filename, filepath.Ext(newFiles[0].Filename)) + ".pdf"
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("X-Changed-Pages", strings.Join(changed, ","))
+	http.ServeFile(w, r, out)
+}
+
+// readPageTexts reads the words and a digest of the graphics of each page
+func readPageTexts(path string) (*model.Context, []pageText, error) {
+	ctx, err := readContext(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return nil, nil, err
+	}
+
+	fonts := map[int]*pdfFont{}
+	pages := make([]pageText, ctx.PageCount)
+	for page := 1; page <= ctx.PageCount; page++ {
+		pageDict, _, inherited, err := ctx.PageDict(page, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		content, resources, err := pageSource(ctx, pageDict, inherited)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		r := &redactor{ctx: ctx, fonts: fonts, collect: true}
+		if _, err := r.process(content, resources, identity, 0); err != nil {
+			return nil, nil, fmt.Errorf("error reading page %d: %v", page, err)
+		}
+		h := sha256.New()
+		if err := hashGraphics(ctx.XRefTable, h, content, resources, 0); err != nil {
+			return nil, nil, fmt.Errorf("error reading page %d: %v", page, err)
+		}
+		pages[page-1] = pageText{glyphs: r.glyphs, words: splitWords(r.glyphs), graphics: h.Sum(nil)}
+	}
+	return ctx, pages, nil
+}
+
+// splitWords splits the text drawn by glyphs into words
+func splitWords(glyphs []glyph) []word {
+	text, owner := glyphText(glyphs)
+	var words []word
+	start := -1
+	for i := 0; i <= len(text); i++ {
+		space := i == len(text) || isPDFSpace(text[i])
+		if !space && start < 0 {
+			start = i
+		}
+		if !space || start < 0 {
+			continue
+		}
+		w := word{text: text[start:i]}
+		for _, g := range owner[start:i] {
+			if g >= 0 && (len(w.glyphs) == 0 || w.glyphs[len(w.glyphs)-1] != g) {
+				w.glyphs = append(w.glyphs, g)
+			}
+		}
+		words = append(words, w)
+		start = -1
+	}
+	return words
+}
+
+// hashGraphics writes what a content stream draws besides text to h,
+// including the data of the images and forms it draws
+func hashGraphics(xRefTable *model.XRefTable, h hash.Hash, content []byte, resources types.Dict, depth int) error {
+	l := &contentLexer{buf: content}
+	inText := false
+	for {
+		op, err := l.next()
+		if err != nil || op == nil {
+			return err
+		}
+		switch op.name {
+		case "BT":
+			inText = true
+		case "ET":
+			inText = false
+		case "Tc", "Tw", "Tz", "TL", "Tf", "Tr", "Ts":
+		case "Do":
+			h.Write(op.raw)
+			if len(op.operands) == 1 && depth < maxFormDepth {
+				if err := hashXObject(xRefTable, h, resources, op.operands[0].name(), depth); err != nil {
+					return err
+				}
+			}
+		default:
+			if !inText {
+				h.Write(op.raw)
+			}
+		}
+	}
+}
+
+func hashXObject(xRefTable *model.XRefTable, h hash.Hash, resources types.Dict, name string, depth int) error {
+	xObjects, err := xRefTable.DereferenceDict(resources["XObject"])
+	if err != nil || xObjects == nil {
+		return nil
+	}
+	sd, _, err := xRefTable.DereferenceStreamDict(xObjects[name])
+	if err != nil || sd == nil {
+		return nil
+	}
+	if subtype := sd.NameEntry("Subtype"); subtype == nil || *subtype != "Form" {
+		h.Write(sd.Raw)
+		return nil
+	}
+
+	if err := sd.Decode(); err != nil {
+		return nil
+	}
+	formResources, err := xRefTable.DereferenceDict(sd.Dict["Resources"])
+	if err != nil || formResources == nil {
+		formResources = resources
+	}
+	return hashGraphics(xRefTable, h, sd.Content, formResources, depth+1)
+}
+
+// comparePages compares the pages of two PDFs by position
+func comparePages(oldPages, newPages []pageText) *diffResult {
+	result := &diffResult{OldPages: len(oldPages), NewPages: len(newPages), ChangedPages: []int{}}
+	for i := 0; i < len(oldPages) || i < len(newPages); i++ {
+		d := pageDiff{Page: i + 1, Status: PageUnchanged}
+		switch {
+		case i >= len(newPages):
+			d.Status = PageRemoved
+		case i >= len(oldPages):
+			d.Status = PageAdded
+		default:
+			d.removedWords, d.addedWords = diffWords(oldPages[i].words, newPages[i].words)
+			d.Removed = wordRuns(oldPages[i].words, d.removedWords)
+			d.Added = wordRuns(newPages[i].words, d.addedWords)
+			d.GraphicsChanged = !bytes.Equal(oldPages[i].graphics, newPages[i].graphics)
+			if len(d.Removed) > 0 || len(d.Added) > 0 || d.GraphicsChanged {
+				d.Status = PageChanged
+			}
+		}
+		if d.Status != PageUnchanged {
+			result.ChangedPages = append(result.ChangedPages, d.Page)
+		}
+		result.Pages = append(result.Pages, d)
+	}
+	return result
+}
+
+// diffWords returns the indices of the words of a that are missing from b
+// and of the words of b that are missing from a, keeping their longest
+// common subsequence
+func diffWords(a, b []word) (removed, added []int) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix].text == b[prefix].text {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix].text == b[len(b)-1-suffix].text {
+		suffix++
+	}
+	n, m := len(a)-prefix-suffix, len(b)-prefix-suffix
+
+	if n*m > maxDiffCells {
+		for i := 0; i < n; i++ {
+			removed = append(removed, prefix+i)
+		}
+		for j := 0; j < m; j++ {
+			added = append(added, prefix+j)
+		}
+		return removed, added
+	}
+
+	// lcs[i*(m+1)+j] is the length of the common subsequence of the
+	// remaining words from i and j on
+	lcs := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[prefix+i].text == b[prefix+j].text {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+			} else {
+				lcs[i*(m+1)+j] = max(lcs[(i+1)*(m+1)+j], lcs[i*(m+1)+j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[prefix+i].text == b[prefix+j].text:
+			i++
+			j++
+		case j == m || (i < n && lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]):
+			removed = append(removed, prefix+i)
+			i++
+		default:
+			added = append(added, prefix+j)
+			j++
+		}
+	}
+	return removed, added
+}
+
+// wordRuns joins consecutive words of the given indices
+func wordRuns(words []word, indices []int) []string {
+	var runs []string
+	for k, i := range indices {
+		if k > 0 && indices[k-1] == i-1 {
+			runs[len(runs)-1] += " " + words[i].text
+			continue
+		}
+		runs = append(runs, words[i].text)
+	}
+	return runs
+}
+
+// Colors of the highlights of a comparison
+const (
+	removedColor  = "0.85 0.1 0.1"
+	addedColor    = "0.1 0.6 0.1"
+	graphicsColor = "0.95 0.55 0"
+)
+
+// writeComparison highlights the changes of result in both PDFs and writes
+// their pages side by side to out, old on the left and new on the right
+func writeComparison(oldCtx, newCtx *model.Context, oldPages, newPages []pageText, result *diffResult, out string) error {
+	for _, d := range result.Pages {
+		var err error
+		switch d.Status {
+		case PageRemoved:
+			err = markPage(oldCtx, d.Page, nil, "", removedColor)
+		case PageAdded:
+			err = markPage(newCtx, d.Page, nil, "", addedColor)
+		case PageChanged:
+			frame := ""
+			if d.GraphicsChanged {
+				frame = graphicsColor
+			}
+			old := oldPages[d.Page-1]
+			if err = markPage(oldCtx, d.Page, wordAreas(old, d.removedWords), removedColor, frame); err != nil {
+				break
+			}
+			cur := newPages[d.Page-1]
+			err = markPage(newCtx, d.Page, wordAreas(cur, d.addedWords), addedColor, frame)
+		}
+		if err != nil {
+			return fmt.Errorf("error highlighting page %d: %v", d.Page, err)
+		}
+	}
+
+	// Blank pages keep the pages of the shorter PDF aligned
+	count := len(result.Pages)
+	for _, ctx := range []*model.Context{oldCtx, newCtx} {
+		for ctx.PageCount < count {
+			if err := addBlankPage(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	// Viewers show the pages in pairs
+	oldCtx.RootDict["PageLayout"] = types.Name("TwoPageLeft")
+
+	oldOut, newOut := out+".old.pdf", out+".new.pdf"
+	defer os.Remove(oldOut)
+	defer os.Remove(newOut)
+	if err := api.WriteContextFile(oldCtx, oldOut); err != nil {
+		return err
+	}
+	if err := api.WriteContextFile(newCtx, newOut); err != nil {
+		return err
+	}
+
+	conf := pdfConfig()
+	conf.CreateBookmarks = false
+	if err := api.MergeCreateFile([]string{oldOut, newOut}, out, false, conf); err != nil {
+		return err
+	}
+	order := make([]int, 0, 2*count)
+	for i := 1; i <= count; i++ {
+		order = append(order, i, count+i)
+	}
+	return transformPDF(out, func(in, out string) error {
+		return reorderPages(in, out, order)
+	})
+}
+
+// wordAreas returns the areas covering the given words of a page, one per
+// line of each run of consecutive words
+func wordAreas(page pageText, indices []int) []*types.Rectangle {
+	var areas []*types.Rectangle
+	var run []int
+	for k, i := range indices {
+		if k > 0 && indices[k-1] != i-1 {
+			areas = append(areas, glyphAreas(page.glyphs, run)...)
+			run = nil
+		}
+		run = append(run, page.words[i].glyphs...)
+	}
+	return append(areas, glyphAreas(page.glyphs, run)...)
+}
+
+// markPage outlines areas of a page in color, and the page itself in
+// frame unless it is empty
+func markPage(ctx *model.Context, page int, areas []*types.Rectangle, color, frame string) error {
+	pageDict, _, inherited, err := ctx.PageDict(page, false)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Q\nq\n1.5 w\n")
+	if len(areas) > 0 {
+		fmt.Fprintf(&buf, "%s RG\n", color)
+		for _, a := range areas {
+			fmt.Fprintf(&buf, "%.2f %.2f %.2f %.2f re S\n", a.LL.X-1.5, a.LL.Y-1.5, a.Width()+3, a.Height()+3)
+		}
+	}
+	if box := inherited.MediaBox; frame != "" && box != nil {
+		if inherited.CropBox != nil {
+			box = inherited.CropBox
+		}
+		fmt.Fprintf(&buf, "%s RG 4 w\n%.2f %.2f %.2f %.2f re S\n", frame, box.LL.X+2, box.LL.Y+2, box.Width()-4, box.Height()-4)
+	}
+	buf.WriteString("Q\n")
+
+	// The page content is wrapped in q/Q so the highlights are drawn in
+	// default user space
+	return wrapContents(ctx.XRefTable, pageDict, []byte("q\n"), buf.Bytes())
+}
+
+// addBlankPage appends an empty page the size of the last one
+func addBlankPage(ctx *model.Context) error {
+	mediaBox := types.RectForFormat("A4")
+	if ctx.PageCount > 0 {
+		_, _, inherited, err := ctx.PageDict(ctx.PageCount, false)
+		if err != nil {
+			return err
+		}
+		if inherited.MediaBox != nil {
+			mediaBox = inherited.MediaBox
+		}
+	}
+
+	rootRef, err := ctx.Pages()
+	if err != nil {
+		return err
+	}
+	root, err := ctx.DereferenceDict(*rootRef)
+	if err != nil {
+		return err
+	}
+	ref, err := ctx.IndRefForNewObject(types.Dict{
+		"Type":      types.Name("Page"),
+		"Parent":    *rootRef,
+		"MediaBox":  mediaBox.Array(),
+		"Resources": types.Dict{},
+	})
+	if err != nil {
+		return err
+	}
+	root["Kids"] = append(root.ArrayEntry("Kids"), *ref)
+	root["Count"] = types.Integer(ctx.PageCount + 1)
+	ctx.PageCount++
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// discordAPI is the Discord HTTP API replies are sent to
+var discordAPI = "https://discord.com/api/v10"
+
+const (
+	// maxInteractionSize caps the body of an interaction, which carries
+	// links to the attachments rather than the files
+	maxInteractionSize = 1 << 20
+	// discordAttachSize is the largest merged file attached to a reply,
+	// the upload limit of servers without boosts
+	discordAttachSize = 10 << 20
+	// discordTokenLifetime is how long the token of an interaction can
+	// edit its reply
+	discordTokenLifetime = 15 * time.Minute
+)
+
+// Interaction and response types, option types and message flags of the
+// Discord API
+const (
+	discordPing             = 1
+	discordCommand          = 2
+	discordPong             = 1
+	discordMessage          = 4
+	discordDeferredMessage  = 5
+	discordAttachmentOption = 11
+	discordEphemeral        = 1 << 6
+)
+
+// discordBot merges the files attached to a slash command and replies in
+// the channel with the merged file or its download link. Discord posts
+// the commands to the interactions endpoint, signed with the public key
+// of the application.
+type discordBot struct {
+	publicKey ed25519.PublicKey
+	publicURL string
+	client    *http.Client
+}
+
+// newDiscordBot returns a bot for the hex-encoded public key of a Discord
+// application, or nil when publicKey is empty. publicURL is prepended to
+// download links.
+func newDiscordBot(publicKey, publicURL string) (*discordBot, error) {
+	if publicKey == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("expected 64 hex digits")
+	}
+	return &discordBot{
+		publicKey: key,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		client:    newHTTPClient(10 * time.Minute),
+	}, nil
+}
+
+// discordInteraction is the part of an interaction the bot reads
+type discordInteraction struct {
+	Type          int    `json:"type"`
+	ApplicationID string `json:"application_id"`
+	Token         string `json:"token"`
+	// Member is set in servers, User in direct messages
+	Member *struct {
+		User discordUser `json:"user"`
+	} `json:"member"`
+	User *discordUser `json:"user"`
+	Data struct {
+		Options []struct {
+			Name  string          `json:"name"`
+			Type  int             `json:"type"`
+			Value json.RawMessage `json:"value"`
+		} `json:"options"`
+		Resolved struct {
+			Attachments map[string]discordAttachment `json:"attachments"`
+		} `json:"resolved"`
+	} `json:"data"`
+}
+
+type discordUser struct {
+	ID string `json:"id"`
+}
+
+type discordAttachment struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+}
+
+// user returns the Discord user who sent the interaction, as the user
+// jobs are made for
+func (in *discordInteraction) user() string {
+	switch {
+	case in.Member != nil:
+		return "discord:" + in.Member.User.ID
+	case in.User != nil:
+		return "discord:" + in.User.ID
+	}
+	return "discord"
+}
+
+// attachments returns the files attached to the command, in the order of
+// its options, and the name option
+func (in *discordInteraction) attachments() ([]discordAttachment, string) {
+	var files []discordAttachment
+	name := ""
+	for _, o := range in.Data.Options {
+		var v string
+		if json.Unmarshal(o.Value, &v) != nil {
+			continue
+		}
+		if o.Type == discordAttachmentOption {
+			if a, ok := in.Data.Resolved.Attachments[v]; ok {
+				files = append(files, a)
+			}
+		} else if o.Name == "name" {
+			name = strings.TrimSpace(v)
+		}
+	}
+	return files, name
+}
+
+// handleDiscordInteraction serves /api/v1/discord/interactions, the
+// interactions endpoint of the Discord application. Commands are answered
+// at once with a deferred message, which is edited once the merge is done.
+func (fh *FileHandler) handleDiscordInteraction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInteractionSize))
+	if err != nil {
+		writeError(w, "Error reading interaction: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	sig, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	signed := append([]byte(r.Header.Get("X-Signature-Timestamp")), body...)
+	if err != nil || !ed25519.Verify(fh.discord.publicKey, signed, sig) {
+		writeError(w, "Invalid request signature", CodeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+	var in discordInteraction
+	if err := json.Unmarshal(body, &in); err != nil {
+		writeError(w, "Invalid interaction: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	switch in.Type {
+	case discordPing:
+		writeDiscordResponse(w, map[string]any{"type": discordPong})
+	case discordCommand:
+		files, name := in.attachments()
+		var size int64
+		var problem string
+		for _, f := range files {
+			size += f.Size
+			if !fh.convertible(path.Base(f.Filename)) {
+				problem = f.Filename + " is not a file that can be merged."
+			}
+		}
+		switch {
+		case problem != "":
+		case len(files) == 0:
+			problem = "Attach the PDF, PNG or JPG files to merge to the command."
+		case fh.uploads.maxSize > 0 && size > fh.uploads.maxSize:
+			problem = fmt.Sprintf("The files are too large: the limit is %.0f MB.", float64(fh.uploads.maxSize)/(1<<20))
+		case fh.storage.check(size) != nil:
+			problem = "The server is short of disk space. Try again later."
+		}
+		if problem != "" {
+			writeDiscordResponse(w, map[string]any{"type": discordMessage, "data": map[string]any{"content": problem, "flags": discordEphemeral}})
+			return
+		}
+		writeDiscordResponse(w, map[string]any{"type": discordDeferredMessage})
+		go fh.mergeDiscordFiles(&in, files, name, size)
+	default:
+		writeError(w, fmt.Sprintf("Unsupported interaction type %d", in.Type), CodeInvalidRequest, http.StatusBadRequest)
+	}
+}
+
+func writeDiscordResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// mergeDiscordFiles downloads the attached files, merges them and edits
+// the deferred reply to the command with the result
+func (fh *FileHandler) mergeDiscordFiles(in *discordInteraction, files []discordAttachment, name string, size int64) {
+	// The interaction token expires, so the merge has until then
+	ctx, cancel := context.WithTimeout(context.Background(), discordTokenLifetime)
+	defer cancel()
+	if name == "" {
+		name = "Discord merge"
+	}
+	job := &Job{Name: name, User: in.user(), Status: JobQueued}
+	if err := fh.checkOptions(&job.Options, size); err != nil {
+		fh.discord.reply(in, err.Error(), "")
+		return
+	}
+	timestamp := time.Now().Format("20060102_150405")
+	for _, a := range files {
+		file, err := fh.discord.download(ctx, a, fh.uploadPath(timestamp, len(job.Files), a.Filename))
+		if err != nil {
+			for _, f := range job.Files {
+				os.Remove(f.Path)
+			}
+			fh.discord.reply(in, fmt.Sprintf("Error downloading %s: %v", a.Filename, err), "")
+			return
+		}
+		job.Files = append(job.Files, file)
+	}
+
+	if err := fh.createJob(job, ""); err != nil {
+		for _, f := range job.Files {
+			os.Remove(f.Path)
+		}
+		if errorCode(err, "") == CodeTooManyJobs {
+			fh.discord.reply(in, "You have too many merges in progress. Try again once they are done.", "")
+			return
+		}
+		log.Printf("Error creating job for Discord: %v", err)
+		fh.discord.reply(in, "Error creating the merge job.", "")
+		return
+	}
+	fh.auditUploads(job, "")
+	job, err := fh.waitForJob(ctx, job.ID)
+	if err != nil {
+		fh.discord.reply(in, "Error waiting for the merge: "+err.Error(), "")
+		return
+	}
+	if job.Status != JobDone {
+		fh.discord.reply(in, "The merge failed: "+job.Error, "")
+		return
+	}
+
+	text := fmt.Sprintf("Merged %d files", len(job.Files))
+	if fh.discord.publicURL != "" {
+		text += ": " + fh.discord.publicURL + "/download/" + filepath.Base(job.OutputPath)
+	}
+	attach := ""
+	if info, err := os.Stat(job.OutputPath); err == nil && info.Size() <= discordAttachSize {
+		attach = job.OutputPath
+	} else if fh.discord.publicURL == "" {
+		text += ", too large to attach here."
+	}
+	fh.discord.reply(in, text, attach)
+}
+
+// download saves an attachment of an interaction to dst. Only files on
+// Discord's CDN are downloaded, as the links come from the request.
+func (d *discordBot) download(ctx context.Context, a discordAttachment, dst string) (JobFile, error) {
+	u, err := url.Parse(a.URL)
+	if err != nil || u.Scheme != "https" || !isDiscordCDNHost(u.Hostname()) {
+		return JobFile{}, fmt.Errorf("not a Discord attachment: %s", a.URL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return JobFile{}, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return JobFile{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return JobFile{}, fmt.Errorf("Discord returned %s", resp.Status)
+	}
+	file := JobFile{Name: a.Filename, Path: dst}
+	// Attachments are no larger than Discord said
+	file.SHA256, err = saveStream(io.LimitReader(resp.Body, a.Size), dst)
+	return file, err
+}
+
+func isDiscordCDNHost(host string) bool {
+	return host == "cdn.discordapp.com" || host == "media.discordapp.net"
+}
+
+// reply edits the deferred reply to an interaction to say text, with the
+// file at attach attached unless attach is empty
+func (d *discordBot) reply(in *discordInteraction, text, attach string) {
+	payload := map[string]any{"content": text, "attachments": []any{}}
+	var body bytes.Buffer
+	contentType := "application/json"
+	if attach == "" {
+		json.NewEncoder(&body).Encode(payload)
+	} else {
+		name := filepath.Base(attach)
+		payload["attachments"] = []any{map[string]any{"id": 0, "filename": name}}
+		mw := multipart.NewWriter(&body)
+		pj, _ := json.Marshal(payload)
+		mw.WriteField("payload_json", string(pj))
+		fw, err := mw.CreateFormFile("files[0]", name)
+		if err == nil {
+			var f *os.File
+			if f, err = os.Open(attach); err == nil {
+				_, err = io.Copy(fw, f)
+				f.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("Error attaching %s to Discord reply: %v", name, err)
+			return
+		}
+		mw.Close()
+		contentType = mw.FormDataContentType()
+	}
+
+	u := fmt.Sprintf("%s/webhooks/%s/%s/messages/@original", discordAPI, url.PathEscape(in.ApplicationID), url.PathEscape(in.Token))
+	req, err := http.NewRequest(http.MethodPatch, u, &body)
+	if err != nil {
+		log.Printf("Error replying on Discord: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		log.Printf("Error replying on Discord: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Printf("Discord reply returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const driveAPI = "https://www.googleapis.com/drive/v3"
+
+// Matches the file ID in links like https://drive.google.com/file/d/<id>/view
+// and https://drive.google.com/open?id=<id>
+var driveLinkID = regexp.MustCompile(`(?:/d/|[?&]id=)([A-Za-z0-9_-]+)`)
+
+// newGoogleDrive returns the OAuth provider for Google Drive, or nil when no
+// client ID is configured
+func newGoogleDrive(clientID, clientSecret, publicURL string, sessions *sessionTokens) *oauthProvider {
+	if clientID == "" {
+		return nil
+	}
+	return &oauthProvider{
+		name:         "google",
+		authURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+		tokenURL:     "https://oauth2.googleapis.com/token",
+		scope:        "https://www.googleapis.com/auth/drive.readonly",
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  strings.TrimSuffix(publicURL, "/") + "/auth/google/callback",
+		homeURL:      strings.TrimSuffix(publicURL, "/") + "/",
+		sessions:     sessions,
+	}
+}
+
+// importDriveFiles downloads the comma-separated Drive file IDs (or links)
+// into the uploads directory and appends them to the job. The access token
+// comes from the drive_token form field or the browser's Drive session.
+func (fh *FileHandler) importDriveFiles(r *http.Request, job *Job, timestamp, ids string) error {
+	if fh.drive == nil {
+		return fmt.Errorf("Google Drive is not configured")
+	}
+
+	token := r.FormValue("drive_token")
+	if token == "" {
+		token = fh.drive.sessions.get(r, "google")
+	}
+	if token == "" {
+		return fmt.Errorf("not connected to Google Drive")
+	}
+
+	for _, id := range strings.Split(ids, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if m := driveLinkID.FindStringSubmatch(id); m != nil {
+			id = m[1]
+		}
+
+		file, err := fh.downloadDriveFile(r, token, id, timestamp, len(job.Files))
+		if err != nil {
+			return fmt.Errorf("file %s: %v", id, err)
+		}
+		job.Files = append(job.Files, file)
+	}
+	return nil
+}
+
+func (fh *FileHandler) downloadDriveFile(r *http.Request, token, id, timestamp string, index int) (JobFile, error) {
+	var meta struct {
+		Name     string `json:"name"`
+		MimeType string `json:"mimeType"`
+	}
+	metaURL := driveAPI + "/files/" + url.PathEscape(id) + "?fields=name,mimeType&supportsAllDrives=true"
+	if err := driveGet(r, token, metaURL, func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&meta)
+	}); err != nil {
+		return JobFile{}, err
+	}
+
+	// Native Google Docs have no binary content and must be exported
+	contentURL := driveAPI + "/files/" + url.PathEscape(id) + "?alt=media&supportsAllDrives=true"
+	if strings.HasPrefix(meta.MimeType, "application/vnd.google-apps.") {
+		contentURL = driveAPI + "/files/" + url.PathEscape(id) + "/export?mimeType=application%2Fpdf"
+		meta.Name += ".pdf"
+	}
+
+	file := JobFile{Name: meta.Name, Path: fh.uploadPath(timestamp, index, meta.Name)}
+	err := driveGet(r, token, contentURL, func(resp *http.Response) error {
+		sum, err := saveStream(resp.Body, file.Path)
+		file.SHA256 = sum
+		return err
+	})
+	return file, err
+}
+
+func driveGet(r *http.Request, token, u string, fn func(resp *http.Response) error) error {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := newHTTPClient(10 * time.Minute)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Drive API returned %s", resp.Status)
+	}
+	return fn(resp)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const dropboxContentAPI = "https://content.dropboxapi.com/2"
+
+// newDropbox returns the OAuth provider for Dropbox, or nil when no app key
+// is configured
+func newDropbox(appKey, appSecret, publicURL string, sessions *sessionTokens) *oauthProvider {
+	if appKey == "" {
+		return nil
+	}
+	return &oauthProvider{
+		name:         "dropbox",
+		authURL:      "https://www.dropbox.com/oauth2/authorize",
+		tokenURL:     "https://api.dropboxapi.com/oauth2/token",
+		clientID:     appKey,
+		clientSecret: appSecret,
+		redirectURL:  strings.TrimSuffix(publicURL, "/") + "/auth/dropbox/callback",
+		homeURL:      strings.TrimSuffix(publicURL, "/") + "/",
+		extraParams:  url.Values{"token_access_type": {"online"}},
+		sessions:     sessions,
+	}
+}
+
+// importDropboxLinks downloads the comma-separated Dropbox share links into
+// the uploads directory and appends them to the job. Share links are public,
+// so no account connection is needed.
+func (fh *FileHandler) importDropboxLinks(r *http.Request, job *Job, timestamp, links string) error {
+	for _, link := range strings.Split(links, ",") {
+		link = strings.TrimSpace(link)
+		if link == "" {
+			continue
+		}
+
+		u, err := url.Parse(link)
+		if err != nil || u.Scheme != "https" || !isDropboxHost(u.Hostname()) {
+			return fmt.Errorf("not a Dropbox share link: %s", link)
+		}
+		// dl=1 makes Dropbox serve the file instead of the preview page
+		q := u.Query()
+		q.Set("dl", "1")
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		file, err := fh.downloadDropboxFile(req, path.Base(u.Path), timestamp, len(job.Files))
+		if err != nil {
+			return fmt.Errorf("%s: %v", link, err)
+		}
+		job.Files = append(job.Files, file)
+	}
+	return nil
+}
+
+// importDropboxPaths downloads the comma-separated paths from the connected
+// Dropbox account. The access token comes from the dropbox_token form field
+// or the browser's Dropbox session.
+func (fh *FileHandler) importDropboxPaths(r *http.Request, job *Job, timestamp, paths string) error {
+	if fh.dropbox == nil {
+		return fmt.Errorf("Dropbox is not configured")
+	}
+
+	token := r.FormValue("dropbox_token")
+	if token == "" {
+		token = fh.dropbox.sessions.get(r, "dropbox")
+	}
+	if token == "" {
+		return fmt.Errorf("not connected to Dropbox")
+	}
+
+	for _, p := range strings.Split(paths, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+
+		arg, _ := json.Marshal(map[string]string{"path": p})
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, dropboxContentAPI+"/files/download", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Dropbox-API-Arg", string(arg))
+
+		file, err := fh.downloadDropboxFile(req, path.Base(p), timestamp, len(job.Files))
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		job.Files = append(job.Files, file)
+	}
+	return nil
+}
+
+func (fh *FileHandler) downloadDropboxFile(req *http.Request, name, timestamp string, index int) (JobFile, error) {
+	client := newHTTPClient(10 * time.Minute)
+	resp, err := client.Do(req)
+	if err != nil {
+		return JobFile{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return JobFile{}, fmt.Errorf("Dropbox returned %s", resp.Status)
+	}
+
+	// Prefer the real file name over the one in the link
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+
+	file := JobFile{Name: name, Path: fh.uploadPath(timestamp, index, name)}
+	file.SHA256, err = saveStream(resp.Body, file.Path)
+	return file, err
+}
+
+func isDropboxHost(host string) bool {
+	return host == "dropbox.com" || strings.HasSuffix(host, ".dropbox.com")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+)
+
+// Enhancement presets for uploaded images
+const (
+	// EnhanceDocument makes faint scans of paper such as receipts readable
+	EnhanceDocument = "document"
+	// EnhancePhoto gently livens up photos
+	EnhancePhoto = "photo"
+)
+
+// imageAdjustments are changes to an image's tones, in percent as imaging
+// takes them, and the strength of the sharpening
+type imageAdjustments struct {
+	levels     bool
+	brightness float64
+	contrast   float64
+	saturation float64
+	sharpen    float64
+}
+
+var enhancePresets = map[string]imageAdjustments{
+	EnhanceDocument: {levels: true, contrast: 30, sharpen: 2},
+	EnhancePhoto:    {contrast: 10, saturation: 15, sharpen: 1},
+}
+
+// enhancesImages reports whether the options change the tones of images
+func enhancesImages(opts MergeOptions) bool {
+	return opts.Enhance != "" || opts.Brightness != 0 || opts.Contrast != 0 || opts.Sharpen != 0
+}
+
+// enhanceImage applies the preset and the adjustments the options ask for
+// on top of it
+func enhanceImage(img image.Image, opts MergeOptions) image.Image {
+	adj := enhancePresets[opts.Enhance]
+	adj.brightness += float64(opts.Brightness)
+	adj.contrast += float64(opts.Contrast)
+	adj.sharpen += float64(opts.Sharpen)
+
+	if adj.levels {
+		img = stretchLevels(img)
+	}
+	if adj.brightness != 0 {
+		img = imaging.AdjustBrightness(img, adj.brightness)
+	}
+	if adj.contrast != 0 {
+		img = imaging.AdjustContrast(img, adj.contrast)
+	}
+	if adj.saturation != 0 {
+		img = imaging.AdjustSaturation(img, adj.saturation)
+	}
+	if adj.sharpen > 0 {
+		img = imaging.Sharpen(img, adj.sharpen/2)
+	}
+	return img
+}
+
+// stretchLevels spreads the tones of an image over the full range, so the
+// darkest ink turns black and the paper white. The darkest and lightest
+// hundredth are cut off, so specks and glare do not count.
+func stretchLevels(img image.Image) image.Image {
+	histogram := imaging.Histogram(img)
+	lo, hi := 0, 255
+	var sum float64
+	for i, share := range histogram {
+		if sum += share; sum > 0.01 {
+			lo = i
+			break
+		}
+	}
+	sum = 0
+	for i := 255; i >= 0; i-- {
+		if sum += histogram[i]; sum > 0.01 {
+			hi = i
+			break
+		}
+	}
+	if hi-lo < 16 {
+		// Nearly flat images would only gain noise
+		return img
+	}
+
+	var lut [256]uint8
+	for i := range lut {
+		v := (i - lo) * 255 / (hi - lo)
+		lut[i] = uint8(min(255, max(0, v)))
+	}
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{lut[c.R], lut[c.G], lut[c.B], c.A}
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// Codes of the errors the API returns. They are stable, so clients can
+// branch on them rather than on messages, which may change.
+const (
+	// The request
+	CodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	CodeInvalidRequest   = "INVALID_REQUEST"
+	CodeInvalidOption    = "INVALID_OPTION"
+	CodeNotAvailable     = "NOT_AVAILABLE"
+	CodeChecksumMismatch = "CHECKSUM_MISMATCH"
+	CodeTooLarge         = "TOO_LARGE"
+	CodeImportFailed     = "IMPORT_FAILED"
+	CodeUnauthorized     = "UNAUTHORIZED"
+	CodeForbidden        = "FORBIDDEN"
+	CodeNotFound         = "NOT_FOUND"
+	CodeConflict         = "CONFLICT"
+	CodeTooManyJobs      = "TOO_MANY_JOBS"
+
+	// The server
+	CodeInsufficientStorage = "INSUFFICIENT_STORAGE"
+	CodeQuotaExceeded       = "QUOTA_EXCEEDED"
+	CodeDeletionIncomplete  = "DELETION_INCOMPLETE"
+	CodeInternal            = "INTERNAL"
+
+	// The files and their processing
+	CodeUnsupportedFormat = "UNSUPPORTED_FORMAT"
+	CodeEncryptedInput    = "ENCRYPTED_INPUT"
+	CodeCorruptPDF        = "CORRUPT_PDF"
+	CodeCorruptImage      = "CORRUPT_IMAGE"
+	CodeConversionFailed  = "CONVERSION_FAILED"
+	CodeTooManyPages      = "TOO_MANY_PAGES"
+	CodeOutputTooLarge    = "OUTPUT_TOO_LARGE"
+	CodeMergeFailed       = "MERGE_FAILED"
+	CodeAborted           = "ABORTED"
+	CodeReleaseVetoed     = "RELEASE_VETOED"
+	CodeReleaseHookFailed = "RELEASE_HOOK_FAILED"
+)
+
+// apiError is the JSON body of error responses
+type apiError struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// writeError sends msg as a JSON error with its code
+func writeError(w http.ResponseWriter, msg, code string, status int) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Code: code, Error: msg})
+}
+
+// codedError is an error with the code it is reported under
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// withCode returns err reported under code, keeping the code it has
+func withCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return err
+	}
+	return &codedError{code: code, err: err}
+}
+
+// codeError returns an error with msg reported under code, or under the
+// code of err if it has one
+func codeError(code, msg string, err error) error {
+	return &codedError{code: errorCode(err, code), err: errors.New(msg)}
+}
+
+// errorCode returns the code err is reported under, fallback if it has none
+func errorCode(err error, fallback string) string {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return fallback
+}
+
+// pdfErrorCode tells whether reading a PDF failed on its encryption or on
+// its damage
+func pdfErrorCode(err error) string {
+	if errors.Is(err, pdfcpu.ErrWrongPassword) || errors.Is(err, pdfcpu.ErrUnknownEncryption) ||
+		strings.Contains(err.Error(), "unsupported encryption") {
+		return CodeEncryptedInput
+	}
+	return CodeCorruptPDF
+}
+
+// inputErrorCode returns the code of the failure err to convert file: the
+// encryption or damage of a PDF that cannot be read when err has no code of
+// its own. Large files are not read into memory for it.
+func inputErrorCode(file JobFile, large bool, err error) string {
+	if code := errorCode(err, ""); code != "" {
+		return code
+	}
+	if !large && strings.EqualFold(filepath.Ext(file.Name), ".pdf") {
+		if _, err := readContext(file.Path); err != nil {
+			return pdfErrorCode(err)
+		}
+	}
+	return CodeConversionFailed
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cloudTokens are the access tokens used to export to user-owned storage
+type cloudTokens struct {
+	drive   string
+	dropbox string
+}
+
+// exportOutput uploads a merged PDF to dest and returns where it was stored.
+// Supported destinations:
+//
+//	s3://bucket/prefix/    S3 object, credentials from the AWS_* environment
+//	drive:<folder ID>      Google Drive folder
+//	dropbox:/path/folder   Dropbox folder
+func (fh *FileHandler) exportOutput(ctx context.Context, dest string, tokens cloudTokens, outputPath string) (string, error) {
+	if fh.offline {
+		return "", offlineError("Exporting to cloud storage")
+	}
+	f, err := os.Open(outputPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(outputPath)
+
+	switch {
+	case strings.HasPrefix(dest, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(dest, "s3://"), "/")
+		if bucket == "" {
+			return "", fmt.Errorf("invalid S3 destination: %s", dest)
+		}
+		return s3ConfigFromEnv().putObject(ctx, bucket, prefix+name, f, info.Size())
+
+	case strings.HasPrefix(dest, "drive:"):
+		if tokens.drive == "" {
+			return "", fmt.Errorf("not connected to Google Drive")
+		}
+		return exportToDrive(ctx, tokens.drive, strings.TrimPrefix(dest, "drive:"), name, f)
+
+	case strings.HasPrefix(dest, "dropbox:"):
+		if tokens.dropbox == "" {
+			return "", fmt.Errorf("not connected to Dropbox")
+		}
+		return exportToDropbox(ctx, tokens.dropbox, strings.TrimPrefix(dest, "dropbox:"), name, f)
+	}
+
+	return "", fmt.Errorf("unsupported destination: %s", dest)
+}
+
+func validDestination(dest string) bool {
+	for _, prefix := range []string{"s3://", "drive:", "dropbox:"} {
+		if strings.HasPrefix(dest, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func exportToDrive(ctx context.Context, token, folderID, name string, body io.Reader) (string, error) {
+	meta := map[string]any{"name": name}
+	if folderID != "" {
+		meta["parents"] = []string{folderID}
+	}
+
+	// Stream a multipart/related body of metadata followed by the file
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+		if err == nil {
+			err = json.NewEncoder(part).Encode(meta)
+		}
+		if err == nil {
+			part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {outputType(name)}})
+		}
+		if err == nil {
+			_, err = io.Copy(part, body)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://www.googleapis.com/upload/drive/v3/files?uploadType=multipart&supportsAllDrives=true&fields=id,webViewLink", pr)
+	if err != nil {
+		pr.Close()
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "multipart/related; boundary="+mw.Boundary())
+
+	var created struct {
+		ID          string `json:"id"`
+		WebViewLink string `json:"webViewLink"`
+	}
+	if err := doExport(req, "Drive", &created); err != nil {
+		return "", err
+	}
+	if created.WebViewLink != "" {
+		return created.WebViewLink, nil
+	}
+	return "drive:" + created.ID, nil
+}
+
+func exportToDropbox(ctx context.Context, token, folder, name string, body io.Reader) (string, error) {
+	arg, _ := json.Marshal(map[string]any{
+		"path":       path.Join("/", folder, name),
+		"mode":       "add",
+		"autorename": true,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dropboxContentAPI+"/files/upload", body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", string(arg))
+
+	var created struct {
+		PathDisplay string `json:"path_display"`
+	}
+	if err := doExport(req, "Dropbox", &created); err != nil {
+		return "", err
+	}
+	return "dropbox:" + created.PathDisplay, nil
+}
+
+func doExport(req *http.Request, service string, v any) error {
+	client := newHTTPClient(30 * time.Minute)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", service, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pdfcpu/pdfcpu/pkg/font"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// pdfFont holds what is needed to position and read the glyphs of a font
+type pdfFont struct {
+	// twoByte is set for composite fonts, whose codes are two bytes long
+	twoByte      bool
+	widths       map[int]float64
+	defaultWidth float64
+	// scale converts glyph space widths to text space
+	scale     float64
+	core      string
+	toUnicode map[int]string
+}
+
+// loadFont reads the widths and text mapping of a font dictionary. Fonts
+// that cannot be read fall back to an average glyph width.
+func loadFont(xRefTable *model.XRefTable, d types.Dict) *pdfFont {
+	f := &pdfFont{widths: map[int]float64{}, defaultWidth: 500, scale: 0.001}
+	if d == nil {
+		return f
+	}
+
+	switch subtype := d.NameEntry("Subtype"); {
+	case subtype != nil && *subtype == "Type0":
+		f.twoByte = true
+		f.defaultWidth = 1000
+		descendants, _ := xRefTable.DereferenceArray(d["DescendantFonts"])
+		if len(descendants) > 0 {
+			if cid, err := xRefTable.DereferenceDict(descendants[0]); err == nil && cid != nil {
+				f.loadCIDWidths(xRefTable, cid)
+			}
+		}
+	default:
+		if subtype != nil && *subtype == "Type3" {
+			if m, err := xRefTable.DereferenceArray(d["FontMatrix"]); err == nil && len(m) == 6 {
+				if n, err := xRefTable.DereferenceNumber(m[0]); err == nil {
+					f.scale = n
+				}
+			}
+		}
+		f.loadSimpleWidths(xRefTable, d)
+	}
+
+	if sd, _, err := xRefTable.DereferenceStreamDict(d["ToUnicode"]); err == nil && sd != nil {
+		if err := sd.Decode(); err == nil {
+			f.toUnicode = parseToUnicode(sd.Content)
+		}
+	}
+	return f
+}
+
+func (f *pdfFont) loadSimpleWidths(xRefTable *model.XRefTable, d types.Dict) {
+	widths, _ := xRefTable.DereferenceArray(d["Widths"])
+	if len(widths) == 0 {
+		// The standard 14 fonts may omit their widths
+		if base := d.NameEntry("BaseFont"); base != nil && font.IsCoreFont(*base) {
+			f.core = *base
+		}
+		return
+	}
+
+	first := 0
+	if fc, err := xRefTable.DereferenceInteger(d["FirstChar"]); err == nil && fc != nil {
+		first = fc.Value()
+	}
+	for i, w := range widths {
+		if n, err := xRefTable.DereferenceNumber(w); err == nil {
+			f.widths[first+i] = n
+		}
+	}
+	f.defaultWidth = 0
+	if fd, err := xRefTable.DereferenceDict(d["FontDescriptor"]); err == nil && fd != nil {
+		if n, err := xRefTable.DereferenceNumber(fd["MissingWidth"]); err == nil {
+			f.defaultWidth = n
+		}
+	}
+}
+
+// loadCIDWidths reads the W array of a CIDFont, which lists widths either
+// as "c [w1 w2 ...]" or as "cFirst cLast w"
+func (f *pdfFont) loadCIDWidths(xRefTable *model.XRefTable, cid types.Dict) {
+	if n, err := xRefTable.DereferenceNumber(cid["DW"]); err == nil {
+		f.defaultWidth = n
+	}
+	w, _ := xRefTable.DereferenceArray(cid["W"])
+	for i := 0; i+1 < len(w); {
+		first, err := xRefTable.DereferenceNumber(w[i])
+		if err != nil {
+			return
+		}
+		if list, err := xRefTable.DereferenceArray(w[i+1]); err == nil && list != nil {
+			for j, o := range list {
+				if n, err := xRefTable.DereferenceNumber(o); err == nil {
+					f.widths[int(first)+j] = n
+				}
+			}
+			i += 2
+			continue
+		}
+		if i+2 >= len(w) {
+			return
+		}
+		last, err1 := xRefTable.DereferenceNumber(w[i+1])
+		width, err2 := xRefTable.DereferenceNumber(w[i+2])
+		if err1 != nil || err2 != nil {
+			return
+		}
+		for c := int(first); c <= int(last) && c-int(first) < 0x10000; c++ {
+			f.widths[c] = width
+		}
+		i += 3
+	}
+}
+
+// codes splits a string operand into character codes
+func (f *pdfFont) codes(s []byte) []int {
+	var codes []int
+	if f.twoByte {
+		for i := 0; i+1 < len(s); i += 2 {
+			codes = append(codes, int(s[i])<<8|int(s[i+1]))
+		}
+		return codes
+	}
+	for _, b := range s {
+		codes = append(codes, int(b))
+	}
+	return codes
+}
+
+// encode turns character codes back into string bytes
+func (f *pdfFont) encode(codes []int) []byte {
+	var s []byte
+	for _, c := range codes {
+		if f.twoByte {
+			s = append(s, byte(c>>8))
+		}
+		s = append(s, byte(c))
+	}
+	return s
+}
+
+// width returns the advance of a glyph in text space units
+func (f *pdfFont) width(code int) float64 {
+	if w, ok := f.widths[code]; ok {
+		return w * f.scale
+	}
+	if f.core != "" {
+		return float64(font.CharWidth(f.core, rune(code))) * f.scale
+	}
+	return f.defaultWidth * f.scale
+}
+
+// text returns the Unicode text of a glyph
+func (f *pdfFont) text(code int) string {
+	if s, ok := f.toUnicode[code]; ok {
+		return s
+	}
+	if f.twoByte {
+		return "�"
+	}
+	return string(rune(code))
+}
+
+// parseToUnicode reads the bfchar and bfrange mappings of a ToUnicode CMap
+func parseToUnicode(cmap []byte) map[int]string {
+	m := map[int]string{}
+	l := &contentLexer{buf: cmap}
+	for {
+		op, err := l.next()
+		if err != nil || op == nil {
+			return m
+		}
+		switch op.name {
+		case "endbfchar":
+			for i := 0; i+1 < len(op.operands); i += 2 {
+				m[cmapCode(op.operands[i].str)] = utf16Text(op.operands[i+1].str)
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(op.operands); i += 3 {
+				lo, hi := cmapCode(op.operands[i].str), cmapCode(op.operands[i+1].str)
+				dst := op.operands[i+2]
+				for c := lo; c <= hi && c-lo < 0x10000; c++ {
+					if dst.kind == '[' {
+						if c-lo < len(dst.items) {
+							m[c] = utf16Text(dst.items[c-lo].str)
+						}
+						continue
+					}
+					// The last byte of the destination is incremented
+					// through the range
+					s := append([]byte(nil), dst.str...)
+					if len(s) > 0 {
+						s[len(s)-1] += byte(c - lo)
+					}
+					m[c] = utf16Text(s)
+				}
+			}
+		}
+	}
+}
+
+func cmapCode(b []byte) int {
+	c := 0
+	for _, x := range b {
+		c = c<<8 | int(x)
+	}
+	return c
+}
+
+func utf16Text(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return strings.ToValidUTF8(string(utf16.Decode(u)), "�")
+}
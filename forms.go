@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Annotation flags that keep a widget off the page
+const (
+	annotHidden = 1 << 1
+	annotNoView = 1 << 5
+)
+
+// handleFillForm fills the form of an uploaded PDF from a JSON object of
+// field values and returns the filled PDF
+func (fh *FileHandler) handleFillForm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		writeError(w, "Error parsing form: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		writeError(w, "No file uploaded", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	values, err := parseFormValues(r.FormValue("values"))
+	if err != nil {
+		writeError(w, err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	in := fh.uploadPath(time.Now().Format("20060102_150405"), 0, files[0].Filename)
+	out := strings.TrimSuffix(in, filepath.Ext(in)) + "_filled.pdf"
+	defer os.Remove(in)
+	defer os.Remove(out)
+	sum, err := saveUpload(files[0], in)
+	if err != nil {
+		writeError(w, "Error saving file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	fh.auditRequestUpload(r, files[0], sum, "fill form")
+
+	unknown, err := fillForm(in, out, values)
+	if err != nil {
+		writeError(w, "Error filling form: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	if len(unknown) > 0 {
+		writeError(w, "Unknown form fields: "+strings.Join(unknown, ", "), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	name := "filled_" + strings.TrimSuffix(filepath.Base(files[0].Filename), filepath.Ext(files[0].Filename)) + ".pdf"
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeFile(w, r, out)
+}
+
+// parseFormValues parses a JSON object of form field values
+func parseFormValues(s string) (map[string]any, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var values map[string]any
+	if err := json.Unmarshal([]byte(s), &values); err != nil {
+		return nil, fmt.Errorf("invalid form values: %v", err)
+	}
+	return values, nil
+}
+
+// fillForm writes a copy of the PDF at in to out with its form fields set
+// from values, keyed by field name. Checkboxes take booleans and list boxes
+// lists of strings; anything else is used as text. Names that match no
+// field are returned.
+func fillForm(in, out string, values map[string]any) ([]string, error) {
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := api.ReadContext(bytes.NewReader(data), pdfConfig())
+	if err != nil {
+		return nil, err
+	}
+	if !hasForm(ctx) {
+		return sortedKeys(values), copyFile(in, out)
+	}
+
+	group, err := api.ExportForm(bytes.NewReader(data), filepath.Base(in), pdfConfig())
+	if err != nil {
+		return nil, fmt.Errorf("error reading form: %v", err)
+	}
+	f := &group.Forms[0]
+
+	matched := make(map[string]bool)
+	lookup := func(name string) (any, bool) {
+		v, ok := values[name]
+		if ok {
+			matched[name] = true
+		}
+		return v, ok
+	}
+	for _, field := range f.TextFields {
+		if v, ok := lookup(field.Name); ok {
+			field.Value = formText(v)
+		}
+	}
+	for _, field := range f.DateFields {
+		if v, ok := lookup(field.Name); ok {
+			field.Value = formText(v)
+		}
+	}
+	for _, field := range f.CheckBoxes {
+		if v, ok := lookup(field.Name); ok {
+			if field.Value, err = formChecked(v); err != nil {
+				return nil, fmt.Errorf("field %s: %v", field.Name, err)
+			}
+		}
+	}
+	for _, field := range f.RadioButtonGroups {
+		if v, ok := lookup(field.Name); ok {
+			field.Value = formText(v)
+		}
+	}
+	for _, field := range f.ComboBoxes {
+		if v, ok := lookup(field.Name); ok {
+			field.Value = formText(v)
+		}
+	}
+	for _, field := range f.ListBoxes {
+		if v, ok := lookup(field.Name); ok {
+			field.Values = formList(v)
+		}
+	}
+
+	var unknown []string
+	for _, name := range sortedKeys(values) {
+		if !matched[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(matched) == 0 {
+		return unknown, copyFile(in, out)
+	}
+
+	filled, err := json.Marshal(group)
+	if err != nil {
+		return nil, err
+	}
+	w, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	if err := api.FillForm(bytes.NewReader(data), bytes.NewReader(filled), w, pdfConfig()); err != nil {
+		return nil, fmt.Errorf("error filling form: %v", err)
+	}
+	return unknown, nil
+}
+
+func formText(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+func formChecked(v any) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return false, fmt.Errorf("invalid checkbox value %v", v)
+}
+
+func formList(v any) []string {
+	list, ok := v.([]any)
+	if !ok {
+		return []string{formText(v)}
+	}
+	values := make([]string, len(list))
+	for i, item := range list {
+		values[i] = formText(item)
+	}
+	return values
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flattenForms writes a copy of the PDF at in to out with the appearance of
+// every form field drawn into the page content and the form removed, so
+// field values survive merging as plain page content
+func flattenForms(in, out string) error {
+	ctx, err := readContext(in)
+	if err != nil {
+		return err
+	}
+	if !hasForm(ctx) {
+		return copyFile(in, out)
+	}
+
+	for page := 1; page <= ctx.PageCount; page++ {
+		if err := flattenPage(ctx, page); err != nil {
+			return fmt.Errorf("page %d: %v", page, err)
+		}
+	}
+	ctx.RootDict.Delete("AcroForm")
+
+	return api.WriteContextFile(ctx, out)
+}
+
+// flattenPage replaces the widget annotations of a page with their normal
+// appearance streams drawn as form XObjects
+func flattenPage(ctx *model.Context, page int) error {
+	xRefTable := ctx.XRefTable
+	pageDict, _, inherited, err := xRefTable.PageDict(page, false)
+	if err != nil {
+		return err
+	}
+
+	annots, err := xRefTable.DereferenceArray(pageDict["Annots"])
+	if err != nil || len(annots) == 0 {
+		return err
+	}
+
+	var keep types.Array
+	var content bytes.Buffer
+	xObjects := types.Dict{}
+	for _, obj := range annots {
+		annot, err := xRefTable.DereferenceDict(obj)
+		if err != nil {
+			return err
+		}
+		if subtype := annot.NameEntry("Subtype"); subtype == nil || *subtype != "Widget" {
+			keep = append(keep, obj)
+			continue
+		}
+		if flags := annot.IntEntry("F"); flags != nil && *flags&(annotHidden|annotNoView) != 0 {
+			continue
+		}
+
+		ref, bbox, err := widgetAppearance(xRefTable, annot)
+		if err != nil || ref == nil {
+			continue
+		}
+		rect, err := xRefTable.RectForArray(annot.ArrayEntry("Rect"))
+		if err != nil || bbox.Width() == 0 || bbox.Height() == 0 {
+			continue
+		}
+
+		// Map the appearance's bounding box onto the annotation rectangle
+		name := fmt.Sprintf("Flat%d", ref.ObjectNumber.Value())
+		sx, sy := rect.Width()/bbox.Width(), rect.Height()/bbox.Height()
+		fmt.Fprintf(&content, "q %.4f 0 0 %.4f %.4f %.4f cm /%s Do Q\n",
+			sx, sy, rect.LL.X-bbox.LL.X*sx, rect.LL.Y-bbox.LL.Y*sy, name)
+		xObjects[name] = *ref
+	}
+
+	if len(keep) > 0 {
+		pageDict["Annots"] = keep
+	} else {
+		pageDict.Delete("Annots")
+	}
+	if len(xObjects) == 0 {
+		return nil
+	}
+
+	// Register the appearances as page resources
+	resources, err := xRefTable.DereferenceDict(pageDict["Resources"])
+	if err != nil {
+		return err
+	}
+	if resources == nil {
+		resources = types.Dict{}
+		if inherited.Resources != nil {
+			resources = inherited.Resources.Clone().(types.Dict)
+		}
+		pageDict["Resources"] = resources
+	}
+	pageXObjects, err := xRefTable.DereferenceDict(resources["XObject"])
+	if err != nil {
+		return err
+	}
+	if pageXObjects == nil {
+		pageXObjects = types.Dict{}
+		resources["XObject"] = pageXObjects
+	}
+	for name, ref := range xObjects {
+		pageXObjects[name] = ref
+	}
+
+	// Draw them after the existing content, isolated from its graphics state
+	return wrapContents(xRefTable, pageDict, []byte("q\n"), append([]byte("Q\n"), content.Bytes()...))
+}
+
+// widgetAppearance returns the normal appearance stream of a widget in its
+// current state, along with its bounding box
+func widgetAppearance(xRefTable *model.XRefTable, annot types.Dict) (*types.IndirectRef, *types.Rectangle, error) {
+	ap, err := xRefTable.DereferenceDict(annot["AP"])
+	if err != nil || ap == nil {
+		return nil, nil, err
+	}
+
+	normal := ap["N"]
+	if states, err := xRefTable.DereferenceDict(normal); err == nil && states != nil {
+		// Checkboxes and radio buttons have one appearance per state
+		as := annot.NameEntry("AS")
+		if as == nil {
+			return nil, nil, nil
+		}
+		normal = states[*as]
+	}
+
+	ref, ok := normal.(types.IndirectRef)
+	if !ok {
+		return nil, nil, nil
+	}
+	sd, _, err := xRefTable.DereferenceStreamDict(ref)
+	if err != nil || sd == nil {
+		return nil, nil, err
+	}
+	bbox, err := xRefTable.RectForArray(sd.ArrayEntry("BBox"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ref, bbox, nil
+}
+
+// uniqueFormFields renames the top-level form fields of each PDF that clash
+// with a field of an earlier PDF, so merged copies of the same form keep
+// their own values instead of being linked. Renamed PDFs are written to the
+// uploads directory and replace their original in the returned paths.
+func (fh *FileHandler) uniqueFormFields(jobID string, paths []string) ([]string, error) {
+	seen := make(map[string]bool)
+	result := make([]string, len(paths))
+	for i, path := range paths {
+		result[i] = path
+
+		ctx, err := readContext(path)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := topLevelFields(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		renamed := false
+		for _, field := range fields {
+			name, err := types.StringOrHexLiteral(field["T"])
+			if err != nil || name == nil {
+				continue
+			}
+			unique := *name
+			for n := i + 1; seen[unique]; n++ {
+				unique = fmt.Sprintf("%s_%d", *name, n)
+			}
+			seen[unique] = true
+			if unique == *name {
+				continue
+			}
+
+			encoded, err := types.EscapeUTF16String(unique)
+			if err != nil {
+				return nil, err
+			}
+			field["T"] = types.StringLiteral(*encoded)
+			renamed = true
+		}
+		if !renamed {
+			continue
+		}
+
+		out := filepath.Join(fh.scratchDir, fmt.Sprintf("%s_%d_fields.pdf", jobID, i))
+		if err := api.WriteContextFile(ctx, out); err != nil {
+			return nil, err
+		}
+		result[i] = out
+	}
+	return result, nil
+}
+
+// ungroupMergedFields undoes the numbered parent fields pdfcpu wraps around
+// the form of every merged file after the first, so fields renamed by
+// uniqueFormFields keep their plain names instead of e.g. "28.name_2"
+func ungroupMergedFields(path string) error {
+	ctx, err := readContext(path)
+	if err != nil {
+		return err
+	}
+	grouped, err := ungroupFields(ctx, 0)
+	if err != nil || !grouped {
+		return err
+	}
+	return transformPDF(path, func(in, out string) error {
+		return api.WriteContextFile(ctx, out)
+	})
+}
+
+// ungroupFields undoes pdfcpu's parent fields in the form of ctx from the
+// top-level field at index from on, reporting whether it had any
+func ungroupFields(ctx *model.Context, from int) (bool, error) {
+	acroForm, err := ctx.DereferenceDict(ctx.RootDict["AcroForm"])
+	if err != nil || acroForm == nil {
+		return false, err
+	}
+	refs, err := ctx.DereferenceArray(acroForm["Fields"])
+	if err != nil {
+		return false, err
+	}
+
+	var fields types.Array
+	grouped := false
+	for i, ref := range refs {
+		field, err := ctx.DereferenceDict(ref)
+		if err != nil {
+			return false, err
+		}
+
+		// pdfcpu's groups hold only Kids and a T of their index in Fields
+		name, _ := types.StringOrHexLiteral(field["T"])
+		kids, _ := ctx.DereferenceArray(field["Kids"])
+		if i < from || len(field) != 2 || name == nil || *name != strconv.Itoa(i) || kids == nil {
+			fields = append(fields, ref)
+			continue
+		}
+		for _, kid := range kids {
+			if d, err := ctx.DereferenceDict(kid); err == nil && d != nil {
+				d.Delete("Parent")
+			}
+			fields = append(fields, kid)
+		}
+		grouped = true
+	}
+	if grouped {
+		acroForm["Fields"] = fields
+	}
+	return grouped, nil
+}
+
+// topLevelFields returns the root field dictionaries of the form of ctx
+func topLevelFields(ctx *model.Context) ([]types.Dict, error) {
+	acroForm, err := ctx.DereferenceDict(ctx.RootDict["AcroForm"])
+	if err != nil || acroForm == nil {
+		return nil, err
+	}
+	refs, err := ctx.DereferenceArray(acroForm["Fields"])
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []types.Dict
+	for _, ref := range refs {
+		field, err := ctx.DereferenceDict(ref)
+		if err != nil {
+			return nil, err
+		}
+		if field != nil {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// readContext reads and validates the PDF at path
+func readContext(path string) (*model.Context, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ctx, err := api.ReadContext(f, pdfConfig())
+	if err != nil {
+		return nil, err
+	}
+	if err := api.ValidateContext(ctx); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func hasForm(ctx *model.Context) bool {
+	_, ok := ctx.RootDict.Find("AcroForm")
+	return ok
+}
+
+// newContentStream adds a compressed content stream to the document
+func newContentStream(xRefTable *model.XRefTable, buf []byte) (*types.IndirectRef, error) {
+	sd, err := xRefTable.NewStreamDictForBuf(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.Encode(); err != nil {
+		return nil, err
+	}
+	return xRefTable.IndRefForNewObject(*sd)
+}
+
+// wrapContents adds content streams before and after the content of a page
+func wrapContents(xRefTable *model.XRefTable, pageDict types.Dict, before, after []byte) error {
+	first, err := newContentStream(xRefTable, before)
+	if err != nil {
+		return err
+	}
+	last, err := newContentStream(xRefTable, after)
+	if err != nil {
+		return err
+	}
+	contents := types.Array{*first}
+	switch existing := pageDict["Contents"].(type) {
+	case types.IndirectRef:
+		obj, err := xRefTable.Dereference(existing)
+		if err != nil {
+			return err
+		}
+		if arr, ok := obj.(types.Array); ok {
+			contents = append(contents, arr...)
+		} else {
+			contents = append(contents, existing)
+		}
+	case types.Array:
+		contents = append(contents, existing...)
+	}
+	pageDict["Contents"] = append(contents, *last)
+	return nil
+}
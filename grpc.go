@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Size of the chunks streamed by Download
+const downloadChunkSize = 64 << 10
+
+// The messages of proto/merge.proto only have string, bytes and integer
+// fields, so they are encoded by hand instead of pulling in generated code.
+type wireMessage interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+type mergeRequest struct {
+	Filename string
+	Data     []byte
+}
+
+func (m *mergeRequest) marshal() []byte {
+	b := appendField(nil, 1, []byte(m.Filename))
+	return appendField(b, 2, m.Data)
+}
+
+func (m *mergeRequest) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.Filename = string(v)
+		case 2:
+			m.Data = append([]byte(nil), v...)
+		}
+	})
+}
+
+type mergeResponse struct {
+	JobID    string
+	Status   string
+	Filename string
+	Error    string
+	Size     int64
+	SHA256   string
+	// ErrorCode is the code of Error, as in the JSON errors of the HTTP API
+	ErrorCode string
+}
+
+func (m *mergeResponse) marshal() []byte {
+	b := appendField(nil, 1, []byte(m.JobID))
+	b = appendField(b, 2, []byte(m.Status))
+	b = appendField(b, 3, []byte(m.Filename))
+	b = appendField(b, 4, []byte(m.Error))
+	b = appendVarintField(b, 5, uint64(m.Size))
+	b = appendField(b, 6, []byte(m.SHA256))
+	return appendField(b, 7, []byte(m.ErrorCode))
+}
+
+func (m *mergeResponse) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.JobID = string(v)
+		case 2:
+			m.Status = string(v)
+		case 3:
+			m.Filename = string(v)
+		case 4:
+			m.Error = string(v)
+		case 5:
+			n, _ := protowire.ConsumeVarint(v)
+			m.Size = int64(n)
+		case 6:
+			m.SHA256 = string(v)
+		case 7:
+			m.ErrorCode = string(v)
+		}
+	})
+}
+
+type downloadRequest struct {
+	Filename string
+}
+
+func (m *downloadRequest) marshal() []byte {
+	return appendField(nil, 1, []byte(m.Filename))
+}
+
+func (m *downloadRequest) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v []byte) {
+		if num == 1 {
+			m.Filename = string(v)
+		}
+	})
+}
+
+type downloadChunk struct {
+	Data []byte
+}
+
+func (m *downloadChunk) marshal() []byte {
+	return appendField(nil, 1, m.Data)
+}
+
+func (m *downloadChunk) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, v []byte) {
+		if num == 1 {
+			m.Data = append([]byte(nil), v...)
+		}
+	})
+}
+
+func appendField(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// consumeFields calls fn for every length-delimited and varint field and
+// skips the rest. Varints are passed still encoded.
+func consumeFields(b []byte, fn func(num protowire.Number, v []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, v)
+			b = b[n:]
+			continue
+		}
+		if typ == protowire.VarintType {
+			_, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, b[:n])
+			b = b[n:]
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// wireCodec is the gRPC codec for wireMessage values
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+type mergeServiceServer interface {
+	grpcMerge(stream grpc.ServerStream) error
+	grpcDownload(req *downloadRequest, stream grpc.ServerStream) error
+}
+
+var mergeServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pdfmg.v1.MergeService",
+	HandlerType: (*mergeServiceServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Merge",
+			ClientStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				return srv.(mergeServiceServer).grpcMerge(stream)
+			},
+		},
+		{
+			StreamName:    "Download",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				req := new(downloadRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(mergeServiceServer).grpcDownload(req, stream)
+			},
+		},
+	},
+	Metadata: "proto/merge.proto",
+}
+
+// newGRPCServer returns a gRPC server exposing MergeService
+func newGRPCServer(fh *FileHandler) *grpc.Server {
+	srv := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}), grpc.StreamInterceptor(grpcRequestID))
+	srv.RegisterService(&mergeServiceDesc, fh)
+	return srv
+}
+
+func (fh *FileHandler) grpcMerge(stream grpc.ServerStream) error {
+	if err := fh.storage.check(0); err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	remote := grpcRemote(stream.Context())
+	if err := fh.activeJobs.check(fh.jobs, grpcUser(stream.Context()), clientIP(remote)); err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	timestamp := time.Now().Format("20060102_150405")
+	job := &Job{User: grpcUser(stream.Context()), RequestID: requestID(stream.Context()), Status: JobQueued}
+
+	var dst *os.File
+	var h hash.Hash
+	var size int64
+	// The uploads are removed unless the job is created to merge them
+	created := false
+	defer func() {
+		if dst != nil {
+			dst.Close()
+		}
+		if !created {
+			for _, f := range job.Files {
+				os.Remove(f.Path)
+			}
+		}
+	}()
+
+	for {
+		req := new(mergeRequest)
+		err := stream.RecvMsg(req)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if req.Filename != "" {
+			if dst != nil {
+				dst.Close()
+				job.Files[len(job.Files)-1].SHA256 = hex.EncodeToString(h.Sum(nil))
+			}
+			name := filepath.Base(req.Filename)
+			uploadPath := fh.uploadPath(timestamp, len(job.Files), name)
+			dst, err = os.Create(uploadPath)
+			if err != nil {
+				return status.Errorf(codes.Internal, "error creating file: %v", err)
+			}
+			job.Files = append(job.Files, JobFile{Name: name, Path: uploadPath})
+			h = sha256.New()
+		}
+
+		if dst == nil {
+			return status.Error(codes.InvalidArgument, "data sent before filename")
+		}
+		if size += int64(len(req.Data)); fh.uploads.maxSize > 0 && size > fh.uploads.maxSize {
+			return status.Errorf(codes.ResourceExhausted, "upload too large: the limit is %.0f MB", float64(fh.uploads.maxSize)/(1<<20))
+		}
+		h.Write(req.Data)
+		if _, err := dst.Write(req.Data); err != nil {
+			return status.Errorf(codes.Internal, "error saving file: %v", err)
+		}
+	}
+
+	if len(job.Files) == 0 {
+		return status.Error(codes.InvalidArgument, "no files uploaded")
+	}
+	if err := dst.Close(); err != nil {
+		return status.Errorf(codes.Internal, "error saving file: %v", err)
+	}
+	dst = nil
+	job.Files[len(job.Files)-1].SHA256 = hex.EncodeToString(h.Sum(nil))
+	job.Options.LargeFiles = fh.uploads.largeFileMode(size)
+
+	if err := fh.createJob(job, remote); err != nil {
+		if errorCode(err, "") == CodeTooManyJobs {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return status.Errorf(codes.Internal, "error creating job: %v", err)
+	}
+	created = true
+	fh.auditUploads(job, remote)
+
+	job, err := fh.waitForJob(stream.Context(), job.ID)
+	if err != nil {
+		return status.FromContextError(err).Err()
+	}
+
+	return stream.SendMsg(&mergeResponse{
+		JobID:     job.ID,
+		Status:    job.Status,
+		Filename:  filepath.Base(job.OutputPath),
+		Error:     job.Error,
+		Size:      job.OutputSize,
+		SHA256:    job.OutputSHA256,
+		ErrorCode: job.ErrorCode,
+	})
+}
+
+func (fh *FileHandler) grpcDownload(req *downloadRequest, stream grpc.ServerStream) error {
+	if req.Filename == "" {
+		return status.Error(codes.InvalidArgument, "no filename specified")
+	}
+
+	// Outputs are only sent to those who may see the job they belong to
+	name := filepath.Base(req.Filename)
+	job, err := fh.outputJob(name)
+	if errors.Is(err, ErrJobNotFound) {
+		return status.Error(codes.NotFound, "file not found")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "error listing jobs: %v", err)
+	}
+	user := grpcUser(stream.Context())
+	if !fh.mayAccess(job, user) {
+		return status.Error(codes.PermissionDenied, "forbidden")
+	}
+
+	f, err := os.Open(filepath.Join(fh.outputDir, name))
+	if os.IsNotExist(err) {
+		return status.Error(codes.NotFound, "file not found")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "error opening file: %v", err)
+	}
+	defer f.Close()
+	fh.auditFile(AuditEvent{Action: AuditDownload, User: user, Remote: grpcRemote(stream.Context()), JobID: job.ID}, f.Name(), false)
+
+	buf := make([]byte, downloadChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := stream.SendMsg(&downloadChunk{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "error reading file: %v", err)
+		}
+	}
+}
+
+// outputJob returns the job whose output, or manifest of it, is the file of
+// the output directory with the given name, or ErrJobNotFound
+func (fh *FileHandler) outputJob(name string) (*Job, error) {
+	jobs, err := fh.jobs.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.OutputPath == "" {
+			continue
+		}
+		out := filepath.Base(job.OutputPath)
+		if name == out || name == out+manifestSuffix || name == out+manifestSignatureSuffix {
+			return job, nil
+		}
+	}
+	return nil, ErrJobNotFound
+}
+
+// grpcUser mirrors requestUser for gRPC metadata
+func grpcUser(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || !trustedProxies.trusts(p.Addr.Network(), p.Addr.String()) {
+		return ""
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range []string{"x-forwarded-user", "x-remote-user"} {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Sheets pages are imposed on, besides the paper sizes of normalize
+const (
+	SheetA3      = "A3"
+	SheetTabloid = "tabloid"
+)
+
+// sheetSizes are the portrait sizes of the sheets, in points
+var sheetSizes = map[string]types.Dim{
+	SheetA3:         {Width: 841.89, Height: 1190.55},
+	NormalizeA4:     paperSizes[NormalizeA4],
+	NormalizeLetter: paperSizes[NormalizeLetter],
+	SheetTabloid:    {Width: 792, Height: 1224},
+}
+
+// Space cut marks are drawn in around a page, on a sheet or around the
+// bleed of a full-bleed image: they start cutMarkGap from the corners of
+// the page, or of its bleed, and are cutMarkLength long
+const (
+	cutMarkSpace  = 18
+	cutMarkGap    = 3
+	cutMarkLength = 12
+)
+
+// imposePDF writes the PDF at in to out with its pages imposed n-up on
+// sheets, 2 or 4 to a sheet in reading order, scaled down to fit where
+// they are larger. Sheets are turned so portrait pages stay upright, as
+// the first page is: two portrait pages side by side on a landscape sheet,
+// two landscape ones above each other on a portrait sheet. Cut marks show
+// where to trim each page.
+//
+// The sheets are for printing: bookmarks, links, form fields, page labels
+// and structure tags, which refer to the pages, are dropped.
+func imposePDF(in, out string, n int, sheet string, cutMarks bool) error {
+	ctx, err := readContext(in)
+	if err != nil {
+		return fmt.Errorf("error reading PDF: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+
+	// The boxes are read before the pages make way for the sheets
+	boxes := make([]*types.Rectangle, ctx.PageCount)
+	for page := 1; page <= ctx.PageCount; page++ {
+		_, _, inherited, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		box := visibleBox(inherited)
+		if box != nil && (inherited.Rotate == 90 || inherited.Rotate == 270 || inherited.Rotate == -90 || inherited.Rotate == -270) {
+			box = types.RectForDim(box.Height(), box.Width())
+		}
+		boxes[page-1] = box
+	}
+
+	size, ok := sheetSizes[sheet]
+	if !ok {
+		size = sheetSizes[SheetA3]
+	}
+	portrait := len(boxes) == 0 || boxes[0] == nil || boxes[0].Height() >= boxes[0].Width()
+	cols, rows := 2.0, 1.0
+	if n == 4 {
+		rows = 2
+	}
+	if portrait != (n == 4) {
+		size.Width, size.Height = size.Height, size.Width
+	}
+	if !portrait {
+		cols, rows = rows, cols
+	}
+
+	nup := model.DefaultNUpConfig()
+	nup.PageDim = &size
+	nup.Grid = &types.Dim{Width: cols, Height: rows}
+	nup.Margin = cutMarkSpace
+	nup.Border = false
+	selected := types.IntSet{}
+	for page := 1; page <= ctx.PageCount; page++ {
+		selected[page] = true
+	}
+	if err := pdfcpu.NUpFromPDF(ctx, selected, nup); err != nil {
+		return err
+	}
+	// The sheets are counted on top of the pages they replace
+	ctx.PageCount = (len(boxes) + n - 1) / n
+
+	if cutMarks {
+		tiles := nup.RectsForGrid()
+		marks := map[int][]byte{}
+		for i, box := range boxes {
+			if box != nil {
+				marks[i/n+1] = append(marks[i/n+1], drawCutMarks(placedRect(box, tiles[i%n].CroppedCopy(cutMarkSpace)), cutMarkGap)...)
+			}
+		}
+		for number, ops := range marks {
+			pageDict, _, _, err := ctx.PageDict(number, false)
+			if err != nil {
+				return err
+			}
+			if err := wrapContents(ctx.XRefTable, pageDict, []byte("q\n"), append([]byte("Q\n"), ops...)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, key := range []string{"Outlines", "PageLabels", "Dests", "AcroForm", "StructTreeRoot", "MarkInfo", "OpenAction"} {
+		delete(ctx.RootDict, key)
+	}
+	if names, err := ctx.DereferenceDict(ctx.RootDict["Names"]); err == nil && names != nil {
+		delete(names, "Dests")
+		delete(ctx.Names, "Dests")
+	}
+	if mode := ctx.RootDict.NameEntry("PageMode"); mode != nil && *mode == "UseOutlines" {
+		delete(ctx.RootDict, "PageMode")
+	}
+	return api.WriteContextFile(ctx, out)
+}
+
+// placedRect returns where a page with the given box lands in a tile, as
+// pdfcpu fits it: scaled down to fit, turned if its orientation differs,
+// and centred
+func placedRect(box, tile *types.Rectangle) *types.Rectangle {
+	w, h, dx, dy, rot := types.BestFitRectIntoRect(box, tile, true, false)
+	if rot == 90 || rot == 270 {
+		w, h = h, w
+	}
+	x, y := tile.LL.X+dx, tile.LL.Y+dy
+	return types.NewRectangle(x, y, x+w, y+h)
+}
+
+// drawCutMarks returns the content stream operators drawing the marks at
+// the corners of r that show where to trim it, starting gap from them
+func drawCutMarks(r *types.Rectangle, gap float64) []byte {
+	var b bytes.Buffer
+	b.WriteString("q 0.25 w 0 0 0 1 K [] 0 d\n")
+	for _, x := range []float64{r.LL.X, r.UR.X} {
+		for _, y := range []float64{r.LL.Y, r.UR.Y} {
+			// The marks point away from the page
+			dx, dy := -1.0, -1.0
+			if x == r.UR.X {
+				dx = 1
+			}
+			if y == r.UR.Y {
+				dy = 1
+			}
+			fmt.Fprintf(&b, "%.2f %.2f m %.2f %.2f l S\n", x+dx*gap, y, x+dx*(gap+cutMarkLength), y)
+			fmt.Fprintf(&b, "%.2f %.2f m %.2f %.2f l S\n", x, y+dy*gap, x, y+dy*(gap+cutMarkLength))
+		}
+	}
+	b.WriteString("Q\n")
+	return b.Bytes()
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxMailParts caps the parts of an email walked for attachments, nested
+// multiparts included
+const maxMailParts = 200
+
+// inboundMail merges the attachments of emails forwarded to it by a mail
+// server or an inbound mail service, one merge per email named after its
+// subject, and replies to the sender with the download link
+type inboundMail struct {
+	// token authenticates the mail server, which sends it as the token
+	// query parameter or a bearer token
+	token string
+	// allow lists the senders merged for, as addresses or @domains; empty
+	// for anyone
+	allow     []string
+	publicURL string
+	smtp      *smtpSender
+}
+
+// smtpSender sends replies through an SMTP server
+type smtpSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// loadInboundMail reads INBOUND_MAIL_TOKEN, INBOUND_MAIL_ALLOW and the SMTP
+// server replies go through, SMTP_ADDR, SMTP_FROM, SMTP_USERNAME and
+// SMTP_PASSWORD. It returns nil without INBOUND_MAIL_TOKEN.
+func loadInboundMail(publicURL string) (*inboundMail, error) {
+	token := os.Getenv("INBOUND_MAIL_TOKEN")
+	if token == "" {
+		return nil, nil
+	}
+	in := &inboundMail{
+		token:     token,
+		allow:     splitList(strings.ToLower(os.Getenv("INBOUND_MAIL_ALLOW"))),
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+	}
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return in, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR %s: %v", addr, err)
+	}
+	from, err := mail.ParseAddress(os.Getenv("SMTP_FROM"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %v", err)
+	}
+	in.smtp = &smtpSender{addr: addr, from: from.Address}
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		in.smtp.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return in, nil
+}
+
+// allowed reports whether emails from address are merged
+func (in *inboundMail) allowed(address string) bool {
+	if len(in.allow) == 0 {
+		return true
+	}
+	address = strings.ToLower(address)
+	for _, a := range in.allow {
+		if a == address || strings.HasPrefix(a, "@") && strings.HasSuffix(address, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleInboundMail serves /api/v1/inbound/email, which takes an email as
+// its raw MIME body, as piped from a mail server, or as the email or
+// body-mime field of a form, as posted by inbound mail services
+func (fh *FileHandler) handleInboundMail(w http.ResponseWriter, r *http.Request) {
+	in := fh.inboundMail
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(in.token)) != 1 {
+		writeError(w, "Invalid token", CodeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+	// Attachments are base64 encoded, a third larger than the files
+	if fh.uploads.maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, fh.uploads.maxSize/3*4+maxFormValues)
+	}
+
+	var raw io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxFormValues); err != nil {
+			writeMailError(w, err)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		raw = nil
+		for _, field := range []string{"email", "body-mime"} {
+			if v := r.MultipartForm.Value[field]; len(v) > 0 {
+				raw = strings.NewReader(v[0])
+			} else if f, _, err := r.FormFile(field); err == nil {
+				defer f.Close()
+				raw = f
+			}
+			if raw != nil {
+				break
+			}
+		}
+		if raw == nil {
+			writeError(w, "No email in the form: expected an email or body-mime field", CodeInvalidRequest, http.StatusBadRequest)
+			return
+		}
+	}
+
+	msg, err := mail.ReadMessage(raw)
+	if err != nil {
+		writeMailError(w, err)
+		return
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		writeError(w, "Invalid sender: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if !in.allowed(from.Address) {
+		log.Printf("Ignored email from %s: sender not allowed", from.Address)
+		writeError(w, "Sender not allowed", CodeForbidden, http.StatusForbidden)
+		return
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	reply := mailReply{to: from.Address, subject: headerText(subject), inReplyTo: headerText(msg.Header.Get("Message-Id"))}
+
+	timestamp := time.Now().Format("20060102_150405")
+	files, err := fh.saveMailAttachments(msg, timestamp)
+	if err != nil {
+		for _, f := range files {
+			os.Remove(f.Path)
+		}
+		writeMailError(w, err)
+		return
+	}
+	if len(files) == 0 {
+		go in.send(reply, "Nothing was merged: the email had no PDF, PNG or JPG attachments.\r\n")
+		writeError(w, "No PDF, PNG or JPG attachments", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	var size int64
+	for _, f := range files {
+		if info, err := os.Stat(f.Path); err == nil {
+			size += info.Size()
+		}
+	}
+	var opts MergeOptions
+	if err := fh.checkOptions(&opts, size); err != nil {
+		for _, f := range files {
+			os.Remove(f.Path)
+		}
+		writeError(w, err.Error(), errorCode(err, CodeInvalidOption), http.StatusBadRequest)
+		return
+	}
+	job := &Job{Name: reply.subject, User: from.Address, RequestID: requestID(r.Context()), Options: opts, Status: JobQueued, Files: files}
+	// The address the email came from is the mail server's, so only the
+	// sender's limit applies
+	if err := fh.createJob(job, ""); err != nil {
+		for _, f := range files {
+			os.Remove(f.Path)
+		}
+		if errorCode(err, "") == CodeTooManyJobs {
+			go in.send(reply, "Nothing was merged: you have too many merges in progress. Try again once they are done.\r\n")
+		}
+		writeJobCreateError(w, err)
+		return
+	}
+	fh.auditUploads(job, r.RemoteAddr)
+	log.Printf("Queued job %s for %d attachments emailed by %s", job.ID, len(files), from.Address)
+	go fh.replyWhenMerged(job.ID, reply)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"jobId": job.ID, "files": len(files)})
+}
+
+// writeMailError reports an email that could not be read
+func writeMailError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, fmt.Sprintf("Email too large: the limit is %.0f MB", float64(tooLarge.Limit)/(1<<20)), CodeTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+	writeError(w, "Error reading email: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+}
+
+// saveMailAttachments saves the PDF, PNG and JPG attachments of msg to the
+// uploads directory in the order they appear. Inline images, such as logos
+// in signatures, are left out.
+func (fh *FileHandler) saveMailAttachments(msg *mail.Message, timestamp string) ([]JobFile, error) {
+	var files []JobFile
+	parts := 0
+	var walk func(header textproto.MIMEHeader, body io.Reader) error
+	walk = func(header textproto.MIMEHeader, body io.Reader) error {
+		if parts++; parts > maxMailParts {
+			return fmt.Errorf("more than %d parts", maxMailParts)
+		}
+		mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") {
+			mr := multipart.NewReader(body, params["boundary"])
+			for {
+				part, err := mr.NextRawPart()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := walk(part.Header, part); err != nil {
+					return err
+				}
+			}
+		}
+
+		disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+		if disposition != "attachment" && header.Get("Content-Id") != "" {
+			return nil
+		}
+		name := dparams["filename"]
+		if name == "" {
+			name = params["name"]
+		}
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+			name = decoded
+		}
+		name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+		switch {
+		case fh.convertible(name):
+		case mediaType == "application/pdf" || mediaType == "image/png" || mediaType == "image/jpeg":
+			// Named after the subtype when the name has no usable extension
+			if name == "" || name == "." || name == "/" {
+				name = "attachment"
+			}
+			name += "." + mediaType[strings.Index(mediaType, "/")+1:]
+		default:
+			return nil
+		}
+
+		switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+		case "base64":
+			body = base64.NewDecoder(base64.StdEncoding, body)
+		case "quoted-printable":
+			body = quotedprintable.NewReader(body)
+		}
+		file := JobFile{Name: name, Path: fh.uploadPath(timestamp, len(files), name)}
+		sum, err := saveStream(body, file.Path)
+		if err != nil {
+			os.Remove(file.Path)
+			return fmt.Errorf("error saving %s: %v", name, err)
+		}
+		file.SHA256 = sum
+		files = append(files, file)
+		return nil
+	}
+	err := walk(textproto.MIMEHeader(msg.Header), msg.Body)
+	return files, err
+}
+
+// headerText strips line breaks and other control characters from a
+// header value, so it can be written to another header
+func headerText(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s))
+}
+
+// mailReply is a reply to an inbound email
+type mailReply struct {
+	to        string
+	subject   string
+	inReplyTo string
+}
+
+// replyWhenMerged waits for the job of an inbound email and replies with
+// its download link or what went wrong
+func (fh *FileHandler) replyWhenMerged(id string, reply mailReply) {
+	in := fh.inboundMail
+	job, err := fh.waitForJob(context.Background(), id)
+	if err != nil {
+		log.Printf("Error waiting for job %s: %v", id, err)
+		return
+	}
+	var text string
+	switch job.Status {
+	case JobDone:
+		text = fmt.Sprintf("Your %d attachments were merged. Download the result at:\r\n\r\n%s/download/%s\r\n",
+			len(job.Files), in.publicURL, filepath.Base(job.OutputPath))
+	default:
+		text = fmt.Sprintf("Your attachments could not be merged: %s\r\n", job.Error)
+	}
+	in.send(reply, text)
+}
+
+// send sends text as a plain text reply, if replies are configured
+func (in *inboundMail) send(reply mailReply, text string) {
+	if in.smtp == nil {
+		return
+	}
+	subject := reply.subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", in.smtp.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", reply.to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if reply.inReplyTo != "" {
+		fmt.Fprintf(&msg, "In-Reply-To: %s\r\nReferences: %s\r\n", reply.inReplyTo, reply.inReplyTo)
+	}
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(text)
+	if err := smtp.SendMail(in.smtp.addr, in.smtp.auth, in.smtp.from, []string{reply.to}, msg.Bytes()); err != nil {
+		log.Printf("Error replying to %s: %v", reply.to, err)
+	}
+}
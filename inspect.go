@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// fileReport describes an input file before it is merged
+type fileReport struct {
+	Name       string            `json:"name"`
+	Pages      int               `json:"pages,omitempty"`
+	Signatures []signatureReport `json:"signatures,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// signatureReport describes a digital signature found in an input PDF
+type signatureReport struct {
+	Field    string     `json:"field"`
+	Signer   string     `json:"signer,omitempty"`
+	Issuer   string     `json:"issuer,omitempty"`
+	SignedAt *time.Time `json:"signedAt,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Location string     `json:"location,omitempty"`
+	// CoversDocument is false when the file was changed after signing
+	CoversDocument bool `json:"coversDocument"`
+	// Intact reports whether the signed bytes still match the signature
+	Intact bool   `json:"intact"`
+	Error  string `json:"error,omitempty"`
+}
+
+type inspectResult struct {
+	Files   []fileReport `json:"files"`
+	Warning string       `json:"warning,omitempty"`
+}
+
+// handleInspect reports on uploaded files without merging them, so users can
+// see which inputs are signed before merging invalidates the signatures
+func (fh *FileHandler) handleInspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		writeError(w, "Error parsing form: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	files := r.MultipartForm.File["files"]
+	if len(files) == 0 {
+		writeError(w, "No files uploaded", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	var result inspectResult
+	var signed []string
+	timestamp := time.Now().Format("20060102_150405")
+	for i, fileHeader := range files {
+		report := fileReport{Name: fileHeader.Filename}
+		path := fh.uploadPath(timestamp, i, "inspect_"+fileHeader.Filename)
+		sum, err := saveUpload(fileHeader, path)
+		if err != nil {
+			writeError(w, "Error saving file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+			return
+		}
+		fh.auditRequestUpload(r, fileHeader, sum, "inspect")
+
+		switch strings.ToLower(filepath.Ext(fileHeader.Filename)) {
+		case ".pdf":
+			report.Pages, report.Signatures, err = inspectPDF(path)
+			if err != nil {
+				report.Error = err.Error()
+			}
+		case ".png", ".jpg", ".jpeg":
+			report.Pages = 1
+		default:
+			if fh.plugin(fileHeader.Filename) == nil {
+				report.Error = "unsupported file format"
+			}
+		}
+		os.Remove(path)
+
+		if len(report.Signatures) > 0 {
+			signed = append(signed, report.Name)
+		}
+		result.Files = append(result.Files, report)
+	}
+	if len(signed) > 0 {
+		result.Warning = "Merging invalidates the digital signatures of " + strings.Join(signed, ", ")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// inspectPDF returns the page count and digital signatures of a PDF
+func inspectPDF(path string) (int, []signatureReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	ctx, err := api.ReadContext(bytes.NewReader(data), pdfConfig())
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return 0, nil, err
+	}
+
+	fields, err := topLevelFields(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	var reports []signatureReport
+	for _, field := range fields {
+		signatureFields(ctx, field, "", func(name string, sig types.Dict) {
+			reports = append(reports, inspectSignature(ctx, data, name, sig))
+		})
+	}
+	return ctx.PageCount, reports, nil
+}
+
+// signatureFields calls fn for every signed signature field in the field
+// tree below field
+func signatureFields(ctx *model.Context, field types.Dict, parent string, fn func(name string, sig types.Dict)) {
+	name := parent
+	if t, err := types.StringOrHexLiteral(field["T"]); err == nil && t != nil {
+		if name != "" {
+			name += "."
+		}
+		name += *t
+	}
+
+	if ft := field.NameEntry("FT"); ft != nil && *ft == "Sig" {
+		if sig, err := ctx.DereferenceDict(field["V"]); err == nil && sig != nil {
+			fn(name, sig)
+		}
+	}
+
+	kids, _ := ctx.DereferenceArray(field["Kids"])
+	for _, kid := range kids {
+		if d, err := ctx.DereferenceDict(kid); err == nil && d != nil {
+			signatureFields(ctx, d, name, fn)
+		}
+	}
+}
+
+// inspectSignature reads the signer of a signature dictionary and checks
+// the signed byte ranges of data against it
+func inspectSignature(ctx *model.Context, data []byte, name string, sig types.Dict) signatureReport {
+	report := signatureReport{Field: name}
+	text := func(key string) string {
+		obj, _ := ctx.Dereference(sig[key])
+		s, err := types.StringOrHexLiteral(obj)
+		if err != nil || s == nil {
+			return ""
+		}
+		return *s
+	}
+	report.Reason = text("Reason")
+	report.Location = text("Location")
+	if t, ok := types.DateTime(text("M"), true); ok {
+		report.SignedAt = &t
+	}
+
+	// Collect the signed bytes
+	byteRange, err := ctx.DereferenceArray(sig["ByteRange"])
+	if err != nil || len(byteRange)%2 != 0 || len(byteRange) == 0 {
+		report.Error = "invalid byte range"
+		return report
+	}
+	var signed []byte
+	end := 0
+	for i := 0; i < len(byteRange); i += 2 {
+		start, err1 := ctx.DereferenceInteger(byteRange[i])
+		length, err2 := ctx.DereferenceInteger(byteRange[i+1])
+		if err1 != nil || err2 != nil || start == nil || length == nil ||
+			start.Value() < 0 || length.Value() < 0 || start.Value()+length.Value() > len(data) {
+			report.Error = "invalid byte range"
+			return report
+		}
+		signed = append(signed, data[start.Value():start.Value()+length.Value()]...)
+		end = start.Value() + length.Value()
+	}
+	report.CoversDocument = end == len(data)
+
+	contents, err := signatureContents(ctx, sig["Contents"])
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	signer, err := verifyCMS(contents, signed)
+	if signer != nil {
+		report.Signer = signer.Subject.CommonName
+		report.Issuer = signer.Issuer.CommonName
+		if report.Signer == "" {
+			report.Signer = signer.Subject.String()
+		}
+	}
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Intact = true
+	return report
+}
+
+func signatureContents(ctx *model.Context, obj types.Object) ([]byte, error) {
+	obj, err := ctx.Dereference(obj)
+	if err != nil {
+		return nil, err
+	}
+	switch v := obj.(type) {
+	case types.HexLiteral:
+		return v.Bytes()
+	case types.StringLiteral:
+		return types.Unescape(v.Value(), false)
+	}
+	return nil, errors.New("missing signature contents")
+}
+
+var (
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// verifyCMS checks a detached CMS SignedData against the signed content and
+// returns the signer's certificate, which is also returned when the check
+// fails
+func verifyCMS(der, content []byte) (*x509.Certificate, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("unsupported signature format")
+	}
+	elems, err := asn1Elements(ci.Content.Bytes)
+	if err != nil || len(elems) != 1 {
+		return nil, errors.New("unsupported signature format")
+	}
+	if elems, err = asn1Elements(elems[0].Bytes); err != nil || len(elems) < 4 {
+		return nil, errors.New("unsupported signature format")
+	}
+
+	// SignedData: version, digest algorithms, content info, [0] certificates,
+	// [1] CRLs, signer infos
+	var certs []*x509.Certificate
+	for _, e := range elems[3 : len(elems)-1] {
+		if e.Class == asn1.ClassContextSpecific && e.Tag == 0 {
+			if certs, err = x509.ParseCertificates(e.Bytes); err != nil {
+				return nil, fmt.Errorf("error parsing certificates: %v", err)
+			}
+		}
+	}
+	signerInfos, err := asn1Elements(elems[len(elems)-1].Bytes)
+	if err != nil || len(signerInfos) == 0 {
+		return nil, errors.New("signature has no signer")
+	}
+
+	// SignerInfo: version, sid, digest algorithm, [0] signed attributes,
+	// signature algorithm, signature
+	si, err := asn1Elements(signerInfos[0].Bytes)
+	if err != nil || len(si) < 5 {
+		return nil, errors.New("invalid signer info")
+	}
+	signer := findSigner(certs, si[1])
+	if signer == nil {
+		return nil, errors.New("signer certificate not included")
+	}
+
+	var digestAlg pkix.AlgorithmIdentifier
+	if _, err := asn1.Unmarshal(si[2].FullBytes, &digestAlg); err != nil {
+		return signer, err
+	}
+	hash, err := cmsHash(digestAlg.Algorithm)
+	if err != nil {
+		return signer, err
+	}
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+
+	var signature []byte
+	if _, err := asn1.Unmarshal(si[len(si)-1].FullBytes, &signature); err != nil {
+		return signer, err
+	}
+
+	signedBytes := content
+	if si[3].Class == asn1.ClassContextSpecific && si[3].Tag == 0 {
+		// The signature covers the attributes, which carry the digest
+		attrs, err := asn1Elements(si[3].Bytes)
+		if err != nil {
+			return signer, err
+		}
+		var messageDigest []byte
+		for _, attr := range attrs {
+			var a cmsAttribute
+			if _, err := asn1.Unmarshal(attr.FullBytes, &a); err == nil && a.Type.Equal(oidMessageDigest) {
+				asn1.Unmarshal(a.Values.Bytes, &messageDigest)
+			}
+		}
+		if !bytes.Equal(messageDigest, digest) {
+			return signer, errors.New("document was modified after signing")
+		}
+		signedBytes = append([]byte{0x31}, si[3].FullBytes[1:]...)
+	}
+
+	if err := signer.CheckSignature(signatureAlgorithm(signer, hash), signedBytes, signature); err != nil {
+		return signer, fmt.Errorf("invalid signature: %v", err)
+	}
+	return signer, nil
+}
+
+// asn1Elements splits the contents of a constructed value into its elements
+func asn1Elements(b []byte) ([]asn1.RawValue, error) {
+	var elems []asn1.RawValue
+	for len(b) > 0 {
+		var e asn1.RawValue
+		rest, err := asn1.Unmarshal(b, &e)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, e)
+		b = rest
+	}
+	return elems, nil
+}
+
+// findSigner returns the certificate identified by a signer identifier,
+// either an issuer and serial number or a subject key identifier
+func findSigner(certs []*x509.Certificate, sid asn1.RawValue) *x509.Certificate {
+	for _, cert := range certs {
+		if sid.Class == asn1.ClassContextSpecific {
+			if bytes.Equal(sid.Bytes, cert.SubjectKeyId) {
+				return cert
+			}
+			continue
+		}
+		var ias issuerAndSerial
+		if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err != nil {
+			return nil
+		}
+		if bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && bytes.Equal(ias.Serial.FullBytes, mustMarshal(cert.SerialNumber)) {
+			return cert
+		}
+	}
+	return nil
+}
+
+func cmsHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %v", oid)
+}
+
+func signatureAlgorithm(cert *x509.Certificate, hash crypto.Hash) x509.SignatureAlgorithm {
+	ecdsa := cert.PublicKeyAlgorithm == x509.ECDSA
+	switch hash {
+	case crypto.SHA1:
+		if ecdsa {
+			return x509.ECDSAWithSHA1
+		}
+		return x509.SHA1WithRSA
+	case crypto.SHA384:
+		if ecdsa {
+			return x509.ECDSAWithSHA384
+		}
+		return x509.SHA384WithRSA
+	case crypto.SHA512:
+		if ecdsa {
+			return x509.ECDSAWithSHA512
+		}
+		return x509.SHA512WithRSA
+	}
+	if ecdsa {
+		return x509.ECDSAWithSHA256
+	}
+	return x509.SHA256WithRSA
+}
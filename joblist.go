@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Pages of the job list
+const (
+	defaultJobsPerPage = 50
+	maxJobsPerPage     = 200
+	maxJobsPage        = 1000000
+)
+
+// jobSummary is a job as the job list shows it; its status has the rest
+type jobSummary struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Status      string    `json:"status"`
+	Files       int       `json:"files"`
+	DownloadURL string    `json:"downloadUrl,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	ErrorCode   string    `json:"errorCode,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// jobList is a page of the job list
+type jobList struct {
+	Jobs    []jobSummary `json:"jobs"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"perPage"`
+	// NextPage is the number of the page after this one, unless this is
+	// the last
+	NextPage int `json:"nextPage,omitempty"`
+}
+
+// handleJobList serves GET /api/v1/jobs, the jobs of the requesting user,
+// newest first, a page at a time. The users in ADMIN_USERS see the jobs of
+// everyone, or of the user they name.
+func (fh *FileHandler) handleJobList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, "No user specified", CodeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := JobFilter{User: user, Status: q.Get("status")}
+	if other := q.Get("user"); other != "" && other != user {
+		if !slices.Contains(fh.adminUsers, user) {
+			writeError(w, "Forbidden", CodeForbidden, http.StatusForbidden)
+			return
+		}
+		filter.User = other
+	} else if other == "" && slices.Contains(fh.adminUsers, user) {
+		filter.AllUsers = true
+	}
+	switch filter.Status {
+	case "", JobQueued, JobProcessing, JobDone, JobFailed:
+	default:
+		writeError(w, "Invalid status: "+filter.Status, CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := parseAuditTime(v)
+		if err != nil {
+			writeError(w, "Invalid "+p.name+": "+v, CodeInvalidRequest, http.StatusBadRequest)
+			return
+		}
+		*p.t = t
+	}
+	list := jobList{Page: 1, PerPage: defaultJobsPerPage}
+	for _, p := range []struct {
+		name string
+		n    *int
+		max  int
+	}{{"page", &list.Page, maxJobsPage}, {"per_page", &list.PerPage, maxJobsPerPage}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > p.max {
+			writeError(w, "Invalid "+p.name+": "+v, CodeInvalidRequest, http.StatusBadRequest)
+			return
+		}
+		*p.n = n
+	}
+
+	// One job more than the page holds tells whether there is another
+	filter.Offset = (list.Page - 1) * list.PerPage
+	filter.Limit = list.PerPage + 1
+	jobs, err := fh.jobs.Find(filter)
+	if err != nil {
+		writeError(w, "Error listing jobs: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	if len(jobs) > list.PerPage {
+		jobs = jobs[:list.PerPage]
+		list.NextPage = list.Page + 1
+	}
+	list.Jobs = []jobSummary{}
+	for _, job := range jobs {
+		s := jobSummary{
+			ID:        job.ID,
+			Name:      job.Name,
+			User:      job.User,
+			Status:    job.Status,
+			Files:     len(job.Files),
+			Error:     job.Error,
+			ErrorCode: job.ErrorCode,
+			CreatedAt: job.CreatedAt,
+			UpdatedAt: job.UpdatedAt,
+		}
+		if job.Status == JobDone {
+			s.DownloadURL = fh.basePath + "/download/" + filepath.Base(job.OutputPath)
+			s.Size = job.OutputSize
+		}
+		list.Jobs = append(list.Jobs, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// How the pages of a merged PDF are labelled
+const (
+	PageLabelsKeep     = "keep"
+	PageLabelsRenumber = "renumber"
+)
+
+// Deepest page label tree read, against cycles in damaged files
+const maxLabelTreeDepth = 32
+
+// labelRange is a range of page labels of a PDF, starting at a page
+// counted from 0: its numbering style, prefix and first number
+type labelRange struct {
+	start  int
+	style  types.Name
+	prefix types.Object
+	first  int
+}
+
+// readPageLabels returns the label ranges of the PDF at path by first page,
+// none when it has no page labels
+func readPageLabels(path string) ([]labelRange, error) {
+	ctx, err := readContext(path)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := ctx.DereferenceDict(ctx.RootDict["PageLabels"])
+	if err != nil || tree == nil {
+		return nil, err
+	}
+	var ranges []labelRange
+	if err := collectLabels(ctx, tree, 0, &ranges); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// collectLabels appends the ranges of the number tree node d to ranges
+func collectLabels(ctx *model.Context, d types.Dict, depth int, ranges *[]labelRange) error {
+	if depth > maxLabelTreeDepth {
+		return nil
+	}
+	if kids, err := ctx.DereferenceArray(d["Kids"]); err == nil {
+		for _, kid := range kids {
+			node, err := ctx.DereferenceDict(kid)
+			if err != nil {
+				return err
+			}
+			if node != nil {
+				if err := collectLabels(ctx, node, depth+1, ranges); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	nums, err := ctx.DereferenceArray(d["Nums"])
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(nums); i += 2 {
+		start, ok := nums[i].(types.Integer)
+		if !ok || start < 0 {
+			continue
+		}
+		label, err := ctx.DereferenceDict(nums[i+1])
+		if err != nil || label == nil {
+			continue
+		}
+		r := labelRange{start: start.Value(), first: 1}
+		if s := label.NameEntry("S"); s != nil {
+			r.style = types.Name(*s)
+		}
+		if p, err := ctx.Dereference(label["P"]); err == nil {
+			switch p.(type) {
+			case types.StringLiteral, types.HexLiteral:
+				r.prefix = p
+			}
+		}
+		if st := label.IntEntry("St"); st != nil && *st > 0 {
+			r.first = *st
+		}
+		*ranges = append(*ranges, r)
+	}
+	return nil
+}
+
+// labelOf returns the range of ranges the page, counted from 1, falls in,
+// by index, and its number there. Pages before the first range are
+// numbered as they are.
+func labelOf(ranges []labelRange, page int) (int, int) {
+	at := -1
+	for i, r := range ranges {
+		if r.start <= page-1 && (at < 0 || r.start >= ranges[at].start) {
+			at = i
+		}
+	}
+	if at < 0 {
+		return -1, page
+	}
+	return at, ranges[at].first + page - 1 - ranges[at].start
+}
+
+// applyPageLabels gives the PDF at path, whose last pages are pages of the
+// uploads of a job, the labels these pages have in their uploads, so front
+// matter numbered "iv" or an appendix page "A-3" keeps its label. Uploads
+// without labels number their pages as they are, and the pages the service
+// puts in front, such as the cover, are numbered in lower roman numerals.
+// Jobs that renumber their pages, and those none of whose uploads has
+// labels, get none at all, nor do imposed ones, whose sheets hold several
+// pages.
+func applyPageLabels(job *Job, path string, pages []pageOrigin) error {
+	if job.Options.NUp > 0 {
+		return nil
+	}
+	// Only PDFs have labels to carry over
+	labels := map[int][]labelRange{}
+	if job.Options.PageLabels != PageLabelsRenumber {
+		for i, f := range job.Files {
+			if f.Error != "" || !strings.EqualFold(filepath.Ext(f.Name), ".pdf") {
+				continue
+			}
+			// An upload whose labels cannot be read merges without them
+			if ranges, err := readPageLabels(f.Path); err == nil && len(ranges) > 0 {
+				labels[i] = ranges
+			}
+		}
+		if len(labels) == 0 {
+			return nil
+		}
+	}
+
+	return transformPDF(path, func(in, out string) error {
+		ctx, err := readContext(in)
+		if err != nil {
+			return err
+		}
+		if err := ctx.EnsurePageCount(); err != nil {
+			return err
+		}
+		lead := ctx.PageCount - len(pages)
+		if len(labels) == 0 || lead < 0 {
+			// Merged pages come with the labels of the first upload
+			delete(ctx.RootDict, "PageLabels")
+			return api.WriteContextFile(ctx, out)
+		}
+
+		// A new range starts wherever the pages stop following one another
+		type key struct{ file, at int }
+		var nums types.Array
+		var last key
+		next := 0
+		add := func(page int, k key, style types.Name, prefix types.Object, n int) {
+			if page > 0 && k == last && n == next {
+				next++
+				return
+			}
+			d := types.Dict{}
+			if style != "" {
+				d["S"] = style
+			}
+			if prefix != nil {
+				d["P"] = prefix
+			}
+			if n != 1 {
+				d["St"] = types.Integer(n)
+			}
+			nums = append(nums, types.Integer(page), d)
+			last, next = k, n+1
+		}
+		for i := 0; i < lead; i++ {
+			add(i, key{-1, 0}, "r", nil, i+1)
+		}
+		for i, p := range pages {
+			if p.page == 0 {
+				add(lead+i, key{p.file, -2}, "", types.StringLiteral("Separator"), 1)
+				continue
+			}
+			at, n := -1, p.page
+			if ranges, ok := labels[p.file]; ok {
+				at, n = labelOf(ranges, p.page)
+			}
+			if at < 0 {
+				add(lead+i, key{p.file, -1}, "D", nil, n)
+				continue
+			}
+			r := labels[p.file][at]
+			add(lead+i, key{p.file, at}, r.style, r.prefix, n)
+		}
+
+		ref, err := ctx.IndRefForNewObject(types.Dict{"Nums": nums})
+		if err != nil {
+			return err
+		}
+		ctx.RootDict["PageLabels"] = *ref
+		return api.WriteContextFile(ctx, out)
+	})
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Uploads of this many bytes or more are merged in large-file mode unless
+// LARGE_FILE_MB says otherwise
+const defaultLargeFileSize = 1 << 30
+
+// Largest upload request unless MAX_UPLOAD_MB says otherwise, so a single
+// request cannot fill the disk
+const defaultMaxUploadSize = 4 << 30
+
+// uploadLimits control how much an upload may bring; zero disables a limit
+type uploadLimits struct {
+	// maxSize caps the size of an upload request
+	maxSize int64
+	// largeFiles is the total size of the uploaded files from which a job
+	// is merged in large-file mode
+	largeFiles int64
+}
+
+// loadUploadLimits reads MAX_UPLOAD_MB and LARGE_FILE_MB
+func loadUploadLimits() (uploadLimits, error) {
+	limits := uploadLimits{maxSize: defaultMaxUploadSize, largeFiles: defaultLargeFileSize}
+	for _, v := range []struct {
+		name string
+		dst  *int64
+	}{{"MAX_UPLOAD_MB", &limits.maxSize}, {"LARGE_FILE_MB", &limits.largeFiles}} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		mb, err := strconv.ParseFloat(s, 64)
+		if err != nil || mb < 0 {
+			return limits, fmt.Errorf("invalid %s: %s", v.name, s)
+		}
+		*v.dst = int64(mb * (1 << 20))
+	}
+	return limits, nil
+}
+
+// largeFileMode reports whether uploads of size bytes in total are merged
+// in large-file mode
+func (l uploadLimits) largeFileMode(size int64) bool {
+	return l.largeFiles > 0 && size >= l.largeFiles
+}
+
+// largeFileConflicts returns the form fields of the options that need the
+// whole document in memory, which large-file mode does without
+func largeFileConflicts(opts MergeOptions) []string {
+	var fields []string
+	for _, o := range []struct {
+		field string
+		set   bool
+	}{
+		{"mode", opts.Mode == ModeInterleave},
+		{"ocr", opts.OCR},
+		{"form_values", len(opts.FormValues) > 0},
+		{"flatten_forms", opts.FlattenForms},
+		{"remove_annotations", opts.RemoveAnnotations},
+		{"sanitize", opts.Sanitize},
+		{"attach_sources", opts.AttachSources},
+		{"deskew", opts.Deskew},
+		{"tag_images", opts.TagImages},
+		{"crop", opts.Crop != ""},
+		{"normalize", opts.Normalize != ""},
+		{"nup", opts.NUp > 0},
+		{"overlay", opts.Overlay != ""},
+		{"stamp_source", opts.StampSource},
+		{"qr_stamp", opts.QRStamp != ""},
+		{"cover", opts.Cover != nil},
+		{"max_pages_per_file", opts.MaxPagesPerFile > 0},
+		{"separators", opts.Separators != ""},
+		{"sign", opts.Sign},
+		{"xmp", opts.XMP == XMPFirst || opts.XMP == XMPSynthesize},
+		{"lang", opts.Lang != ""},
+		{"page_layout", opts.PageLayout != ""},
+		{"zoom", opts.Zoom != ""},
+		{"open_page", opts.OpenPage > 0},
+		{"bookmarks_panel", opts.BookmarksPanel != ""},
+		{"pdfx", opts.PDFX != ""},
+		{"portfolio", opts.Portfolio},
+	} {
+		if o.set {
+			fields = append(fields, o.field)
+		}
+	}
+	return fields
+}
+
+// mergeLargePDFs merges the PDFs of a large-file job into the output
+// directory, keeping to the page limit of truncated jobs
+func (fh *FileHandler) mergeLargePDFs(pdfPaths []string, timestamp string) (string, error) {
+	if len(pdfPaths) == 0 {
+		return "", fmt.Errorf("no PDF files to merge")
+	}
+	maxPages := 0
+	if fh.limits.truncate {
+		maxPages = fh.limits.maxPages
+	}
+
+	outputPath := filepath.Join(fh.outputDir, fmt.Sprintf("merged_%s.pdf", timestamp))
+	if len(pdfPaths) == 1 && maxPages == 0 {
+		return outputPath, copyFile(pdfPaths[0], outputPath)
+	}
+	if err := mergeLarge(pdfPaths, outputPath, maxPages); err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("error merging PDFs: %v", err)
+	}
+	return outputPath, nil
+}
+
+// mergeLarge merges the PDFs at paths into out without reading them into
+// memory. The pages are collected from the page trees and the objects they
+// use are copied one at a time, their stream data straight from the file.
+// Only the pages come along: outlines, forms and structure tags of the
+// files are dropped. With maxPages set it stops after that many pages.
+func mergeLarge(paths []string, out string, maxPages int) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := &pdfWriter{w: bufio.NewWriterSize(f, 1<<20)}
+	w.writeString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	// The page tree and the catalog are written last, once the pages are
+	// known
+	tree, catalog := w.reserve(), w.reserve()
+
+	var kids types.Array
+	for _, path := range paths {
+		limit := 0
+		if maxPages > 0 {
+			if limit = maxPages - len(kids); limit <= 0 {
+				break
+			}
+		}
+		refs, err := copyPages(w, path, tree, limit)
+		if err != nil {
+			return fmt.Errorf("error copying %s: %v", path, err)
+		}
+		kids = append(kids, refs...)
+	}
+
+	w.writeObject(tree, types.Dict{"Type": types.Name("Pages"), "Kids": kids, "Count": types.Integer(len(kids))})
+	w.writeObject(catalog, types.Dict{"Type": types.Name("Catalog"), "Pages": *types.NewIndirectRef(tree, 0)})
+	w.writeTrailer(catalog)
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// copyPages copies up to limit pages of the PDF at path, or all with limit
+// 0, and the objects they use to w, returning references to the pages. The
+// pages become children of tree.
+func copyPages(w *pdfWriter, path string, tree, limit int) (types.Array, error) {
+	pr, err := openPDFReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.close()
+
+	pages, nodes, err := pr.pages(limit)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &objectCopier{pr: pr, w: w, numbers: map[int]int{}}
+	// References to the page tree of the file, as from annotations, go to
+	// the merged tree
+	for _, nr := range nodes {
+		c.numbers[nr] = tree
+	}
+	// Pages are numbered first, so links between them are kept
+	refs := make(types.Array, len(pages))
+	for i, p := range pages {
+		c.numbers[p.nr] = w.reserve()
+		refs[i] = *types.NewIndirectRef(c.numbers[p.nr], 0)
+	}
+	for _, p := range pages {
+		page := c.remap(p.dict).(types.Dict)
+		page["Parent"] = *types.NewIndirectRef(tree, 0)
+		w.writeObject(c.numbers[p.nr], page)
+		if err := c.drain(); err != nil {
+			return nil, err
+		}
+	}
+	return refs, w.err
+}
+
+// objectCopier copies the objects of one file, numbering them anew
+type objectCopier struct {
+	pr *pdfReader
+	w  *pdfWriter
+	// Output object numbers by object number in the file
+	numbers map[int]int
+	// Objects referred to but not yet copied
+	queue []int
+}
+
+// ref returns the output reference for object nr of the file, queueing the
+// object to be copied the first time
+func (c *objectCopier) ref(nr int) types.IndirectRef {
+	n, ok := c.numbers[nr]
+	if !ok {
+		n = c.w.reserve()
+		c.numbers[nr] = n
+		c.queue = append(c.queue, nr)
+	}
+	return *types.NewIndirectRef(n, 0)
+}
+
+// remap returns o with its references changed to the output numbers
+func (c *objectCopier) remap(o types.Object) types.Object {
+	switch o := o.(type) {
+	case types.IndirectRef:
+		return c.ref(o.ObjectNumber.Value())
+	case types.Dict:
+		d := types.Dict{}
+		for k, v := range o {
+			d[k] = c.remap(v)
+		}
+		return d
+	case types.Array:
+		a := make(types.Array, len(o))
+		for i, v := range o {
+			a[i] = c.remap(v)
+		}
+		return a
+	}
+	return o
+}
+
+// drain copies the queued objects and those they refer to
+func (c *objectCopier) drain() error {
+	for len(c.queue) > 0 && c.w.err == nil {
+		nr := c.queue[0]
+		c.queue = c.queue[1:]
+		o, err := c.pr.object(nr)
+		if err != nil {
+			return fmt.Errorf("error reading object %d: %v", nr, err)
+		}
+		sd, ok := o.(types.StreamDict)
+		if !ok {
+			c.w.writeObject(c.numbers[nr], c.remap(o))
+			continue
+		}
+		length, err := c.pr.streamLength(sd)
+		if err != nil {
+			return fmt.Errorf("error reading object %d: %v", nr, err)
+		}
+		d := sd.Dict.Clone().(types.Dict)
+		d["Length"] = types.Integer(length)
+		c.w.writeStream(c.numbers[nr], c.remap(d).(types.Dict), io.NewSectionReader(c.pr.f, sd.StreamOffset, length))
+	}
+	return c.w.err
+}
+
+// pdfWriter writes a PDF object by object, keeping their offsets for the
+// cross-reference table. The first error sticks.
+type pdfWriter struct {
+	w   *bufio.Writer
+	pos int64
+	// offsets by object number; 0 is the head of the free list
+	offsets []int64
+	err     error
+}
+
+// reserve returns the number of a new object
+func (w *pdfWriter) reserve() int {
+	if len(w.offsets) == 0 {
+		w.offsets = append(w.offsets, 0)
+	}
+	w.offsets = append(w.offsets, 0)
+	return len(w.offsets) - 1
+}
+
+func (w *pdfWriter) writeString(s string) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.WriteString(s)
+	w.pos += int64(n)
+	w.err = err
+}
+
+func (w *pdfWriter) writeObject(nr int, o types.Object) {
+	w.offsets[nr] = w.pos
+	s := "null"
+	if o != nil {
+		s = o.PDFString()
+	}
+	w.writeString(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", nr, s))
+}
+
+func (w *pdfWriter) writeStream(nr int, d types.Dict, data io.Reader) {
+	w.offsets[nr] = w.pos
+	w.writeString(fmt.Sprintf("%d 0 obj\n%s\nstream\n", nr, d.PDFString()))
+	if w.err != nil {
+		return
+	}
+	n, err := io.Copy(w.w, data)
+	w.pos += n
+	w.err = err
+	w.writeString("\nendstream\nendobj\n")
+}
+
+func (w *pdfWriter) writeTrailer(catalog int) {
+	xref := w.pos
+	w.writeString(fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", len(w.offsets)))
+	for _, off := range w.offsets[1:] {
+		w.writeString(fmt.Sprintf("%010d 00000 n \n", off))
+	}
+	id := randomHex(16)
+	w.writeString(fmt.Sprintf("trailer\n<</Size %d /Root %d 0 R /ID [<%s> <%s>]>>\nstartxref\n%d\n%%%%EOF\n",
+		len(w.offsets), catalog, id, id, xref))
+}
+
+// countPages returns the number of pages of the PDF at path without reading
+// it into memory
+func countPages(path string) (int, error) {
+	pr, err := openPDFReader(path)
+	if err != nil {
+		return 0, err
+	}
+	defer pr.close()
+	pages, err := pr.pageTree()
+	if err != nil {
+		return 0, err
+	}
+	if n, ok := pages["Count"].(types.Integer); ok {
+		return n.Value(), nil
+	}
+	return 0, errors.New("page tree without count")
+}
+
+// pdfReader reads the objects of a PDF on demand, seeking to them in the
+// file; stream data is left in the file
+type pdfReader struct {
+	f *os.File
+	// ctx serves pdfcpu's parser, which reads objects at an offset
+	ctx     *model.Context
+	xref    map[int]xrefEntry
+	trailer types.Dict
+	// Decoded object streams by object number
+	objStreams map[int]*objectStream
+}
+
+// xrefEntry locates an object of a PDF
+type xrefEntry struct {
+	free   bool
+	offset int64
+	// Objects compressed in an object stream are found by the number of
+	// the stream and their position in it
+	compressed bool
+	stream     int
+	index      int
+}
+
+// objectStream is the decoded content of an object stream
+type objectStream struct {
+	content []byte
+	// Offsets of the objects in content
+	offsets []int
+}
+
+// Object streams decoded at most at once per file
+const maxObjectStreams = 64
+
+func openPDFReader(path string) (*pdfReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := model.NewContext(f, pdfConfig())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pr := &pdfReader{f: f, ctx: ctx, xref: map[int]xrefEntry{}, objStreams: map[int]*objectStream{}}
+	if err := pr.readXRef(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading cross-reference table: %v", err)
+	}
+	if pr.trailer["Encrypt"] != nil {
+		f.Close()
+		return nil, errors.New("encrypted PDFs are not supported in large-file mode")
+	}
+	return pr, nil
+}
+
+func (pr *pdfReader) close() {
+	pr.f.Close()
+}
+
+// readXRef reads the cross-reference sections from the last one back,
+// later sections overriding earlier ones
+func (pr *pdfReader) readXRef() error {
+	offset, err := pr.startXRef()
+	if err != nil {
+		return err
+	}
+	seen := map[int64]bool{}
+	for !seen[offset] {
+		seen[offset] = true
+		trailer, err := pr.readXRefSection(offset)
+		if err != nil {
+			return err
+		}
+		if pr.trailer == nil {
+			pr.trailer = trailer
+		} else if pr.trailer["Root"] == nil {
+			pr.trailer["Root"] = trailer["Root"]
+		}
+		// Hybrid files list their compressed objects in a stream as well
+		if stm, ok := trailer["XRefStm"].(types.Integer); ok {
+			if _, err := pr.readXRefStream(int64(stm.Value())); err != nil {
+				return err
+			}
+		}
+		prev, ok := trailer["Prev"].(types.Integer)
+		if !ok {
+			break
+		}
+		offset = int64(prev.Value())
+	}
+	if pr.trailer["Root"] == nil {
+		return errors.New("no catalog")
+	}
+	return nil
+}
+
+// startXRef returns the offset of the last cross-reference section
+func (pr *pdfReader) startXRef() (int64, error) {
+	size := pr.ctx.Read.FileSize
+	n := min(size, 1024)
+	buf := make([]byte, n)
+	if _, err := pr.f.ReadAt(buf, size-n); err != nil {
+		return 0, err
+	}
+	i := bytes.LastIndex(buf, []byte("startxref"))
+	if i < 0 {
+		return 0, errors.New("startxref not found")
+	}
+	fields := strings.Fields(string(buf[i+len("startxref"):]))
+	if len(fields) == 0 {
+		return 0, errors.New("startxref without offset")
+	}
+	return strconv.ParseInt(fields[0], 10, 64)
+}
+
+// readXRefSection reads the cross-reference table or stream at offset and
+// returns its trailer
+func (pr *pdfReader) readXRefSection(offset int64) (types.Dict, error) {
+	br := bufio.NewReader(io.NewSectionReader(pr.f, offset, pr.ctx.Read.FileSize-offset))
+	tok, err := readToken(br)
+	if err != nil {
+		return nil, err
+	}
+	if tok != "xref" {
+		return pr.readXRefStream(offset)
+	}
+
+	for {
+		if tok, err = readToken(br); err != nil {
+			return nil, err
+		}
+		if rest, ok := strings.CutPrefix(tok, "trailer"); ok {
+			return readTrailer(br, rest)
+		}
+		start, err := strconv.Atoi(tok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subsection: %s", tok)
+		}
+		if tok, err = readToken(br); err != nil {
+			return nil, err
+		}
+		count, err := strconv.Atoi(tok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subsection: %s", tok)
+		}
+		for nr := start; nr < start+count; nr++ {
+			var fields [3]string
+			for i := range fields {
+				if fields[i], err = readToken(br); err != nil {
+					return nil, err
+				}
+			}
+			off, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry for object %d", nr)
+			}
+			if _, ok := pr.xref[nr]; !ok {
+				pr.xref[nr] = xrefEntry{free: fields[2] != "n", offset: off}
+			}
+		}
+	}
+}
+
+// readTrailer parses the trailer dictionary following the trailer keyword,
+// of which rest was read along with it
+func readTrailer(br *bufio.Reader, rest string) (types.Dict, error) {
+	var sb strings.Builder
+	sb.WriteString(rest)
+	buf := make([]byte, 4096)
+	for !strings.Contains(sb.String(), "startxref") && sb.Len() < 1<<20 {
+		n, err := br.Read(buf)
+		sb.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	s, _, _ := strings.Cut(sb.String(), "startxref")
+	o, err := model.ParseObject(&s)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := o.(types.Dict)
+	if !ok {
+		return nil, errors.New("invalid trailer")
+	}
+	return d, nil
+}
+
+// readToken reads the next token separated by whitespace
+func readToken(br *bufio.Reader) (string, error) {
+	var tok []byte
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF && len(tok) > 0 {
+			return string(tok), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n', '\f', 0:
+			if len(tok) > 0 {
+				return string(tok), nil
+			}
+		default:
+			tok = append(tok, c)
+		}
+	}
+}
+
+// readXRefStream reads the cross-reference stream at offset and returns
+// its dictionary, which is the trailer
+func (pr *pdfReader) readXRefStream(offset int64) (types.Dict, error) {
+	o, err := pdfcpu.ParseObject(pr.ctx, offset, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	sd, ok := o.(types.StreamDict)
+	if !ok || sd.Type() == nil || *sd.Type() != "XRef" {
+		return nil, fmt.Errorf("no cross-reference section at offset %d", offset)
+	}
+	content, err := pr.decodeStream(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	widths, ok := sd.Dict["W"].(types.Array)
+	if !ok || len(widths) != 3 {
+		return nil, errors.New("invalid cross-reference stream widths")
+	}
+	var w [3]int
+	for i, v := range widths {
+		n, ok := v.(types.Integer)
+		if !ok || n < 0 || n > 8 {
+			return nil, errors.New("invalid cross-reference stream widths")
+		}
+		w[i] = n.Value()
+	}
+	index, ok := sd.Dict["Index"].(types.Array)
+	if !ok {
+		size, _ := sd.Dict["Size"].(types.Integer)
+		index = types.Array{types.Integer(0), size}
+	}
+
+	field := func(b []byte) int64 {
+		var v int64
+		for _, c := range b {
+			v = v<<8 | int64(c)
+		}
+		return v
+	}
+	entrySize := w[0] + w[1] + w[2]
+	for i := 0; i+1 < len(index); i += 2 {
+		start, ok1 := index[i].(types.Integer)
+		count, ok2 := index[i+1].(types.Integer)
+		if !ok1 || !ok2 {
+			return nil, errors.New("invalid cross-reference stream index")
+		}
+		for nr := start.Value(); nr < start.Value()+count.Value(); nr++ {
+			if len(content) < entrySize {
+				return nil, errors.New("cross-reference stream too short")
+			}
+			entry := content[:entrySize]
+			content = content[entrySize:]
+			typ := int64(1)
+			if w[0] > 0 {
+				typ = field(entry[:w[0]])
+			}
+			f2, f3 := field(entry[w[0]:w[0]+w[1]]), field(entry[w[0]+w[1]:])
+			if _, ok := pr.xref[nr]; ok {
+				continue
+			}
+			switch typ {
+			case 0:
+				pr.xref[nr] = xrefEntry{free: true}
+			case 1:
+				pr.xref[nr] = xrefEntry{offset: f2}
+			case 2:
+				pr.xref[nr] = xrefEntry{compressed: true, stream: int(f2), index: int(f3)}
+			}
+		}
+	}
+	return sd.Dict, nil
+}
+
+// object returns object nr of the file, or nil if there is none. Streams
+// come without their data.
+func (pr *pdfReader) object(nr int) (types.Object, error) {
+	e, ok := pr.xref[nr]
+	if !ok || e.free {
+		return nil, nil
+	}
+	if e.compressed {
+		return pr.compressedObject(e.stream, e.index)
+	}
+	return pdfcpu.ParseObject(pr.ctx, e.offset, nr, 0)
+}
+
+// resolve returns o, or the object it refers to
+func (pr *pdfReader) resolve(o types.Object) (types.Object, error) {
+	if ref, ok := o.(types.IndirectRef); ok {
+		return pr.object(ref.ObjectNumber.Value())
+	}
+	return o, nil
+}
+
+func (pr *pdfReader) compressedObject(stream, index int) (types.Object, error) {
+	stm, ok := pr.objStreams[stream]
+	if !ok {
+		o, err := pr.object(stream)
+		if err != nil {
+			return nil, err
+		}
+		sd, ok := o.(types.StreamDict)
+		if !ok {
+			return nil, fmt.Errorf("object %d is not an object stream", stream)
+		}
+		content, err := pr.decodeStream(sd)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := sd.Dict["N"].(types.Integer)
+		first, _ := sd.Dict["First"].(types.Integer)
+		if first.Value() < 0 || first.Value() > len(content) {
+			return nil, fmt.Errorf("invalid object stream %d", stream)
+		}
+		header := strings.Fields(string(content[:first.Value()]))
+		stm = &objectStream{content: content[first.Value():]}
+		for i := 0; i < n.Value() && 2*i+1 < len(header); i++ {
+			off, err := strconv.Atoi(header[2*i+1])
+			if err != nil || off < 0 || off > len(stm.content) {
+				return nil, fmt.Errorf("invalid object stream %d", stream)
+			}
+			stm.offsets = append(stm.offsets, off)
+		}
+		if len(pr.objStreams) >= maxObjectStreams {
+			clear(pr.objStreams)
+		}
+		pr.objStreams[stream] = stm
+	}
+
+	if index < 0 || index >= len(stm.offsets) {
+		return nil, fmt.Errorf("object %d of object stream %d not found", index, stream)
+	}
+	end := len(stm.content)
+	if index+1 < len(stm.offsets) {
+		end = max(stm.offsets[index+1], stm.offsets[index])
+	}
+	s := string(stm.content[stm.offsets[index]:end])
+	return model.ParseObject(&s)
+}
+
+// streamLength returns the length of the data of sd, which may be given by
+// another object
+func (pr *pdfReader) streamLength(sd types.StreamDict) (int64, error) {
+	if sd.StreamLength != nil {
+		return *sd.StreamLength, nil
+	}
+	if sd.StreamLengthObjNr != nil {
+		o, err := pr.object(*sd.StreamLengthObjNr)
+		if err != nil {
+			return 0, err
+		}
+		if n, ok := o.(types.Integer); ok {
+			return int64(n.Value()), nil
+		}
+	}
+	return 0, errors.New("stream without length")
+}
+
+// decodeStream reads and decodes the data of sd, which must be small, as
+// that of cross-reference and object streams is
+func (pr *pdfReader) decodeStream(sd types.StreamDict) ([]byte, error) {
+	length, err := pr.streamLength(sd)
+	if err != nil {
+		return nil, err
+	}
+	sd.Raw = make([]byte, length)
+	if _, err := pr.f.ReadAt(sd.Raw, sd.StreamOffset); err != nil {
+		return nil, err
+	}
+	if err := sd.Decode(); err != nil {
+		return nil, err
+	}
+	return sd.Content, nil
+}
+
+// pageTree returns the root of the page tree
+func (pr *pdfReader) pageTree() (types.Dict, error) {
+	o, err := pr.resolve(pr.trailer["Root"])
+	if err != nil {
+		return nil, err
+	}
+	root, ok := o.(types.Dict)
+	if !ok {
+		return nil, errors.New("invalid catalog")
+	}
+	if o, err = pr.resolve(root["Pages"]); err != nil {
+		return nil, err
+	}
+	pages, ok := o.(types.Dict)
+	if !ok {
+		return nil, errors.New("invalid page tree")
+	}
+	return pages, nil
+}
+
+// largePage is a page of a file with the attributes it inherits
+type largePage struct {
+	nr   int
+	dict types.Dict
+}
+
+// Page attributes that may be given by the page tree
+var inheritedPageAttrs = []string{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// pages returns up to limit pages of the file in order, or all with limit
+// 0, and the object numbers of the nodes of its page tree
+func (pr *pdfReader) pages(limit int) ([]largePage, []int, error) {
+	o, err := pr.resolve(pr.trailer["Root"])
+	if err != nil {
+		return nil, nil, err
+	}
+	root, ok := o.(types.Dict)
+	if !ok {
+		return nil, nil, errors.New("invalid catalog")
+	}
+
+	var pages []largePage
+	var nodes []int
+	seen := map[int]bool{}
+	var walk func(o types.Object, inherited types.Dict) error
+	walk = func(o types.Object, inherited types.Dict) error {
+		ref, ok := o.(types.IndirectRef)
+		if !ok {
+			return errors.New("page tree node is not an indirect object")
+		}
+		nr := ref.ObjectNumber.Value()
+		if seen[nr] || (limit > 0 && len(pages) >= limit) {
+			return nil
+		}
+		seen[nr] = true
+		obj, err := pr.object(nr)
+		if err != nil {
+			return err
+		}
+		d, ok := obj.(types.Dict)
+		if !ok {
+			return fmt.Errorf("page tree node %d is not a dictionary", nr)
+		}
+
+		if kids, ok := d["Kids"]; ok {
+			nodes = append(nodes, nr)
+			attrs := inherited.Clone().(types.Dict)
+			for _, k := range inheritedPageAttrs {
+				if v, ok := d[k]; ok {
+					attrs[k] = v
+				}
+			}
+			kids, err := pr.resolve(kids)
+			if err != nil {
+				return err
+			}
+			a, _ := kids.(types.Array)
+			for _, kid := range a {
+				if err := walk(kid, attrs); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		for k, v := range inherited {
+			if _, ok := d[k]; !ok {
+				d[k] = v
+			}
+		}
+		pages = append(pages, largePage{nr: nr, dict: d})
+		return nil
+	}
+	if err := walk(root["Pages"], types.Dict{}); err != nil {
+		return nil, nil, err
+	}
+	return pages, nodes, nil
+}
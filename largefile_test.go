@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// testPDFLayout shapes the one-page PDF writeTestPDF writes
+type testPDFLayout struct {
+	// gap is a hole in the file before the objects, putting them at
+	// offsets as large
+	gap int64
+	// content is the length of the content stream of the page, a hole of
+	// zeros too; without it the page draws lines
+	content int64
+	// xrefStream writes the cross-reference section as a stream, and the
+	// page tree and page in an object stream
+	xrefStream bool
+}
+
+// writeTestPDF writes a one-page PDF laid out as l to path. Holes take no
+// space on file systems that support them, so files of gigabytes are made
+// in an instant.
+func writeTestPDF(t testing.TB, path string, l testPDFLayout) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var pos int64
+	write := func(s string) {
+		n, err := f.WriteString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos += int64(n)
+	}
+	skip := func(n int64) {
+		if _, err := f.Seek(n, io.SeekCurrent); err != nil {
+			t.Fatal(err)
+		}
+		pos += n
+	}
+	offsets := map[int]int64{}
+	object := func(nr int, s string) {
+		offsets[nr] = pos
+		write(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", nr, s))
+	}
+
+	write("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	skip(l.gap)
+	write("\n")
+	if l.content > 0 {
+		offsets[4] = pos
+		write(fmt.Sprintf("4 0 obj\n<</Length %d>>\nstream\n", l.content))
+		skip(l.content)
+		write("\nendstream\nendobj\n")
+	} else {
+		// pdfcpu looks for the cross-reference section in the last 512
+		// bytes, so files must be longer
+		lines := strings.Repeat("0 0 m 595 842 l S\n", 40)
+		object(4, fmt.Sprintf("<</Length %d>>\nstream\n%sendstream", len(lines), lines))
+	}
+	object(1, "<</Type/Catalog/Pages 2 0 R>>")
+	tree := "<</Type/Pages/Kids[3 0 R]/Count 1/MediaBox[0 0 595 842]>>"
+	page := "<</Type/Page/Parent 2 0 R/Contents 4 0 R/Resources<<>>>>"
+
+	if !l.xrefStream {
+		object(2, tree)
+		object(3, page)
+		xref := pos
+		write("xref\n0 5\n0000000000 65535 f \n")
+		for nr := 1; nr <= 4; nr++ {
+			write(fmt.Sprintf("%010d 00000 n \n", offsets[nr]))
+		}
+		write(fmt.Sprintf("trailer\n<</Size 5/Root 1 0 R>>\nstartxref\n%d\n%%%%EOF\n", xref))
+		return
+	}
+
+	header := fmt.Sprintf("2 0 3 %d ", len(tree)+1)
+	data := header + tree + "\n" + page
+	object(5, fmt.Sprintf("<</Type/ObjStm/N 2/First %d/Length %d>>\nstream\n%s\nendstream", len(header), len(data), data))
+
+	// Entries of 1, 8 and 2 bytes, so offsets past 4 GB fit
+	offsets[6] = pos
+	var entries bytes.Buffer
+	entry := func(typ byte, f2 uint64, f3 uint16) {
+		entries.WriteByte(typ)
+		binary.Write(&entries, binary.BigEndian, f2)
+		binary.Write(&entries, binary.BigEndian, f3)
+	}
+	entry(0, 0, 65535)
+	entry(1, uint64(offsets[1]), 0)
+	entry(2, 5, 0)
+	entry(2, 5, 1)
+	entry(1, uint64(offsets[4]), 0)
+	entry(1, uint64(offsets[5]), 0)
+	entry(1, uint64(offsets[6]), 0)
+	object(6, fmt.Sprintf("<</Type/XRef/Size 7/W[1 8 2]/Root 1 0 R/Length %d>>\nstream\n%s\nendstream", entries.Len(), entries.String()))
+	write(fmt.Sprintf("startxref\n%d\n%%%%EOF\n", offsets[6]))
+}
+
+// requireFreeSpace skips tests that write more than the free space of dir
+func requireFreeSpace(t *testing.T, dir string, n int64) {
+	t.Helper()
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skipf("free space unknown: %v", err)
+	}
+	if free < n {
+		t.Skipf("needs %d MB free in %s, %d MB are", n>>20, dir, free>>20)
+	}
+}
+
+// checkXRef checks that every object of the cross-reference section of
+// the PDF at path starts at its offset, and returns the largest offset
+func checkXRef(t *testing.T, path string) int64 {
+	t.Helper()
+	pr, err := openPDFReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.close()
+
+	var last int64
+	for nr, e := range pr.xref {
+		if e.free || e.compressed {
+			continue
+		}
+		want := fmt.Sprintf("%d 0 obj", nr)
+		buf := make([]byte, len(want))
+		if _, err := pr.f.ReadAt(buf, e.offset); err != nil {
+			t.Fatalf("object %d at offset %d: %v", nr, e.offset, err)
+		}
+		if string(buf) != want {
+			t.Errorf("object %d at offset %d starts with %q", nr, e.offset, buf)
+		}
+		last = max(last, e.offset)
+	}
+	return last
+}
+
+func TestMergeLarge(t *testing.T) {
+	dir := t.TempDir()
+	table, stream := filepath.Join(dir, "table.pdf"), filepath.Join(dir, "stream.pdf")
+	writeTestPDF(t, table, testPDFLayout{})
+	writeTestPDF(t, stream, testPDFLayout{xrefStream: true})
+
+	for _, tc := range []struct {
+		maxPages, want int
+	}{{0, 4}, {3, 3}, {1, 1}} {
+		out := filepath.Join(dir, fmt.Sprintf("merged_%d.pdf", tc.maxPages))
+		if err := mergeLarge([]string{table, stream, table, stream}, out, tc.maxPages); err != nil {
+			t.Fatalf("maxPages %d: %v", tc.maxPages, err)
+		}
+		if err := api.ValidateFile(out, pdfConfig()); err != nil {
+			t.Fatalf("maxPages %d: merged PDF is invalid: %v", tc.maxPages, err)
+		}
+		n, err := api.PageCountFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.want {
+			t.Errorf("maxPages %d: %d pages, want %d", tc.maxPages, n, tc.want)
+		}
+		checkXRef(t, out)
+	}
+}
+
+func TestReadXRefStreamPast4GB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream.pdf")
+	writeTestPDF(t, path, testPDFLayout{gap: 5 << 30, xrefStream: true})
+
+	pr, err := openPDFReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.close()
+	if e := pr.xref[1]; e.offset <= 1<<32 {
+		t.Errorf("catalog at offset %d, want past 4 GB", e.offset)
+	}
+	if e := pr.xref[3]; !e.compressed || e.stream != 5 || e.index != 1 {
+		t.Errorf("page entry %+v, want the second object of stream 5", e)
+	}
+	pages, nodes, err := pr.pages(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || len(nodes) != 1 {
+		t.Fatalf("%d pages and %d page tree nodes, want 1 and 1", len(pages), len(nodes))
+	}
+	// The media box is inherited from the page tree
+	if _, ok := pages[0].dict["MediaBox"].(types.Array); !ok {
+		t.Errorf("page without inherited media box: %v", pages[0].dict)
+	}
+	if checkXRef(t, path) <= 1<<32 {
+		t.Error("no object past 4 GB")
+	}
+}
+
+func TestMergeLargeOver2GB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes more than 2 GB")
+	}
+	dir := t.TempDir()
+	// The inputs are holes; the output is written out
+	requireFreeSpace(t, dir, 3<<30)
+
+	const content = 1<<31 + 1<<20
+	big, far := filepath.Join(dir, "big.pdf"), filepath.Join(dir, "far.pdf")
+	writeTestPDF(t, big, testPDFLayout{content: content})
+	writeTestPDF(t, far, testPDFLayout{gap: 5 << 30, xrefStream: true})
+
+	out := filepath.Join(dir, "merged.pdf")
+	if err := mergeLarge([]string{big, far}, out, 0); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() <= content {
+		t.Errorf("merged PDF of %d bytes, want more than %d", info.Size(), content)
+	}
+	if n, err := countPages(out); err != nil || n != 2 {
+		t.Fatalf("merged PDF has %d pages (%v), want 2", n, err)
+	}
+	if last := checkXRef(t, out); last <= 1<<31 {
+		t.Errorf("last object at offset %d, want past 2 GB", last)
+	}
+
+	pr, err := openPDFReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.close()
+	pages, _, err := pr.pages(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := pr.resolve(pages[0].dict["Contents"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, ok := o.(types.StreamDict)
+	if !ok {
+		t.Fatalf("contents of the first page are %T", o)
+	}
+	if n, err := pr.streamLength(sd); err != nil || n != content {
+		t.Errorf("content stream of %d bytes (%v), want %d", n, err, content)
+	}
+	// The stream is copied whole, its end where the next object starts
+	end := make([]byte, len("\nendstream"))
+	if _, err := pr.f.ReadAt(end, sd.StreamOffset+content); err != nil || string(end) != "\nendstream" {
+		t.Errorf("content stream ends with %q (%v)", end, err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// jobLimits cap the merged PDFs of shared instances; zero means no limit
+type jobLimits struct {
+	maxPages      int
+	maxOutputSize int64
+	// truncate keeps the first maxPages pages of longer jobs instead of
+	// failing them
+	truncate bool
+}
+
+// loadJobLimits reads the limits from MAX_TOTAL_PAGES, MAX_OUTPUT_MB and
+// TRUNCATE_PAGES
+func loadJobLimits() (jobLimits, error) {
+	var limits jobLimits
+	if v := os.Getenv("MAX_TOTAL_PAGES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return limits, fmt.Errorf("invalid MAX_TOTAL_PAGES: %s", v)
+		}
+		limits.maxPages = n
+	}
+	if v := os.Getenv("MAX_OUTPUT_MB"); v != "" {
+		mb, err := strconv.ParseFloat(v, 64)
+		if err != nil || mb < 0 {
+			return limits, fmt.Errorf("invalid MAX_OUTPUT_MB: %s", v)
+		}
+		limits.maxOutputSize = int64(mb * (1 << 20))
+	}
+	if v := os.Getenv("TRUNCATE_PAGES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return limits, fmt.Errorf("invalid TRUNCATE_PAGES: %s", v)
+		}
+		limits.truncate = b
+	}
+	return limits, nil
+}
+
+// checkPages fails jobs whose converted files have more than the allowed
+// total pages, before they are merged. Truncated jobs are cut after merging
+// instead.
+func (l jobLimits) checkPages(total int) error {
+	if l.maxPages == 0 || l.truncate {
+		return nil
+	}
+	if total > l.maxPages {
+		return fmt.Errorf("the files have %d pages, more than the limit of %d", total, l.maxPages)
+	}
+	return nil
+}
+
+// truncatePages cuts the merged PDF at path to the page limit, returning
+// whether it was longer
+func (l jobLimits) truncatePages(path string) (bool, error) {
+	if l.maxPages == 0 || !l.truncate {
+		return false, nil
+	}
+	n, err := api.PageCountFile(path)
+	if err != nil {
+		return false, fmt.Errorf("error counting pages: %v", err)
+	}
+	if n <= l.maxPages {
+		return false, nil
+	}
+	return true, transformPDF(path, func(in, out string) error {
+		return api.TrimFile(in, out, []string{fmt.Sprintf("1-%d", l.maxPages)}, pdfConfig())
+	})
+}
+
+// checkOutputSize fails jobs whose finished PDF at path is too large
+func (l jobLimits) checkOutputSize(path string) error {
+	if l.maxOutputSize == 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > l.maxOutputSize {
+		return fmt.Errorf("the merged PDF is %.2f MB, more than the limit of %.2f MB",
+			float64(info.Size())/(1<<20), float64(l.maxOutputSize)/(1<<20))
+	}
+	return nil
+}
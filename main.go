@@ -1,125 +1,443 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"image"
+	"image/color"
 	"io"
+	"io/fs"
 	"log"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/disintegration/imaging"
-	"github.com/jung-kurt/gofpdf"
 	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
 	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
 )
 
+//go:embed openapi.json
+var openAPISpec []byte
+
 type FileHandler struct {
 	uploadsDir string
 	outputDir  string
+	cacheDir   string
+	scratchDir string
+	jobs       JobStore
+	notifier   *Notifier
+	// Merges of emailed attachments; nil unless INBOUND_MAIL_TOKEN is set
+	inboundMail *inboundMail
+	// Merges of files attached to Discord commands; nil unless
+	// DISCORD_PUBLIC_KEY is set
+	discord  *discordBot
+	sessions *sessionTokens
+	drive    *oauthProvider
+	dropbox  *oauthProvider
+	ocr      *ocrEngine
+	gs       *ghostscript
+	// Engines merges are tried with in turn; pdfcpu when empty
+	mergeBackends []MergeBackend
+	// Converter plugins by the extension they convert
+	plugins map[string]*converterPlugin
+	signer  *pdfSigner
+	// URL QR stamps link to, with {job} standing for the job ID
+	verifyURL string
+	// Asked before outputs are released; nil unless RELEASE_HOOK_URL or
+	// RELEASE_HOOK_COMMAND is set
+	releaseHook *releaseHook
+	// Set by OFFLINE: nothing connects to other hosts
+	offline bool
+	// Downloads the files of URL inputs
+	remoteFetch *remoteFetcher
+
+	// How long converted PDFs are reused for identical uploads; 0 disables it
+	dedupRetention time.Duration
+	// Total size of the converted PDFs kept for reuse; 0 for no limit
+	dedupMaxSize int64
+	dedupLeases  dedupLeases
+	limits       jobLimits
+	uploads      uploadLimits
+	storage      *storageGuard
+	activeJobs   *activeJobLimits
+	auditLog     AuditLog
+	// Upload sessions, kept for sessionTTL after they last changed
+	uploadSessions UploadSessionStore
+	sessionTTL     time.Duration
+	// SHA-256 digests of downloaded outputs, by path and ETag
+	checksums sync.Map
+	resources workerResources
+	running   runningJobs
+	// Users allowed to export the audit log
+	auditUsers []string
+	// Users who see the jobs of everyone
+	adminUsers []string
+	// Templates and static files of the web interface
+	web   fs.FS
+	brand branding
+	// Path prefix the app is served under behind a reverse proxy, e.g.
+	// "/pdfmerge"; empty when served at the root
+	basePath string
 }
 
-func NewFileHandler() *FileHandler {
-	uploadsDir := "uploads"
-	outputDir := "output"
-
-	// Create directories if they don't exist
-	os.MkdirAll(uploadsDir, 0755)
-	os.MkdirAll(outputDir, 0755)
-
+func NewFileHandler(jobs JobStore, dirs workDirs) *FileHandler {
+	uploadSessions, _ := jobs.(UploadSessionStore)
 	return &FileHandler{
-		uploadsDir: uploadsDir,
-		outputDir:  outputDir,
+		uploadsDir:     dirs.uploads,
+		outputDir:      dirs.output,
+		cacheDir:       dirs.cache,
+		scratchDir:     dirs.scratch,
+		jobs:           jobs,
+		sessions:       newSessionTokens(),
+		uploadSessions: uploadSessions,
+		sessionTTL:     defaultSessionTTL,
+		dedupRetention: 24 * time.Hour,
+		dedupMaxSize:   defaultDedupCacheSize,
+		resources:      workerResources{concurrency: 1, jobThreads: 1},
+		activeJobs:     &activeJobLimits{},
+		web:            embeddedAssets(),
+		brand:          defaultBranding(),
 	}
 }
 
 func (fh *FileHandler) handleUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
 		return
 	}
 
-	err := r.ParseMultipartForm(32 << 20) // 32MB max
+	// Files go straight to the uploads directory as they arrive, so their
+	// size is not limited by memory
+	timestamp := time.Now().Format("20060102_150405")
+	sf, err := fh.spoolForm(w, r, timestamp)
 	if err != nil {
-		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, fmt.Sprintf("Upload too large: the limit is %.0f MB", float64(tooLarge.Limit)/(1<<20)), CodeTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeError(w, "Error parsing form: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
 		return
 	}
+	// Nothing of a rejected upload is kept
+	accepted := false
+	defer func() {
+		if !accepted {
+			sf.remove()
+		}
+	}()
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		http.Error(w, "No files uploaded", http.StatusBadRequest)
+	checksums, err := parseChecksums(r.PostForm["checksums"], len(sf.files))
+	if err != nil {
+		writeError(w, err.Error(), CodeInvalidRequest, http.StatusBadRequest)
 		return
 	}
 
-	var convertedPDFs []string
-	timestamp := time.Now().Format("20060102_150405")
+	opts, err := parseMergeOptions(r)
+	if err != nil {
+		writeError(w, err.Error(), CodeInvalidOption, http.StatusBadRequest)
+		return
+	}
 
-	// Process each uploaded file
-	for i, fileHeader := range files {
-		file, err := fileHeader.Open()
-		if err != nil {
-			http.Error(w, "Error opening file: "+err.Error(), http.StatusInternalServerError)
+	if f, ok := sf.options["overlay"]; ok {
+		opts.Overlay = f.path
+	}
+	if f, ok := sf.options["icc_profile"]; ok {
+		if opts.CMYK || opts.PDFX != "" {
+			opts.ICCProfile = f.path
+		} else {
+			os.Remove(f.path)
+		}
+	}
+	if f, ok := sf.options["cover_logo"]; ok {
+		if opts.Cover != nil {
+			opts.Cover.Logo = f.path
+		} else {
+			os.Remove(f.path)
+		}
+	}
+
+	// The files of an upload session are merged ahead of those uploaded
+	var session *UploadSession
+	if token := r.FormValue("session"); token != "" {
+		if fh.uploadSessions == nil {
+			writeError(w, "Upload sessions not available", CodeNotAvailable, http.StatusBadRequest)
+			return
+		}
+		if session, err = fh.uploadSession(token, requestUser(r)); err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		if r.FormValue("manifest") != "" {
+			writeError(w, "manifest is not available with session", CodeInvalidRequest, http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
+	}
 
-		// Save uploaded file
-		fileName := fmt.Sprintf("%s_%d_%s", timestamp, i, fileHeader.Filename)
-		uploadPath := filepath.Join(fh.uploadsDir, fileName)
+	if err := fh.checkOptions(&opts, sf.size()+session.size()); err != nil {
+		writeError(w, err.Error(), errorCode(err, CodeInvalidOption), http.StatusBadRequest)
+		return
+	}
 
-		dst, err := os.Create(uploadPath)
-		if err != nil {
-			http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+	job := &Job{Name: r.FormValue("name"), User: requestUser(r), RequestID: requestID(r.Context()), Options: opts, Status: JobQueued}
+	// The session keeps its files for later merges, so the job takes copies
+	if session != nil {
+		if job.Files, err = fh.copySessionFiles(session, timestamp, len(sf.files)); err != nil {
+			writeError(w, "Error reading upload session: "+err.Error(), CodeInternal, http.StatusInternalServerError)
 			return
 		}
-		defer dst.Close()
+		copied := job.Files
+		defer func() {
+			if !accepted {
+				for _, f := range copied {
+					os.Remove(f.Path)
+				}
+			}
+		}()
+	}
 
-		_, err = io.Copy(dst, file)
-		if err != nil {
-			http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+	for i, f := range sf.files {
+		if checksums[i] != "" && checksums[i] != f.sha256 {
+			writeError(w, fmt.Sprintf("Checksum mismatch for %s: received SHA-256 %s, expected %s",
+				f.name, f.sha256, checksums[i]), CodeChecksumMismatch, http.StatusBadRequest)
+			return
+		}
+		job.Files = append(job.Files, JobFile{Name: f.name, Path: f.path, SHA256: f.sha256})
+	}
+	// A manifest lays out the uploads in place of their order in the form
+	if manifest := r.FormValue("manifest"); manifest != "" {
+		if job.Files, err = manifestFiles(manifest, sf.files); err != nil {
+			writeError(w, "Invalid manifest: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
 			return
 		}
+		if opts.LargeFiles && hasLayout(job.Files) {
+			writeError(w, "Not available for large files: manifest pages, rotate, scale, fit and bookmark", CodeNotAvailable, http.StatusBadRequest)
+			return
+		}
+	}
 
-		// Convert to PDF if necessary
-		pdfPath, err := fh.convertToPDF(uploadPath, fileHeader.Filename)
-		if err != nil {
-			http.Error(w, "Error converting file to PDF: "+err.Error(), http.StatusInternalServerError)
+	// Files picked from cloud storage are merged after the uploaded ones
+	if fh.offline && (r.FormValue("drive_file_ids") != "" || r.FormValue("dropbox_links") != "" || r.FormValue("dropbox_paths") != "") {
+		writeError(w, "Importing from cloud storage is not available offline", CodeNotAvailable, http.StatusBadRequest)
+		return
+	}
+	if ids := r.FormValue("drive_file_ids"); ids != "" {
+		if err := fh.importDriveFiles(r, job, timestamp, ids); err != nil {
+			writeError(w, "Error importing from Google Drive: "+err.Error(), CodeImportFailed, http.StatusBadRequest)
 			return
 		}
+	}
+	if links := r.FormValue("dropbox_links"); links != "" {
+		if err := fh.importDropboxLinks(r, job, timestamp, links); err != nil {
+			writeError(w, "Error importing from Dropbox: "+err.Error(), CodeImportFailed, http.StatusBadRequest)
+			return
+		}
+	}
+	if paths := r.FormValue("dropbox_paths"); paths != "" {
+		if err := fh.importDropboxPaths(r, job, timestamp, paths); err != nil {
+			writeError(w, "Error importing from Dropbox: "+err.Error(), CodeImportFailed, http.StatusBadRequest)
+			return
+		}
+	}
 
-		convertedPDFs = append(convertedPDFs, pdfPath)
+	if urls := r.PostForm["urls"]; len(urls) > 0 {
+		if fh.offline {
+			writeError(w, "Fetching URLs is not available offline", CodeNotAvailable, http.StatusBadRequest)
+			return
+		}
+		if err := fh.importURLs(r, job, timestamp, urls); err != nil {
+			status := http.StatusBadRequest
+			if errorCode(err, "") == CodeTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			writeError(w, "Error fetching URL: "+err.Error(), errorCode(err, CodeImportFailed), status)
+			return
+		}
 	}
 
-	// Merge all PDFs
-	mergedPath, err := fh.mergePDFs(convertedPDFs, timestamp)
-	if err != nil {
-		http.Error(w, "Error merging PDFs: "+err.Error(), http.StatusInternalServerError)
+	if len(job.Files) == 0 {
+		writeError(w, "No files uploaded", CodeInvalidRequest, http.StatusBadRequest)
 		return
 	}
 
-	// Clean up temporary files
-	for _, path := range convertedPDFs {
-		if !strings.Contains(path, fh.outputDir) {
-			os.Remove(path)
+	if opts.Mode == ModeInterleave && len(job.Files) != 2 {
+		writeError(w, "Interleaving needs exactly 2 files", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	destination := r.FormValue("destination")
+	if destination != "" && fh.offline {
+		writeError(w, "Exporting to cloud storage is not available offline", CodeNotAvailable, http.StatusBadRequest)
+		return
+	}
+	if destination != "" && !validDestination(destination) {
+		writeError(w, "Unsupported destination: "+destination, CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	// Uploads used by several manifest entries are copied for each
+	copies := fh.copies(sf, timestamp)
+	for i := range job.Files {
+		if err := copies.take(&job.Files[i].Path); err != nil {
+			copies.remove()
+			writeError(w, "Error copying "+job.Files[i].Name+": "+err.Error(), CodeInternal, http.StatusInternalServerError)
+			return
 		}
 	}
+	if err := fh.createJob(job, r.RemoteAddr); err != nil {
+		copies.remove()
+		writeJobCreateError(w, err)
+		return
+	}
+	accepted = true
+	fh.auditUploads(job, r.RemoteAddr)
+
+	job, err = fh.waitForJob(r.Context(), job.ID)
+	if err != nil {
+		writeError(w, "Error waiting for job: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	if job.Status == JobFailed {
+		writeError(w, job.Error, job.ErrorCode, http.StatusInternalServerError)
+		return
+	}
+	mergedPath := job.OutputPath
 
 	// Return success response with download link
-	response := map[string]string{
+	response := map[string]any{
 		"status":      "success",
-		"downloadUrl": "/download/" + filepath.Base(mergedPath),
+		"jobId":       job.ID,
+		"downloadUrl": fh.basePath + "/download/" + filepath.Base(mergedPath),
 		"filename":    filepath.Base(mergedPath),
+		"size":        job.OutputSize,
+		"sha256":      job.OutputSHA256,
+		"untagged":    untaggedFiles(job),
+		"pageMap":     job.PageMap,
+		"report":      inputReports(job),
+		"skipped":     skippedFiles(job),
+	}
+	if job.SizeReport != nil {
+		response["sizeReport"] = job.SizeReport
+	}
+	if job.Options.SignedManifest {
+		response["manifestUrl"] = fh.basePath + "/download/" + filepath.Base(mergedPath) + manifestSuffix
+		response["manifestSignatureUrl"] = fh.basePath + "/download/" + filepath.Base(mergedPath) + manifestSignatureSuffix
+	}
+	// Outputs missing failed volumes are partial, a 207 Multi-Status
+	status := http.StatusOK
+	if len(job.FailedVolumes) > 0 {
+		response["status"] = "partial"
+		response["failedVolumes"] = job.FailedVolumes
+		status = http.StatusMultiStatus
+	}
+
+	// Push the result to the requested cloud location
+	if destination != "" {
+		tokens := cloudTokens{drive: r.FormValue("drive_token"), dropbox: r.FormValue("dropbox_token")}
+		if tokens.drive == "" {
+			tokens.drive = fh.sessions.get(r, "google")
+		}
+		if tokens.dropbox == "" {
+			tokens.dropbox = fh.sessions.get(r, "dropbox")
+		}
+
+		location, err := fh.exportOutput(r.Context(), destination, tokens, mergedPath)
+		if err != nil {
+			log.Printf("Error exporting job %s to %s (request %s): %v", job.ID, destination, job.RequestID, err)
+			response["exportError"] = err.Error()
+		} else {
+			response["exportedTo"] = location
+			fh.auditFile(AuditEvent{Action: AuditExport, User: job.User, Remote: r.RemoteAddr, JobID: job.ID, Detail: location}, mergedPath, false)
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"status": "%s", "downloadUrl": "%s", "filename": "%s"}`,
-		response["status"], response["downloadUrl"], response["filename"])
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// checkOptions refuses options this server cannot honour for uploads of
+// size bytes, and switches those too large to read into memory to
+// large-file mode
+func (fh *FileHandler) checkOptions(opts *MergeOptions, size int64) error {
+	if opts.OCR && fh.ocr == nil {
+		return withCode(CodeNotAvailable, errors.New("OCR is not available on this server"))
+	}
+	if opts.PDFX != "" && fh.gs == nil {
+		return withCode(CodeNotAvailable, errors.New("PDF/X output is not available on this server"))
+	}
+	if opts.CMYK && fh.gs == nil {
+		return withCode(CodeNotAvailable, errors.New("CMYK conversion is not available on this server"))
+	}
+	if opts.ICCProfile != "" {
+		profile, err := os.ReadFile(opts.ICCProfile)
+		if err != nil {
+			return err
+		}
+		if err := checkCMYKProfile(profile); err != nil {
+			return withCode(CodeInvalidOption, fmt.Errorf("invalid icc_profile: %v", err))
+		}
+	} else if opts.PDFX == PDFX4 && fh.gs.profile == nil {
+		return withCode(CodeNotAvailable, errors.New("PDF/X-4 output is not available on this server without an uploaded icc_profile"))
+	}
+	if opts.Sign && fh.signer == nil {
+		return withCode(CodeNotAvailable, errors.New("Signing is not configured on this server"))
+	}
+	if opts.SignedManifest && fh.signer == nil {
+		return withCode(CodeNotAvailable, errors.New("Signed manifests are not available on this server without a signing certificate"))
+	}
+
+	if fh.uploads.largeFileMode(size) {
+		opts.LargeFiles = true
+	}
+	if opts.LargeFiles {
+		if fields := largeFileConflicts(*opts); len(fields) > 0 {
+			return withCode(CodeNotAvailable, errors.New("Not available for large files: "+strings.Join(fields, ", ")))
+		}
+	}
+	return nil
+}
+
+// requestUser returns the user name set by an authenticating reverse proxy, if any.
+// The headers of clients other than the trusted proxies are ignored.
+func requestUser(r *http.Request) string {
+	if !fromTrustedProxy(r) {
+		return ""
+	}
+	if u := r.Header.Get("X-Forwarded-User"); u != "" {
+		return u
+	}
+	return r.Header.Get("X-Remote-User")
+}
+
+// mayAccess tells whether user may see and delete job: its own, or any
+// for the users in ADMIN_USERS. Once they are set, the server is behind an
+// authenticating proxy, and jobs without a user are no longer anyone's.
+func (fh *FileHandler) mayAccess(job *Job, user string) bool {
+	if slices.Contains(fh.adminUsers, user) {
+		return true
+	}
+	return job.User == user && (job.User != "" || len(fh.adminUsers) == 0)
 }
 
-func (fh *FileHandler) convertToPDF(filePath, originalName string) (string, error) {
+func (fh *FileHandler) convertToPDF(filePath, originalName string, opts MergeOptions) (string, error) {
 	ext := strings.ToLower(filepath.Ext(originalName))
 
 	// If already PDF, return as is
@@ -129,22 +447,30 @@ func (fh *FileHandler) convertToPDF(filePath, originalName string) (string, erro
 
 	// Convert image to PDF
 	if ext == ".png" || ext == ".jpg" || ext == ".jpeg" {
-		return fh.imageToPDF(filePath, originalName)
+		return fh.imageToPDF(filePath, originalName, opts)
 	}
 
-	return "", fmt.Errorf("unsupported file format: %s", ext)
+	// Other formats are left to the plugin declared for them
+	if p := fh.plugin(originalName); p != nil {
+		pdfPath := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".pdf"
+		if err := p.convert(filePath, pdfPath, ext); err != nil {
+			return "", withCode(CodeConversionFailed, err)
+		}
+		return pdfPath, nil
+	}
+
+	return "", withCode(CodeUnsupportedFormat, fmt.Errorf("unsupported file format: %s", ext))
 }
 
-func (fh *FileHandler) imageToPDF(imagePath, originalName string) (string, error) {
-	// Open and decode image
-	img, err := imaging.Open(imagePath)
+func (fh *FileHandler) imageToPDF(imagePath, originalName string, opts MergeOptions) (string, error) {
+	// Open and decode image, turned as the camera held it when deskewing
+	img, err := imaging.Open(imagePath, imaging.AutoOrientation(opts.Deskew))
 	if err != nil {
-		return "", fmt.Errorf("error opening image: %v", err)
+		return "", withCode(CodeCorruptImage, fmt.Errorf("error opening image: %v", err))
 	}
-
-	// Create PDF
-	pdf := gofpdf.New("P", "mm", "A4", "")
-	pdf.AddPage()
+	// Images nothing is done to are embedded from the upload
+	untouched := !opts.Deskew && !enhancesImages(opts) && !opts.AutoCrop && opts.ImageQuality == 0
+	img = prepareImage(img, opts, color.Transparent)
 
 	// Get image dimensions
 	bounds := img.Bounds()
@@ -155,40 +481,106 @@ func (fh *FileHandler) imageToPDF(imagePath, originalName string) (string, error
 	pageWidth := 190.0  // A4 width minus margins
 	pageHeight := 277.0 // A4 height minus margins
 
+	// Full-bleed images are cut to fill their page and its bleed instead,
+	// and cut marks go on the sheets when the pages are imposed
+	var layout bleedLayout
+	marks := opts.CutMarks && opts.NUp == 0
+	if opts.FullBleed {
+		layout = newBleedLayout(imgWidth > imgHeight, opts.Bleed, marks)
+		img = fillBleed(img, layout)
+		untouched = false
+		bounds = img.Bounds()
+		imgWidth, imgHeight = float64(bounds.Dx()), float64(bounds.Dy())
+		pageWidth, pageHeight = layout.bleed.Width()/pointsPerMM, layout.bleed.Height()/pointsPerMM
+	}
+
+	// Tall images split across pages keep the scale that fits their width
+	split := opts.SplitTallImages && !opts.FullBleed && tallImage(imgWidth, imgHeight, pageWidth, pageHeight)
+
 	scale := 1.0
-	if imgWidth > pageWidth || imgHeight > pageHeight {
+	if opts.FullBleed || imgWidth > pageWidth || imgHeight > pageHeight {
 		scaleX := pageWidth / imgWidth
 		scaleY := pageHeight / imgHeight
 		scale = scaleX
 		if scaleY < scaleX {
 			scale = scaleY
 		}
+		// Full-bleed images cover the bleed box whole, whatever was lost
+		// in cutting them to its proportions in whole pixels
+		if opts.FullBleed {
+			scale = max(scaleX, scaleY)
+		}
+		if split {
+			scale = min(scaleX, 1)
+		}
 	}
 
 	finalWidth := imgWidth * scale
-	finalHeight := imgHeight * scale
 
-	// Center the image on page
-	x := (210 - finalWidth) / 2
-	y := (297 - finalHeight) / 2
+	// Downsample images finer than the requested resolution at their size
+	// on the page
+	if opts.ImageDPI > 0 {
+		maxWidth := int(finalWidth / 25.4 * float64(opts.ImageDPI))
+		maxHeight := int(imgHeight * scale / 25.4 * float64(opts.ImageDPI))
+		if bounds.Dx() > maxWidth || bounds.Dy() > maxHeight {
+			img = imaging.Fit(img, max(maxWidth, 1), max(maxHeight, 1), imaging.Lanczos)
+			untouched = false
+		}
+	}
 
-	// Convert image to temporary file for gofpdf
-	tempImagePath := strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + "_temp.png"
-	err = imaging.Save(img, tempImagePath)
-	if err != nil {
-		return "", fmt.Errorf("error saving temporary image: %v", err)
+	// Tall images are cut into slices a page high, which go on pages of
+	// their own
+	slices := []image.Image{img}
+	ptsPerPixel := finalWidth * pointsPerMM / float64(img.Bounds().Dx())
+	if split {
+		slices = sliceImage(img, pageHeight*pointsPerMM/ptsPerPixel, float64(opts.SplitOverlap)*pointsPerMM/ptsPerPixel)
+		untouched = false
+	}
+	images := make([]io.Reader, len(slices))
+	for i, slice := range slices {
+		data, err := encodeImage(slice, imagePath, untouched, opts)
+		if err != nil {
+			return "", err
+		}
+		images[i] = data
 	}
-	defer os.Remove(tempImagePath)
 
-	// Add image to PDF
-	pdf.Image(tempImagePath, x, y, finalWidth, finalHeight, false, "", 0, "")
+	// Center the image on an A4 page at its size in points
+	page := paperSizes[NormalizeA4]
+	if opts.FullBleed {
+		page = layout.page
+	}
+	imp := pdfcpu.DefaultImportConfig()
+	imp.PageDim = &page
+	imp.Pos = types.Center
+	imp.ScaleAbs = true
+	imp.Scale = ptsPerPixel
+	// Slices hang from the top margin, so the last one, which is shorter,
+	// follows on from the others
+	if split {
+		imp.Pos = types.TopCenter
+		imp.Dy = -(page.Height - pageHeight*pointsPerMM) / 2
+	}
 
-	// Save PDF
 	pdfPath := strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ".pdf"
-	err = pdf.OutputFileAndClose(pdfPath)
+	out, err := os.Create(pdfPath)
 	if err != nil {
 		return "", fmt.Errorf("error creating PDF: %v", err)
 	}
+	err = api.ImportImages(nil, out, images, imp, pdfConfig())
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(pdfPath)
+		return "", fmt.Errorf("error creating PDF: %v", err)
+	}
+	if opts.FullBleed {
+		if err := markBleed(pdfPath, layout, marks); err != nil {
+			os.Remove(pdfPath)
+			return "", fmt.Errorf("error creating PDF: %v", err)
+		}
+	}
 
 	// Clean up original image file
 	os.Remove(imagePath)
@@ -196,6 +588,100 @@ func (fh *FileHandler) imageToPDF(imagePath, originalName string) (string, error
 	return pdfPath, nil
 }
 
+// encodeImage returns img encoded for embedding in a PDF. Untouched JPEGs
+// go into the PDF as they are, from the upload at path, without
+// re-encoding them. Other images are stored losslessly, or as JPEG with a
+// quality set.
+func encodeImage(img image.Image, path string, untouched bool, opts MergeOptions) (*bytes.Buffer, error) {
+	var data bytes.Buffer
+	if untouched && plainJPEG(path) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening image: %v", err)
+		}
+		_, err = data.ReadFrom(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading image: %v", err)
+		}
+		return &data, nil
+	}
+
+	// Transparent areas are drawn on the background, as viewers show
+	// soft masks on black or not at all
+	background := color.NRGBA{255, 255, 255, 255}
+	if opts.ImageBackground != "" {
+		var err error
+		if background, err = parseHexColor(opts.ImageBackground); err != nil {
+			return nil, err
+		}
+	}
+	flat := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), background)
+	flat = imaging.Overlay(flat, img, image.Pt(0, 0), 1)
+	var err error
+	if opts.ImageQuality > 0 {
+		err = imaging.Encode(&data, flat, imaging.JPEG, imaging.JPEGQuality(opts.ImageQuality))
+	} else {
+		err = imaging.Encode(&data, flat, imaging.PNG)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error encoding image: %v", err)
+	}
+	return &data, nil
+}
+
+// plainJPEG reports whether the file at path is a JPEG that PDF viewers
+// show as it is: gray or YCbCr, as CMYK JPEGs are often stored inverted
+func plainJPEG(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	config, format, err := image.DecodeConfig(f)
+	return err == nil && format == "jpeg" && (config.ColorModel == color.YCbCrModel || config.ColorModel == color.GrayModel)
+}
+
+// prepareImage straightens, enhances and trims an uploaded image as the
+// options ask, filling uncovered corners with bg. Enhancing first whitens
+// gray paper so its borders can be trimmed.
+func prepareImage(img image.Image, opts MergeOptions, bg color.Color) image.Image {
+	if opts.Deskew {
+		if angle, ok := straightenAngle(img); ok {
+			img = rotateImage(img, angle, bg)
+		}
+	}
+	if enhancesImages(opts) {
+		img = enhanceImage(img, opts)
+	}
+	if opts.AutoCrop {
+		img = trimImage(img)
+	}
+	return img
+}
+
+// prepareImageFile applies prepareImage to the image at path in place
+func prepareImageFile(path string, opts MergeOptions) error {
+	img, err := imaging.Open(path, imaging.AutoOrientation(opts.Deskew))
+	if err != nil {
+		return fmt.Errorf("error opening image: %v", err)
+	}
+	return imaging.Save(prepareImage(img, opts, color.White), path, imaging.JPEGQuality(95))
+}
+
+// parseHexColor reads a color given as "#rrggbb"
+func parseHexColor(s string) (color.NRGBA, error) {
+	var c color.NRGBA
+	if len(s) != 7 || s[0] != '#' {
+		return c, fmt.Errorf("invalid color: %s (expected #rrggbb)", s)
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return c, fmt.Errorf("invalid color: %s (expected #rrggbb)", s)
+	}
+	return color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
 func (fh *FileHandler) mergePDFs(pdfPaths []string, timestamp string) (string, error) {
 	if len(pdfPaths) == 0 {
 		return "", fmt.Errorf("no PDF files to merge")
@@ -211,414 +697,335 @@ func (fh *FileHandler) mergePDFs(pdfPaths []string, timestamp string) (string, e
 	// Merge multiple PDFs
 	outputPath := filepath.Join(fh.outputDir, fmt.Sprintf("merged_%s.pdf", timestamp))
 
-	// Use pdfcpu to merge PDFs
-	conf := model.NewDefaultConfiguration()
-	conf.ValidationMode = model.ValidationRelaxed
-
-	err := api.MergeCreateFile(pdfPaths, outputPath, false, conf)
-	if err != nil {
+	// Merge with the configured engines, pdfcpu unless MERGE_BACKEND says
+	// otherwise
+	backends := fh.mergeBackends
+	if len(backends) == 0 {
+		backends = []MergeBackend{pdfcpuBackend{resources: fh.resources}}
+	}
+	if err := mergeWith(backends, pdfPaths, outputPath); err != nil {
 		return "", fmt.Errorf("error merging PDFs: %v", err)
 	}
 
 	return outputPath, nil
 }
 
+// pdfConfig returns the pdfcpu configuration used for all PDF operations
+func pdfConfig() *model.Configuration {
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	return conf
+}
+
 func (fh *FileHandler) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
 	filename := strings.TrimPrefix(r.URL.Path, "/download/")
 	if filename == "" {
-		http.Error(w, "No filename specified", http.StatusBadRequest)
+		writeError(w, "No filename specified", CodeInvalidRequest, http.StatusBadRequest)
 		return
 	}
 
 	filePath := filepath.Join(fh.outputDir, filename)
 
 	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		writeError(w, "File not found", CodeNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, "Error opening file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, "Error reading file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
 		return
 	}
 
 	// Set headers for PDF download
-	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Type", outputType(filename))
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", fileETag(info))
+	// Outputs may be private to their user, and are removed, so only the
+	// client keeps them, revalidating them before reuse
+	w.Header().Set("Cache-Control", "private, no-cache")
+	sum, err := fh.outputChecksum(filePath, info)
+	if err != nil {
+		writeError(w, "Error reading file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Checksum", "sha256="+sum)
+
+	if r.Method != http.MethodHead {
+		fh.audit(AuditEvent{Action: AuditDownload, User: requestUser(r), Remote: r.RemoteAddr, File: filename, Size: info.Size(), Detail: r.Header.Get("Range")})
+	}
+
+	// Serve the file; ServeContent handles HEAD, Range, If-Range,
+	// If-None-Match based on the ETag set above, and If-Modified-Since
+	// with the Last-Modified it sets
+	http.ServeContent(w, r, filename, info.ModTime(), f)
+}
+
+// outputType returns the media type of a job output, a PDF or the ZIP
+// archive of its volumes, or of its signed manifest or signature
+func outputType(name string) string {
+	switch {
+	case strings.EqualFold(filepath.Ext(name), ".zip"):
+		return "application/zip"
+	case strings.HasSuffix(name, manifestSuffix):
+		return "application/json"
+	case strings.HasSuffix(name, manifestSignatureSuffix):
+		return "application/pkcs7-signature"
+	}
+	return "application/pdf"
+}
+
+// outputChecksum returns the SHA-256 hex digest of the merged file at path,
+// hashing it only on its first download
+func (fh *FileHandler) outputChecksum(path string, info os.FileInfo) (string, error) {
+	key := path + fileETag(info)
+	if sum, ok := fh.checksums.Load(key); ok {
+		return sum.(string), nil
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	fh.checksums.Store(key, sum)
+	return sum, nil
+}
+
+// fileETag derives a strong ETag from the size and modification time of a
+// merged file, which never changes once written
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+}
 
-	// Serve the file
-	http.ServeFile(w, r, filePath)
+// jobStatus is the public view of a job returned by the API
+type jobStatus struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name,omitempty"`
+	Status      string   `json:"status"`
+	Files       []string `json:"files"`
+	DownloadURL string   `json:"downloadUrl,omitempty"`
+	Size        int64    `json:"size,omitempty"`
+	SHA256      string   `json:"sha256,omitempty"`
+	// Untagged names the files that had no structure tags, once converted
+	Untagged []string `json:"untagged,omitempty"`
+	// PageMap traces the pages of the output to the uploads, once done
+	PageMap []PageRun `json:"pageMap,omitempty"`
+	// Report tells what the worker found in the uploads it examined
+	Report []inputResult `json:"report,omitempty"`
+	// Skipped lists the uploads left out as they failed to convert
+	Skipped []skippedFile `json:"skipped,omitempty"`
+	// FailedVolumes are the volumes the output goes without, once done
+	FailedVolumes []VolumeError `json:"failedVolumes,omitempty"`
+	// SizeReport compares the output with the uploads, once a job that
+	// optimizes images is done
+	SizeReport *SizeReport `json:"sizeReport,omitempty"`
+	// ManifestURL and ManifestSignatureURL download the signed manifest
+	// of a job with signed_manifest, once done
+	ManifestURL          string `json:"manifestUrl,omitempty"`
+	ManifestSignatureURL string `json:"manifestSignatureUrl,omitempty"`
+	// RequestID is the X-Request-ID of the request that queued the job
+	RequestID string `json:"requestId,omitempty"`
+	// Progress is left out until a worker picks the job up
+	Progress  *JobProgress `json:"progress,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	ErrorCode string       `json:"errorCode,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+func (fh *FileHandler) handleJob(w http.ResponseWriter, r *http.Request) {
+	if id, ok := jobDataID(r.URL.Path); ok {
+		fh.handleDeleteJobData(w, r, id)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/jobs/")
+	if id == "" {
+		writeError(w, "No job ID specified", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	job, err := fh.jobs.Get(id)
+	if errors.Is(err, ErrJobNotFound) {
+		writeError(w, "Job not found", CodeNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, "Error loading job: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	if !fh.mayAccess(job, requestUser(r)) {
+		writeError(w, "Forbidden", CodeForbidden, http.StatusForbidden)
+		return
+	}
+
+	resp := jobStatus{
+		ID:        job.ID,
+		Name:      job.Name,
+		Status:    job.Status,
+		Error:     job.Error,
+		ErrorCode: job.ErrorCode,
+		RequestID: job.RequestID,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+	for _, f := range job.Files {
+		resp.Files = append(resp.Files, f.Name)
+		if f.Untagged {
+			resp.Untagged = append(resp.Untagged, f.Name)
+		}
+	}
+	if job.Progress.Stage != "" {
+		resp.Progress = &job.Progress
+	}
+	resp.Report = inputReports(job)
+	resp.Skipped = skippedFiles(job)
+	if job.Status == JobDone {
+		resp.DownloadURL = fh.basePath + "/download/" + filepath.Base(job.OutputPath)
+		resp.Size = job.OutputSize
+		resp.SHA256 = job.OutputSHA256
+		resp.PageMap = job.PageMap
+		resp.FailedVolumes = job.FailedVolumes
+		resp.SizeReport = job.SizeReport
+		if job.Options.SignedManifest {
+			resp.ManifestURL = resp.DownloadURL + manifestSuffix
+			resp.ManifestSignatureURL = resp.DownloadURL + manifestSignatureSuffix
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
 }
 
 func (fh *FileHandler) handleIndex(w http.ResponseWriter, r *http.Request) {
-	tmpl := `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>PDF Merger</title>
-    <style>
-        body {
-            font-family: Arial, sans-serif;
-            max-width: 800px;
-            margin: 0 auto;
-            padding: 20px;
-            background-color: #f5f5f5;
-        }
-        .container {
-            background-color: white;
-            padding: 30px;
-            border-radius: 10px;
-            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
-        }
-        h1 {
-            color: #333;
-            text-align: center;
-            margin-bottom: 30px;
-        }
-        .upload-area {
-            border: 2px dashed #ccc;
-            border-radius: 10px;
-            padding: 40px;
-            text-align: center;
-            margin-bottom: 20px;
-            transition: border-color 0.3s;
-        }
-        .upload-area:hover {
-            border-color: #007bff;
-        }
-        .upload-area.dragover {
-            border-color: #007bff;
-            background-color: #f8f9ff;
-        }
-        #fileInput {
-            display: none;
-        }
-        .file-label {
-            cursor: pointer;
-            color: #007bff;
-            font-size: 18px;
-        }
-        .file-list {
-            margin: 20px 0;
-        }
-        .file-item {
-            background-color: #f8f9fa;
-            padding: 10px;
-            margin: 5px 0;
-            border-radius: 5px;
-            display: flex;
-            justify-content: space-between;
-            align-items: center;
-            cursor: move;
-            transition: background-color 0.2s;
-        }
-        .file-item:hover {
-            background-color: #e9ecef;
-        }
-        .file-item.dragging {
-            opacity: 0.5;
-            background-color: #dee2e6;
-        }
-        .file-item.drag-over {
-            border-top: 3px solid #007bff;
-        }
-        .drag-handle {
-            color: #6c757d;
-            margin-right: 10px;
-            cursor: move;
-        }
-        .file-item .remove-btn {
-            background-color: #dc3545;
-            color: white;
-            border: none;
-            padding: 5px 10px;
-            border-radius: 3px;
-            cursor: pointer;
-        }
-        .merge-btn {
-            background-color: #28a745;
-            color: white;
-            border: none;
-            padding: 15px 30px;
-            border-radius: 5px;
-            cursor: pointer;
-            font-size: 16px;
-            width: 100%;
-            margin-top: 20px;
-        }
-        .merge-btn:disabled {
-            background-color: #ccc;
-            cursor: not-allowed;
-        }
-        .result {
-            margin-top: 20px;
-            padding: 15px;
-            border-radius: 5px;
-        }
-        .success {
-            background-color: #d4edda;
-            color: #155724;
-            border: 1px solid #c3e6cb;
-        }
-        .error {
-            background-color: #f8d7da;
-            color: #721c24;
-            border: 1px solid #f5c6cb;
-        }
-        .download-btn {
-            background-color: #007bff;
-            color: white;
-            border: none;
-            padding: 10px 20px;
-            border-radius: 5px;
-            cursor: pointer;
-            text-decoration: none;
-            display: inline-block;
-            margin-top: 10px;
-        }
-        .loading {
-            display: none;
-            text-align: center;
-            margin: 20px 0;
-        }
-        .spinner {
-            border: 4px solid #f3f3f3;
-            border-top: 4px solid #3498db;
-            border-radius: 50%;
-            width: 40px;
-            height: 40px;
-            animation: spin 2s linear infinite;
-            margin: 0 auto;
-        }
-        @keyframes spin {
-            0% { transform: rotate(0deg); }
-            100% { transform: rotate(360deg); }
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <h1>PDF Merger & Image Converter</h1>
-        <p style="text-align: center; color: #666;">
-            Select multiple PDF, PNG, or JPG files to merge into a single PDF
-        </p>
-        
-        <div class="upload-area" id="uploadArea">
-            <label for="fileInput" class="file-label">
-                📁 Click here to select files or drag and drop them
-            </label>
-            <input type="file" id="fileInput" multiple accept=".pdf,.png,.jpg,.jpeg">
-        </div>
-        
-        <div class="file-list" id="fileList"></div>
-        
-        <button class="merge-btn" id="mergeBtn" disabled onclick="mergePDFs()">
-            Merge Files
-        </button>
-        
-        <div class="loading" id="loading">
-            <div class="spinner"></div>
-            <p>Processing files...</p>
-        </div>
-        
-        <div id="result"></div>
-    </div>
-
-    <script>
-        let selectedFiles = [];
-        const fileInput = document.getElementById('fileInput');
-        const fileList = document.getElementById('fileList');
-        const mergeBtn = document.getElementById('mergeBtn');
-        const uploadArea = document.getElementById('uploadArea');
-        const loading = document.getElementById('loading');
-        const result = document.getElementById('result');
-
-        // Handle file selection
-        fileInput.addEventListener('change', function(e) {
-            handleFiles(e.target.files);
-        });
-
-        // Handle drag and drop
-        uploadArea.addEventListener('dragover', function(e) {
-            e.preventDefault();
-            uploadArea.classList.add('dragover');
-        });
-
-        uploadArea.addEventListener('dragleave', function(e) {
-            e.preventDefault();
-            uploadArea.classList.remove('dragover');
-        });
-
-        uploadArea.addEventListener('drop', function(e) {
-            e.preventDefault();
-            uploadArea.classList.remove('dragover');
-            handleFiles(e.dataTransfer.files);
-        });
-
-        function handleFiles(files) {
-            for (let file of files) {
-                if (file.type === 'application/pdf' || 
-                    file.type.startsWith('image/png') || 
-                    file.type.startsWith('image/jpeg') ||
-                    file.name.toLowerCase().endsWith('.pdf') ||
-                    file.name.toLowerCase().endsWith('.png') ||
-                    file.name.toLowerCase().endsWith('.jpg') ||
-                    file.name.toLowerCase().endsWith('.jpeg')) {
-                    selectedFiles.push(file);
-                }
-            }
-            updateFileList();
-        }
-
-        function updateFileList() {
-            fileList.innerHTML = '';
-            selectedFiles.forEach((file, index) => {
-                const fileItem = document.createElement('div');
-                fileItem.className = 'file-item';
-                fileItem.draggable = true;
-                fileItem.dataset.index = index;
-                fileItem.innerHTML = ` + "`" + `
-                    <div style="display: flex; align-items: center;">
-                        <span class="drag-handle">⋮⋮</span>
-                        <span>${file.name} (${(file.size / 1024 / 1024).toFixed(2)} MB)</span>
-                    </div>
-                    <button class="remove-btn" onclick="removeFile(${index})">Remove</button>
-                ` + "`" + `;
-                
-                // Add drag event listeners
-                fileItem.addEventListener('dragstart', handleDragStart);
-                fileItem.addEventListener('dragover', handleDragOver);
-                fileItem.addEventListener('drop', handleDrop);
-                fileItem.addEventListener('dragend', handleDragEnd);
-                fileItem.addEventListener('dragenter', handleDragEnter);
-                fileItem.addEventListener('dragleave', handleDragLeave);
-                
-                fileList.appendChild(fileItem);
-            });
-            
-            mergeBtn.disabled = selectedFiles.length === 0;
-        }
-
-        function removeFile(index) {
-            selectedFiles.splice(index, 1);
-            updateFileList();
-        }
-
-        // Drag and drop reordering functionality
-        let draggedIndex = null;
-
-        function handleDragStart(e) {
-            draggedIndex = parseInt(e.target.dataset.index);
-            e.target.classList.add('dragging');
-            e.dataTransfer.effectAllowed = 'move';
-        }
-
-        function handleDragEnd(e) {
-            e.target.classList.remove('dragging');
-            draggedIndex = null;
-            
-            // Remove all drag-over classes
-            document.querySelectorAll('.file-item').forEach(item => {
-                item.classList.remove('drag-over');
-            });
-        }
-
-        function handleDragOver(e) {
-            e.preventDefault();
-            e.dataTransfer.dropEffect = 'move';
-        }
-
-        function handleDragEnter(e) {
-            e.preventDefault();
-            if (e.target.classList.contains('file-item') && draggedIndex !== null) {
-                const targetIndex = parseInt(e.target.dataset.index);
-                if (targetIndex !== draggedIndex) {
-                    e.target.classList.add('drag-over');
-                }
-            }
-        }
-
-        function handleDragLeave(e) {
-            if (e.target.classList.contains('file-item')) {
-                e.target.classList.remove('drag-over');
-            }
-        }
-
-        function handleDrop(e) {
-            e.preventDefault();
-            
-            if (draggedIndex === null) return;
-            
-            const targetIndex = parseInt(e.target.dataset.index);
-            
-            if (targetIndex !== draggedIndex) {
-                // Reorder the files array
-                const draggedFile = selectedFiles[draggedIndex];
-                selectedFiles.splice(draggedIndex, 1);
-                selectedFiles.splice(targetIndex, 0, draggedFile);
-                
-                // Update the display
-                updateFileList();
-            }
-            
-            // Clean up
-            e.target.classList.remove('drag-over');
-        }
-
-        async function mergePDFs() {
-            if (selectedFiles.length === 0) return;
-
-            loading.style.display = 'block';
-            result.innerHTML = '';
-            mergeBtn.disabled = true;
-
-            const formData = new FormData();
-            selectedFiles.forEach(file => {
-                formData.append('files', file);
-            });
-
-            try {
-                const response = await fetch('/upload', {
-                    method: 'POST',
-                    body: formData
-                });
-
-                const data = await response.json();
-
-                if (response.ok && data.status === 'success') {
-                    result.innerHTML = ` + "`" + `
-                        <div class="result success">
-                            <strong>Success!</strong> Your PDF has been merged successfully.
-                            <br>
-                            <a href="${data.downloadUrl}" class="download-btn" download>
-                                📥 Download ${data.filename}
-                            </a>
-                        </div>
-                    ` + "`" + `;
-                } else {
-                    throw new Error(data.error || 'Unknown error occurred');
-                }
-            } catch (error) {
-                result.innerHTML = ` + "`" + `
-                    <div class="result error">
-                        <strong>Error:</strong> ${error.message}
-                    </div>
-                ` + "`" + `;
-            } finally {
-                loading.style.display = 'none';
-                mergeBtn.disabled = false;
-            }
-        }
-    </script>
-</body>
-</html>
-	`
-
-	t, err := template.New("index").Parse(tmpl)
+	// Parsed on every request so edits to overridden templates show at once
+	t, err := template.ParseFS(fh.web, "templates/index.html")
 	if err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
+		writeError(w, "Template error: "+err.Error(), CodeInternal, http.StatusInternalServerError)
 		return
 	}
 
-	t.Execute(w, nil)
+	data := struct {
+		BasePath         string
+		Brand            branding
+		GoogleDrive      bool
+		DriveConnected   bool
+		Dropbox          bool
+		DropboxConnected bool
+		// DropboxLinks offers importing from share links, which needs no
+		// connected account
+		DropboxLinks bool
+		OCR          bool
+		PDFX         bool
+		CMYKProfile  bool
+		Sign         bool
+		// Accept lists the extensions of the files that can be merged
+		Accept string
+		// LocalMerge offers merging in the browser, when the WebAssembly
+		// build is among the static files
+		LocalMerge bool
+	}{
+		BasePath:         fh.basePath,
+		Brand:            fh.brand,
+		GoogleDrive:      fh.drive != nil,
+		DriveConnected:   fh.drive != nil && fh.sessions.get(r, "google") != "",
+		Dropbox:          fh.dropbox != nil,
+		DropboxConnected: fh.dropbox != nil && fh.sessions.get(r, "dropbox") != "",
+		DropboxLinks:     !fh.offline,
+		OCR:              fh.ocr != nil,
+		PDFX:             fh.gs != nil,
+		CMYKProfile:      fh.gs != nil && fh.gs.profile != nil,
+		Sign:             fh.signer != nil,
+		Accept:           fh.acceptedExtensions(),
+		LocalMerge:       fh.hasLocalMerge(),
+	}
+	t.Execute(w, data)
+}
+
+// uploadPath returns where the index-th input of a request is stored. A
+// random token keeps the files of requests made in the same second with the
+// same names apart.
+func (fh *FileHandler) uploadPath(timestamp string, index int, name string) string {
+	return filepath.Join(fh.uploadsDir, fmt.Sprintf("%s_%s_%d_%s", timestamp, randomHex(4), index, filepath.Base(name)))
+}
+
+// parseBasePath normalizes a BASE_PATH such as "/pdfmerge/" to "/pdfmerge"
+func parseBasePath(v string) (string, error) {
+	v = strings.TrimRight(v, "/")
+	if v == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(v, "/") || strings.ContainsAny(v, "?#") {
+		return "", fmt.Errorf("%s is not a path starting with /", v)
+	}
+	return v, nil
+}
+
+// parseChecksums checks the SHA-256 digests clients may send for their n
+// uploaded files, in the same order; empty ones are not checked
+func parseChecksums(values []string, n int) ([]string, error) {
+	if len(values) > n {
+		return nil, fmt.Errorf("got %d checksums for %d files", len(values), n)
+	}
+	checksums := make([]string, n)
+	for i, v := range values {
+		v = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(v), "sha256="))
+		if v == "" {
+			continue
+		}
+		if b, err := hex.DecodeString(v); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 checksum: %s", values[i])
+		}
+		checksums[i] = v
+	}
+	return checksums, nil
+}
+
+// saveUpload writes the uploaded file to dst and returns its SHA-256 hex digest
+func saveUpload(fileHeader *multipart.FileHeader, dst string) (string, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return saveStream(file, dst)
+}
+
+// saveStream writes src to dst and returns its SHA-256 hex digest
+func saveStream(src io.Reader, dst string) (string, error) {
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), out.Close()
 }
 
 func copyFile(src, dst string) error {
@@ -639,21 +1046,254 @@ func copyFile(src, dst string) error {
 }
 
 func main() {
-	fh := NewFileHandler()
+	jobs, err := openJobStore(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal("Failed to open job store:", err)
+	}
+	defer jobs.Close()
+
+	dirs, err := loadWorkDirs()
+	if err != nil {
+		log.Fatal("Invalid directories:", err)
+	}
+	if err := dirs.create(); err != nil {
+		log.Fatal("Failed to create directories:", err)
+	}
+	fh := NewFileHandler(jobs, dirs)
+	if fh.offline, err = loadOffline(); err != nil {
+		log.Fatal("Invalid offline mode:", err)
+	}
+	if fh.offline {
+		log.Printf("Running offline: features connecting to other hosts are not available")
+	}
+	if err := loadTrustedProxies(); err != nil {
+		log.Fatal("Invalid trusted proxies:", err)
+	}
+	proxy, err := loadOutboundProxy()
+	if err != nil {
+		log.Fatal("Invalid outbound proxy:", err)
+	}
+	if proxy != "" {
+		log.Printf("Connecting to other hosts through %s", proxy)
+	}
+	if fh.remoteFetch, err = loadRemoteFetcher(); err != nil {
+		log.Fatal("Invalid remote fetch limits:", err)
+	}
+	if v := os.Getenv("DEDUP_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatal("Invalid DEDUP_RETENTION:", err)
+		}
+		fh.dedupRetention = d
+	}
+	if v := os.Getenv("DEDUP_CACHE_MB"); v != "" {
+		mb, err := strconv.ParseFloat(v, 64)
+		if err != nil || mb < 0 {
+			log.Fatal("Invalid DEDUP_CACHE_MB:", v)
+		}
+		fh.dedupMaxSize = int64(mb * (1 << 20))
+	}
+	if v := os.Getenv("UPLOAD_SESSION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatal("Invalid UPLOAD_SESSION_TTL:", v)
+		}
+		fh.sessionTTL = d
+	}
+	if fh.web, err = loadWebAssets(os.Getenv("WEB_DIR")); err != nil {
+		log.Fatal("Invalid WEB_DIR:", err)
+	}
+	if fh.brand, err = loadBranding(); err != nil {
+		log.Fatal("Invalid branding:", err)
+	}
+	if fh.basePath, err = parseBasePath(os.Getenv("BASE_PATH")); err != nil {
+		log.Fatal("Invalid BASE_PATH:", err)
+	}
+	if fh.limits, err = loadJobLimits(); err != nil {
+		log.Fatal("Invalid job limits:", err)
+	}
+	if fh.uploads, err = loadUploadLimits(); err != nil {
+		log.Fatal("Invalid upload limits:", err)
+	}
+	if fh.resources, err = loadWorkerResources(); err != nil {
+		log.Fatal("Invalid worker resources:", err)
+	}
+	storageDirs := []string{dirs.uploads, dirs.output, dirs.cache}
+	if dirs.scratch != dirs.uploads {
+		storageDirs = append(storageDirs, dirs.scratch)
+	}
+	if fh.storage, err = loadStorageGuard(storageDirs...); err != nil {
+		log.Fatal("Invalid storage limits:", err)
+	}
+	if fh.activeJobs, err = loadActiveJobLimits(); err != nil {
+		log.Fatal("Invalid active job limits:", err)
+	}
+	if v := os.Getenv("AUDIT_LOG"); v != "" {
+		if fh.auditLog, err = openAuditLog(v, jobs); err != nil {
+			log.Fatal("Failed to open audit log:", err)
+		}
+		fh.auditUsers = splitList(os.Getenv("AUDIT_USERS"))
+	}
+	fh.notifier = NewNotifier(os.Getenv("NOTIFY_WEBHOOK_URL"), os.Getenv("PUBLIC_URL"))
+	fh.adminUsers = splitList(os.Getenv("ADMIN_USERS"))
+	if fh.inboundMail, err = loadInboundMail(os.Getenv("PUBLIC_URL")); err != nil {
+		log.Fatal("Invalid inbound mail settings:", err)
+	}
+	if fh.discord, err = newDiscordBot(os.Getenv("DISCORD_PUBLIC_KEY"), os.Getenv("PUBLIC_URL")); err != nil {
+		log.Fatal("Invalid DISCORD_PUBLIC_KEY:", err)
+	}
+	fh.drive = newGoogleDrive(os.Getenv("GOOGLE_CLIENT_ID"), os.Getenv("GOOGLE_CLIENT_SECRET"), os.Getenv("PUBLIC_URL"), fh.sessions)
+	fh.dropbox = newDropbox(os.Getenv("DROPBOX_APP_KEY"), os.Getenv("DROPBOX_APP_SECRET"), os.Getenv("PUBLIC_URL"), fh.sessions)
+	sandbox, err := loadSandbox(dirs.scratch)
+	if err != nil {
+		log.Fatal("Invalid converter limits:", err)
+	}
+	sandbox.offline = fh.offline
+	fh.ocr = newOCR(os.Getenv("TESSERACT_PATH"), os.Getenv("TESSERACT_URL"), os.Getenv("OCR_LANG"), sandbox)
+	if fh.gs, err = newGhostscript(os.Getenv("GHOSTSCRIPT_PATH"), os.Getenv("PDFX_ICC_PROFILE"), os.Getenv("PDFX_OUTPUT_CONDITION"), sandbox); err != nil {
+		log.Fatal("Invalid PDF/X output profile:", err)
+	}
+	if fh.mergeBackends, err = loadMergeBackends(fh.resources, sandbox); err != nil {
+		log.Fatal("Invalid MERGE_BACKEND:", err)
+	}
+	if fh.releaseHook, err = loadReleaseHook(sandbox); err != nil {
+		log.Fatal("Invalid release hook:", err)
+	}
+	if path := os.Getenv("CONVERTER_PLUGINS"); path != "" {
+		if fh.plugins, err = loadConverterPlugins(path, sandbox); err != nil {
+			log.Fatal("Failed to load converter plugins:", err)
+		}
+		log.Printf("Loaded converter plugins for %s", strings.Join(fh.pluginExtensions(), ", "))
+	}
+	policy, err := loadCryptoPolicy()
+	if err != nil {
+		log.Fatal("Invalid crypto policy:", err)
+	}
+	if policy.fips || os.Getenv("CRYPTO_CIPHERS") != "" || policy.minRSABits > 0 {
+		log.Printf("Crypto policy: %s", policy)
+	}
+	if fh.signer, err = loadSigner(os.Getenv("SIGN_CERT"), os.Getenv("SIGN_CERT_PASSWORD"), policy); err != nil {
+		log.Fatal("Failed to load signing certificate:", err)
+	}
+	if fh.verifyURL = os.Getenv("VERIFY_URL"); fh.verifyURL != "" && !strings.Contains(fh.verifyURL, "{job}") {
+		log.Fatal("Invalid VERIFY_URL: it has no {job} for the job ID")
+	}
+	if dir := os.Getenv("FONT_DIR"); dir != "" {
+		if err := loadTextFonts(dir); err != nil {
+			log.Fatal("Failed to load fonts:", err)
+		}
+		log.Printf("Loaded %d fonts for generated text", len(textFonts))
+	}
+
+	// Other processes sharing the directories may be mid-request
+	workerOnly := len(os.Args) > 1 && os.Args[1] == "worker"
+	grace := time.Duration(0)
+	if workerOnly || os.Getenv("MODE") == "api" {
+		grace = orphanGrace
+	}
+	if err := fh.cleanOrphans(grace); err != nil {
+		log.Printf("Error cleaning up orphaned files: %v", err)
+	}
+	fh.requeueInterrupted(grace)
+
+	// "pdfmg worker" runs only the conversion/merge worker
+	if workerOnly {
+		log.Printf("Worker started")
+		fh.runWorker(context.Background())
+		return
+	}
+
+	// MODE=api leaves processing to separately started workers
+	if os.Getenv("MODE") != "api" {
+		go fh.runWorker(context.Background())
+	}
+
+	if path := os.Getenv("SCHEDULE_FILE"); path != "" {
+		schedules, err := loadSchedules(path)
+		if err != nil {
+			log.Fatal("Failed to load schedules:", err)
+		}
+		for _, s := range schedules {
+			if s.Destination != "" && fh.offline {
+				log.Fatalf("Failed to load schedules: schedule %q exports to %s, which is not available offline", s.Name, s.Destination)
+			}
+		}
+		if _, err := fh.startScheduler(schedules); err != nil {
+			log.Fatal("Failed to start scheduler:", err)
+		}
+		log.Printf("Scheduled %d recurring merges", len(schedules))
+	}
 
 	http.HandleFunc("/", fh.handleIndex)
-	http.HandleFunc("/upload", fh.handleUpload)
+	http.HandleFunc("/upload", fh.requireStorage(fh.limitActiveJobs(fh.handleUpload)))
 	http.HandleFunc("/download/", fh.handleDownload)
+	http.Handle("/static/", http.FileServer(http.FS(fh.web)))
+	http.HandleFunc("/api/v1/openapi.json", handleOpenAPI)
+	http.HandleFunc("/api/v1/jobs", fh.handleJobList)
+	http.HandleFunc("/api/v1/jobs/", fh.handleJob)
+	http.HandleFunc("/api/v1/batch", fh.requireStorage(fh.limitActiveJobs(fh.handleBatch)))
+	http.HandleFunc("/api/v1/sessions", fh.requireStorage(fh.handleUploadSessions))
+	http.HandleFunc("/api/v1/sessions/", fh.requireStorage(fh.handleUploadSessions))
+	http.HandleFunc("/collect/", fh.requireStorage(fh.handleCollect))
+	http.HandleFunc("/api/v1/forms/fill", fh.requireStorage(fh.handleFillForm))
+	http.HandleFunc("/api/v1/check", fh.requireStorage(fh.handleCheck))
+	http.HandleFunc("/api/v1/inspect", fh.requireStorage(fh.handleInspect))
+	http.HandleFunc("/api/v1/redact", fh.requireStorage(fh.handleRedact))
+	http.HandleFunc("/api/v1/diff", fh.requireStorage(fh.handleDiff))
+	http.HandleFunc("/api/v1/sanitize", fh.requireStorage(fh.handleSanitize))
+	http.HandleFunc("/api/v1/audit", fh.handleAudit)
+	http.HandleFunc("/api/v1/data", fh.handleDeleteUserData)
+	if fh.inboundMail != nil {
+		http.HandleFunc("/api/v1/inbound/email", fh.requireStorage(fh.handleInboundMail))
+	}
+	if fh.discord != nil {
+		http.HandleFunc("/api/v1/discord/interactions", fh.handleDiscordInteraction)
+	}
+	if fh.drive != nil {
+		http.HandleFunc("/auth/google", fh.drive.handleLogin)
+		http.HandleFunc("/auth/google/callback", fh.drive.handleCallback)
+	}
+	if fh.dropbox != nil {
+		http.HandleFunc("/auth/dropbox", fh.dropbox.handleLogin)
+		http.HandleFunc("/auth/dropbox/callback", fh.dropbox.handleCallback)
+	}
 
-	port := "8080"
+	// LISTEN takes precedence over PORT, which binds all interfaces
+	addr := ":8080"
 	if p := os.Getenv("PORT"); p != "" {
-		port = p
+		addr = ":" + p
+	}
+	if v := os.Getenv("LISTEN"); v != "" {
+		addr = v
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Printf("Open http://localhost:%s in your browser", port)
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		lis, err := net.Listen("tcp", ":"+grpcPort)
+		if err != nil {
+			log.Fatal("gRPC server failed to start:", err)
+		}
+		log.Printf("gRPC server starting on port %s", grpcPort)
+		go newGRPCServer(fh).Serve(lis)
+	}
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	l, err := listen(addr)
+	if err != nil {
 		log.Fatal("Server failed to start:", err)
 	}
+	log.Printf("Server starting on %s", l.Addr())
+	if tcp, ok := l.Addr().(*net.TCPAddr); ok {
+		log.Printf("Open http://localhost:%d%s/ in your browser", tcp.Port, fh.basePath)
+	}
+
+	// Routes are matched with the base path stripped
+	var handler http.Handler = http.DefaultServeMux
+	if fh.basePath != "" {
+		mux := http.NewServeMux()
+		mux.Handle(fh.basePath+"/", http.StripPrefix(fh.basePath, handler))
+		handler = mux
+	}
+	handler = withRequestID(withCompression(handler))
+	if err := http.Serve(l, handler); err != nil {
+		log.Fatal("Server failed:", err)
+	}
 }
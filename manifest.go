@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Largest factor manifest entries may scale pages by
+const maxPageScale = 10
+
+// ManifestEntry places pages of an uploaded file in the output of a merge.
+// Scale resizes them by a factor, or Fit to a paper size, A4 or letter.
+// Position is the 1-based place of the entry in the output; entries without
+// one fill the places left in manifest order.
+type ManifestEntry struct {
+	File     string  `json:"file"`
+	Pages    string  `json:"pages,omitempty"`
+	Rotate   int     `json:"rotate,omitempty"`
+	Scale    float64 `json:"scale,omitempty"`
+	Fit      string  `json:"fit,omitempty"`
+	Bookmark string  `json:"bookmark,omitempty"`
+	Position int     `json:"position,omitempty"`
+}
+
+// manifestFiles returns the files of a job as the manifest of an upload
+// lays them out, in output order. Every entry names one of the uploaded
+// files, which may be used by several entries, and every upload must be
+// used.
+func manifestFiles(manifest string, files []spooledFile) ([]JobFile, error) {
+	var entries []ManifestEntry
+	if err := json.Unmarshal([]byte(manifest), &entries); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no entries")
+	}
+
+	uploads := map[string]spooledFile{}
+	for _, f := range files {
+		if _, ok := uploads[f.name]; ok {
+			return nil, fmt.Errorf("duplicate file name %s", f.name)
+		}
+		uploads[f.name] = f
+	}
+
+	placed := make([]*JobFile, len(entries))
+	var rest []*JobFile
+	used := map[string]bool{}
+	for i, e := range entries {
+		f, ok := uploads[e.File]
+		if !ok {
+			return nil, fmt.Errorf("entry %d: no uploaded file named %s", i+1, e.File)
+		}
+		used[e.File] = true
+		if e.Pages != "" {
+			if _, err := api.ParsePageSelection(e.Pages); err != nil {
+				return nil, fmt.Errorf("entry %d: invalid pages: %v", i+1, err)
+			}
+		}
+		if e.Rotate%90 != 0 {
+			return nil, fmt.Errorf("entry %d: invalid rotate: %d (expected a multiple of 90)", i+1, e.Rotate)
+		}
+		if e.Scale < 0 || e.Scale > maxPageScale {
+			return nil, fmt.Errorf("entry %d: invalid scale: %g (expected up to %d)", i+1, e.Scale, maxPageScale)
+		}
+		if _, ok := paperSizes[e.Fit]; e.Fit != "" && !ok {
+			return nil, fmt.Errorf("entry %d: invalid fit: %s (expected %s or %s)", i+1, e.Fit, NormalizeA4, NormalizeLetter)
+		}
+		if e.Fit != "" && e.Scale != 0 {
+			return nil, fmt.Errorf("entry %d: scale and fit exclude each other", i+1)
+		}
+
+		file := &JobFile{Name: f.name, Path: f.path, SHA256: f.sha256, PageRange: e.Pages,
+			Rotate: (e.Rotate%360 + 360) % 360, Scale: e.Scale, Fit: e.Fit, Bookmark: e.Bookmark}
+		if e.Scale == 1 {
+			file.Scale = 0
+		}
+		switch {
+		case e.Position == 0:
+			rest = append(rest, file)
+		case e.Position < 0 || e.Position > len(entries):
+			return nil, fmt.Errorf("entry %d: invalid position: %d (expected 1 to %d)", i+1, e.Position, len(entries))
+		case placed[e.Position-1] != nil:
+			return nil, fmt.Errorf("entry %d: position %d is taken", i+1, e.Position)
+		default:
+			placed[e.Position-1] = file
+		}
+	}
+	for _, f := range files {
+		if !used[f.name] {
+			return nil, fmt.Errorf("%s is not in the manifest", f.name)
+		}
+	}
+
+	jobFiles := make([]JobFile, len(entries))
+	for i, f := range placed {
+		if f == nil {
+			f, rest = rest[0], rest[1:]
+		}
+		jobFiles[i] = *f
+	}
+	return jobFiles, nil
+}
+
+// hasLayout reports whether a manifest gave any of files pages, a rotation,
+// a scale, a size to fit or a bookmark title
+func hasLayout(files []JobFile) bool {
+	for _, f := range files {
+		if f.PageRange != "" || f.Rotate != 0 || f.Scale != 0 || f.Fit != "" || f.Bookmark != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// selectPages writes the pages of the PDF at in that selection picks to out,
+// and returns their numbers
+func selectPages(in, out, selection string) ([]int, error) {
+	n, err := api.PageCountFile(in)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := api.PagesForPageSelection(n, pageSelection(selection), true, true)
+	if err != nil {
+		return nil, err
+	}
+	var pages []int
+	for page := 1; page <= n; page++ {
+		if selected[page] {
+			pages = append(pages, page)
+		}
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no pages %s of %d", selection, n)
+	}
+	return pages, extractPages(in, out, pages)
+}
+
+// titleBookmarks renames the bookmarks merging gave the files of a job once
+// the manifest titles any, the others after their uploads. They are named
+// after the base names of paths, the PDFs merged in file order.
+func titleBookmarks(path string, job *Job, paths []string) error {
+	titled := false
+	for _, f := range job.Files {
+		titled = titled || f.Bookmark != ""
+	}
+	if !titled {
+		return nil
+	}
+	// Skipped files have no PDF among paths
+	titles := map[string]string{}
+	next := 0
+	for _, f := range job.Files {
+		if f.Error == "" && next < len(paths) {
+			titles[filepath.Base(paths[next])] = fileTitle(f)
+			next++
+		}
+	}
+
+	return transformPDF(path, func(in, out string) error {
+		ctx, err := readContext(in)
+		if err != nil {
+			return err
+		}
+		outlines, err := ctx.DereferenceDict(ctx.RootDict["Outlines"])
+		if err != nil || outlines == nil {
+			return api.WriteContextFile(ctx, out)
+		}
+		seen := map[int]bool{}
+		for ref := outlines.IndirectRefEntry("First"); ref != nil && !seen[ref.ObjectNumber.Value()]; {
+			seen[ref.ObjectNumber.Value()] = true
+			item, err := ctx.DereferenceDict(*ref)
+			if err != nil || item == nil {
+				return err
+			}
+			if name, err := model.Text(item["Title"]); err == nil && titles[name] != "" {
+				s, err := types.EscapeUTF16String(titles[name])
+				if err != nil {
+					return err
+				}
+				item["Title"] = types.StringLiteral(*s)
+			}
+			ref = item.IndirectRefEntry("Next")
+		}
+		return api.WriteContextFile(ctx, out)
+	})
+}
+
+// fileTitle returns the bookmark title of a file, by default its name
+func fileTitle(f JobFile) string {
+	if f.Bookmark != "" {
+		return f.Bookmark
+	}
+	return f.Name
+}
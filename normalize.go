@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Page sizes pages can be normalized to
+const (
+	NormalizeA4     = "A4"
+	NormalizeLetter = "letter"
+	// NormalizeMax uses the size of the largest page
+	NormalizeMax = "max"
+)
+
+// Portrait sizes of the paper formats, in points
+var paperSizes = map[string]types.Dim{
+	NormalizeA4:     {Width: 595.28, Height: 841.89},
+	NormalizeLetter: {Width: 612, Height: 792},
+}
+
+// normalizeSize returns the portrait size the pages of the PDF at path are
+// normalized to
+func normalizeSize(path, normalize string) (types.Dim, error) {
+	if size, ok := paperSizes[normalize]; ok {
+		return size, nil
+	}
+
+	ctx, err := readContext(path)
+	if err != nil {
+		return types.Dim{}, fmt.Errorf("error reading PDF: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return types.Dim{}, err
+	}
+	var size types.Dim
+	for page := 1; page <= ctx.PageCount; page++ {
+		_, _, inherited, err := ctx.PageDict(page, false)
+		if err != nil {
+			return types.Dim{}, err
+		}
+		box := visibleBox(inherited)
+		if box == nil {
+			continue
+		}
+		short, long := math.Min(box.Width(), box.Height()), math.Max(box.Width(), box.Height())
+		size.Width, size.Height = math.Max(size.Width, short), math.Max(size.Height, long)
+	}
+	if size.Width == 0 {
+		return types.Dim{}, fmt.Errorf("no page sizes found")
+	}
+	return size, nil
+}
+
+// visibleBox returns the crop box of a page, which defaults to its media box
+func visibleBox(inherited *model.InheritedPageAttrs) *types.Rectangle {
+	if inherited.CropBox != nil {
+		return inherited.CropBox
+	}
+	return inherited.MediaBox
+}
+
+// normalizePDF writes the PDF at in to out with its pages, or only the
+// selected ones, scaled to fit and centred on pages of the given portrait
+// size. Landscape pages get landscape pages of that size.
+func normalizePDF(in, out string, size types.Dim, selected types.IntSet) error {
+	ctx, err := readContext(in)
+	if err != nil {
+		return fmt.Errorf("error reading PDF: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+
+	// Annotations are moved once, even if listed on several pages
+	moved := map[int]bool{}
+	for page := 1; page <= ctx.PageCount; page++ {
+		if selected != nil && !selected[page] {
+			continue
+		}
+		if err := normalizePage(ctx, page, size, moved); err != nil {
+			return fmt.Errorf("error resizing page %d: %v", page, err)
+		}
+	}
+	return api.WriteContextFile(ctx, out)
+}
+
+func normalizePage(ctx *model.Context, page int, size types.Dim, moved map[int]bool) error {
+	pageDict, _, inherited, err := ctx.PageDict(page, false)
+	if err != nil {
+		return err
+	}
+	box := visibleBox(inherited)
+	if box == nil || box.Width() <= 0 || box.Height() <= 0 {
+		return nil
+	}
+
+	// The orientation is judged on the unrotated page, so rotated pages
+	// keep theirs when displayed
+	width, height := size.Width, size.Height
+	if box.Width() > box.Height() {
+		width, height = height, width
+	}
+	if math.Abs(box.Width()-width) < 0.5 && math.Abs(box.Height()-height) < 0.5 && box.LL.X == 0 && box.LL.Y == 0 {
+		return nil
+	}
+
+	scale := math.Min(width/box.Width(), height/box.Height())
+	m := matrix{scale, 0, 0, scale,
+		(width-box.Width()*scale)/2 - box.LL.X*scale,
+		(height-box.Height()*scale)/2 - box.LL.Y*scale}
+	return transformPage(ctx, pageDict, box, m, width, height, moved)
+}
+
+// transformPage draws the visible box of a page transformed by m on a page
+// of width by height, moving its annotations along
+func transformPage(ctx *model.Context, pageDict types.Dict, box *types.Rectangle, m matrix, width, height float64, moved map[int]bool) error {
+	// What lay outside the crop box stays hidden in the added margins
+	before := fmt.Sprintf("q %.5f 0 0 %.5f %.5f %.5f cm %.2f %.2f %.2f %.2f re W n\n",
+		m[0], m[3], m[4], m[5], box.LL.X, box.LL.Y, box.Width(), box.Height())
+	if err := wrapContents(ctx.XRefTable, pageDict, []byte(before), []byte("Q\n")); err != nil {
+		return err
+	}
+
+	pageDict["MediaBox"] = types.RectForDim(width, height).Array()
+	for _, key := range []string{"CropBox", "BleedBox", "TrimBox", "ArtBox"} {
+		delete(pageDict, key)
+	}
+	return moveAnnotations(ctx.XRefTable, pageDict, m, moved)
+}
+
+// scalePDF writes the PDF at in to out with its pages and their content
+// scaled by factor
+func scalePDF(in, out string, factor float64) error {
+	ctx, err := readContext(in)
+	if err != nil {
+		return fmt.Errorf("error reading PDF: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+
+	moved := map[int]bool{}
+	for page := 1; page <= ctx.PageCount; page++ {
+		pageDict, _, inherited, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		box := visibleBox(inherited)
+		if box == nil || box.Width() <= 0 || box.Height() <= 0 {
+			continue
+		}
+		m := matrix{factor, 0, 0, factor, -box.LL.X * factor, -box.LL.Y * factor}
+		if err := transformPage(ctx, pageDict, box, m, box.Width()*factor, box.Height()*factor, moved); err != nil {
+			return fmt.Errorf("error scaling page %d: %v", page, err)
+		}
+	}
+	return api.WriteContextFile(ctx, out)
+}
+
+// moveAnnotations transforms the positions of the annotations of a page by m
+func moveAnnotations(xRefTable *model.XRefTable, pageDict types.Dict, m matrix, moved map[int]bool) error {
+	annots, err := xRefTable.DereferenceArray(pageDict["Annots"])
+	if err != nil {
+		return err
+	}
+	for _, obj := range annots {
+		if ref, ok := obj.(types.IndirectRef); ok {
+			if moved[ref.ObjectNumber.Value()] {
+				continue
+			}
+			moved[ref.ObjectNumber.Value()] = true
+		}
+		annot, err := xRefTable.DereferenceDict(obj)
+		if err != nil || annot == nil {
+			continue
+		}
+
+		if rect, err := xRefTable.RectForArray(annot.ArrayEntry("Rect")); err == nil && rect != nil {
+			annot["Rect"] = transformBox(m, rect.LL.X, rect.LL.Y, rect.UR.X, rect.UR.Y).Array()
+		}
+		// Markup annotations also give the points they are drawn along
+		for _, key := range []string{"QuadPoints", "L", "Vertices", "CL"} {
+			if points, err := xRefTable.DereferenceArray(annot[key]); err == nil && points != nil {
+				annot[key] = transformPoints(xRefTable, points, m)
+			}
+		}
+		if ink, err := xRefTable.DereferenceArray(annot["InkList"]); err == nil && ink != nil {
+			paths := types.Array{}
+			for _, p := range ink {
+				points, err := xRefTable.DereferenceArray(p)
+				if err != nil || points == nil {
+					continue
+				}
+				paths = append(paths, transformPoints(xRefTable, points, m))
+			}
+			annot["InkList"] = paths
+		}
+	}
+	return nil
+}
+
+// transformPoints maps an array of x, y coordinates by m
+func transformPoints(xRefTable *model.XRefTable, points types.Array, m matrix) types.Array {
+	out := make(types.Array, 0, len(points))
+	for i := 0; i+1 < len(points); i += 2 {
+		x, err1 := xRefTable.DereferenceNumber(points[i])
+		y, err2 := xRefTable.DereferenceNumber(points[i+1])
+		if err1 != nil || err2 != nil {
+			return points
+		}
+		x, y = m.apply(x, y)
+		out = append(out, types.Float(x), types.Float(y))
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// Notifier posts job results to Slack or Microsoft Teams incoming webhooks.
+// Both accept a JSON payload with a "text" field.
+type Notifier struct {
+	webhookURLs []string
+	publicURL   string
+	client      *http.Client
+}
+
+// NewNotifier returns a notifier for the comma-separated webhook URLs, or
+// nil when urls is empty. publicURL is prepended to download links.
+func NewNotifier(urls, publicURL string) *Notifier {
+	var webhooks []string
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			webhooks = append(webhooks, u)
+		}
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	return &Notifier{
+		webhookURLs: webhooks,
+		publicURL:   strings.TrimSuffix(publicURL, "/"),
+		client:      newHTTPClient(10 * time.Second),
+	}
+}
+
+// JobFinished announces a done or failed job
+func (n *Notifier) JobFinished(job *Job) {
+	if n == nil {
+		return
+	}
+
+	name := job.Name
+	if name == "" {
+		name = "Job " + job.ID
+	}
+
+	var text string
+	if job.Status == JobDone && job.Options.MaxPagesPerFile > 0 {
+		var volumes int
+		if zr, err := zip.OpenReader(job.OutputPath); err != nil {
+			log.Printf("Error counting volumes of job %s: %v", job.ID, err)
+		} else {
+			volumes = len(zr.File)
+			zr.Close()
+		}
+		text = fmt.Sprintf("✅ %s merged %d files into %d volumes: %s/download/%s",
+			name, len(job.Files), volumes, n.publicURL, filepath.Base(job.OutputPath))
+	} else if job.Status == JobDone {
+		pages, err := api.PageCountFile(job.OutputPath)
+		if err != nil {
+			log.Printf("Error counting pages of job %s: %v", job.ID, err)
+		}
+		text = fmt.Sprintf("✅ %s merged %d files into %d pages: %s/download/%s",
+			name, len(job.Files), pages, n.publicURL, filepath.Base(job.OutputPath))
+	} else {
+		text = fmt.Sprintf("❌ %s failed: %s", name, job.Error)
+	}
+
+	body, _ := json.Marshal(map[string]string{"text": text})
+	for _, u := range n.webhookURLs {
+		req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error sending notification for job %s: %v", job.ID, err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if job.RequestID != "" {
+			req.Header.Set(requestIDHeader, job.RequestID)
+		}
+		resp, err := n.client.Do(req)
+		if err != nil {
+			log.Printf("Error sending notification for job %s: %v", job.ID, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Notification webhook for job %s returned %s", job.ID, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionCookie = "pdfmg_session"
+
+// oauthProvider implements the OAuth 2.0 authorization code flow for a
+// cloud storage provider. Access tokens are kept per browser session.
+type oauthProvider struct {
+	name         string
+	authURL      string
+	tokenURL     string
+	scope        string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	// Where the browser returns to once connected
+	homeURL     string
+	extraParams url.Values
+
+	sessions *sessionTokens
+}
+
+// sessionTokens holds OAuth access tokens per browser session and provider
+type sessionTokens struct {
+	mu     sync.Mutex
+	tokens map[string]map[string]string
+}
+
+func newSessionTokens() *sessionTokens {
+	return &sessionTokens{tokens: make(map[string]map[string]string)}
+}
+
+func (s *sessionTokens) get(r *http.Request, provider string) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[c.Value][provider]
+}
+
+func (s *sessionTokens) set(w http.ResponseWriter, r *http.Request, provider, token string) {
+	session := ""
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		session = c.Value
+	} else {
+		session = randomHex(16)
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: session, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens[session] == nil {
+		s.tokens[session] = make(map[string]string)
+	}
+	s.tokens[session][provider] = token
+}
+
+// handleLogin redirects the browser to the provider's consent screen
+func (p *oauthProvider) handleLogin(w http.ResponseWriter, r *http.Request) {
+	state := randomHex(8)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "pdfmg_oauth_state",
+		Value:    state,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURL},
+		"state":         {state},
+	}
+	if p.scope != "" {
+		q.Set("scope", p.scope)
+	}
+	for k, v := range p.extraParams {
+		q[k] = v
+	}
+	http.Redirect(w, r, p.authURL+"?"+q.Encode(), http.StatusFound)
+}
+
+// handleCallback exchanges the authorization code for an access token
+func (p *oauthProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	state, err := r.Cookie("pdfmg_oauth_state")
+	if err != nil || state.Value == "" || state.Value != r.URL.Query().Get("state") {
+		writeError(w, "Invalid OAuth state", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		writeError(w, "Authorization failed: "+e, CodeImportFailed, http.StatusBadRequest)
+		return
+	}
+
+	token, err := p.exchange(r.URL.Query().Get("code"))
+	if err != nil {
+		writeError(w, "Error obtaining access token: "+err.Error(), CodeImportFailed, http.StatusBadGateway)
+		return
+	}
+
+	p.sessions.set(w, r, p.name, token)
+	http.Redirect(w, r, p.homeURL, http.StatusFound)
+}
+
+func (p *oauthProvider) exchange(code string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+	}
+
+	client := newHTTPClient(30 * time.Second)
+	resp, err := client.Post(p.tokenURL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("%s token endpoint returned %s %s", p.name, resp.Status, tok.Error)
+	}
+	return tok.AccessToken, nil
+}
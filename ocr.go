@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// ocrEngine adds an invisible text layer to scanned pages with Tesseract,
+// either through the local binary or an HTTP service wrapping it
+type ocrEngine struct {
+	path    string
+	url     string
+	lang    string
+	client  *http.Client
+	sandbox *sandbox
+}
+
+// newOCR returns an OCR engine, or nil when neither a Tesseract URL nor a
+// binary (given or found in PATH) is available. The binary is run in sb.
+func newOCR(path, serviceURL, lang string, sb *sandbox) *ocrEngine {
+	if path == "" && serviceURL == "" {
+		found, err := exec.LookPath("tesseract")
+		if err != nil {
+			return nil
+		}
+		path = found
+	}
+	if lang == "" {
+		lang = "eng"
+	}
+
+	return &ocrEngine{
+		path:    path,
+		url:     serviceURL,
+		lang:    lang,
+		client:  newHTTPClient(5 * time.Minute),
+		sandbox: sb,
+	}
+}
+
+// recognize turns an image into a one-page searchable PDF at out, with the
+// page sized for the given resolution
+func (o *ocrEngine) recognize(imagePath, out string, dpi int) error {
+	if o.url != "" {
+		return o.recognizeRemote(imagePath, out, dpi)
+	}
+
+	imagePath, err := filepath.Abs(imagePath)
+	if err != nil {
+		return err
+	}
+	if out, err = filepath.Abs(out); err != nil {
+		return err
+	}
+	// Tesseract appends .pdf to the output base itself
+	output, err := o.sandbox.run(o.path, imagePath, strings.TrimSuffix(out, ".pdf"),
+		"--dpi", strconv.Itoa(dpi), "-l", o.lang, "pdf")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("tesseract failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// recognizeRemote posts the image to the OCR service, which responds with
+// the searchable PDF
+func (o *ocrEngine) recognizeRemote(imagePath, out string, dpi int) error {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	query := url.Values{"lang": {o.lang}, "dpi": {strconv.Itoa(dpi)}}
+	req, err := http.NewRequest(http.MethodPost, o.url+"?"+query.Encode(), f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling OCR service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("OCR service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, err = saveStream(resp.Body, out)
+	return err
+}
+
+// ocrFile converts file to a searchable PDF. Images are recognized as a
+// whole, after preparing them as the options ask; PDFs get a text layer on
+// their image-only pages.
+func (fh *FileHandler) ocrFile(file JobFile, opts MergeOptions) (string, error) {
+	ext := strings.ToLower(filepath.Ext(file.Name))
+	switch ext {
+	case ".pdf":
+		return file.Path, fh.ocrPDF(file.Path)
+	case ".png", ".jpg", ".jpeg":
+	default:
+		// Files converted by plugins are recognized as PDFs
+		path, err := fh.convertToPDF(file.Path, file.Name, opts)
+		if err != nil {
+			return "", err
+		}
+		return path, fh.ocrPDF(path)
+	}
+	if opts.Deskew || opts.AutoCrop || enhancesImages(opts) {
+		if err := prepareImageFile(file.Path, opts); err != nil {
+			return "", err
+		}
+	}
+
+	cfg, err := decodeImageConfig(file.Path)
+	if err != nil {
+		return "", fmt.Errorf("error opening image: %v", err)
+	}
+
+	// Size the page to fit A4 with margins (7.5 x 10.9 inches)
+	dpi := 72
+	if d := int(float64(cfg.Width)/7.48 + 1); d > dpi {
+		dpi = d
+	}
+	if d := int(float64(cfg.Height)/10.9 + 1); d > dpi {
+		dpi = d
+	}
+
+	pdfPath := strings.TrimSuffix(file.Path, filepath.Ext(file.Path)) + ".pdf"
+	if err := fh.ocr.recognize(file.Path, pdfPath, dpi); err != nil {
+		return "", err
+	}
+	os.Remove(file.Path)
+	return pdfPath, nil
+}
+
+// ocrPDF replaces the image-only pages of the PDF at path with recognized
+// copies of their scanned image
+func (fh *FileHandler) ocrPDF(path string) error {
+	dir, err := os.MkdirTemp(fh.scratchDir, "ocr_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := api.ExtractContent(bytes.NewReader(data), dir, "page", nil, pdfConfig()); err != nil {
+		return fmt.Errorf("error reading page content: %v", err)
+	}
+	dims, err := api.PageDimsFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading page sizes: %v", err)
+	}
+
+	recognized := make(map[int]string)
+	for i, dim := range dims {
+		page := i + 1
+		content, _ := os.ReadFile(filepath.Join(dir, fmt.Sprintf("page_Content_page_%d.txt", page)))
+		if bytes.Contains(content, []byte("Tj")) || bytes.Contains(content, []byte("TJ")) {
+			continue
+		}
+
+		img, err := largestPageImage(data, page)
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			continue
+		}
+
+		imagePath := filepath.Join(dir, fmt.Sprintf("scan_%d.%s", page, img.FileType))
+		if _, err := saveStream(img, imagePath); err != nil {
+			return err
+		}
+
+		// Keep the page size: the scan spans the page width
+		dpi := 300
+		if w := imageWidth(imagePath); w > 0 {
+			dpi = int(float64(w)/(dim.Width/72) + 0.5)
+		}
+		out := filepath.Join(dir, fmt.Sprintf("ocr_%d.pdf", page))
+		if err := fh.ocr.recognize(imagePath, out, dpi); err != nil {
+			return fmt.Errorf("error recognizing page %d: %v", page, err)
+		}
+		recognized[page] = out
+	}
+	if len(recognized) == 0 {
+		return nil
+	}
+
+	// Reassemble the document from its original and recognized pages
+	if err := api.ExtractPages(bytes.NewReader(data), dir, "page", nil, pdfConfig()); err != nil {
+		return fmt.Errorf("error splitting pages: %v", err)
+	}
+	var pages []string
+	for page := 1; page <= len(dims); page++ {
+		if out, ok := recognized[page]; ok {
+			pages = append(pages, out)
+		} else {
+			pages = append(pages, filepath.Join(dir, fmt.Sprintf("page_page_%d.pdf", page)))
+		}
+	}
+	return transformPDF(path, func(in, out string) error {
+		return api.MergeCreateFile(pages, out, false, pdfConfig())
+	})
+}
+
+func decodeImageConfig(path string) (image.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	return cfg, err
+}
+
+// imageWidth returns the pixel width of an image file, or 0 if it cannot be
+// decoded
+func imageWidth(path string) int {
+	cfg, err := decodeImageConfig(path)
+	if err != nil {
+		return 0
+	}
+	return cfg.Width
+}
+
+// largestPageImage returns the biggest image on a page, which for a scan is
+// the scanned page itself, or nil if the page has no images
+func largestPageImage(data []byte, page int) (*model.Image, error) {
+	images, err := api.ExtractImagesRaw(bytes.NewReader(data), []string{strconv.Itoa(page)}, pdfConfig())
+	if err != nil {
+		return nil, fmt.Errorf("error reading images of page %d: %v", page, err)
+	}
+
+	var largest *model.Image
+	for _, m := range images {
+		for _, img := range m {
+			img := img
+			if largest == nil || img.Size > largest.Size {
+				largest = &img
+			}
+		}
+	}
+	return largest, nil
+}
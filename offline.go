@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// networkSettings are the variables turning on features that connect to
+// other hosts, which the server refuses to start with offline
+var networkSettings = []struct {
+	name    string
+	feature string
+}{
+	{"NOTIFY_WEBHOOK_URL", "notifications post to webhooks"},
+	{"TESSERACT_URL", "OCR uses a remote service"},
+	{"GOOGLE_CLIENT_ID", "Google Drive imports and exports"},
+	{"DROPBOX_APP_KEY", "Dropbox imports and exports"},
+	{"SMTP_ADDR", "inbound email is replied to through an SMTP server"},
+	{"DISCORD_PUBLIC_KEY", "the Discord bot downloads attachments from Discord and replies to it"},
+	{"RELEASE_HOOK_URL", "outputs are posted to a release hook"},
+}
+
+// loadOffline reads OFFLINE, which set to true guarantees that the server
+// connects to no other host, for air-gapped sites: features needing the
+// network are refused, and converters only run isolated from it. Settings
+// of such features are an error rather than silently ignored.
+func loadOffline() (bool, error) {
+	v := os.Getenv("OFFLINE")
+	if v == "" {
+		return false, nil
+	}
+	offline, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid OFFLINE: %s", v)
+	}
+	if !offline {
+		return false, nil
+	}
+	for _, s := range networkSettings {
+		if os.Getenv(s.name) != "" {
+			return false, fmt.Errorf("%s needs the network: %s", s.name, s.feature)
+		}
+	}
+	if network, _ := strconv.ParseBool(os.Getenv("CONVERTER_NETWORK")); network {
+		return false, errors.New("CONVERTER_NETWORK gives converters network access")
+	}
+	return true, nil
+}
+
+// offlineError is the error of a feature refused offline
+func offlineError(feature string) error {
+	return withCode(CodeNotAvailable, fmt.Errorf("%s is not available offline", feature))
+}
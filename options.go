@@ -0,0 +1,522 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// Merge modes
+const (
+	ModeMerge      = "merge"
+	ModeInterleave = "interleave"
+)
+
+// What the worker does with files it fails to convert
+const (
+	OnErrorFail = "fail"
+	OnErrorSkip = "skip"
+)
+
+// MergeOptions control how the files of a job are combined. They are parsed
+// from the upload form and stored with the job for the worker.
+type MergeOptions struct {
+	Mode string `json:"mode,omitempty"`
+	// ReverseSecond reverses the second file before interleaving, for back
+	// sides scanned last page first
+	ReverseSecond bool `json:"reverseSecond,omitempty"`
+	// OnError is "skip" to merge the files that convert and leave out the
+	// ones that fail, instead of failing the job
+	OnError string `json:"onError,omitempty"`
+	// OCR adds a text layer to images and scanned PDF pages
+	OCR bool `json:"ocr,omitempty"`
+	// FormValues fill the form fields of the uploaded PDFs by name
+	FormValues map[string]any `json:"formValues,omitempty"`
+	// FlattenForms draws form field values into the page content
+	FlattenForms bool `json:"flattenForms,omitempty"`
+	// RemoveAnnotations drops comments and markup from the uploaded PDFs
+	RemoveAnnotations bool `json:"removeAnnotations,omitempty"`
+	// Sanitize removes scripts, launch actions and executable embedded
+	// files from the uploaded PDFs
+	Sanitize bool `json:"sanitize,omitempty"`
+	// AttachSources embeds the original uploads in the merged PDF
+	AttachSources bool `json:"attachSources,omitempty"`
+
+	// ImageDPI downsamples converted images to at most this resolution at
+	// their size on the page, and ImageQuality stores them as JPEG of this
+	// quality (1-100) instead of lossless PNG
+	ImageDPI     int `json:"imageDpi,omitempty"`
+	ImageQuality int `json:"imageQuality,omitempty"`
+	// ImageBackground is the "#rrggbb" color transparent areas of images
+	// are drawn on, white by default
+	ImageBackground string `json:"imageBackground,omitempty"`
+	// Deskew turns scanned images and image-only PDF pages upright and
+	// straightens their text lines
+	Deskew bool `json:"deskew,omitempty"`
+	// AutoCrop trims the white borders of images before fitting them to
+	// the page
+	AutoCrop bool `json:"autoCrop,omitempty"`
+	// SplitTallImages cuts images much taller than the page, such as
+	// screenshots of whole chats, across pages at the scale that fits
+	// their width, repeating SplitOverlap mm of each page on the next
+	SplitTallImages bool `json:"splitTallImages,omitempty"`
+	SplitOverlap    int  `json:"splitOverlap,omitempty"`
+	// FullBleed makes images fill their page to its edges and Bleed mm
+	// beyond, to be trimmed to A4 by the cut marks of CutMarks
+	FullBleed bool `json:"fullBleed,omitempty"`
+	Bleed     int  `json:"bleed,omitempty"`
+	// TagImages tags converted images as figures, so they are part of the
+	// structure of a tagged PDF. AltText describes them by upload position;
+	// images without one are described by their file name.
+	TagImages bool     `json:"tagImages,omitempty"`
+	AltText   []string `json:"altText,omitempty"`
+	// Enhance is a preset of image adjustments, "document" or "photo", that
+	// Brightness and Contrast (-100 to 100) and Sharpen (0 to 10) add to
+	Enhance    string `json:"enhance,omitempty"`
+	Brightness int    `json:"brightness,omitempty"`
+	Contrast   int    `json:"contrast,omitempty"`
+	Sharpen    int    `json:"sharpen,omitempty"`
+
+	// Crop is "auto" to trim the whitespace around the content, or the
+	// margins to cut off in mm. It applies to the selected pages of the
+	// selected uploads, by default all of them.
+	Crop      string `json:"crop,omitempty"`
+	CropFiles string `json:"cropFiles,omitempty"`
+	CropPages string `json:"cropPages,omitempty"`
+
+	// Normalize scales all pages to one size: A4, letter, or max for the
+	// largest page size
+	Normalize string `json:"normalize,omitempty"`
+
+	// Overlay is the stored path of a PDF whose first page is stamped under
+	// or over the selected pages of the output
+	Overlay         string `json:"overlay,omitempty"`
+	OverlayPosition string `json:"overlayPosition,omitempty"`
+	OverlayPages    string `json:"overlayPages,omitempty"`
+
+	// NUp imposes the output 2 or 4 pages to a sheet of NUpSheet, A3 by
+	// default, for printing handouts. CutMarks marks the corners of the
+	// pages on the sheets, or else of full-bleed images.
+	NUp      int    `json:"nUp,omitempty"`
+	NUpSheet string `json:"nUpSheet,omitempty"`
+	CutMarks bool   `json:"cutMarks,omitempty"`
+
+	// StampSource prints the originating file name in a corner of each page
+	StampSource      bool   `json:"stampSource,omitempty"`
+	StampPageNumbers bool   `json:"stampPageNumbers,omitempty"`
+	StampPosition    string `json:"stampPosition,omitempty"`
+
+	// QRStamp puts a QR code linking to the verification URL of the job,
+	// or holding its ID, on the "first" page or on "all" of them, in the
+	// QRPosition corner
+	QRStamp    string `json:"qrStamp,omitempty"`
+	QRPosition string `json:"qrPosition,omitempty"`
+
+	// PageLabels is "renumber" to number the pages of the output from 1
+	// instead of keeping the page labels of the uploads
+	PageLabels string `json:"pageLabels,omitempty"`
+
+	// XMP is what becomes of the XMP metadata of the uploads: "drop" it,
+	// take that of the "first" upload, the default, or "synthesize" a new
+	// packet listing the uploads
+	XMP string `json:"xmp,omitempty"`
+
+	// Lang is the language of the output, such as "en-US", and the others
+	// how viewers open it: PageLayout shows "single" pages, "continuous"
+	// ones, "two-up" or "two-up-continuous"; Zoom fits the page opened on
+	// to the window, "fit-page" or "fit-width"; OpenPage is that page, from
+	// 1; and BookmarksPanel is "show" or "hide"
+	Lang           string `json:"lang,omitempty"`
+	PageLayout     string `json:"pageLayout,omitempty"`
+	Zoom           string `json:"zoom,omitempty"`
+	OpenPage       int    `json:"openPage,omitempty"`
+	BookmarksPanel string `json:"bookmarksPanel,omitempty"`
+
+	// CMYK converts the colors and images of the output to CMYK with the
+	// ICC profile at ICCProfile, the stored path of an uploaded one, else
+	// with the server's. PDF/X output is converted with it too.
+	CMYK       bool   `json:"cmyk,omitempty"`
+	ICCProfile string `json:"iccProfile,omitempty"`
+
+	// PDFX makes the output print-ready PDF/X, "1a" for PDF/X-1a or "4"
+	// for PDF/X-4
+	PDFX string `json:"pdfx,omitempty"`
+
+	// Cover, when set, is rendered as a first page before the merged files
+	Cover *CoverPage `json:"cover,omitempty"`
+
+	// MaxPagesPerFile splits the merged PDF into volumes of at most this
+	// many pages of the uploads, each led by an index of the volumes
+	MaxPagesPerFile int `json:"maxPagesPerFile,omitempty"`
+
+	// Separators puts a sheet with a "code128" or "qr" barcode of
+	// SeparatorValue between the uploads, for scanners to split the bundle
+	// at; {n} in the value stands for the number of the upload that follows
+	Separators     string `json:"separators,omitempty"`
+	SeparatorValue string `json:"separatorValue,omitempty"`
+
+	// Sign adds a digital signature with the server's certificate
+	Sign        bool   `json:"sign,omitempty"`
+	SignVisible bool   `json:"signVisible,omitempty"`
+	SignReason  string `json:"signReason,omitempty"`
+	// SignedManifest writes a manifest of the inputs, options and output,
+	// signed with the server's certificate, next to the output
+	SignedManifest bool `json:"signedManifest,omitempty"`
+
+	// LargeFiles merges the files without reading them into memory, for
+	// uploads of several gigabytes. Only the pages are kept, and the
+	// options that rework documents are not available.
+	LargeFiles bool `json:"largeFiles,omitempty"`
+
+	// Portfolio embeds the converted files whole in a PDF portfolio, which
+	// viewers show as a list of the documents, instead of merging their
+	// pages. The options that work on merged pages are not available.
+	Portfolio bool `json:"portfolio,omitempty"`
+}
+
+// parseMergeOptions reads the merge options from the form of r
+func parseMergeOptions(r *http.Request) (MergeOptions, error) {
+	var opts MergeOptions
+	var err error
+
+	opts.Mode = r.FormValue("mode")
+	switch opts.Mode {
+	case "", ModeMerge, ModeInterleave:
+	default:
+		return opts, fmt.Errorf("unknown mode: %s", opts.Mode)
+	}
+
+	if opts.ReverseSecond, err = formBool(r, "reverse_second"); err != nil {
+		return opts, err
+	}
+	opts.OnError = r.FormValue("on_error")
+	switch opts.OnError {
+	case "", OnErrorFail, OnErrorSkip:
+	default:
+		return opts, fmt.Errorf("invalid on_error: %s (expected %s or %s)", opts.OnError, OnErrorFail, OnErrorSkip)
+	}
+	// Interleaving pairs the pages of both files
+	if opts.OnError == OnErrorSkip && opts.Mode == ModeInterleave {
+		return opts, fmt.Errorf("on_error=%s is not available in %s mode", OnErrorSkip, ModeInterleave)
+	}
+	opts.PageLabels = r.FormValue("page_labels")
+	switch opts.PageLabels {
+	case "", PageLabelsKeep, PageLabelsRenumber:
+	default:
+		return opts, fmt.Errorf("invalid page_labels: %s (expected %s or %s)", opts.PageLabels, PageLabelsKeep, PageLabelsRenumber)
+	}
+	opts.XMP = r.FormValue("xmp")
+	switch opts.XMP {
+	case "", XMPDrop, XMPFirst, XMPSynthesize:
+	default:
+		return opts, fmt.Errorf("invalid xmp: %s (expected %s, %s or %s)", opts.XMP, XMPDrop, XMPFirst, XMPSynthesize)
+	}
+	opts.Lang = r.FormValue("lang")
+	if opts.Lang != "" && !validLang(opts.Lang) {
+		return opts, fmt.Errorf("invalid lang: %s (expected a language tag such as en-US)", opts.Lang)
+	}
+	opts.PageLayout = r.FormValue("page_layout")
+	if _, ok := pageLayouts[opts.PageLayout]; opts.PageLayout != "" && !ok {
+		return opts, fmt.Errorf("invalid page_layout: %s", opts.PageLayout)
+	}
+	opts.Zoom = r.FormValue("zoom")
+	switch opts.Zoom {
+	case "", ZoomFitPage, ZoomFitWidth:
+	default:
+		return opts, fmt.Errorf("invalid zoom: %s (expected %s or %s)", opts.Zoom, ZoomFitPage, ZoomFitWidth)
+	}
+	if opts.OpenPage, err = formInt(r, "open_page", 1, 1000000); err != nil {
+		return opts, err
+	}
+	opts.BookmarksPanel = r.FormValue("bookmarks_panel")
+	switch opts.BookmarksPanel {
+	case "", BookmarksShow, BookmarksHide:
+	default:
+		return opts, fmt.Errorf("invalid bookmarks_panel: %s (expected %s or %s)", opts.BookmarksPanel, BookmarksShow, BookmarksHide)
+	}
+	if opts.CMYK, err = formBool(r, "cmyk"); err != nil {
+		return opts, err
+	}
+	opts.PDFX = r.FormValue("pdfx")
+	switch opts.PDFX {
+	case "", PDFX1a, PDFX4:
+	default:
+		return opts, fmt.Errorf("invalid pdfx: %s (expected %s or %s)", opts.PDFX, PDFX1a, PDFX4)
+	}
+	// PDF/X-4 output gets an XMP packet with the properties it requires
+	if opts.PDFX == PDFX4 && (opts.XMP == XMPDrop || opts.XMP == XMPFirst) {
+		return opts, fmt.Errorf("xmp=%s is not available with pdfx=%s", opts.XMP, PDFX4)
+	}
+	if opts.OCR, err = formBool(r, "ocr"); err != nil {
+		return opts, err
+	}
+	if opts.FormValues, err = parseFormValues(r.FormValue("form_values")); err != nil {
+		return opts, err
+	}
+	if opts.FlattenForms, err = formBool(r, "flatten_forms"); err != nil {
+		return opts, err
+	}
+	if opts.RemoveAnnotations, err = formBool(r, "remove_annotations"); err != nil {
+		return opts, err
+	}
+	if opts.Sanitize, err = formBool(r, "sanitize"); err != nil {
+		return opts, err
+	}
+	if opts.AttachSources, err = formBool(r, "attach_sources"); err != nil {
+		return opts, err
+	}
+	// The originals would bring back what sanitizing removed
+	if opts.Sanitize && opts.AttachSources {
+		return opts, fmt.Errorf("attach_sources is not available with sanitize")
+	}
+	// PDF/X allows no embedded files
+	if opts.PDFX != "" && opts.AttachSources {
+		return opts, fmt.Errorf("attach_sources is not available with pdfx")
+	}
+	if opts.ImageDPI, err = formInt(r, "image_dpi", 10, 2400); err != nil {
+		return opts, err
+	}
+	if opts.ImageQuality, err = formInt(r, "image_quality", 1, 100); err != nil {
+		return opts, err
+	}
+	opts.ImageBackground = strings.ToLower(r.FormValue("image_background"))
+	if opts.ImageBackground != "" {
+		if _, err := parseHexColor(opts.ImageBackground); err != nil {
+			return opts, fmt.Errorf("invalid image_background: %s (expected #rrggbb)", opts.ImageBackground)
+		}
+	}
+	if opts.Deskew, err = formBool(r, "deskew"); err != nil {
+		return opts, err
+	}
+	if opts.AutoCrop, err = formBool(r, "autocrop"); err != nil {
+		return opts, err
+	}
+	if opts.SplitTallImages, err = formBool(r, "split_tall_images"); err != nil {
+		return opts, err
+	}
+	if opts.SplitOverlap, err = formInt(r, "split_overlap", 0, maxSplitOverlap); err != nil {
+		return opts, err
+	}
+	if opts.FullBleed, err = formBool(r, "full_bleed"); err != nil {
+		return opts, err
+	}
+	if opts.Bleed, err = formInt(r, "bleed", 1, maxBleed); err != nil {
+		return opts, err
+	}
+	// Full-bleed images fill a single page, as OCR reads images whole
+	if opts.SplitTallImages && opts.FullBleed {
+		return opts, fmt.Errorf("split_tall_images is not available with full_bleed")
+	}
+	if opts.SplitTallImages && opts.OCR {
+		return opts, fmt.Errorf("split_tall_images is not available with ocr")
+	}
+	if opts.TagImages, err = formBool(r, "tag_images"); err != nil {
+		return opts, err
+	}
+	opts.AltText = r.Form["alt_text"]
+	opts.Enhance = r.FormValue("enhance")
+	switch opts.Enhance {
+	case "", EnhanceDocument, EnhancePhoto:
+	default:
+		return opts, fmt.Errorf("invalid enhance: %s", opts.Enhance)
+	}
+	if opts.Brightness, err = formInt(r, "brightness", -100, 100); err != nil {
+		return opts, err
+	}
+	if opts.Contrast, err = formInt(r, "contrast", -100, 100); err != nil {
+		return opts, err
+	}
+	if opts.Sharpen, err = formInt(r, "sharpen", 0, 10); err != nil {
+		return opts, err
+	}
+
+	opts.Crop = r.FormValue("crop")
+	if opts.Crop != "" && opts.Crop != CropAuto {
+		if _, err := parseCropMargins(opts.Crop); err != nil {
+			return opts, err
+		}
+	}
+	if opts.CropFiles, err = formPages(r, "crop_files"); err != nil {
+		return opts, err
+	}
+	if opts.CropPages, err = formPages(r, "crop_pages"); err != nil {
+		return opts, err
+	}
+
+	opts.Normalize = r.FormValue("normalize")
+	switch opts.Normalize {
+	case "", NormalizeA4, NormalizeLetter, NormalizeMax:
+	default:
+		return opts, fmt.Errorf("invalid normalize: %s", opts.Normalize)
+	}
+
+	opts.OverlayPosition = r.FormValue("overlay_position")
+	switch opts.OverlayPosition {
+	case "", OverlayUnder, OverlayOver:
+	default:
+		return opts, fmt.Errorf("invalid overlay_position: %s", opts.OverlayPosition)
+	}
+	if opts.OverlayPages, err = formPages(r, "overlay_pages"); err != nil {
+		return opts, err
+	}
+
+	switch v := r.FormValue("nup"); v {
+	case "":
+	case "2", "4":
+		opts.NUp, _ = strconv.Atoi(v)
+	default:
+		return opts, fmt.Errorf("invalid nup: %s (expected 2 or 4)", v)
+	}
+	opts.NUpSheet = r.FormValue("nup_sheet")
+	if _, ok := sheetSizes[opts.NUpSheet]; opts.NUpSheet != "" && !ok {
+		return opts, fmt.Errorf("invalid nup_sheet: %s (expected %s, %s, %s or %s)", opts.NUpSheet, SheetA3, NormalizeA4, NormalizeLetter, SheetTabloid)
+	}
+	if opts.CutMarks, err = formBool(r, "cut_marks"); err != nil {
+		return opts, err
+	}
+
+	if opts.StampSource, err = formBool(r, "stamp_source"); err != nil {
+		return opts, err
+	}
+	if opts.StampPageNumbers, err = formBool(r, "stamp_page_numbers"); err != nil {
+		return opts, err
+	}
+	opts.StampPosition = r.FormValue("stamp_position")
+	if _, ok := stampPositions[opts.StampPosition]; opts.StampPosition != "" && !ok {
+		return opts, fmt.Errorf("invalid stamp_position: %s", opts.StampPosition)
+	}
+	switch opts.QRStamp = r.FormValue("qr_stamp"); opts.QRStamp {
+	case "", QRStampFirst, QRStampAll:
+	default:
+		return opts, fmt.Errorf("invalid qr_stamp: %s (expected %s or %s)", opts.QRStamp, QRStampFirst, QRStampAll)
+	}
+	opts.QRPosition = r.FormValue("qr_position")
+	if _, ok := stampPositions[opts.QRPosition]; opts.QRPosition != "" && !ok {
+		return opts, fmt.Errorf("invalid qr_position: %s", opts.QRPosition)
+	}
+
+	if opts.Cover, err = parseCoverPage(r); err != nil {
+		return opts, err
+	}
+
+	if opts.MaxPagesPerFile, err = formInt(r, "max_pages_per_file", 1, 1000000); err != nil {
+		return opts, err
+	}
+	// Interleaved uploads have no pages of their own to list in the index
+	if opts.MaxPagesPerFile > 0 && opts.Mode == ModeInterleave {
+		return opts, fmt.Errorf("max_pages_per_file is not available in %s mode", ModeInterleave)
+	}
+
+	switch opts.Separators = r.FormValue("separators"); opts.Separators {
+	case "", SeparatorCode128, SeparatorQR:
+	default:
+		return opts, fmt.Errorf("invalid separators: %s (expected %s or %s)", opts.Separators, SeparatorCode128, SeparatorQR)
+	}
+	if opts.Separators != "" {
+		if opts.SeparatorValue = r.FormValue("separator_value"); opts.SeparatorValue == "" {
+			opts.SeparatorValue = "SEPARATOR"
+		}
+		if err := checkSeparatorValue(opts.Separators, opts.SeparatorValue); err != nil {
+			return opts, err
+		}
+		// Interleaved uploads are not documents of their own, and volumes
+		// are split by the pages of the uploads
+		if opts.Mode == ModeInterleave {
+			return opts, fmt.Errorf("separators is not available in %s mode", ModeInterleave)
+		}
+		if opts.MaxPagesPerFile > 0 {
+			return opts, fmt.Errorf("separators is not available with max_pages_per_file")
+		}
+	}
+
+	if opts.Sign, err = formBool(r, "sign"); err != nil {
+		return opts, err
+	}
+	if opts.SignVisible, err = formBool(r, "sign_visible"); err != nil {
+		return opts, err
+	}
+	opts.SignReason = r.FormValue("sign_reason")
+	if opts.SignedManifest, err = formBool(r, "signed_manifest"); err != nil {
+		return opts, err
+	}
+	// Signing writes a PDF version later than PDF/X allows
+	if opts.PDFX != "" && opts.Sign {
+		return opts, fmt.Errorf("sign is not available with pdfx")
+	}
+
+	if opts.LargeFiles, err = formBool(r, "large_files"); err != nil {
+		return opts, err
+	}
+	if opts.Portfolio, err = formBool(r, "portfolio"); err != nil {
+		return opts, err
+	}
+	if opts.Portfolio {
+		if fields := portfolioConflicts(opts); len(fields) > 0 {
+			return opts, fmt.Errorf("not available with portfolio: %s", strings.Join(fields, ", "))
+		}
+	}
+	return opts, nil
+}
+
+// formPages validates an optional page selection such as "1-3,5,even"
+func formPages(r *http.Request, name string) (string, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return "", nil
+	}
+	if _, err := api.ParsePageSelection(v); err != nil {
+		return "", fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return v, nil
+}
+
+// pageSelection turns a validated page selection into pdfcpu's form; an
+// empty selection means all pages
+func pageSelection(s string) []string {
+	if s == "" {
+		return nil
+	}
+	pages, _ := api.ParsePageSelection(s)
+	return pages
+}
+
+// formBool parses an optional boolean form field
+func formBool(r *http.Request, name string) (bool, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return b, nil
+}
+
+// formInt parses an optional integer form field between min and max
+func formInt(r *http.Request, name string, min, max int) (int, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("invalid %s: %s (expected %d to %d)", name, v, min, max)
+	}
+	return n, nil
+}
+
+// transformPDF rewrites the PDF at path through fn, replacing it only when
+// fn succeeds
+func transformPDF(path string, fn func(in, out string) error) error {
+	tmp := path + ".tmp"
+	if err := fn(path, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Overlay positions
+const (
+	OverlayUnder = "under"
+	OverlayOver  = "over"
+)
+
+// applyOverlay stamps the first page of the overlay PDF under (like a
+// letterhead) or over every selected page of the PDF at path
+func applyOverlay(path string, opts MergeOptions) error {
+	onTop := opts.OverlayPosition == OverlayOver
+	wm, err := api.PDFWatermark(opts.Overlay+":1", "scalefactor:1 rel, rotation:0, opacity:1", onTop, false, types.POINTS)
+	if err != nil {
+		return fmt.Errorf("invalid overlay: %v", err)
+	}
+
+	return transformPDF(path, func(in, out string) error {
+		return api.AddWatermarksFile(in, out, pageSelection(opts.OverlayPages), wm, pdfConfig())
+	})
+}
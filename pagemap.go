@@ -0,0 +1,72 @@
+package main
+
+// PageRun maps consecutive pages of the output to consecutive pages of one
+// upload, so pages of a merged bundle can be cited by their source. Pages
+// the service adds, such as the cover and the index of volumes, are left
+// out.
+type PageRun struct {
+	// Volume is the volume holding the pages, from 1, when the output is
+	// split into volumes
+	Volume int `json:"volume,omitempty"`
+	// First and Last are pages of the output, or of the volume
+	First int    `json:"first"`
+	Last  int    `json:"last"`
+	File  string `json:"file"`
+	// SourcePage is the page of the upload on the first page of the run
+	SourcePage int `json:"sourcePage"`
+}
+
+// pageOrigin is the upload, by position, and the page of it a merged page
+// shows. Page 0 is the separator sheet in front of the upload.
+type pageOrigin struct {
+	file, page int
+}
+
+// mergedPages returns the sources of the first total pages of the merged
+// PDF of a job, which total less than the files when it was truncated
+func mergedPages(job *Job, total int) []pageOrigin {
+	var pages []pageOrigin
+	for i, f := range job.Files {
+		if job.Options.Separators != "" && len(pages) > 0 && f.Pages > 0 {
+			pages = append(pages, pageOrigin{file: i})
+		}
+		for p := 1; p <= f.Pages; p++ {
+			page := p
+			if p <= len(f.SourcePages) {
+				page = f.SourcePages[p-1]
+			}
+			pages = append(pages, pageOrigin{file: i, page: page})
+		}
+	}
+	if job.Options.Mode == ModeInterleave && len(job.Files) == 2 {
+		order := interleaveOrder(job.Files[0].Pages, job.Files[1].Pages, job.Options.ReverseSecond)
+		interleaved := make([]pageOrigin, len(order))
+		for i, p := range order {
+			interleaved[i] = pages[p-1]
+		}
+		pages = interleaved
+	}
+	return pages[:min(total, len(pages))]
+}
+
+// pageRuns returns the runs of pages that follow the lead pages added in
+// front of them, in the given volume or 0 for the whole output. Separator
+// sheets are left out.
+func pageRuns(job *Job, pages []pageOrigin, volume, lead int) []PageRun {
+	var runs []PageRun
+	for i, p := range pages {
+		if p.page == 0 {
+			continue
+		}
+		page := lead + i + 1
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			if last.File == job.Files[p.file].Name && last.SourcePage+last.Last-last.First+1 == p.page {
+				last.Last = page
+				continue
+			}
+		}
+		runs = append(runs, PageRun{Volume: volume, First: page, Last: page, File: job.Files[p.file].Name, SourcePage: p.page})
+	}
+	return runs
+}
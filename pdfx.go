@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// PDF/X conformance levels of print-ready output
+const (
+	// PDFX1a is PDF/X-1a:2001: CMYK only, transparency flattened, PDF 1.3
+	PDFX1a = "1a"
+	// PDFX4 is PDF/X-4: CMYK with live transparency, PDF 1.6, which needs
+	// the ICC profile of the printing condition
+	PDFX4 = "4"
+)
+
+// Printing condition of PDF/X-1a output without a profile of its own:
+// SWOP, registered with the ICC so the profile may be left out
+const defaultOutputCondition = "CGATS TR 001"
+
+// pdfxVersions are the GTS_PDFXVersion of each level and the PDF version
+// its header must not exceed
+var pdfxVersions = map[string]struct{ name, pdf string }{
+	PDFX1a: {"PDF/X-1a:2001", "1.3"},
+	PDFX4:  {"PDF/X-4", "1.6"},
+}
+
+// ghostscript converts merged PDFs for print with Ghostscript: their
+// colors and images to CMYK and, for PDF/X, their fonts embedded and their
+// transparency flattened as the level needs
+type ghostscript struct {
+	path string
+	// profile is the CMYK ICC profile of the server's printing condition,
+	// at profilePath, and condition its name
+	profile     []byte
+	profilePath string
+	condition   string
+	sandbox     *sandbox
+}
+
+// newGhostscript returns a Ghostscript engine, or nil when no Ghostscript
+// binary is given or found in PATH. The output profile is optional: without
+// one, colors are converted with Ghostscript's own CMYK profile and PDF/X-1a
+// names the SWOP printing condition, but PDF/X-4 needs one uploaded.
+func newGhostscript(path, profilePath, condition string, sb *sandbox) (*ghostscript, error) {
+	if path == "" {
+		found, err := exec.LookPath("gs")
+		if err != nil {
+			return nil, nil
+		}
+		path = found
+	}
+
+	g := &ghostscript{path: path, condition: condition, sandbox: sb}
+	if profilePath != "" {
+		var err error
+		if g.profilePath, err = filepath.Abs(profilePath); err != nil {
+			return nil, err
+		}
+		if g.profile, err = os.ReadFile(g.profilePath); err != nil {
+			return nil, err
+		}
+		if err := checkCMYKProfile(g.profile); err != nil {
+			return nil, fmt.Errorf("%s: %v", profilePath, err)
+		}
+		if g.condition == "" {
+			g.condition = strings.TrimSuffix(filepath.Base(profilePath), filepath.Ext(profilePath))
+		}
+	}
+	if g.condition == "" {
+		g.condition = defaultOutputCondition
+	}
+	return g, nil
+}
+
+// checkCMYKProfile checks that profile is an ICC profile of a CMYK output
+// device, as its header says
+func checkCMYKProfile(profile []byte) error {
+	if len(profile) < 132 || string(profile[36:40]) != "acsp" {
+		return errors.New("not an ICC profile")
+	}
+	if string(profile[12:16]) != "prtr" || string(profile[16:20]) != "CMYK" {
+		return errors.New("not a CMYK output profile")
+	}
+	return nil
+}
+
+// iccDescription returns the description of an ICC profile, such as
+// "Coated FOGRA39 (ISO 12647-2:2004)", which names the printing condition
+// of an uploaded one, or "Custom" if it has none
+func iccDescription(profile []byte) string {
+	be := binary.BigEndian
+	count := int(be.Uint32(profile[128:]))
+	for i := 0; i < count && 132+12*(i+1) <= len(profile); i++ {
+		entry := profile[132+12*i:]
+		if string(entry[:4]) != "desc" {
+			continue
+		}
+		offset, size := int(be.Uint32(entry[4:])), int(be.Uint32(entry[8:]))
+		if offset < 0 || size < 12 || offset+size > len(profile) {
+			break
+		}
+		tag := profile[offset : offset+size]
+		var desc string
+		switch string(tag[:4]) {
+		case "desc":
+			// ICC v2: ASCII text with its length, including a terminating NUL
+			if n := int(be.Uint32(tag[8:])); n > 0 && 12+n <= len(tag) {
+				desc = string(tag[12 : 12+n])
+			}
+		case "mluc":
+			// ICC v4: UTF-16 records by language, of which the first is taken
+			if len(tag) >= 28 && be.Uint32(tag[8:]) > 0 {
+				n, at := int(be.Uint32(tag[20:])), int(be.Uint32(tag[24:]))
+				if at >= 0 && n >= 0 && at+n <= len(tag) {
+					units := make([]uint16, n/2)
+					for j := range units {
+						units[j] = be.Uint16(tag[at+2*j:])
+					}
+					desc = string(utf16.Decode(units))
+				}
+			}
+		}
+		if desc = strings.TrimSpace(strings.TrimRight(desc, "\x00")); desc != "" {
+			return desc
+		}
+		break
+	}
+	return "Custom"
+}
+
+// profileFor returns the output profile a job converts to and its path:
+// the one uploaded with it or the server's, none for Ghostscript's own
+func (g *ghostscript) profileFor(job *Job) ([]byte, string, error) {
+	if job.Options.ICCProfile == "" {
+		return g.profile, g.profilePath, nil
+	}
+	path, err := filepath.Abs(job.Options.ICCProfile)
+	if err != nil {
+		return nil, "", err
+	}
+	profile, err := os.ReadFile(path)
+	return profile, path, err
+}
+
+// convert rewrites the PDF at in to out with Ghostscript for a job: colors
+// and images in CMYK, with the output profile of the job, and for PDF/X
+// fonts embedded and, for PDF/X-1a, transparency flattened by writing PDF
+// 1.3, which has none
+func (g *ghostscript) convert(job *Job, in, out string) error {
+	in, err := filepath.Abs(in)
+	if err != nil {
+		return err
+	}
+	if out, err = filepath.Abs(out); err != nil {
+		return err
+	}
+	args := []string{"-q", "-dBATCH", "-dNOPAUSE", "-dSAFER", "-sDEVICE=pdfwrite",
+		"-sColorConversionStrategy=CMYK", "-sProcessColorModel=DeviceCMYK",
+		// Pages keep their orientation whatever their text runs like
+		"-dAutoRotatePages=/None"}
+	if level := job.Options.PDFX; level != "" {
+		args = append(args, "-dCompatibilityLevel="+pdfxVersions[level].pdf,
+			"-dEmbedAllFonts=true", "-dSubsetFonts=true")
+	}
+	_, profile, err := g.profileFor(job)
+	if err != nil {
+		return err
+	}
+	if profile != "" {
+		args = append(args, "--permit-file-read="+profile, "-sOutputICCProfile="+profile)
+	}
+	args = append(args, "-sOutputFile="+out, in)
+
+	output, err := g.sandbox.run(g.path, args...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("ghostscript failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
+
+// mark makes the PDF at path, converted for the level of a job and made
+// of pages of its uploads, PDF/X: it gets the output intent, the trim box
+// of its pages and the document information PDF/X requires, a new XMP
+// packet for PDF/X-4, and loses the scripts, launch actions and embedded
+// files PDF/X forbids
+func (g *ghostscript) mark(job *Job, path string, pages []pageOrigin) error {
+	level := job.Options.PDFX
+	return transformPDF(path, func(in, out string) error {
+		ctx, err := readContext(in)
+		if err != nil {
+			return err
+		}
+		if err := ctx.EnsurePageCount(); err != nil {
+			return err
+		}
+
+		// PDF/X-1a predates object streams, so none are written
+		ctx.Configuration.WriteObjectStream = false
+		ctx.Configuration.WriteXRefStream = false
+
+		var res sanitizeResult
+		for _, entry := range ctx.Table {
+			if entry != nil && !entry.Free && entry.Object != nil {
+				sanitizeActions(ctx, entry.Object, &res)
+			}
+		}
+		if names, err := ctx.DereferenceDict(ctx.RootDict["Names"]); err == nil && names != nil {
+			delete(names, "JavaScript")
+			delete(names, "EmbeddedFiles")
+			delete(ctx.Names, "JavaScript")
+			delete(ctx.Names, "EmbeddedFiles")
+		}
+
+		profile, _, err := g.profileFor(job)
+		if err != nil {
+			return err
+		}
+		condition := g.condition
+		if job.Options.ICCProfile != "" {
+			condition = iccDescription(profile)
+		}
+		if err := setOutputIntent(ctx, profile, condition); err != nil {
+			return err
+		}
+		if err := setTrimBoxes(ctx); err != nil {
+			return err
+		}
+		if err := setPDFXInfo(ctx, level, documentTitle(job)); err != nil {
+			return err
+		}
+		if level == PDFX4 {
+			// Written now so its dates match those writing puts in the
+			// document information
+			packet := synthesizeXMP(job, xmpIngredients(job, pages), time.Now())
+			ref, err := newMetadataStream(ctx, packet)
+			if err != nil {
+				return err
+			}
+			ctx.RootDict["Metadata"] = *ref
+		}
+
+		if err := api.WriteContextFile(ctx, out); err != nil {
+			return err
+		}
+		return setPDFVersion(out, pdfxVersions[level].pdf)
+	})
+}
+
+// setOutputIntent replaces the output intents of ctx with the printing
+// condition named condition, with its profile unless it has none
+func setOutputIntent(ctx *model.Context, profile []byte, condition string) error {
+	intent := types.Dict{
+		"Type":                      types.Name("OutputIntent"),
+		"S":                         types.Name("GTS_PDFX"),
+		"OutputConditionIdentifier": types.StringLiteral(condition),
+		"Info":                      types.StringLiteral(condition),
+	}
+	if profile == nil {
+		intent["RegistryName"] = types.StringLiteral("http://www.color.org")
+	} else {
+		sd, err := ctx.NewStreamDictForBuf(profile)
+		if err != nil {
+			return err
+		}
+		sd.InsertInt("N", 4)
+		if err := sd.Encode(); err != nil {
+			return err
+		}
+		ref, err := ctx.IndRefForNewObject(*sd)
+		if err != nil {
+			return err
+		}
+		intent["DestOutputProfile"] = *ref
+	}
+	ctx.RootDict["OutputIntents"] = types.Array{intent}
+	return nil
+}
+
+// setTrimBoxes gives the pages of ctx that have neither a trim nor an art
+// box a trim box, their crop box, which PDF/X requires
+func setTrimBoxes(ctx *model.Context) error {
+	for page := 1; page <= ctx.PageCount; page++ {
+		pageDict, _, inherited, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		if pageDict == nil || pageDict["TrimBox"] != nil || pageDict["ArtBox"] != nil {
+			continue
+		}
+		box := inherited.CropBox
+		if box == nil {
+			box = inherited.MediaBox
+		}
+		if box == nil {
+			return fmt.Errorf("page %d has no media box", page)
+		}
+		pageDict["TrimBox"] = box.Array()
+	}
+	return nil
+}
+
+// setPDFXInfo puts the PDF/X version of level in the document information
+// of ctx, with the title and trapping state PDF/X requires: title is used
+// unless the document has one. Trapping is left to the printer.
+func setPDFXInfo(ctx *model.Context, level, title string) error {
+	var info types.Dict
+	if ctx.Info != nil {
+		d, err := ctx.DereferenceDict(*ctx.Info)
+		if err != nil {
+			return err
+		}
+		info = d
+	}
+	if info == nil {
+		info = types.Dict{}
+		ref, err := ctx.IndRefForNewObject(info)
+		if err != nil {
+			return err
+		}
+		ctx.Info = ref
+	}
+
+	version := pdfxVersions[level].name
+	info["GTS_PDFXVersion"] = types.StringLiteral(version)
+	if level == PDFX1a {
+		info["GTS_PDFXConformance"] = types.StringLiteral(version)
+	}
+	info["Trapped"] = types.Name("False")
+	// That of PDF/X-4 matches the title of its XMP packet
+	if t, err := ctx.DereferenceStringOrHexLiteral(info["Title"], model.V10, nil); level == PDFX4 || err != nil || t == "" {
+		info["Title"] = types.StringLiteral(title)
+	}
+	return nil
+}
+
+// setPDFVersion rewrites the version in the header of the PDF at path,
+// which pdfcpu always writes as 1.7, to v. Both are as long, so nothing
+// after the header moves.
+func setPDFVersion(path, v string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, 8)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(header, []byte("%PDF-")) || len(v) != 3 {
+		return fmt.Errorf("cannot set PDF version %s", v)
+	}
+	_, err = f.WriteAt([]byte("%PDF-"+v), 0)
+	return err
+}
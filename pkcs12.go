@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"unicode/utf16"
+)
+
+// Decoding of PKCS#12 (.p12/.pfx) key stores, enough to load a signing key
+// and its certificate chain as exported by OpenSSL, Windows or macOS. Key
+// and certificate bags may be encrypted with PBES2 (PBKDF2 with AES or 3DES)
+// or the PKCS#12 3DES scheme; the legacy RC2 scheme is not supported.
+
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidShroudedKeyBag       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidPBEWithSHAAnd3DES    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBES2                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1         = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256       = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC           = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidSHA1                 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	errPKCS12WrongPassword  = errors.New("wrong password or corrupt key store")
+	errPKCS12NoKeyOrCertBag = errors.New("key store has no private key or certificate")
+)
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decodePKCS12 returns the private key of a PKCS#12 key store along with
+// its certificate, followed by the rest of the chain. Keys and certificates
+// encrypted with ciphers policy does not allow are refused.
+func decodePKCS12(data []byte, password string, policy cryptoPolicy) (crypto.Signer, []*x509.Certificate, error) {
+	var pfx pfxPDU
+	if rest, err := asn1.Unmarshal(data, &pfx); err != nil {
+		return nil, nil, fmt.Errorf("not a PKCS#12 file: %v", err)
+	} else if len(rest) != 0 {
+		return nil, nil, errors.New("not a PKCS#12 file: trailing data")
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return nil, nil, errors.New("PKCS#12 files with public-key integrity are not supported")
+	}
+
+	var authSafeData []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafeData); err != nil {
+		return nil, nil, err
+	}
+	if len(pfx.MacData.Mac.Digest) > 0 {
+		if err := verifyPKCS12MAC(&pfx.MacData, authSafeData, password); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var authSafe []contentInfo
+	if _, err := asn1.Unmarshal(authSafeData, &authSafe); err != nil {
+		return nil, nil, err
+	}
+
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	for _, ci := range authSafe {
+		var contents []byte
+		switch {
+		case ci.ContentType.Equal(oidData):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &contents); err != nil {
+				return nil, nil, err
+			}
+		case ci.ContentType.Equal(oidEncryptedData):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, err
+			}
+			var err error
+			info := ed.EncryptedContentInfo
+			if contents, err = pbeDecrypt(info.ContentEncryptionAlgorithm, info.EncryptedContent, password, policy); err != nil {
+				return nil, nil, err
+			}
+		default:
+			continue
+		}
+
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(contents, &bags); err != nil {
+			return nil, nil, err
+		}
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidKeyBag), bag.ID.Equal(oidShroudedKeyBag):
+				der := bag.Value.Bytes
+				if bag.ID.Equal(oidShroudedKeyBag) {
+					var epki encryptedPrivateKeyInfo
+					if _, err := asn1.Unmarshal(der, &epki); err != nil {
+						return nil, nil, err
+					}
+					var err error
+					if der, err = pbeDecrypt(epki.Algorithm, epki.EncryptedData, password, policy); err != nil {
+						return nil, nil, err
+					}
+				}
+				parsed, err := x509.ParsePKCS8PrivateKey(der)
+				if err != nil {
+					return nil, nil, fmt.Errorf("error parsing private key: %v", err)
+				}
+				signer, ok := parsed.(crypto.Signer)
+				if !ok {
+					return nil, nil, errors.New("unsupported private key type")
+				}
+				key = signer
+
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, err
+				}
+				if !cb.ID.Equal(oidX509Certificate) {
+					continue
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, nil, fmt.Errorf("error parsing certificate: %v", err)
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if key == nil || len(certs) == 0 {
+		return nil, nil, errPKCS12NoKeyOrCertBag
+	}
+
+	// Put the certificate of the key first
+	for i, cert := range certs {
+		if publicKeysEqual(cert.PublicKey, key.Public()) {
+			certs[0], certs[i] = certs[i], certs[0]
+			return key, certs, nil
+		}
+	}
+	return nil, nil, errors.New("no certificate matches the private key")
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+func verifyPKCS12MAC(md *macData, content []byte, password string) error {
+	newHash, size, err := pkcs12Hash(md.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	key := pkcs12KDF(newHash, size, bmpString(password), md.MacSalt, md.Iterations, 3, size)
+	mac := hmac.New(newHash, key)
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), md.Mac.Digest) {
+		return errPKCS12WrongPassword
+	}
+	return nil
+}
+
+// pbeDecrypt decrypts data encrypted with a password-based scheme
+func pbeDecrypt(alg pkix.AlgorithmIdentifier, data []byte, password string, policy cryptoPolicy) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+
+	switch {
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd3DES):
+		if err := policy.allowPKCS12KDF(); err != nil {
+			return nil, err
+		}
+		if err := policy.allowCipher(cipher3DES); err != nil {
+			return nil, err
+		}
+		var params pbeParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		pw := bmpString(password)
+		key := pkcs12KDF(sha1.New, 20, pw, params.Salt, params.Iterations, 1, 24)
+		iv = pkcs12KDF(sha1.New, 20, pw, params.Salt, params.Iterations, 2, 8)
+		var err error
+		if block, err = des.NewTripleDESCipher(key); err != nil {
+			return nil, err
+		}
+
+	case alg.Algorithm.Equal(oidPBES2):
+		var params pbes2Params
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+			return nil, fmt.Errorf("unsupported key derivation %v", params.KeyDerivationFunc.Algorithm)
+		}
+		var kdf pbkdf2Params
+		if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+			return nil, err
+		}
+		prf := sha1.New
+		if kdf.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+			prf = sha256.New
+		} else if len(kdf.PRF.Algorithm) > 0 && !kdf.PRF.Algorithm.Equal(oidHMACWithSHA1) {
+			return nil, fmt.Errorf("unsupported PBKDF2 function %v", kdf.PRF.Algorithm)
+		}
+
+		var keyLen int
+		var name string
+		scheme := params.EncryptionScheme.Algorithm
+		switch {
+		case scheme.Equal(oidAES128CBC):
+			keyLen, name = 16, cipherAES128
+		case scheme.Equal(oidAES192CBC):
+			keyLen, name = 24, cipherAES192
+		case scheme.Equal(oidAES256CBC):
+			keyLen, name = 32, cipherAES256
+		case scheme.Equal(oidDESEDE3CBC):
+			keyLen, name = 24, cipher3DES
+		default:
+			return nil, fmt.Errorf("unsupported cipher %v", scheme)
+		}
+		if err := policy.allowCipher(name); err != nil {
+			return nil, err
+		}
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, err
+		}
+
+		key := pbkdf2Key(prf, []byte(password), kdf.Salt, kdf.Iterations, keyLen)
+		var err error
+		if scheme.Equal(oidDESEDE3CBC) {
+			block, err = des.NewTripleDESCipher(key)
+		} else {
+			block, err = aes.NewCipher(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported encryption %v; re-export the key store with AES", alg.Algorithm)
+	}
+
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errPKCS12WrongPassword
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	// Strip the PKCS#7 padding
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > block.BlockSize() || !bytes.Equal(out[len(out)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errPKCS12WrongPassword
+	}
+	return out[:len(out)-pad], nil
+}
+
+func pkcs12Hash(oid asn1.ObjectIdentifier) (func() hash.Hash, int, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return sha1.New, sha1.Size, nil
+	case oid.Equal(oidSHA256):
+		return sha256.New, sha256.Size, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MAC algorithm %v", oid)
+}
+
+// bmpString encodes a password as PKCS#12 expects: UTF-16BE with a
+// terminating zero
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return append(b, 0, 0)
+}
+
+// pkcs12KDF derives key material as described in RFC 7292, appendix B.2.
+// u is the output size of the hash; its block size is 64 for SHA-1 and
+// SHA-256.
+func pkcs12KDF(newHash func() hash.Hash, u int, password, salt []byte, iterations int, id byte, size int) []byte {
+	const v = 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	D := bytes.Repeat([]byte{id}, v)
+	I := append(fill(salt), fill(password)...)
+
+	var out []byte
+	for len(out) < size {
+		h := newHash()
+		h.Write(D)
+		h.Write(I)
+		A := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			h.Reset()
+			h.Write(A)
+			A = h.Sum(nil)
+		}
+		out = append(out, A...)
+
+		// I_j = (I_j + B + 1) mod 2^(v*8) for every v-byte block of I
+		B := new(big.Int).SetBytes(fill(A[:u])[:v])
+		B.Add(B, big.NewInt(1))
+		mod := new(big.Int).Lsh(big.NewInt(1), v*8)
+		for j := 0; j < len(I); j += v {
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			Ij.Add(Ij, B).Mod(Ij, mod)
+			b := Ij.Bytes()
+			copy(I[j:j+v], make([]byte, v-len(b)))
+			copy(I[j+v-len(b):j+v], b)
+		}
+	}
+	return out[:size]
+}
+
+// pbkdf2Key derives a key with PBKDF2 (RFC 8018)
+func pbkdf2Key(newHash func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(newHash, password)
+	var out []byte
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Extensions converted without plugins
+var builtinExtensions = []string{".pdf", ".png", ".jpg", ".jpeg"}
+
+// converterPlugin converts uploads of its extensions to PDF with a program
+// of the site's own, such as a CAD converter. The program reads the upload
+// on its standard input and writes the PDF to its standard output; it fails
+// by exiting with a nonzero status, saying why on standard error. It runs
+// in the converter sandbox like Tesseract.
+type converterPlugin struct {
+	Name string `json:"name"`
+	// Command is the program and its arguments, in which {ext} stands for
+	// the extension of the upload, e.g. "dwg"
+	Command    []string `json:"command"`
+	Extensions []string `json:"extensions"`
+	sandbox    *sandbox
+}
+
+// loadConverterPlugins reads the plugins declared in a JSON file and
+// returns them by extension, e.g. ".dwg"
+func loadConverterPlugins(path string, sb *sandbox) (map[string]*converterPlugin, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plugins []*converterPlugin
+	if err := json.Unmarshal(data, &plugins); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	byExt := map[string]*converterPlugin{}
+	for _, p := range plugins {
+		if p.Name == "" {
+			return nil, errors.New("plugin without a name")
+		}
+		if len(p.Command) == 0 || p.Command[0] == "" {
+			return nil, fmt.Errorf("plugin %q has no command", p.Name)
+		}
+		// The program runs in a temporary directory, so it is found first
+		program, err := exec.LookPath(p.Command[0])
+		if err == nil {
+			program, err = filepath.Abs(program)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("plugin %q: %v", p.Name, err)
+		}
+		p.Command[0] = program
+		if len(p.Extensions) == 0 {
+			return nil, fmt.Errorf("plugin %q has no extensions", p.Name)
+		}
+		for i, ext := range p.Extensions {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			if len(ext) < 2 || strings.ContainsAny(ext[1:], `./\ `) {
+				return nil, fmt.Errorf("plugin %q has invalid extension %q", p.Name, p.Extensions[i])
+			}
+			for _, builtin := range builtinExtensions {
+				if ext == builtin {
+					return nil, fmt.Errorf("plugin %q: %s files are converted by the server", p.Name, ext)
+				}
+			}
+			if other := byExt[ext]; other != nil {
+				return nil, fmt.Errorf("plugins %q and %q both convert %s files", other.Name, p.Name, ext)
+			}
+			p.Extensions[i] = ext
+			byExt[ext] = p
+		}
+		p.sandbox = sb
+	}
+	return byExt, nil
+}
+
+// convert converts the upload at in, of extension ext, to the PDF at out
+func (p *converterPlugin) convert(in, out, ext string) error {
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	args := make([]string, len(p.Command)-1)
+	for i, arg := range p.Command[1:] {
+		args[i] = strings.ReplaceAll(arg, "{ext}", strings.TrimPrefix(ext, "."))
+	}
+	stderr, err := p.sandbox.runPiped(p.Command[0], src, dst, args...)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = fmt.Errorf("%s failed: %v: %s", p.Name, err, strings.TrimSpace(string(stderr)))
+	}
+	if err == nil {
+		err = checkPluginOutput(out, p.Name)
+	}
+	if err != nil {
+		os.Remove(out)
+	}
+	return err
+}
+
+// checkPluginOutput checks that a plugin wrote a PDF to path, as viewers
+// find its header anywhere in the first kilobyte
+func checkPluginOutput(path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 1024)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if !bytes.Contains(head[:n], []byte("%PDF-")) {
+		return fmt.Errorf("%s did not write a PDF", name)
+	}
+	return nil
+}
+
+// plugin returns the plugin converting uploads named name, or nil
+func (fh *FileHandler) plugin(name string) *converterPlugin {
+	return fh.plugins[strings.ToLower(filepath.Ext(name))]
+}
+
+// convertible reports whether uploads named name can be merged, by the
+// server itself or a plugin
+func (fh *FileHandler) convertible(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, builtin := range builtinExtensions {
+		if ext == builtin {
+			return true
+		}
+	}
+	return fh.plugins[ext] != nil
+}
+
+// pluginExtensions returns the extensions plugins convert, sorted
+func (fh *FileHandler) pluginExtensions() []string {
+	var exts []string
+	for ext := range fh.plugins {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// acceptedExtensions returns the extensions of the uploads that can be
+// merged, for the file pickers of the web interface
+func (fh *FileHandler) acceptedExtensions() string {
+	exts := append([]string(nil), builtinExtensions...)
+	return strings.Join(append(exts, fh.pluginExtensions()...), ",")
+}
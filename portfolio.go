@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// portfolioDoc is a converted file embedded in a portfolio
+type portfolioDoc struct {
+	file  int
+	name  string
+	path  string
+	pages int
+}
+
+// portfolioConflicts returns the form fields of the options that work on
+// the pages of a merged PDF, which portfolios do not have
+func portfolioConflicts(opts MergeOptions) []string {
+	var fields []string
+	for _, o := range []struct {
+		field string
+		set   bool
+	}{
+		{"mode", opts.Mode == ModeInterleave},
+		{"attach_sources", opts.AttachSources},
+		{"normalize", opts.Normalize != ""},
+		{"nup", opts.NUp > 0},
+		{"overlay", opts.Overlay != ""},
+		{"qr_stamp", opts.QRStamp != ""},
+		{"page_labels", opts.PageLabels != ""},
+		{"page_layout", opts.PageLayout != ""},
+		{"zoom", opts.Zoom != ""},
+		{"open_page", opts.OpenPage > 0},
+		{"bookmarks_panel", opts.BookmarksPanel != ""},
+		{"cmyk", opts.CMYK},
+		{"pdfx", opts.PDFX != ""},
+		{"cover", opts.Cover != nil},
+		{"max_pages_per_file", opts.MaxPagesPerFile > 0},
+		{"separators", opts.Separators != ""},
+		{"large_files", opts.LargeFiles},
+	} {
+		if o.set {
+			fields = append(fields, o.field)
+		}
+	}
+	return fields
+}
+
+// buildPortfolio writes a PDF portfolio of the converted files of a job to
+// the output directory instead of merging them: each file is embedded
+// whole, in upload order, behind a sheet listing them that viewers without
+// portfolio support show.
+func (fh *FileHandler) buildPortfolio(job *Job, pdfPaths []string, timestamp string) (string, error) {
+	if len(pdfPaths) == 0 {
+		return "", fmt.Errorf("no PDF files to merge")
+	}
+	// Skipped files have no PDF among pdfPaths
+	var docs []portfolioDoc
+	taken := map[string]bool{}
+	next := 0
+	for i, f := range job.Files {
+		if f.Error == "" && next < len(pdfPaths) {
+			name := attachmentName(strings.TrimSuffix(f.Name, filepath.Ext(f.Name))+".pdf", taken)
+			taken[name] = true
+			docs = append(docs, portfolioDoc{file: i, name: name, path: pdfPaths[next], pages: f.Pages})
+			next++
+		}
+	}
+
+	outputPath := filepath.Join(fh.outputDir, fmt.Sprintf("merged_%s.pdf", timestamp))
+	if err := renderPortfolioSheet(job, docs, outputPath); err != nil {
+		return "", err
+	}
+	err := transformPDF(outputPath, func(in, out string) error {
+		ctx, err := readContext(in)
+		if err != nil {
+			return err
+		}
+		if err := embedPortfolio(ctx, job, docs); err != nil {
+			return err
+		}
+		return api.WriteContextFile(ctx, out)
+	})
+	if err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("error building portfolio: %v", err)
+	}
+	return outputPath, nil
+}
+
+// embedPortfolio embeds docs in ctx and makes it a collection, which
+// viewers open on a list of the documents, ordered as uploaded, with the
+// first one shown
+func embedPortfolio(ctx *model.Context, job *Job, docs []portfolioDoc) error {
+	if err := ctx.LocateNameTree("EmbeddedFiles", true); err != nil {
+		return err
+	}
+	for i, doc := range docs {
+		f, err := os.Open(doc.path)
+		if err != nil {
+			return err
+		}
+		a := model.Attachment{Reader: f, ID: doc.name, Desc: fileTitle(job.Files[doc.file]), ModTime: &job.CreatedAt}
+		d, err := ctx.NewFileSpecDictForAttachment(a)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error embedding %s: %v", job.Files[doc.file].Name, err)
+		}
+		d["CI"] = types.Dict{
+			"Type":  types.Name("CollectionItem"),
+			"Order": types.Integer(i + 1),
+			"Pages": types.Integer(doc.pages),
+		}
+		ref, err := ctx.IndRefForNewObject(d)
+		if err != nil {
+			return err
+		}
+		m := model.NameMap{doc.name: []types.Dict{d}}
+		if err := ctx.Names["EmbeddedFiles"].Add(ctx.XRefTable, doc.name, *ref, m, []string{"F", "UF"}); err != nil {
+			return err
+		}
+	}
+
+	field := func(subtype, name string, order int, visible bool) types.Dict {
+		return types.Dict{
+			"Type":    types.Name("CollectionField"),
+			"Subtype": types.Name(subtype),
+			"N":       types.StringLiteral(name),
+			"O":       types.Integer(order),
+			"V":       types.Boolean(visible),
+		}
+	}
+	schema, err := ctx.IndRefForNewObject(types.Dict{
+		"Type":        types.Name("CollectionSchema"),
+		"Order":       field("N", "Order", 0, false),
+		"FileName":    field("F", "Name", 1, true),
+		"Description": field("Desc", "Description", 2, true),
+		"Pages":       field("N", "Pages", 3, true),
+		"Size":        field("Size", "Size", 4, true),
+	})
+	if err != nil {
+		return err
+	}
+	first, err := types.EscapeUTF16String(docs[0].name)
+	if err != nil {
+		return err
+	}
+	collection, err := ctx.IndRefForNewObject(types.Dict{
+		"Type":   types.Name("Collection"),
+		"Schema": *schema,
+		"D":      types.StringLiteral(*first),
+		"View":   types.Name("D"),
+		"Sort":   types.Dict{"Type": types.Name("CollectionSort"), "S": types.Name("Order"), "A": types.Boolean(true)},
+	})
+	if err != nil {
+		return err
+	}
+	ctx.RootDict["Collection"] = *collection
+	// Viewers without portfolio support open the attachments panel
+	ctx.RootDict["PageMode"] = types.Name("UseAttachments")
+	return nil
+}
+
+// renderPortfolioSheet writes the sheet of a portfolio to out: the
+// documents it holds, and how to open them
+func renderPortfolioSheet(job *Job, docs []portfolioDoc, out string) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	text := newFpdfText(pdf)
+	pdf.SetMargins(25, 25, 25)
+	pdf.SetAutoPageBreak(true, 25)
+	pdf.AddPage()
+
+	title := job.Name
+	if title == "" {
+		title = "Job " + job.ID
+	}
+	text.multiCell(0, "B", 18, 9, title, "L")
+	pdf.SetFont("Helvetica", "", 11)
+	pdf.MultiCell(0, 5.5, "This PDF is a portfolio of the documents below. Open them from the portfolio "+
+		"or attachments panel of your PDF viewer.", "", "L", false)
+
+	pdf.Ln(6)
+	for i, doc := range docs {
+		line := fmt.Sprintf("%d. %s", i+1, fileTitle(job.Files[doc.file]))
+		switch {
+		case doc.pages == 1:
+			line += " (1 page)"
+		case doc.pages > 1:
+			line += fmt.Sprintf(" (%d pages)", doc.pages)
+		}
+		text.multiCell(0, "", 11, 5.5, line, "L")
+		if doc.name != fileTitle(job.Files[doc.file]) {
+			pdf.SetTextColor(110, 110, 110)
+			text.multiCell(0, "", 9, 4.5, doc.name, "L")
+			pdf.SetTextColor(0, 0, 0)
+		}
+		pdf.Ln(1.5)
+	}
+
+	if err := pdf.OutputFileAndClose(out); err != nil {
+		return fmt.Errorf("error rendering portfolio sheet: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// outboundTransport carries every HTTP request the server makes to other
+// hosts: imports and exports of cloud storage, fetched URLs, webhooks, the
+// OCR service, Discord and the release hook. It goes through the proxies of
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY unless loadOutboundProxy sets one.
+var outboundTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	return t
+}()
+
+// newHTTPClient returns a client for requests to other hosts, giving up on
+// them after timeout
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: outboundTransport, Timeout: timeout}
+}
+
+// loadOutboundProxy reads OUTBOUND_PROXY, the URL of a proxy all outbound
+// requests go through whatever their scheme, e.g. "http://proxy:3128",
+// except those to the hosts NO_PROXY lists. It returns the proxy with
+// credentials redacted for the log, or "" without one.
+func loadOutboundProxy() (string, error) {
+	v := os.Getenv("OUTBOUND_PROXY")
+	if v == "" {
+		return "", nil
+	}
+	proxy, err := url.Parse(v)
+	if err != nil || proxy.Host == "" {
+		return "", fmt.Errorf("invalid OUTBOUND_PROXY %s: expected a URL such as http://proxy:3128", v)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return "", fmt.Errorf("invalid OUTBOUND_PROXY %s: expected an http, https or socks5 URL", v)
+	}
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	bypass := splitList(noProxy)
+	outboundTransport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), bypass) {
+			return nil, nil
+		}
+		return proxy, nil
+	}
+	return proxy.Redacted(), nil
+}
+
+// bypassProxy tells whether host is reached directly: the local machine,
+// or a host listed as hostListed matches them
+func bypassProxy(host string, list []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+	return hostListed(host, list)
+}
+
+// hostListed tells whether host is one of the hosts, domains, IP addresses
+// or CIDR ranges listed, or "*" for all. Domains match their subdomains,
+// with or without a leading dot.
+func hostListed(host string, list []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		if entry == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		if ip != nil {
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+			if e := net.ParseIP(entry); e != nil && e.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+)
+
+// qrVersion is the layout of a QR code version at error correction level M:
+// its blocks of data codewords, each followed by ecLen error correction
+// codewords, and the centres of its alignment patterns
+type qrVersion struct {
+	ecLen     int
+	blocks    []int
+	alignment []int
+}
+
+// qrVersions are versions 1 to 10, up to 213 bytes of data
+var qrVersions = []qrVersion{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// qrCode is the grid of modules of a QR code, true where dark
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// encodeQR encodes data in the smallest QR code that holds it, in byte
+// mode at error correction level M, which recovers from 15% damage
+func encodeQR(data []byte) (*qrCode, error) {
+	for v, layout := range qrVersions {
+		version := v + 1
+		capacity := 0
+		for _, n := range layout.blocks {
+			capacity += n
+		}
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) > capacity*8 {
+			continue
+		}
+
+		var bits qrBits
+		bits.append(0b0100, 4)
+		bits.append(len(data), countBits)
+		for _, b := range data {
+			bits.append(int(b), 8)
+		}
+		bits.append(0, min(4, capacity*8-len(bits)))
+		bits.append(0, (8-len(bits)%8)%8)
+		codewords := bits.bytes()
+		for pad := 0xEC; len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+			codewords = append(codewords, byte(pad))
+		}
+
+		qr := newQRCode(version, layout)
+		qr.placeCodewords(interleaveBlocks(codewords, layout))
+		qr.applyBestMask()
+		return qr, nil
+	}
+	return nil, fmt.Errorf("%d bytes are too many for a QR code", len(data))
+}
+
+// qrBits is a bit stream, one bit per element
+type qrBits []bool
+
+func (b *qrBits) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, v>>i&1 == 1)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// interleaveBlocks splits codewords into the blocks of layout, adds their
+// error correction codewords, and interleaves them as they are placed
+func interleaveBlocks(codewords []byte, layout qrVersion) []byte {
+	divisor := reedSolomonDivisor(layout.ecLen)
+	var data, ec [][]byte
+	for _, n := range layout.blocks {
+		data = append(data, codewords[:n])
+		ec = append(ec, reedSolomonRemainder(codewords[:n], divisor))
+		codewords = codewords[n:]
+	}
+
+	var out []byte
+	longest := layout.blocks[len(layout.blocks)-1]
+	for i := 0; i < longest; i++ {
+		for _, block := range data {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecLen; i++ {
+		for _, block := range ec {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+// gfMultiply multiplies in GF(256) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ z>>7*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// reedSolomonDivisor returns the generator polynomial of degree n, highest
+// coefficient first, without its leading 1
+func reedSolomonDivisor(n int) []byte {
+	divisor := make([]byte, n)
+	divisor[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range divisor {
+			divisor[j] = gfMultiply(divisor[j], root)
+			if j+1 < n {
+				divisor[j] ^= divisor[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+	return divisor
+}
+
+// reedSolomonRemainder returns the error correction codewords of data
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+// newQRCode lays out the function patterns of version: finder, timing and
+// alignment patterns, and the version information of versions 7 and up.
+// The format information is reserved until the mask is chosen.
+func newQRCode(version int, layout qrVersion) *qrCode {
+	size := version*4 + 17
+	qr := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range qr.modules {
+		qr.modules[y] = make([]bool, size)
+		qr.function[y] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		qr.set(6, i, i%2 == 0)
+		qr.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := max(abs(dx), abs(dy))
+					qr.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	last := len(layout.alignment) - 1
+	for i, x := range layout.alignment {
+		for j, y := range layout.alignment {
+			// Alignment patterns overlapping finder patterns are left out
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ rem>>11*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			qr.set(a, b, dark)
+			qr.set(b, a, dark)
+		}
+	}
+	qr.placeFormat(0)
+	return qr
+}
+
+// set sets the function module at column x, row y
+func (qr *qrCode) set(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+// placeFormat places the format information, error correction level M and
+// mask, in both its copies, with the dark module beside the lower one
+func (qr *qrCode) placeFormat(mask int) {
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ rem>>9*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		qr.set(8, i, bit(i))
+	}
+	qr.set(8, 7, bit(6))
+	qr.set(8, 8, bit(7))
+	qr.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		qr.set(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.set(8, qr.size-15+i, bit(i))
+	}
+	qr.set(8, qr.size-8, true)
+}
+
+// placeCodewords fills the modules that are not function modules with
+// codewords, in two-module columns zigzagging up and down from the right
+func (qr *qrCode) placeCodewords(codewords []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		// The vertical timing pattern is skipped over
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vert
+				}
+				if !qr.function[y][x] && i < len(codewords)*8 {
+					qr.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by mask
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qr.function[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask that leaves the fewest patterns scanners
+// could mistake for function patterns
+func (qr *qrCode) applyBestMask() {
+	best, lowest := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.placeFormat(mask)
+		if p := qr.penalty(); lowest < 0 || p < lowest {
+			best, lowest = mask, p
+		}
+		// Masks are their own inverse
+		qr.applyMask(mask)
+	}
+	qr.applyMask(best)
+	qr.placeFormat(best)
+}
+
+// penalty scores the modules as the QR code specification does: runs of
+// five or more modules of a colour, 2x2 blocks of a colour, patterns like
+// those of the finders, and an imbalance of dark and light
+func (qr *qrCode) penalty() int {
+	score := 0
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return qr.modules[x][y]
+		}
+		return qr.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < qr.size; y++ {
+			run := 1
+			for x := 1; x <= qr.size; x++ {
+				if x < qr.size && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+7 <= qr.size; x++ {
+				match := true
+				for i, dark := range finder {
+					if at(x+i, y, vertical) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (qr.light(x-4, x, y, vertical) || qr.light(x+7, x+11, y, vertical)) {
+					score += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x+1 < qr.size && y+1 < qr.size {
+				c := qr.modules[y][x]
+				if qr.modules[y][x+1] == c && qr.modules[y+1][x] == c && qr.modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+	total := qr.size * qr.size
+	score += abs(dark*20-total*10) / total * 10
+	return score
+}
+
+// light reports whether the modules from..to of line y are light, counting
+// those beyond the edge, which is the light quiet zone
+func (qr *qrCode) light(from, to, y int, vertical bool) bool {
+	for x := from; x < to; x++ {
+		if x < 0 || x >= qr.size {
+			continue
+		}
+		if vertical && qr.modules[x][y] || !vertical && qr.modules[y][x] {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
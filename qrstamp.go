@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Pages QR codes are stamped on
+const (
+	QRStampFirst = "first"
+	QRStampAll   = "all"
+)
+
+const (
+	// qrStampWidth is the width of a QR stamp with its quiet zone, 2cm
+	qrStampWidth = 20 * pointsPerMM
+	// qrModulePixels is the size of a module in the image of a QR stamp,
+	// large enough for viewers not to blur modules as they scale it
+	qrModulePixels = 8
+	// qrQuietZone is the light border of a QR code, in modules
+	qrQuietZone = 4
+)
+
+// verificationText returns what the QR stamp of job encodes: VERIFY_URL
+// with the job ID in place of {job}, or the job ID alone
+func (fh *FileHandler) verificationText(job *Job) string {
+	if fh.verifyURL == "" {
+		return job.ID
+	}
+	return strings.ReplaceAll(fh.verifyURL, "{job}", url.PathEscape(job.ID))
+}
+
+// stampQR writes a copy of the PDF at in to out with a QR code of text in
+// a corner of its first page, or of every page
+func stampQR(in, out, text string, opts MergeOptions) error {
+	qr, err := encodeQR([]byte(text))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, qr.image()); err != nil {
+		return err
+	}
+
+	pos := stampPositions[opts.QRPosition]
+	if pos == "" {
+		pos = "bl"
+	}
+	// The quiet zone keeps the code itself clear of the edges
+	dx, dy := 6, 6
+	if pos[1] == 'r' {
+		dx = -6
+	}
+	if pos[0] == 't' {
+		dy = -6
+	}
+	scale := qrStampWidth / float64((qr.size+2*qrQuietZone)*qrModulePixels)
+	desc := fmt.Sprintf("position:%s, offset:%d %d, scalefactor:%.4f abs, rotation:0, opacity:1", pos, dx, dy, scale)
+	wm, err := api.ImageWatermarkForReader(&buf, desc, true, false, types.POINTS)
+	if err != nil {
+		return fmt.Errorf("error creating QR stamp: %v", err)
+	}
+	var pages []string
+	if opts.QRStamp == QRStampFirst {
+		pages = []string{"1"}
+	}
+	return api.AddWatermarksFile(in, out, pages, wm, pdfConfig())
+}
+
+// image draws qr black on white with its quiet zone
+func (qr *qrCode) image() image.Image {
+	size := (qr.size + 2*qrQuietZone) * qrModulePixels
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			mx, my := x/qrModulePixels-qrQuietZone, y/qrModulePixels-qrQuietZone
+			c := color.Gray{Y: 0xff}
+			if mx >= 0 && my >= 0 && mx < qr.size && my < qr.size && qr.modules[my][mx] {
+				c = color.Gray{}
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+	return img
+}
@@ -0,0 +1,973 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// redactRegion is an area to redact, in points from the bottom-left corner
+// of the unrotated page. Page 0 applies the region to every page.
+type redactRegion struct {
+	Page   int     `json:"page"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// handleRedact removes the text, images and annotations under the given
+// regions or text matches of an uploaded PDF, covers them with black boxes
+// and returns the redacted PDF
+func (fh *FileHandler) handleRedact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		writeError(w, "Error parsing form: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		writeError(w, "No file uploaded", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	regions, err := parseRedactRegions(r.FormValue("regions"))
+	if err != nil {
+		writeError(w, err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	var pattern *regexp.Regexp
+	if p := r.FormValue("pattern"); p != "" {
+		if pattern, err = regexp.Compile(p); err != nil {
+			writeError(w, "Invalid pattern: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+			return
+		}
+	}
+	if len(regions) == 0 && pattern == nil {
+		writeError(w, "Nothing to redact: give regions or a pattern", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	in := fh.uploadPath(time.Now().Format("20060102_150405"), 0, files[0].Filename)
+	out := strings.TrimSuffix(in, filepath.Ext(in)) + "_redacted.pdf"
+	defer os.Remove(in)
+	defer os.Remove(out)
+	sum, err := saveUpload(files[0], in)
+	if err != nil {
+		writeError(w, "Error saving file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	fh.auditRequestUpload(r, files[0], sum, "redact")
+
+	count, err := redactPDF(in, out, regions, pattern)
+	if err != nil {
+		writeError(w, "Error redacting PDF: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+
+	name := "redacted_" + strings.TrimSuffix(files[0].Filename, filepath.Ext(files[0].Filename)) + ".pdf"
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("X-Redactions", strconv.Itoa(count))
+	http.ServeFile(w, r, out)
+}
+
+// parseRedactRegions parses the JSON array of regions to redact
+func parseRedactRegions(s string) ([]redactRegion, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var regions []redactRegion
+	if err := json.Unmarshal([]byte(s), &regions); err != nil {
+		return nil, fmt.Errorf("Invalid regions: %v", err)
+	}
+	for _, reg := range regions {
+		if reg.Page < 0 || reg.Width <= 0 || reg.Height <= 0 {
+			return nil, errors.New("Invalid regions: page must not be negative and width and height must be positive")
+		}
+	}
+	return regions, nil
+}
+
+// redactPDF writes a copy of the PDF at in with the regions and the text
+// matching pattern redacted to out, and returns the number of redacted areas
+func redactPDF(in, out string, regions []redactRegion, pattern *regexp.Regexp) (int, error) {
+	ctx, err := readContext(in)
+	if err != nil {
+		return 0, fmt.Errorf("error reading PDF: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return 0, err
+	}
+
+	fonts := map[int]*pdfFont{}
+	redacted, widgets := map[int]bool{}, map[int]bool{}
+	count := 0
+	for page := 1; page <= ctx.PageCount; page++ {
+		n, err := redactPage(ctx, fonts, redacted, widgets, page, regions, pattern)
+		if err != nil {
+			return 0, fmt.Errorf("error redacting page %d: %v", page, err)
+		}
+		count += n
+	}
+
+	// Pages sharing resources may still list the redacted originals
+	if len(redacted) > 0 {
+		for page := 1; page <= ctx.PageCount; page++ {
+			if err := pruneXObjects(ctx, page, redacted); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(widgets) > 0 {
+		if err := pruneFields(ctx.XRefTable, widgets); err != nil {
+			return 0, err
+		}
+	}
+	return count, api.WriteContextFile(ctx, out)
+}
+
+func redactPage(ctx *model.Context, fonts map[int]*pdfFont, redacted, widgets map[int]bool, page int, regions []redactRegion, pattern *regexp.Regexp) (int, error) {
+	pageDict, _, inherited, err := ctx.PageDict(page, false)
+	if err != nil {
+		return 0, err
+	}
+
+	// Regions are relative to the media box
+	var originX, originY float64
+	if inherited.MediaBox != nil {
+		originX, originY = inherited.MediaBox.LL.X, inherited.MediaBox.LL.Y
+	}
+	var areas []*types.Rectangle
+	for _, reg := range regions {
+		if reg.Page == 0 || reg.Page == page {
+			x, y := originX+reg.X, originY+reg.Y
+			areas = append(areas, types.NewRectangle(x, y, x+reg.Width, y+reg.Height))
+		}
+	}
+
+	content, resources, err := pageSource(ctx, pageDict, inherited)
+	if err != nil {
+		return 0, err
+	}
+
+	if pattern != nil {
+		r := &redactor{ctx: ctx, fonts: fonts, collect: true}
+		if _, err := r.process(content, resources, identity, 0); err != nil {
+			return 0, err
+		}
+		areas = append(areas, matchAreas(r.glyphs, pattern)...)
+	}
+	if len(areas) == 0 {
+		return 0, nil
+	}
+
+	// Rewrite the content against a private copy of the resources, which
+	// may be shared with other pages
+	resources = resources.Clone().(types.Dict)
+	r := &redactor{ctx: ctx, fonts: fonts, areas: areas, redacted: redacted}
+	body, err := r.process(content, resources, identity, 0)
+	if err != nil {
+		return 0, err
+	}
+	pageDict["Resources"] = resources
+
+	var buf bytes.Buffer
+	buf.WriteString("q\n")
+	buf.Write(body)
+	buf.WriteString("Q\n0 g\n")
+	for _, a := range areas {
+		fmt.Fprintf(&buf, "%.2f %.2f %.2f %.2f re f\n", a.LL.X, a.LL.Y, a.Width(), a.Height())
+	}
+	ref, err := newContentStream(ctx.XRefTable, buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	pageDict["Contents"] = *ref
+
+	if err := redactAnnotations(ctx.XRefTable, pageDict, areas, widgets); err != nil {
+		return 0, err
+	}
+	return len(areas), nil
+}
+
+// pageSource returns the content of a page and the resources it is drawn
+// with
+func pageSource(ctx *model.Context, pageDict types.Dict, inherited *model.InheritedPageAttrs) ([]byte, types.Dict, error) {
+	content, err := ctx.PageContent(pageDict)
+	if err != nil && err != model.ErrNoContent {
+		return nil, nil, err
+	}
+	resources, err := ctx.DereferenceDict(pageDict["Resources"])
+	if err != nil {
+		return nil, nil, err
+	}
+	if resources == nil {
+		resources = inherited.Resources
+	}
+	if resources == nil {
+		resources = types.Dict{}
+	}
+	return content, resources, nil
+}
+
+// pruneFields removes redacted widgets from the form, together with the
+// fields left without widgets
+func pruneFields(xRefTable *model.XRefTable, widgets map[int]bool) error {
+	acroForm, err := xRefTable.DereferenceDict(xRefTable.RootDict["AcroForm"])
+	if err != nil || acroForm == nil {
+		return err
+	}
+	fields, err := xRefTable.DereferenceArray(acroForm["Fields"])
+	if err != nil {
+		return err
+	}
+	acroForm["Fields"] = pruneFieldArray(xRefTable, fields, widgets)
+	return nil
+}
+
+func pruneFieldArray(xRefTable *model.XRefTable, fields types.Array, widgets map[int]bool) types.Array {
+	kept := types.Array{}
+	for _, obj := range fields {
+		if ref, ok := obj.(types.IndirectRef); ok && widgets[ref.ObjectNumber.Value()] {
+			continue
+		}
+		field, err := xRefTable.DereferenceDict(obj)
+		if err != nil || field == nil {
+			kept = append(kept, obj)
+			continue
+		}
+		if kids, err := xRefTable.DereferenceArray(field["Kids"]); err == nil && len(kids) > 0 {
+			kids = pruneFieldArray(xRefTable, kids, widgets)
+			if len(kids) == 0 {
+				continue
+			}
+			field["Kids"] = kids
+		}
+		kept = append(kept, obj)
+	}
+	return kept
+}
+
+// pruneXObjects removes redacted XObjects a page lists in its resources
+// without drawing them
+func pruneXObjects(ctx *model.Context, page int, redacted map[int]bool) error {
+	pageDict, _, inherited, err := ctx.PageDict(page, false)
+	if err != nil {
+		return err
+	}
+	resources, err := ctx.DereferenceDict(pageDict["Resources"])
+	if err != nil {
+		return err
+	}
+	if resources == nil {
+		resources = inherited.Resources
+	}
+	xObjects, err := ctx.DereferenceDict(resources["XObject"])
+	if err != nil || xObjects == nil {
+		return err
+	}
+	var stale []string
+	for name, obj := range xObjects {
+		if ref, ok := obj.(types.IndirectRef); ok && redacted[ref.ObjectNumber.Value()] {
+			stale = append(stale, name)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	content, err := ctx.PageContent(pageDict)
+	if err != nil && err != model.ErrNoContent {
+		return err
+	}
+	drawn := map[string]bool{}
+	l := &contentLexer{buf: content}
+	for {
+		op, err := l.next()
+		if err != nil {
+			return err
+		}
+		if op == nil {
+			break
+		}
+		if op.name == "Do" && len(op.operands) == 1 {
+			drawn[op.operands[0].name()] = true
+		}
+	}
+
+	resources = resources.Clone().(types.Dict)
+	xObjects = xObjects.Clone().(types.Dict)
+	for _, name := range stale {
+		if !drawn[name] {
+			delete(xObjects, name)
+		}
+	}
+	resources["XObject"] = xObjects
+	pageDict["Resources"] = resources
+	return nil
+}
+
+// redactAnnotations removes the annotations overlapping areas, together with
+// their popups, and collects the removed form widgets
+func redactAnnotations(xRefTable *model.XRefTable, pageDict types.Dict, areas []*types.Rectangle, widgets map[int]bool) error {
+	annots, err := xRefTable.DereferenceArray(pageDict["Annots"])
+	if err != nil || len(annots) == 0 {
+		return err
+	}
+
+	removed := map[int]bool{}
+	var keep types.Array
+	for _, obj := range annots {
+		annot, err := xRefTable.DereferenceDict(obj)
+		if err != nil || annot == nil {
+			continue
+		}
+		rect, err := xRefTable.RectForArray(annot.ArrayEntry("Rect"))
+		if err == nil {
+			// Some writers swap the corners
+			rect = transformBox(identity, rect.LL.X, rect.LL.Y, rect.UR.X, rect.UR.Y)
+		}
+		if err != nil || !anyOverlap(rect, areas) {
+			keep = append(keep, obj)
+			continue
+		}
+
+		ref, ok := obj.(types.IndirectRef)
+		if !ok {
+			continue
+		}
+		removed[ref.ObjectNumber.Value()] = true
+		if subtype := annot.NameEntry("Subtype"); subtype != nil && *subtype == "Widget" {
+			widgets[ref.ObjectNumber.Value()] = true
+		}
+	}
+
+	// Popups show the contents of their removed parent
+	var kept types.Array
+	for _, obj := range keep {
+		annot, _ := xRefTable.DereferenceDict(obj)
+		if parent, ok := annot["Parent"].(types.IndirectRef); ok && removed[parent.ObjectNumber.Value()] {
+			if subtype := annot.NameEntry("Subtype"); subtype != nil && *subtype == "Popup" {
+				continue
+			}
+		}
+		kept = append(kept, obj)
+	}
+
+	if len(kept) > 0 {
+		pageDict["Annots"] = kept
+	} else {
+		pageDict.Delete("Annots")
+	}
+	return nil
+}
+
+// glyph is a character drawn on a page, located in default user space
+type glyph struct {
+	text string
+	box  *types.Rectangle
+}
+
+// matchAreas returns the areas covering the text matches of pattern, one
+// per line of each match
+func matchAreas(glyphs []glyph, pattern *regexp.Regexp) []*types.Rectangle {
+	text, owner := glyphText(glyphs)
+
+	var areas []*types.Rectangle
+	for _, m := range pattern.FindAllStringIndex(text, -1) {
+		areas = append(areas, glyphAreas(glyphs, owner[m[0]:m[1]])...)
+	}
+	return areas
+}
+
+// glyphText returns the text drawn by glyphs, with spaces and line breaks
+// where they are positioned apart, and the glyph of each of its bytes, or
+// -1 for the inserted separators
+func glyphText(glyphs []glyph) (string, []int) {
+	var text strings.Builder
+	var owner []int
+	for i, g := range glyphs {
+		if i > 0 {
+			// Words and lines are often positioned rather than separated
+			// by spaces
+			prev := glyphs[i-1]
+			h := math.Min(prev.box.Height(), g.box.Height())
+			switch {
+			case !sameLine(prev.box, g.box):
+				text.WriteByte('\n')
+				owner = append(owner, -1)
+			case g.box.LL.X-prev.box.UR.X > h*0.15 && prev.text != " " && g.text != " ":
+				text.WriteByte(' ')
+				owner = append(owner, -1)
+			}
+		}
+		text.WriteString(g.text)
+		for range []byte(g.text) {
+			owner = append(owner, i)
+		}
+	}
+	return text.String(), owner
+}
+
+// glyphAreas returns the areas covering the given glyphs, one per line
+func glyphAreas(glyphs []glyph, indices []int) []*types.Rectangle {
+	var areas []*types.Rectangle
+	var area *types.Rectangle
+	for _, i := range indices {
+		if i < 0 {
+			continue
+		}
+		box := glyphs[i].box
+		if area != nil && !sameLine(area, box) {
+			areas = append(areas, area)
+			area = nil
+		}
+		if area == nil {
+			area = types.NewRectangle(box.LL.X, box.LL.Y, box.UR.X, box.UR.Y)
+			continue
+		}
+		area = unionBox(area, box)
+	}
+	if area != nil {
+		areas = append(areas, area)
+	}
+	return areas
+}
+
+// unionBox returns the smallest rectangle containing a and b
+func unionBox(a, b *types.Rectangle) *types.Rectangle {
+	return types.NewRectangle(math.Min(a.LL.X, b.LL.X), math.Min(a.LL.Y, b.LL.Y),
+		math.Max(a.UR.X, b.UR.X), math.Max(a.UR.Y, b.UR.Y))
+}
+
+func sameLine(a, b *types.Rectangle) bool {
+	return math.Abs(a.LL.Y-b.LL.Y) < math.Min(a.Height(), b.Height())/2
+}
+
+// anyOverlap reports whether a significant part of box lies in one of the
+// areas; boxes without area count when their centre does
+func anyOverlap(box *types.Rectangle, areas []*types.Rectangle) bool {
+	size := box.Width() * box.Height()
+	for _, a := range areas {
+		if size == 0 {
+			if covers(a, (box.LL.X+box.UR.X)/2, (box.LL.Y+box.UR.Y)/2) {
+				return true
+			}
+			continue
+		}
+		w := math.Min(box.UR.X, a.UR.X) - math.Max(box.LL.X, a.LL.X)
+		h := math.Min(box.UR.Y, a.UR.Y) - math.Max(box.LL.Y, a.LL.Y)
+		if w > 0 && h > 0 && w*h >= size/10 {
+			return true
+		}
+	}
+	return false
+}
+
+func covers(a *types.Rectangle, x, y float64) bool {
+	return x >= a.LL.X && x <= a.UR.X && y >= a.LL.Y && y <= a.UR.Y
+}
+
+// transformBox returns the bounding box of a rectangle mapped by m
+func transformBox(m matrix, llx, lly, urx, ury float64) *types.Rectangle {
+	box := types.NewRectangle(math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1))
+	for _, p := range [][2]float64{{llx, lly}, {urx, lly}, {urx, ury}, {llx, ury}} {
+		x, y := m.apply(p[0], p[1])
+		box.LL.X, box.LL.Y = math.Min(box.LL.X, x), math.Min(box.LL.Y, y)
+		box.UR.X, box.UR.Y = math.Max(box.UR.X, x), math.Max(box.UR.Y, y)
+	}
+	return box
+}
+
+// redactor interprets content streams, either collecting what they draw or
+// rewriting them without what lies in the redacted areas
+type redactor struct {
+	ctx     *model.Context
+	fonts   map[int]*pdfFont
+	areas   []*types.Rectangle
+	collect bool
+	glyphs  []glyph
+	names   int
+	// images and paths collect the images drawn and the bounding boxes of
+	// the painted paths
+	images []placedImage
+	paths  []*types.Rectangle
+	// redacted collects the object numbers of replaced XObjects
+	redacted map[int]bool
+}
+
+// placedImage is an image XObject drawn on a page
+type placedImage struct {
+	sd    *types.StreamDict
+	objNr int
+	ctm   matrix
+}
+
+// graphicsState is the part of the graphics state that positions glyphs
+// and images
+type graphicsState struct {
+	ctm       matrix
+	charSpace float64
+	wordSpace float64
+	scale     float64
+	leading   float64
+	rise      float64
+	size      float64
+	font      *pdfFont
+	// whiteFill is set while the fill color is white
+	whiteFill bool
+}
+
+// Forms drawing themselves are cut off at this depth
+const maxFormDepth = 12
+
+// process interprets a content stream drawn with the given resources and
+// transformation. When rewriting, resources must be private to the stream
+// as redacted images and forms are added to it.
+func (r *redactor) process(content []byte, resources types.Dict, ctm matrix, depth int) ([]byte, error) {
+	var out bytes.Buffer
+	gs := graphicsState{ctm: ctm, scale: 1, font: loadFont(r.ctx.XRefTable, nil)}
+	var stack []graphicsState
+	tm, tlm := identity, identity
+	used, replaced := map[string]bool{}, map[string]bool{}
+	var path *types.Rectangle
+
+	l := &contentLexer{buf: content}
+	for {
+		op, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if op == nil {
+			break
+		}
+
+		o := op.operands
+		num := func(i int) float64 {
+			if i < len(o) && o[i].kind == 'n' {
+				return o[i].num
+			}
+			return 0
+		}
+		replacement := op.raw
+		switch op.name {
+		case "q":
+			stack = append(stack, gs)
+		case "Q":
+			if len(stack) > 0 {
+				gs = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "cm":
+			if m, ok := operandMatrix(o); ok {
+				gs.ctm = m.mul(gs.ctm)
+			}
+		case "BT":
+			tm, tlm = identity, identity
+		case "Tc":
+			gs.charSpace = num(0)
+		case "Tw":
+			gs.wordSpace = num(0)
+		case "Tz":
+			gs.scale = num(0) / 100
+		case "TL":
+			gs.leading = num(0)
+		case "Ts":
+			gs.rise = num(0)
+		case "Tf":
+			if len(o) == 2 {
+				gs.font = r.font(resources, o[0].name())
+				gs.size = num(1)
+			}
+		case "Td", "TD":
+			if op.name == "TD" {
+				gs.leading = -num(1)
+			}
+			tlm = matrix{1, 0, 0, 1, num(0), num(1)}.mul(tlm)
+			tm = tlm
+		case "Tm":
+			if m, ok := operandMatrix(o); ok {
+				tm, tlm = m, m
+			}
+		case "T*":
+			tlm = matrix{1, 0, 0, 1, 0, -gs.leading}.mul(tlm)
+			tm = tlm
+		case "Tj", "TJ", "'", "\"":
+			var prefix []byte
+			if op.name == "\"" && len(o) == 3 {
+				gs.wordSpace, gs.charSpace = num(0), num(1)
+				prefix = []byte(fmt.Sprintf("%s Tw %s Tc T* ", o[0].raw, o[1].raw))
+				o = o[2:]
+			} else if op.name == "'" {
+				prefix = []byte("T* ")
+			}
+			if prefix != nil {
+				tlm = matrix{1, 0, 0, 1, 0, -gs.leading}.mul(tlm)
+				tm = tlm
+			}
+			if len(o) != 1 {
+				break
+			}
+			items := o
+			if o[0].kind == '[' {
+				items = o[0].items
+			}
+			if shown, changed := r.showText(&gs, &tm, items); changed {
+				replacement = append(prefix, shown...)
+			}
+		case "Do":
+			if len(o) == 1 {
+				var err error
+				replacement, err = r.drawXObject(replacement, resources, o[0].name(), gs.ctm, depth)
+				if err != nil {
+					return nil, err
+				}
+				if bytes.Equal(replacement, op.raw) {
+					used[o[0].name()] = true
+				} else {
+					replaced[o[0].name()] = true
+				}
+			}
+		case "BI":
+			// Inline images are small; drop the ones touching an area
+			if r.collect {
+				r.paths = append(r.paths, transformBox(gs.ctm, 0, 0, 1, 1))
+			} else if anyOverlap(transformBox(gs.ctm, 0, 0, 1, 1), r.areas) {
+				replacement = nil
+			}
+		case "g", "rg", "k":
+			// CMYK is white without ink, the others at full intensity
+			white := 1.0
+			if op.name == "k" {
+				white = 0
+			}
+			gs.whiteFill = len(o) > 0
+			for i := range o {
+				if num(i) != white {
+					gs.whiteFill = false
+				}
+			}
+		case "m", "l", "c", "v", "y", "re":
+			if r.collect {
+				for i := 0; i+1 < len(o); i += 2 {
+					box := transformBox(gs.ctm, num(i), num(i+1), num(i), num(i+1))
+					if op.name == "re" {
+						box = transformBox(gs.ctm, num(0), num(1), num(0)+num(2), num(1)+num(3))
+					}
+					if path != nil {
+						box = unionBox(path, box)
+					}
+					path = box
+					if op.name == "re" {
+						break
+					}
+				}
+			}
+		case "n":
+			path = nil
+		case "S", "s", "f", "F", "f*", "B", "B*", "b", "b*":
+			// Areas filled white are taken for background
+			fillOnly := op.name[0] == 'f' || op.name[0] == 'F'
+			if path != nil && !(fillOnly && gs.whiteFill) {
+				r.paths = append(r.paths, path)
+			}
+			path = nil
+		}
+
+		if !r.collect && replacement != nil {
+			out.Write(replacement)
+			out.WriteByte('\n')
+		}
+	}
+
+	// Drop the originals of redacted XObjects so they are not written out
+	var unused []string
+	for name := range replaced {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		xObjects, _ := r.ctx.DereferenceDict(resources["XObject"])
+		xObjects = xObjects.Clone().(types.Dict)
+		for _, name := range unused {
+			delete(xObjects, name)
+		}
+		resources["XObject"] = xObjects
+	}
+	return out.Bytes(), nil
+}
+
+// showText positions the glyphs of a text operator. When some of them are
+// redacted, it returns a TJ operator drawing the others in place.
+func (r *redactor) showText(gs *graphicsState, tm *matrix, items []contentObj) ([]byte, bool) {
+	f := gs.font
+	var out bytes.Buffer
+	var run []int
+	adjust := 0.0
+	changed := false
+	flush := func() {
+		if len(run) > 0 {
+			fmt.Fprintf(&out, "<%x>", f.encode(run))
+			run = nil
+		}
+	}
+
+	out.WriteByte('[')
+	for _, item := range items {
+		if item.kind == 'n' {
+			flush()
+			adjust += item.num
+			*tm = matrix{1, 0, 0, 1, -item.num / 1000 * gs.size * gs.scale, 0}.mul(*tm)
+			continue
+		}
+		if item.kind != 's' {
+			continue
+		}
+
+		for _, code := range f.codes(item.str) {
+			w := f.width(code)
+			trm := matrix{gs.size * gs.scale, 0, 0, gs.size, 0, gs.rise}.mul(*tm).mul(gs.ctm)
+			box := transformBox(trm, 0, -0.2, w, 0.8)
+			tx := w*gs.size + gs.charSpace
+			if code == ' ' && !f.twoByte {
+				tx += gs.wordSpace
+			}
+			tx *= gs.scale
+			*tm = matrix{1, 0, 0, 1, tx, 0}.mul(*tm)
+
+			if r.collect {
+				r.glyphs = append(r.glyphs, glyph{text: f.text(code), box: box})
+				continue
+			}
+			if anyOverlap(box, r.areas) {
+				// Keep the following glyphs in place
+				flush()
+				if unit := gs.size * gs.scale; unit != 0 {
+					adjust -= tx / unit * 1000
+				}
+				changed = true
+				continue
+			}
+			if adjust != 0 {
+				fmt.Fprintf(&out, " %.3f ", adjust)
+				adjust = 0
+			}
+			run = append(run, code)
+		}
+	}
+	flush()
+	if adjust != 0 {
+		fmt.Fprintf(&out, " %.3f", adjust)
+	}
+	out.WriteString("] TJ")
+	return out.Bytes(), changed
+}
+
+// drawXObject handles a Do operator, returning its replacement: the
+// operator itself, one drawing a redacted copy of the XObject, or nothing
+func (r *redactor) drawXObject(raw []byte, resources types.Dict, name string, ctm matrix, depth int) ([]byte, error) {
+	xObjects, err := r.ctx.DereferenceDict(resources["XObject"])
+	if err != nil || xObjects == nil {
+		return raw, nil
+	}
+	ref, ok := xObjects[name].(types.IndirectRef)
+	if !ok {
+		return raw, nil
+	}
+	sd, _, err := r.ctx.DereferenceStreamDict(ref)
+	if err != nil || sd == nil {
+		return raw, nil
+	}
+
+	switch subtype := sd.Dict.NameEntry("Subtype"); {
+	case subtype != nil && *subtype == "Image":
+		if r.collect {
+			r.images = append(r.images, placedImage{sd: sd, objNr: ref.ObjectNumber.Value(), ctm: ctm})
+			return raw, nil
+		}
+		if !anyOverlap(transformBox(ctm, 0, 0, 1, 1), r.areas) {
+			return raw, nil
+		}
+		r.redacted[ref.ObjectNumber.Value()] = true
+		img, err := r.redactImage(sd, ref.ObjectNumber.Value(), ctm)
+		if err != nil || img == nil {
+			// Leave out images that cannot be edited
+			return nil, nil
+		}
+		return []byte("/" + r.addXObject(resources, *img) + " Do"), nil
+
+	case subtype != nil && *subtype == "Form":
+		if depth >= maxFormDepth {
+			return raw, nil
+		}
+		m := identity
+		if a, err := r.ctx.DereferenceArray(sd.Dict["Matrix"]); err == nil && len(a) == 6 {
+			for i, o := range a {
+				m[i], _ = r.ctx.DereferenceNumber(o)
+			}
+		}
+		formCTM := m.mul(ctm)
+		if !r.collect {
+			bbox, err := r.ctx.RectForArray(sd.Dict.ArrayEntry("BBox"))
+			if err != nil || !anyOverlap(transformBox(formCTM, bbox.LL.X, bbox.LL.Y, bbox.UR.X, bbox.UR.Y), r.areas) {
+				return raw, nil
+			}
+		}
+
+		if err := sd.Decode(); err != nil {
+			return raw, nil
+		}
+		formResources, err := r.ctx.DereferenceDict(sd.Dict["Resources"])
+		if err != nil {
+			return nil, err
+		}
+		if formResources == nil {
+			// Forms without resources use those of the page
+			formResources = resources
+		}
+		if r.collect {
+			_, err := r.process(sd.Content, formResources, formCTM, depth+1)
+			return raw, err
+		}
+
+		r.redacted[ref.ObjectNumber.Value()] = true
+		formResources = formResources.Clone().(types.Dict)
+		content, err := r.process(sd.Content, formResources, formCTM, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		form, err := r.ctx.NewStreamDictForBuf(content)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range sd.Dict {
+			switch k {
+			case "Length", "Filter", "DecodeParms":
+			default:
+				form.Dict[k] = v
+			}
+		}
+		form.Dict["Resources"] = formResources
+		if err := form.Encode(); err != nil {
+			return nil, err
+		}
+		formRef, err := r.ctx.IndRefForNewObject(*form)
+		if err != nil {
+			return nil, err
+		}
+		return []byte("/" + r.addXObject(resources, *formRef) + " Do"), nil
+	}
+	return raw, nil
+}
+
+// redactImage returns a copy of an image with the pixels in the redacted
+// areas painted black, or nil if the image cannot be decoded
+func (r *redactor) redactImage(sd *types.StreamDict, objNr int, ctm matrix) (*types.IndirectRef, error) {
+	if mask := sd.Dict.BooleanEntry("ImageMask"); mask != nil && *mask {
+		return nil, nil
+	}
+	extracted, err := pdfcpu.ExtractImage(r.ctx, sd, false, "", objNr, false)
+	if err != nil || extracted == nil || extracted.Reader == nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(extracted)
+	if err != nil {
+		return nil, nil
+	}
+
+	b := src.Bounds()
+	img := image.NewRGBA(b)
+	draw.Draw(img, b, src, b.Min, draw.Src)
+	black := color.RGBA{A: 255}
+	w, h := float64(b.Dx()), float64(b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			// Images fill the unit square, with their first row at the top
+			px, py := ctm.apply((float64(x-b.Min.X)+0.5)/w, 1-(float64(y-b.Min.Y)+0.5)/h)
+			for _, a := range r.areas {
+				if covers(a, px, py) {
+					img.Set(x, y, black)
+					break
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	redacted, _, _, err := model.CreateImageStreamDict(r.ctx.XRefTable, &buf, false, false)
+	if err != nil {
+		return nil, err
+	}
+	if smask, ok := sd.Dict["SMask"]; ok {
+		redacted.Dict["SMask"] = smask
+	}
+	return r.ctx.IndRefForNewObject(*redacted)
+}
+
+// addXObject registers an XObject under a new name in resources
+func (r *redactor) addXObject(resources types.Dict, ref types.IndirectRef) string {
+	xObjects, _ := r.ctx.DereferenceDict(resources["XObject"])
+	if xObjects == nil {
+		xObjects = types.Dict{}
+	} else {
+		xObjects = xObjects.Clone().(types.Dict)
+	}
+	for {
+		r.names++
+		name := "Redacted" + strconv.Itoa(r.names)
+		if _, ok := xObjects[name]; !ok {
+			xObjects[name] = ref
+			resources["XObject"] = xObjects
+			return name
+		}
+	}
+}
+
+// font returns the font registered under name in resources
+func (r *redactor) font(resources types.Dict, name string) *pdfFont {
+	fonts, err := r.ctx.DereferenceDict(resources["Font"])
+	if err != nil || fonts == nil {
+		return loadFont(r.ctx.XRefTable, nil)
+	}
+	ref, ok := fonts[name].(types.IndirectRef)
+	if !ok {
+		d, _ := r.ctx.DereferenceDict(fonts[name])
+		return loadFont(r.ctx.XRefTable, d)
+	}
+	if f, ok := r.fonts[ref.ObjectNumber.Value()]; ok {
+		return f
+	}
+	d, _ := r.ctx.DereferenceDict(ref)
+	f := loadFont(r.ctx.XRefTable, d)
+	r.fonts[ref.ObjectNumber.Value()] = f
+	return f
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Longest veto reason kept for the job status
+const maxVetoReason = 1024
+
+// releaseHook is asked whether the output of each job may be released, so
+// sites can scan bundles before anyone downloads them, e.g. for data loss
+// prevention. It is an HTTP endpoint the output is posted to, or a program
+// reading it on its standard input in the converter sandbox.
+type releaseHook struct {
+	url     string
+	client  *http.Client
+	command []string
+	sandbox *sandbox
+}
+
+// vetoError is the refusal of a release hook to release an output
+type vetoError struct {
+	reason string
+}
+
+func (e *vetoError) Error() string { return "release vetoed: " + e.reason }
+
+// loadReleaseHook reads RELEASE_HOOK_URL or RELEASE_HOOK_COMMAND, of which
+// only one may be set, and returns nil without either. Commands run in sb.
+func loadReleaseHook(sb *sandbox) (*releaseHook, error) {
+	u, command := os.Getenv("RELEASE_HOOK_URL"), strings.Fields(os.Getenv("RELEASE_HOOK_COMMAND"))
+	switch {
+	case u != "" && len(command) > 0:
+		return nil, errors.New("set RELEASE_HOOK_URL or RELEASE_HOOK_COMMAND, not both")
+	case u != "":
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("invalid RELEASE_HOOK_URL %s: expected an http or https URL", u)
+		}
+		return &releaseHook{url: u, client: newHTTPClient(10 * time.Minute)}, nil
+	case len(command) > 0:
+		// The program runs in a temporary directory, so it is found first
+		program, err := exec.LookPath(command[0])
+		if err == nil {
+			program, err = filepath.Abs(program)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid RELEASE_HOOK_COMMAND: %v", err)
+		}
+		command[0] = program
+		return &releaseHook{command: command, sandbox: sb}, nil
+	}
+	return nil, nil
+}
+
+// check asks the hook about the output of job at path, whose SHA-256 digest
+// is sum. It returns a *vetoError when the hook refuses the release, and
+// other errors when the hook could not tell.
+func (h *releaseHook) check(job *Job, path, sum string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if h.url != "" {
+		return h.post(job, f, filepath.Base(path), sum)
+	}
+
+	args := make([]string, len(h.command)-1)
+	for i, arg := range h.command[1:] {
+		args[i] = strings.ReplaceAll(arg, "{job}", job.ID)
+	}
+	var stdout bytes.Buffer
+	stderr, err := h.sandbox.runPiped(h.command[0], f, &stdout, args...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// Exit status 1 vetoes the release, saying why on standard output
+		if exitErr.ExitCode() == 1 {
+			reason := stdout.Bytes()
+			if len(bytes.TrimSpace(reason)) == 0 {
+				reason = stderr
+			}
+			return &vetoError{reason: vetoReason(reason)}
+		}
+		return fmt.Errorf("%s failed: %v: %s", filepath.Base(h.command[0]), err, strings.TrimSpace(string(stderr)))
+	}
+	return err
+}
+
+// post sends the output to the hook's URL. A 2xx status releases it, 403
+// and 422 veto it with the reason in the body, as text or the reason of a
+// JSON object.
+func (h *releaseHook) post(job *Job, f *os.File, name, sum string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.url, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", outputType(name))
+	req.Header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	req.Header.Set("X-Checksum", "sha256="+sum)
+	req.Header.Set("X-Job-ID", job.ID)
+	if job.User != "" {
+		req.Header.Set("X-Job-User", job.User)
+	}
+	if job.RequestID != "" {
+		req.Header.Set(requestIDHeader, job.RequestID)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnprocessableEntity:
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		var v struct {
+			Reason string `json:"reason"`
+		}
+		if json.Unmarshal(data, &v) == nil && v.Reason != "" {
+			data = []byte(v.Reason)
+		}
+		return &vetoError{reason: vetoReason(data)}
+	}
+	return fmt.Errorf("release hook returned %s", resp.Status)
+}
+
+// vetoReason cleans up the reason a hook gave for the job status
+func vetoReason(data []byte) string {
+	reason := strings.TrimSpace(string(data))
+	if len(reason) > maxVetoReason {
+		reason = strings.ToValidUTF8(reason[:maxVetoReason], "") + "..."
+	}
+	if reason == "" {
+		return "no reason given"
+	}
+	return reason
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the files fetched from the URLs of an upload
+const (
+	maxRemoteURLs      = 20
+	maxRemoteRedirects = 5
+)
+
+// Shared address space of carrier-grade NAT, private like RFC 1918 ranges
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// remoteFetcher downloads the files of URL inputs without letting them
+// reach the server's own network: only allowed schemes are fetched, and
+// never from loopback, private or link-local addresses, which include the
+// metadata services of cloud providers, or blocked hosts. Addresses are
+// checked as connections are made, so host names cannot resolve to other
+// addresses than the ones checked.
+type remoteFetcher struct {
+	schemes []string
+	// Largest file fetched; 0 for no limit
+	maxSize int64
+	// block lists hosts, domains, addresses and ranges never fetched from,
+	// and allow private ones that may be, such as an intranet server.
+	// Link-local addresses are never allowed.
+	block  []string
+	allow  []string
+	direct *http.Transport
+	client *http.Client
+}
+
+// loadRemoteFetcher reads REMOTE_FETCH_SCHEMES, REMOTE_FETCH_MAX_MB,
+// REMOTE_FETCH_TIMEOUT, REMOTE_FETCH_BLOCK and REMOTE_FETCH_ALLOW
+func loadRemoteFetcher() (*remoteFetcher, error) {
+	f := &remoteFetcher{
+		schemes: []string{"https"},
+		maxSize: 100 << 20,
+		block:   splitList(os.Getenv("REMOTE_FETCH_BLOCK")),
+		allow:   splitList(os.Getenv("REMOTE_FETCH_ALLOW")),
+	}
+	if v := os.Getenv("REMOTE_FETCH_SCHEMES"); v != "" {
+		f.schemes = splitList(strings.ToLower(v))
+		for _, scheme := range f.schemes {
+			if scheme != "http" && scheme != "https" {
+				return nil, fmt.Errorf("invalid REMOTE_FETCH_SCHEMES: %s is not http or https", scheme)
+			}
+		}
+	}
+	if v := os.Getenv("REMOTE_FETCH_MAX_MB"); v != "" {
+		mb, err := strconv.ParseFloat(v, 64)
+		if err != nil || mb < 0 {
+			return nil, fmt.Errorf("invalid REMOTE_FETCH_MAX_MB: %s", v)
+		}
+		f.maxSize = int64(mb * (1 << 20))
+	}
+	timeout := 2 * time.Minute
+	if v := os.Getenv("REMOTE_FETCH_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid REMOTE_FETCH_TIMEOUT: %s", v)
+		}
+		timeout = d
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	f.direct = outboundTransport.Clone()
+	f.direct.Proxy = nil
+	f.direct.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := f.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		// The checked addresses are dialed, not the name again
+		var conn net.Conn
+		for _, ip := range ips {
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+	f.client = &http.Client{
+		Transport: f,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRemoteRedirects {
+				return fmt.Errorf("more than %d redirects", maxRemoteRedirects)
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f, nil
+}
+
+// RoundTrip sends requests to hosts reached directly through the checking
+// transport. Proxies would resolve the names of the hosts they connect to
+// again, so they are sent the checked address instead, with the host name
+// in the Host header and for TLS. HTTP proxies take plain HTTP requests by
+// the host name, so those are refused.
+func (f *remoteFetcher) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxy, err := outboundTransport.Proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return f.direct.RoundTrip(req)
+	}
+	host := req.URL.Hostname()
+	if req.URL.Scheme == "http" && proxy.Scheme != "socks5" {
+		return nil, fmt.Errorf("http URLs are not fetched through the proxy, which would look up %s again: use https", host)
+	}
+	ips, err := f.resolve(req.Context(), host)
+	if err != nil {
+		return nil, err
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "443"
+		if req.URL.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	pinned := req.Clone(req.Context())
+	pinned.URL.Host = net.JoinHostPort(ips[0].String(), port)
+	if pinned.Host == "" {
+		pinned.Host = req.URL.Host
+	}
+	// A transport per request, as its TLS configuration names the host;
+	// fetches are few, so connections are not kept
+	t := outboundTransport.Clone()
+	t.Proxy = func(*http.Request) (*url.URL, error) { return proxy, nil }
+	t.DisableKeepAlives = true
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.ServerName = host
+	resp, err := t.RoundTrip(pinned)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// checkURL refuses URLs of other schemes than allowed and of blocked hosts
+func (f *remoteFetcher) checkURL(u *url.URL) error {
+	if !slices.Contains(f.schemes, u.Scheme) {
+		return fmt.Errorf("%s URLs are not allowed: expected %s", u.Scheme, strings.Join(f.schemes, " or "))
+	}
+	if u.Hostname() == "" {
+		return errors.New("no host in URL")
+	}
+	if hostListed(u.Hostname(), f.block) {
+		return fmt.Errorf("%s is blocked", u.Hostname())
+	}
+	return nil
+}
+
+// resolve returns the addresses of host, refusing hosts with any address
+// that may not be fetched from
+func (f *remoteFetcher) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if err := f.checkIP(host, ip); err != nil {
+			return nil, err
+		}
+	}
+	return ips, nil
+}
+
+// checkIP refuses link-local and blocked addresses, and loopback, private
+// and other internal ones unless they are allowed
+func (f *remoteFetcher) checkIP(host string, ip net.IP) error {
+	switch {
+	case ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast():
+		return fmt.Errorf("%s resolves to the link-local address %s", host, ip)
+	case hostListed(ip.String(), f.block):
+		return fmt.Errorf("%s resolves to the blocked address %s", host, ip)
+	case hostListed(host, f.allow) || hostListed(ip.String(), f.allow):
+		return nil
+	case ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() || sharedAddressSpace.Contains(ip):
+		return fmt.Errorf("%s resolves to the internal address %s", host, ip)
+	}
+	return nil
+}
+
+// fetch downloads the file at rawURL to the uploads directory as the
+// index-th file of an upload made at timestamp
+func (fh *FileHandler) fetch(ctx context.Context, rawURL, timestamp string, index int) (JobFile, error) {
+	f := fh.remoteFetch
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return JobFile{}, fmt.Errorf("invalid URL: %v", err)
+	}
+	if err := f.checkURL(u); err != nil {
+		return JobFile{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return JobFile{}, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return JobFile{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return JobFile{}, fmt.Errorf("server returned %s", resp.Status)
+	}
+	tooLarge := withCode(CodeTooLarge, fmt.Errorf("file too large: the limit is %.0f MB", float64(f.maxSize)/(1<<20)))
+	if f.maxSize > 0 && resp.ContentLength > f.maxSize {
+		return JobFile{}, tooLarge
+	}
+
+	// Prefer the name the server gives over the one in the URL
+	name := path.Base(resp.Request.URL.Path)
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = path.Base(params["filename"])
+	}
+	if name == "/" || name == "." {
+		name = "download"
+	}
+	if path.Ext(name) == "" {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/pdf":
+			name += ".pdf"
+		case "image/png":
+			name += ".png"
+		case "image/jpeg":
+			name += ".jpg"
+		}
+	}
+
+	file := JobFile{Name: name, Path: fh.uploadPath(timestamp, index, name)}
+	body := io.Reader(resp.Body)
+	if f.maxSize > 0 {
+		body = io.LimitReader(resp.Body, f.maxSize+1)
+	}
+	if file.SHA256, err = saveStream(body, file.Path); err != nil {
+		os.Remove(file.Path)
+		return JobFile{}, err
+	}
+	if info, err := os.Stat(file.Path); err == nil && f.maxSize > 0 && info.Size() > f.maxSize {
+		os.Remove(file.Path)
+		return JobFile{}, tooLarge
+	}
+	return file, nil
+}
+
+// importURLs downloads the files of the urls form fields, merged after the
+// uploaded ones and those imported from cloud storage
+func (fh *FileHandler) importURLs(r *http.Request, job *Job, timestamp string, urls []string) error {
+	if len(urls) > maxRemoteURLs {
+		return fmt.Errorf("too many URLs: the limit is %d", maxRemoteURLs)
+	}
+	fetched := len(job.Files)
+	for _, u := range urls {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		file, err := fh.fetch(r.Context(), u, timestamp, len(job.Files))
+		if err != nil {
+			for _, f := range job.Files[fetched:] {
+				os.Remove(f.Path)
+			}
+			job.Files = job.Files[:fetched]
+			return fmt.Errorf("%s: %w", u, err)
+		}
+		job.Files = append(job.Files, file)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// InputReport tells what the worker found in an upload on its way into the
+// output
+type InputReport struct {
+	// Format is the media type detected from the content of the upload
+	Format string `json:"format,omitempty"`
+	// Pages is the number of pages the file contributes to the output
+	Pages int `json:"pages"`
+	// Repairs lists the damage fixed in reading the file
+	Repairs []string `json:"repairs,omitempty"`
+	// SubstitutedFonts are the fonts the file uses without embedding them,
+	// which viewers replace with fonts of their own
+	SubstitutedFonts []string `json:"substitutedFonts,omitempty"`
+	Warnings         []string `json:"warnings,omitempty"`
+	// Sanitized lists what sanitizing removed from the file
+	Sanitized []string `json:"sanitized,omitempty"`
+	// Size and ConvertedSize are the bytes of the upload and of the PDF it
+	// became, reported for jobs that optimize images
+	Size          int64 `json:"size,omitempty"`
+	ConvertedSize int64 `json:"convertedSize,omitempty"`
+}
+
+// inputResult is the report on an upload returned with the job
+type inputResult struct {
+	Name string `json:"name"`
+	InputReport
+}
+
+// inputReports returns the reports on the uploads of a job once the worker
+// examined them, or nil before
+func inputReports(job *Job) []inputResult {
+	var results []inputResult
+	examined := false
+	for _, f := range job.Files {
+		result := inputResult{Name: f.Name}
+		if f.Report != nil {
+			examined = true
+			result.InputReport = *f.Report
+			result.Warnings = append([]string(nil), f.Report.Warnings...)
+			if job.Status == JobDone && result.Pages < f.Pages {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("%d of its %d pages were cut off by the page limit", f.Pages-result.Pages, f.Pages))
+			}
+		}
+		results = append(results, result)
+	}
+	if !examined {
+		return nil
+	}
+	return results
+}
+
+// skippedFile is an upload the worker left out of a job that skips the
+// files it fails to convert
+type skippedFile struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// skippedFiles returns the uploads the worker left out of a job, with why
+func skippedFiles(job *Job) []skippedFile {
+	var skipped []skippedFile
+	for _, f := range job.Files {
+		if f.Error != "" {
+			skipped = append(skipped, skippedFile{Name: f.Name, Error: f.Error, Code: f.ErrorCode})
+		}
+	}
+	return skipped
+}
+
+// Media types of the extensions uploads are converted by
+var extensionFormats = map[string]string{
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+}
+
+// The 14 fonts every PDF viewer has, which need no embedding
+var standardFonts = map[string]bool{
+	"Times-Roman": true, "Times-Bold": true, "Times-Italic": true, "Times-BoldItalic": true,
+	"Helvetica": true, "Helvetica-Bold": true, "Helvetica-Oblique": true, "Helvetica-BoldOblique": true,
+	"Courier": true, "Courier-Bold": true, "Courier-Oblique": true, "Courier-BoldOblique": true,
+	"Symbol": true, "ZapfDingbats": true,
+}
+
+// The offset of the cross-reference table after startxref at the end of a PDF
+var startXRefPattern = regexp.MustCompile(`startxref\s+(\d+)`)
+
+// The start of an indirect object, as cross-reference streams are
+var objectPattern = regexp.MustCompile(`^\d+\s+\d+\s+obj`)
+
+// examineUpload reports on an upload before it is converted. Large files are
+// only sniffed, as reading them would take them into memory.
+func examineUpload(file JobFile, large bool) (*InputReport, error) {
+	report := &InputReport{}
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 1024)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	// Viewers find PDF headers anywhere in the first kilobyte
+	offset := bytes.Index(head, []byte("%PDF-"))
+	if offset >= 0 {
+		report.Format = "application/pdf"
+	} else {
+		report.Format = strings.TrimSuffix(http.DetectContentType(head), "; charset=utf-8")
+	}
+	ext := strings.ToLower(filepath.Ext(file.Name))
+	if expected := extensionFormats[ext]; expected != "" && expected != report.Format {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("The content is %s, not what the %s extension says", report.Format, ext))
+	}
+	if report.Format != "application/pdf" || ext != ".pdf" || large {
+		return report, nil
+	}
+
+	if offset > 0 {
+		report.Repairs = append(report.Repairs, fmt.Sprintf("Skipped %d bytes before the PDF header", offset))
+	}
+	repairs, err := trailerRepairs(f, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+	report.Repairs = append(report.Repairs, repairs...)
+
+	ctx, err := readContext(file.Path)
+	if err != nil {
+		// Conversion fails with the reason
+		return report, nil
+	}
+	report.SubstitutedFonts = unembeddedFonts(ctx)
+	if ctx.Encrypt != nil {
+		report.Warnings = append(report.Warnings, "Its password protection was removed")
+	}
+	fields, err := topLevelFields(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signed := false
+	for _, field := range fields {
+		signatureFields(ctx, field, "", func(string, types.Dict) { signed = true })
+	}
+	if signed {
+		report.Warnings = append(report.Warnings, "Its digital signatures are invalidated by merging")
+	}
+	return report, nil
+}
+
+// trailerRepairs checks the end of the PDF in f, whose header is at offset,
+// for the damage reading it works around
+func trailerRepairs(f *os.File, offset int64) ([]string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tail := make([]byte, min(info.Size(), 2048))
+	if _, err := f.ReadAt(tail, info.Size()-int64(len(tail))); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var repairs []string
+	xref := false
+	if m := startXRefPattern.FindAllSubmatch(tail, -1); m != nil {
+		if at, err := strconv.ParseInt(string(m[len(m)-1][1]), 10, 64); err == nil {
+			start := make([]byte, 32)
+			n, _ := f.ReadAt(start, at+offset)
+			start = bytes.TrimLeft(start[:n], " \t\r\n")
+			xref = bytes.HasPrefix(start, []byte("xref")) || objectPattern.Match(start)
+		}
+	}
+	if !xref {
+		repairs = append(repairs, "Rebuilt the cross-reference table")
+	}
+	return repairs, nil
+}
+
+// unembeddedFonts returns the names of the fonts of a PDF that are neither
+// embedded nor one of the standard fonts
+func unembeddedFonts(ctx *model.Context) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, entry := range ctx.Table {
+		font, ok := entry.Object.(types.Dict)
+		if !ok || font.Type() == nil || *font.Type() != "Font" || font.Subtype() == nil {
+			continue
+		}
+		descriptor := font
+		switch *font.Subtype() {
+		case "Type3", "CIDFontType0", "CIDFontType2":
+			// Type 3 glyphs are drawn by the PDF, and CID fonts are
+			// checked through the composite font using them
+			continue
+		case "Type0":
+			fonts, err := ctx.DereferenceArray(font["DescendantFonts"])
+			if err != nil || len(fonts) == 0 {
+				continue
+			}
+			if descriptor, err = ctx.DereferenceDict(fonts[0]); err != nil || descriptor == nil {
+				continue
+			}
+		}
+		fd, err := ctx.DereferenceDict(descriptor["FontDescriptor"])
+		if err != nil || fd != nil && (fd["FontFile"] != nil || fd["FontFile2"] != nil || fd["FontFile3"] != nil) {
+			continue
+		}
+
+		name := ""
+		if base := font.NameEntry("BaseFont"); base != nil {
+			name = *base
+		}
+		if name == "" || standardFonts[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
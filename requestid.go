@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Header carrying the ID that ties the logs, jobs and notifications of a
+// request together
+const requestIDHeader = "X-Request-ID"
+
+// Longest request ID taken from clients
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withRequestID takes the X-Request-ID of requests, or generates one when
+// it is missing or unusable, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = randomHex(16)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of the request ctx belongs to, if any
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether id is short and of printable ASCII, so it
+// can go in logs and headers as is
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// grpcRequestID mirrors withRequestID for gRPC streams, taking the
+// x-request-id metadata and echoing it in the response header
+func grpcRequestID(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	id := ""
+	if v := md.Get(requestIDHeader); len(v) > 0 {
+		id = v[0]
+	}
+	if !validRequestID(id) {
+		id = randomHex(16)
+	}
+	stream.SetHeader(metadata.Pairs(requestIDHeader, id))
+	return handler(srv, &requestIDStream{ServerStream: stream, ctx: context.WithValue(stream.Context(), requestIDKey{}, id)})
+}
+
+// requestIDStream is a server stream whose context carries the request ID
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDStream) Context() context.Context {
+	return s.ctx
+}
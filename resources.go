@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often the memory monitor samples the heap
+const memoryCheckInterval = 500 * time.Millisecond
+
+// workerResources tune how much a worker process takes on at once
+type workerResources struct {
+	// Jobs processed at once
+	concurrency int
+	// Files of a job converted at once
+	jobThreads int
+	// Soft heap budget per running job in bytes; 0 disables it
+	jobMemory uint64
+	// Jobs with more files are merged in batches of this many, jobThreads
+	// at once, when there are several; 0 merges all files in one go
+	mergeBatch int
+}
+
+// loadWorkerResources reads MAX_CONCURRENT_JOBS, JOB_THREADS, JOB_MEMORY_MB
+// and MERGE_BATCH_SIZE; by default jobs and their files are processed one at
+// a time
+func loadWorkerResources() (workerResources, error) {
+	res := workerResources{concurrency: 1, jobThreads: 1, mergeBatch: defaultMergeBatch}
+	for _, v := range []struct {
+		name string
+		dst  *int
+	}{{"MAX_CONCURRENT_JOBS", &res.concurrency}, {"JOB_THREADS", &res.jobThreads}} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return res, fmt.Errorf("invalid %s: %s", v.name, s)
+		}
+		*v.dst = n
+	}
+	if s := os.Getenv("JOB_MEMORY_MB"); s != "" {
+		mb, err := strconv.ParseFloat(s, 64)
+		if err != nil || mb < 0 {
+			return res, fmt.Errorf("invalid JOB_MEMORY_MB: %s", s)
+		}
+		res.jobMemory = uint64(mb * (1 << 20))
+	}
+	if s := os.Getenv("MERGE_BATCH_SIZE"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return res, fmt.Errorf("invalid MERGE_BATCH_SIZE: %s", s)
+		}
+		res.mergeBatch = n
+	}
+	return res, nil
+}
+
+// runningJob is a job being processed by this process
+type runningJob struct {
+	id     string
+	cancel context.CancelCauseFunc
+}
+
+// runningJobs are the jobs being processed, in the order they started
+type runningJobs struct {
+	mu   sync.Mutex
+	jobs []*runningJob
+}
+
+func (r *runningJobs) add(job *runningJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs = append(r.jobs, job)
+}
+
+func (r *runningJobs) remove(job *runningJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs = slices.DeleteFunc(r.jobs, func(j *runningJob) bool { return j == job })
+}
+
+// abortNewest cancels the most recently started job, which has the least
+// work to lose, and stops tracking it
+func (r *runningJobs) abortNewest(cause error) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.jobs) == 0 {
+		return "", false
+	}
+	job := r.jobs[len(r.jobs)-1]
+	r.jobs = r.jobs[:len(r.jobs)-1]
+	job.cancel(cause)
+	return job.id, true
+}
+
+func (r *runningJobs) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.jobs)
+}
+
+// monitorMemory aborts jobs while the heap outgrows the memory budget of the
+// jobs running, until ctx is cancelled. The heap is shared, so the newest
+// job is aborted first.
+func (fh *FileHandler) monitorMemory(ctx context.Context) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	heap := func() uint64 {
+		metrics.Read(sample)
+		return sample[0].Value.Uint64()
+	}
+
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n := fh.running.count()
+		budget := fh.resources.jobMemory * uint64(n)
+		if n == 0 || heap() <= budget {
+			continue
+		}
+		// Garbage does not count against the budget
+		runtime.GC()
+		used := heap()
+		if used <= budget {
+			continue
+		}
+		cause := fmt.Errorf("memory budget exceeded: the worker used %.0f MB for %d jobs, more than %.0f MB per job",
+			float64(used)/(1<<20), n, float64(fh.resources.jobMemory)/(1<<20))
+		if id, ok := fh.running.abortNewest(cause); ok {
+			log.Printf("Aborting job %s: %v", id, cause)
+		}
+	}
+}
+
+// aborted fails the job if it was cancelled, as the memory monitor does
+func (fh *FileHandler) aborted(ctx context.Context, job *Job) bool {
+	cause := context.Cause(ctx)
+	if cause == nil {
+		return false
+	}
+	fh.failJob(job, CodeAborted, "Aborted: "+cause.Error())
+	return true
+}
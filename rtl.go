@@ -0,0 +1,315 @@
+package main
+
+import (
+	"golang.org/x/text/unicode/bidi"
+)
+
+// arabicForms are the presentation forms of an Arabic letter. Letters that
+// only join the letter before them have no initial or medial form.
+type arabicForms struct {
+	isolated, final, initial, medial rune
+}
+
+// arabicLetters maps the Arabic and Persian letters to their forms
+var arabicLetters = map[rune]arabicForms{
+	0x0621: {0xFE80, 0, 0, 0},
+	0x0622: {0xFE81, 0xFE82, 0, 0},
+	0x0623: {0xFE83, 0xFE84, 0, 0},
+	0x0624: {0xFE85, 0xFE86, 0, 0},
+	0x0625: {0xFE87, 0xFE88, 0, 0},
+	0x0626: {0xFE89, 0xFE8A, 0xFE8B, 0xFE8C},
+	0x0627: {0xFE8D, 0xFE8E, 0, 0},
+	0x0628: {0xFE8F, 0xFE90, 0xFE91, 0xFE92},
+	0x0629: {0xFE93, 0xFE94, 0, 0},
+	0x062A: {0xFE95, 0xFE96, 0xFE97, 0xFE98},
+	0x062B: {0xFE99, 0xFE9A, 0xFE9B, 0xFE9C},
+	0x062C: {0xFE9D, 0xFE9E, 0xFE9F, 0xFEA0},
+	0x062D: {0xFEA1, 0xFEA2, 0xFEA3, 0xFEA4},
+	0x062E: {0xFEA5, 0xFEA6, 0xFEA7, 0xFEA8},
+	0x062F: {0xFEA9, 0xFEAA, 0, 0},
+	0x0630: {0xFEAB, 0xFEAC, 0, 0},
+	0x0631: {0xFEAD, 0xFEAE, 0, 0},
+	0x0632: {0xFEAF, 0xFEB0, 0, 0},
+	0x0633: {0xFEB1, 0xFEB2, 0xFEB3, 0xFEB4},
+	0x0634: {0xFEB5, 0xFEB6, 0xFEB7, 0xFEB8},
+	0x0635: {0xFEB9, 0xFEBA, 0xFEBB, 0xFEBC},
+	0x0636: {0xFEBD, 0xFEBE, 0xFEBF, 0xFEC0},
+	0x0637: {0xFEC1, 0xFEC2, 0xFEC3, 0xFEC4},
+	0x0638: {0xFEC5, 0xFEC6, 0xFEC7, 0xFEC8},
+	0x0639: {0xFEC9, 0xFECA, 0xFECB, 0xFECC},
+	0x063A: {0xFECD, 0xFECE, 0xFECF, 0xFED0},
+	0x0641: {0xFED1, 0xFED2, 0xFED3, 0xFED4},
+	0x0642: {0xFED5, 0xFED6, 0xFED7, 0xFED8},
+	0x0643: {0xFED9, 0xFEDA, 0xFEDB, 0xFEDC},
+	0x0644: {0xFEDD, 0xFEDE, 0xFEDF, 0xFEE0},
+	0x0645: {0xFEE1, 0xFEE2, 0xFEE3, 0xFEE4},
+	0x0646: {0xFEE5, 0xFEE6, 0xFEE7, 0xFEE8},
+	0x0647: {0xFEE9, 0xFEEA, 0xFEEB, 0xFEEC},
+	0x0648: {0xFEED, 0xFEEE, 0, 0},
+	0x0649: {0xFEEF, 0xFEF0, 0, 0},
+	0x064A: {0xFEF1, 0xFEF2, 0xFEF3, 0xFEF4},
+	0x067E: {0xFB56, 0xFB57, 0xFB58, 0xFB59},
+	0x0686: {0xFB7A, 0xFB7B, 0xFB7C, 0xFB7D},
+	0x0698: {0xFB8A, 0xFB8B, 0, 0},
+	0x06A9: {0xFB8E, 0xFB8F, 0xFB90, 0xFB91},
+	0x06AF: {0xFB92, 0xFB93, 0xFB94, 0xFB95},
+	0x06CC: {0xFBFC, 0xFBFD, 0xFBFE, 0xFBFF},
+}
+
+// lamAlef maps the alefs lam forms a ligature with to the isolated form of
+// the ligature, whose final form follows it
+var lamAlef = map[rune]rune{
+	0x0622: 0xFEF5,
+	0x0623: 0xFEF7,
+	0x0625: 0xFEF9,
+	0x0627: 0xFEFB,
+}
+
+const (
+	arabicLam     = 0x0644
+	arabicTatweel = 0x0640
+)
+
+// arabicTransparent reports whether r is a mark, such as a vowel sign,
+// that letters join across
+func arabicTransparent(r rune) bool {
+	return r >= 0x064B && r <= 0x065F || r == 0x0670
+}
+
+// joinsBefore reports whether r joins the letter before it, and joinsAfter
+// whether it joins the letter after it
+func joinsBefore(r rune) bool {
+	f, ok := arabicLetters[r]
+	return ok && f.final != 0 || r == arabicTatweel
+}
+
+func joinsAfter(r rune) bool {
+	return arabicLetters[r].initial != 0 || r == arabicTatweel
+}
+
+// shapeArabic replaces the Arabic letters of s with the presentation forms
+// they take where they join their neighbours, as fonts draw them in PDFs
+// without shaping them. s stays in logical order.
+func shapeArabic(s string) string {
+	in := []rune(s)
+	out := make([]rune, 0, len(in))
+	// neighbour returns the letter next to i in direction step, past marks
+	neighbour := func(i, step int) rune {
+		for i += step; i >= 0 && i < len(in); i += step {
+			if !arabicTransparent(in[i]) {
+				return in[i]
+			}
+		}
+		return 0
+	}
+
+	for i := 0; i < len(in); i++ {
+		r := in[i]
+		forms, ok := arabicLetters[r]
+		if !ok {
+			out = append(out, r)
+			continue
+		}
+		prev := joinsAfter(neighbour(i, -1))
+		if r == arabicLam && i+1 < len(in) {
+			if lig, ok := lamAlef[in[i+1]]; ok {
+				if prev {
+					lig++
+				}
+				out = append(out, lig)
+				i++
+				continue
+			}
+		}
+		next := forms.initial != 0 && joinsBefore(neighbour(i, 1))
+		switch {
+		case prev && next:
+			out = append(out, forms.medial)
+		case prev && forms.final != 0:
+			out = append(out, forms.final)
+		case next:
+			out = append(out, forms.initial)
+		default:
+			out = append(out, forms.isolated)
+		}
+	}
+	return string(out)
+}
+
+// mirrored are the characters drawn mirrored in right-to-left text
+var mirrored = map[rune]rune{
+	'(': ')', ')': '(', '[': ']', ']': '[', '{': '}', '}': '{',
+	'<': '>', '>': '<', '«': '»', '»': '«',
+}
+
+// rtlParagraph reports whether s reads right to left: whether its first
+// letter of a strong direction is a right-to-left one
+func rtlParagraph(s string) bool {
+	for _, r := range s {
+		p, _ := bidi.LookupRune(r)
+		switch p.Class() {
+		case bidi.L:
+			return false
+		case bidi.R, bidi.AL:
+			return true
+		}
+	}
+	return false
+}
+
+// visualOrder returns the line s in the order its characters are drawn
+// from left to right, following the Unicode bidirectional algorithm for
+// text without explicit embeddings, in a paragraph of the given direction.
+// Runs of right-to-left text are reversed, with their brackets mirrored,
+// and numbers in them keep reading left to right.
+func visualOrder(s string, rtl bool) string {
+	runes := []rune(s)
+	n := len(runes)
+	if n == 0 {
+		return s
+	}
+	base := 0
+	sos := bidi.L
+	if rtl {
+		base, sos = 1, bidi.R
+	}
+
+	classes := make([]bidi.Class, n)
+	for i, r := range runes {
+		p, _ := bidi.LookupRune(r)
+		classes[i] = p.Class()
+	}
+
+	// Weak types: numbers after Arabic letters are Arabic numbers, and
+	// separators and terminators take the class of the numbers they belong to
+	strong := sos
+	for i, c := range classes {
+		switch c {
+		case bidi.NSM:
+			if i > 0 {
+				classes[i] = classes[i-1]
+			} else {
+				classes[i] = sos
+			}
+		case bidi.L, bidi.R, bidi.AL:
+			strong = c
+		case bidi.EN:
+			switch strong {
+			case bidi.AL:
+				classes[i] = bidi.AN
+			case bidi.L:
+				classes[i] = bidi.L
+			}
+		}
+		if c == bidi.AL {
+			classes[i] = bidi.R
+		}
+	}
+	for i := 1; i+1 < n; i++ {
+		c := classes[i]
+		if (c == bidi.ES || c == bidi.CS) && classes[i-1] == classes[i+1] && (classes[i-1] == bidi.EN || classes[i-1] == bidi.AN && c == bidi.CS) {
+			classes[i] = classes[i-1]
+		}
+	}
+	for i := 0; i < n; i++ {
+		if classes[i] != bidi.ET {
+			continue
+		}
+		j := i
+		for j < n && classes[j] == bidi.ET {
+			j++
+		}
+		if i > 0 && classes[i-1] == bidi.EN || j < n && classes[j] == bidi.EN {
+			for k := i; k < j; k++ {
+				classes[k] = bidi.EN
+			}
+		}
+		i = j - 1
+	}
+
+	// Neutrals between letters of the same direction take it, others the
+	// direction of the paragraph; numbers count as right to left
+	direction := func(c bidi.Class) (bidi.Class, bool) {
+		switch c {
+		case bidi.L:
+			return bidi.L, true
+		case bidi.R, bidi.EN, bidi.AN:
+			return bidi.R, true
+		}
+		return 0, false
+	}
+	for i := 0; i < n; i++ {
+		if _, ok := direction(classes[i]); ok {
+			continue
+		}
+		j := i
+		for j < n {
+			if _, ok := direction(classes[j]); ok {
+				break
+			}
+			j++
+		}
+		before, after := sos, sos
+		if i > 0 {
+			before, _ = direction(classes[i-1])
+		}
+		if j < n {
+			after, _ = direction(classes[j])
+		}
+		c := sos
+		if before == after {
+			c = before
+		}
+		for k := i; k < j; k++ {
+			classes[k] = c
+		}
+		i = j - 1
+	}
+
+	levels := make([]int, n)
+	highest := base
+	for i, c := range classes {
+		level := base
+		switch {
+		case base == 0 && c == bidi.R:
+			level = 1
+		case base == 0 && (c == bidi.EN || c == bidi.AN):
+			level = 2
+		case base == 1 && (c == bidi.L || c == bidi.EN || c == bidi.AN):
+			level = 2
+		}
+		levels[i] = level
+		highest = max(highest, level)
+	}
+	// Trailing whitespace keeps the direction of the paragraph
+	for i := n - 1; i >= 0; i-- {
+		p, _ := bidi.LookupRune(runes[i])
+		if p.Class() != bidi.WS {
+			break
+		}
+		levels[i] = base
+	}
+
+	for i, r := range runes {
+		if m, ok := mirrored[r]; ok && levels[i]%2 == 1 {
+			runes[i] = m
+		}
+	}
+	for level := highest; level >= 1; level-- {
+		for i := 0; i < n; i++ {
+			if levels[i] < level {
+				continue
+			}
+			j := i
+			for j < n && levels[j] >= level {
+				j++
+			}
+			for a, b := i, j-1; a < b; a, b = a+1, b-1 {
+				runes[a], runes[b] = runes[b], runes[a]
+				levels[a], levels[b] = levels[b], levels[a]
+			}
+			i = j
+		}
+	}
+	return string(runes)
+}
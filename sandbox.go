@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Converters running longer are killed unless CONVERTER_TIMEOUT says otherwise
+const defaultConverterTimeout = 5 * time.Minute
+
+// Variables of our environment passed on to converters
+var sandboxEnv = []string{"PATH", "LANG", "LC_ALL", "TESSDATA_PREFIX", "OMP_THREAD_LIMIT"}
+
+// sandbox runs external converters such as Tesseract in a temporary
+// directory of their own, with a minimal environment, a timeout, resource
+// limits and, where the platform allows, no network access
+type sandbox struct {
+	dir     string
+	timeout time.Duration
+	// Address space and CPU time limits; zero means none
+	memory  uint64
+	cpuTime time.Duration
+	network bool
+	// Offline, converters that cannot be isolated from the network are
+	// not run at all
+	offline bool
+	// Set once isolating a converter from the network failed
+	noIsolation atomic.Bool
+}
+
+// loadSandbox reads CONVERTER_TIMEOUT, CONVERTER_MEMORY_MB,
+// CONVERTER_CPU_TIME and CONVERTER_NETWORK; temporary directories are
+// created in dir
+func loadSandbox(dir string) (*sandbox, error) {
+	sb := &sandbox{dir: dir, timeout: defaultConverterTimeout}
+	if v := os.Getenv("CONVERTER_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid CONVERTER_TIMEOUT: %s", v)
+		}
+		sb.timeout = d
+	}
+	if v := os.Getenv("CONVERTER_MEMORY_MB"); v != "" {
+		mb, err := strconv.ParseFloat(v, 64)
+		if err != nil || mb < 0 {
+			return nil, fmt.Errorf("invalid CONVERTER_MEMORY_MB: %s", v)
+		}
+		sb.memory = uint64(mb * (1 << 20))
+	}
+	if v := os.Getenv("CONVERTER_CPU_TIME"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid CONVERTER_CPU_TIME: %s", v)
+		}
+		sb.cpuTime = d
+	}
+	if v := os.Getenv("CONVERTER_NETWORK"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CONVERTER_NETWORK: %s", v)
+		}
+		sb.network = b
+	}
+	return sb, nil
+}
+
+// run runs the program at path and returns its combined output. Paths in
+// args must be absolute, as the program runs in a temporary directory that
+// is removed once it exits. When it times out it is killed together with the
+// processes it started.
+func (sb *sandbox) run(path string, args ...string) ([]byte, error) {
+	return sb.runPiped(path, nil, nil, args...)
+}
+
+// runPiped runs the program at path as run does, with stdin as its standard
+// input and its standard output written to stdout. Only what it writes to
+// standard error is returned, or its combined output when stdout is nil.
+func (sb *sandbox) runPiped(path string, stdin io.Reader, stdout io.Writer, args ...string) ([]byte, error) {
+	name := filepath.Base(path)
+	tmp, err := os.MkdirTemp(sb.dir, "exec_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	tmp, err = filepath.Abs(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sb.timeout)
+	defer cancel()
+
+	argv := append([]string{path}, args...)
+	// Limits are set by a shell that then replaces itself with the program
+	if limits := sb.ulimits(); limits != "" {
+		argv = append([]string{"/bin/sh", "-c", limits + `exec "$@"`, "sh"}, argv...)
+	}
+
+	var output bytes.Buffer
+	isolate := !sb.network && !sb.noIsolation.Load()
+	if sb.offline && !networkIsolation {
+		return nil, withCode(CodeNotAvailable, fmt.Errorf("%s cannot be isolated from the network on this platform, which offline mode requires", name))
+	}
+	cmd := sb.command(ctx, tmp, argv, isolate, stdin, stdout, &output)
+	err = cmd.Start()
+	if err != nil && isolate && sb.offline {
+		return nil, withCode(CodeNotAvailable, fmt.Errorf("cannot isolate %s from the network, which offline mode requires: %v", name, err))
+	}
+	if err != nil && isolate {
+		// Unprivileged user namespaces are disabled in many containers
+		log.Printf("Cannot isolate %s from the network, running converters with network access: %v", name, err)
+		sb.noIsolation.Store(true)
+		cmd = sb.command(ctx, tmp, argv, false, stdin, stdout, &output)
+		err = cmd.Start()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error starting %s: %v", name, err)
+	}
+	err = cmd.Wait()
+	// Leave nothing it started running
+	killGroup(cmd.Process)
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("Killed %s after %v", name, sb.timeout)
+		return output.Bytes(), fmt.Errorf("%s did not finish within %v and was killed", name, sb.timeout)
+	}
+	if err != nil && sb.cpuTime > 0 && cpuLimitExceeded(cmd.ProcessState) {
+		return output.Bytes(), fmt.Errorf("%s used more than %v of CPU time and was killed", name, sb.cpuTime)
+	}
+	return output.Bytes(), err
+}
+
+func (sb *sandbox) command(ctx context.Context, dir string, argv []string, isolate bool, stdin io.Reader, stdout io.Writer, output *bytes.Buffer) *exec.Cmd {
+	output.Reset()
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = []string{"HOME=" + dir, "TMPDIR=" + dir}
+	for _, key := range sandboxEnv {
+		if v, ok := os.LookupEnv(key); ok {
+			cmd.Env = append(cmd.Env, key+"="+v)
+		}
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = output
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+	cmd.Stderr = output
+	cmd.SysProcAttr = sandboxAttr(isolate)
+	cmd.Cancel = func() error { return killGroup(cmd.Process) }
+	// Don't wait forever for output of children that outlived it
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+// ulimits returns the shell commands setting the resource limits
+func (sb *sandbox) ulimits() string {
+	var s string
+	if sb.memory > 0 {
+		s += fmt.Sprintf("ulimit -v %d && ", sb.memory>>10)
+	}
+	if sb.cpuTime > 0 {
+		// SIGXCPU at the soft limit tells running out of CPU time apart from
+		// other kills; the hard limit stops converters ignoring it
+		secs := int(math.Ceil(sb.cpuTime.Seconds()))
+		s += fmt.Sprintf("ulimit -S -t %d && ulimit -H -t %d && ", secs, secs+1)
+	}
+	return s
+}
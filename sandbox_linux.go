@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Converters are isolated from the network with namespaces
+const networkIsolation = true
+
+// sandboxAttr starts converters in a process group of their own, killed if
+// we exit. Isolated converters get a network namespace with nothing but a
+// loopback interface; the user namespace around it lets unprivileged
+// processes create one.
+func sandboxAttr(isolate bool) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	if isolate {
+		attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+	return attr
+}
+
+// killGroup kills the process group of a converter
+func killGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// cpuLimitExceeded reports whether a converter was stopped for running out of
+// CPU time
+func cpuLimitExceeded(state *os.ProcessState) bool {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	return ok && ws.Signaled() && ws.Signal() == syscall.SIGXCPU
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Converters cannot be isolated from the network on this platform
+const networkIsolation = false
+
+func sandboxAttr(isolate bool) *syscall.SysProcAttr {
+	return nil
+}
+
+func killGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+func cpuLimitExceeded(state *os.ProcessState) bool {
+	return false
+}
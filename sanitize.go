@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// executableExtensions are the file types that run code when opened, which
+// sanitizing removes from the embedded files of a PDF
+var executableExtensions = map[string]bool{
+	".exe": true, ".dll": true, ".com": true, ".scr": true, ".pif": true, ".cpl": true,
+	".msi": true, ".bat": true, ".cmd": true, ".ps1": true, ".vbs": true, ".vbe": true,
+	".js": true, ".jse": true, ".wsf": true, ".hta": true, ".lnk": true, ".reg": true,
+	".jar": true, ".sh": true, ".app": true, ".dmg": true, ".pkg": true, ".deb": true,
+	".rpm": true, ".apk": true,
+}
+
+// executableMagic are the leading bytes of programs, for executables
+// embedded under another name
+var executableMagic = [][]byte{
+	[]byte("MZ"),             // Windows
+	[]byte("\x7fELF"),        // Linux
+	{0xfe, 0xed, 0xfa, 0xce}, // macOS, 32-bit
+	{0xfe, 0xed, 0xfa, 0xcf}, // macOS, 64-bit
+	{0xce, 0xfa, 0xed, 0xfe}, // macOS, 32-bit little-endian
+	{0xcf, 0xfa, 0xed, 0xfe}, // macOS, 64-bit little-endian
+	{0xca, 0xfe, 0xba, 0xbe}, // macOS universal and Java classes
+	[]byte("#!"),             // scripts
+}
+
+// sanitizeResult is what sanitizing removed from a PDF
+type sanitizeResult struct {
+	// Scripts and Launches count the JavaScript and launch actions cut
+	// off from whatever triggered them
+	Scripts  int
+	Launches int
+	// Files are the names of the executable embedded files removed
+	Files []string
+}
+
+// describe lists what was removed for the report on an upload
+func (s sanitizeResult) describe() []string {
+	var removed []string
+	for _, c := range []struct {
+		n    int
+		what string
+	}{{s.Scripts, "script"}, {s.Launches, "launch action"}} {
+		switch {
+		case c.n == 1:
+			removed = append(removed, "1 "+c.what)
+		case c.n > 1:
+			removed = append(removed, fmt.Sprintf("%d %ss", c.n, c.what))
+		}
+	}
+	for _, name := range s.Files {
+		removed = append(removed, "embedded file "+name)
+	}
+	return removed
+}
+
+// executableFile reports whether an embedded file would run code when
+// opened, by its name or its content
+func executableFile(name string, content []byte) bool {
+	if executableExtensions[strings.ToLower(filepath.Ext(name))] {
+		return true
+	}
+	for _, magic := range executableMagic {
+		if bytes.HasPrefix(content, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// actionKind returns "script" for actions that run JavaScript and "launch"
+// for those that start programs or open files, empty for the others
+func actionKind(ctx *model.Context, o types.Object) string {
+	d, err := ctx.DereferenceDict(o)
+	if err != nil || d == nil {
+		return ""
+	}
+	s := d.NameEntry("S")
+	if s == nil {
+		return ""
+	}
+	switch *s {
+	case "JavaScript":
+		return "script"
+	case "Launch":
+		return "launch"
+	case "Rendition":
+		// Renditions may carry a script of their own
+		if _, ok := d["JS"]; ok {
+			return "script"
+		}
+	case "URI":
+		if uri, err := ctx.DereferenceStringOrHexLiteral(d["URI"], model.V10, nil); err == nil &&
+			strings.HasPrefix(strings.ToLower(strings.TrimSpace(uri)), "javascript:") {
+			return "script"
+		}
+	}
+	return ""
+}
+
+// sanitizeActions cuts the dangerous actions off the dictionaries and
+// arrays held directly in o: the action of links and fields, the document
+// open action, the additional actions triggered by events and the actions
+// chained after others
+func sanitizeActions(ctx *model.Context, o types.Object, res *sanitizeResult) {
+	count := func(kind string) {
+		if kind == "script" {
+			res.Scripts++
+		} else {
+			res.Launches++
+		}
+	}
+
+	var d types.Dict
+	switch o := o.(type) {
+	case types.Dict:
+		d = o
+	case types.StreamDict:
+		d = o.Dict
+	case types.Array:
+		for _, item := range o {
+			sanitizeActions(ctx, item, res)
+		}
+		return
+	default:
+		return
+	}
+
+	for _, key := range []string{"A", "OpenAction"} {
+		if kind := actionKind(ctx, d[key]); kind != "" {
+			count(kind)
+			delete(d, key)
+		}
+	}
+	if aa, err := ctx.DereferenceDict(d["AA"]); err == nil && aa != nil {
+		for event, action := range aa {
+			if kind := actionKind(ctx, action); kind != "" {
+				count(kind)
+				delete(aa, event)
+			}
+		}
+		if len(aa) == 0 {
+			delete(d, "AA")
+		}
+	}
+	switch next := d["Next"].(type) {
+	case types.Array:
+		var keep types.Array
+		for _, action := range next {
+			if kind := actionKind(ctx, action); kind != "" {
+				count(kind)
+				continue
+			}
+			keep = append(keep, action)
+		}
+		if len(keep) > 0 {
+			d["Next"] = keep
+		} else {
+			delete(d, "Next")
+		}
+	case nil:
+	default:
+		if kind := actionKind(ctx, next); kind != "" {
+			count(kind)
+			delete(d, "Next")
+		}
+	}
+
+	for _, v := range d {
+		switch v.(type) {
+		case types.Dict, types.Array:
+			sanitizeActions(ctx, v, res)
+		}
+	}
+}
+
+// sanitizePDF writes a copy of the PDF at in to out without the scripts,
+// launch actions and executable embedded files that could run when it is
+// opened: document-level and XFA form scripts, the JavaScript and launch
+// actions of links, fields, pages and the document, and the executables
+// among its attachments and file annotations
+func sanitizePDF(in, out string) (sanitizeResult, error) {
+	var res sanitizeResult
+	ctx, err := readContext(in)
+	if err != nil {
+		return res, withCode(pdfErrorCode(err), fmt.Errorf("error reading PDF: %v", err))
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return res, err
+	}
+
+	// Every object is walked, so no action is missed wherever it hangs
+	for _, entry := range ctx.Table {
+		if entry != nil && !entry.Free && entry.Object != nil {
+			sanitizeActions(ctx, entry.Object, &res)
+		}
+	}
+	if names, err := ctx.DereferenceDict(ctx.RootDict["Names"]); err == nil && names != nil {
+		if _, ok := names["JavaScript"]; ok {
+			res.Scripts++
+			delete(names, "JavaScript")
+			delete(ctx.Names, "JavaScript")
+		}
+	}
+	if form, err := ctx.DereferenceDict(ctx.RootDict["AcroForm"]); err == nil && form != nil {
+		if _, ok := form["XFA"]; ok {
+			res.Scripts++
+			delete(form, "XFA")
+		}
+	}
+
+	if err := removeExecutableAttachments(ctx, &res); err != nil {
+		return res, err
+	}
+	for page := 1; page <= ctx.PageCount; page++ {
+		if err := removeExecutableAnnotations(ctx, page, &res); err != nil {
+			return res, err
+		}
+	}
+	return res, api.WriteContextFile(ctx, out)
+}
+
+// removeExecutableAttachments removes the executables among the embedded
+// files of the document
+func removeExecutableAttachments(ctx *model.Context, res *sanitizeResult) error {
+	if ctx.Names["EmbeddedFiles"] == nil {
+		return nil
+	}
+	attachments, err := ctx.ExtractAttachments(nil)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		content, err := io.ReadAll(a.Reader)
+		if err != nil {
+			return err
+		}
+		if !executableFile(a.FileName, content) {
+			continue
+		}
+		if _, err := ctx.RemoveAttachments([]string{a.ID}); err != nil {
+			return err
+		}
+		res.Files = append(res.Files, a.FileName)
+	}
+	return nil
+}
+
+// removeExecutableAnnotations removes the file annotations of a page whose
+// file is an executable
+func removeExecutableAnnotations(ctx *model.Context, page int, res *sanitizeResult) error {
+	pageDict, _, _, err := ctx.PageDict(page, false)
+	if err != nil {
+		return err
+	}
+	annots, err := ctx.DereferenceArray(pageDict["Annots"])
+	if err != nil || len(annots) == 0 {
+		return nil
+	}
+
+	var keep types.Array
+	for _, obj := range annots {
+		annot, err := ctx.DereferenceDict(obj)
+		if err == nil && annot != nil {
+			if subtype := annot.NameEntry("Subtype"); subtype != nil && *subtype == "FileAttachment" {
+				if name, ok := executableFileSpec(ctx, annot["FS"]); ok {
+					res.Files = append(res.Files, name)
+					continue
+				}
+			}
+		}
+		keep = append(keep, obj)
+	}
+	if len(keep) > 0 {
+		pageDict["Annots"] = keep
+	} else {
+		pageDict.Delete("Annots")
+	}
+	return nil
+}
+
+// executableFileSpec returns the name of the file of a file specification
+// and whether it is an executable
+func executableFileSpec(ctx *model.Context, o types.Object) (string, bool) {
+	fs, err := ctx.DereferenceDict(o)
+	if err != nil || fs == nil {
+		return "", false
+	}
+	name := ""
+	for _, key := range []string{"UF", "F"} {
+		if s, err := ctx.DereferenceStringOrHexLiteral(fs[key], model.V10, nil); err == nil && s != "" {
+			name = s
+			break
+		}
+	}
+	var content []byte
+	if ef, err := ctx.DereferenceDict(fs["EF"]); err == nil && ef != nil {
+		if sd, _, err := ctx.DereferenceStreamDict(ef["F"]); err == nil && sd != nil && sd.Decode() == nil {
+			content = sd.Content
+		}
+	}
+	return name, executableFile(name, content)
+}
+
+// handleSanitize removes scripts, launch actions and executable embedded
+// files from an uploaded PDF and returns the sanitized PDF
+func (fh *FileHandler) handleSanitize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		writeError(w, "Error parsing form: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		writeError(w, "No file uploaded", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	in := fh.uploadPath(time.Now().Format("20060102_150405"), 0, files[0].Filename)
+	out := strings.TrimSuffix(in, filepath.Ext(in)) + "_sanitized.pdf"
+	defer os.Remove(in)
+	defer os.Remove(out)
+	sum, err := saveUpload(files[0], in)
+	if err != nil {
+		writeError(w, "Error saving file: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	fh.auditRequestUpload(r, files[0], sum, "sanitize")
+
+	res, err := sanitizePDF(in, out)
+	if err != nil {
+		if code := errorCode(err, CodeInternal); code != CodeInternal {
+			writeError(w, "Error sanitizing PDF: "+err.Error(), code, http.StatusBadRequest)
+			return
+		}
+		writeError(w, "Error sanitizing PDF: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+
+	name := "sanitized_" + strings.TrimSuffix(files[0].Filename, filepath.Ext(files[0].Filename)) + ".pdf"
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("X-Removed-Scripts", strconv.Itoa(res.Scripts))
+	w.Header().Set("X-Removed-Launch-Actions", strconv.Itoa(res.Launches))
+	w.Header().Set("X-Removed-Files", strconv.Itoa(len(res.Files)))
+	http.ServeFile(w, r, out)
+}
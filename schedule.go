@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule is a recurring merge of all supported files in a directory
+type Schedule struct {
+	Name        string `json:"name"`
+	Cron        string `json:"cron"`
+	Source      string `json:"source"`
+	Destination string `json:"destination,omitempty"`
+}
+
+// loadSchedules reads the schedules from a JSON file
+func loadSchedules(path string) ([]Schedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	for _, s := range schedules {
+		if s.Source == "" {
+			return nil, fmt.Errorf("schedule %q has no source", s.Name)
+		}
+		if s.Destination != "" && !validDestination(s.Destination) {
+			return nil, fmt.Errorf("schedule %q has unsupported destination %s", s.Name, s.Destination)
+		}
+	}
+	return schedules, nil
+}
+
+// startScheduler runs the schedules in the background. Cron expressions use
+// the standard five fields, or descriptors like @daily.
+func (fh *FileHandler) startScheduler(schedules []Schedule) (*cron.Cron, error) {
+	c := cron.New()
+	for _, s := range schedules {
+		s := s
+		if _, err := c.AddFunc(s.Cron, func() { fh.runSchedule(s) }); err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", s.Name, err)
+		}
+	}
+	c.Start()
+	return c, nil
+}
+
+// runSchedule merges the files in the schedule's source directory in name
+// order and delivers the result to its destination
+func (fh *FileHandler) runSchedule(s Schedule) {
+	entries, err := os.ReadDir(s.Source)
+	if err != nil {
+		log.Printf("Schedule %q: error reading %s: %v", s.Name, s.Source, err)
+		return
+	}
+
+	var names []string
+	for _, e := range entries {
+		if fh.convertible(e.Name()) && e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		log.Printf("Schedule %q: no files in %s", s.Name, s.Source)
+		return
+	}
+	sort.Strings(names)
+	if err := fh.storage.check(0); err != nil {
+		log.Printf("Schedule %q: skipped: %v", s.Name, err)
+		return
+	}
+
+	timestamp := time.Now().Format("20060102_150405")
+	job := &Job{Name: s.Name, User: "scheduler", Status: JobQueued}
+	for i, name := range names {
+		file := JobFile{Name: name, Path: fh.uploadPath(timestamp, i, name)}
+		f, err := os.Open(filepath.Join(s.Source, name))
+		if err != nil {
+			log.Printf("Schedule %q: %v", s.Name, err)
+			return
+		}
+		file.SHA256, err = saveStream(f, file.Path)
+		f.Close()
+		if err != nil {
+			log.Printf("Schedule %q: error copying %s: %v", s.Name, name, err)
+			return
+		}
+		job.Files = append(job.Files, file)
+	}
+
+	if err := fh.jobs.Create(job); err != nil {
+		log.Printf("Schedule %q: error creating job: %v", s.Name, err)
+		return
+	}
+	fh.auditUploads(job, "")
+
+	job, err = fh.waitForJob(context.Background(), job.ID)
+	if err != nil {
+		log.Printf("Schedule %q: %v", s.Name, err)
+		return
+	}
+	if job.Status != JobDone || s.Destination == "" {
+		return
+	}
+
+	tokens := cloudTokens{drive: os.Getenv("DRIVE_ACCESS_TOKEN"), dropbox: os.Getenv("DROPBOX_ACCESS_TOKEN")}
+	location, err := fh.exportOutput(context.Background(), s.Destination, tokens, job.OutputPath)
+	if err != nil {
+		log.Printf("Schedule %q: error exporting job %s: %v", s.Name, job.ID, err)
+		return
+	}
+	fh.auditFile(AuditEvent{Action: AuditExport, User: job.User, JobID: job.ID, Detail: location}, job.OutputPath, false)
+	log.Printf("Schedule %q: exported job %s to %s", s.Name, job.ID, location)
+}
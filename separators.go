@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/font"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Barcodes of separator sheets
+const (
+	SeparatorCode128 = "code128"
+	SeparatorQR      = "qr"
+)
+
+const (
+	// maxSeparatorValue is the longest value of a separator barcode, which
+	// keeps Code 128 bars wide enough to scan across a page
+	maxSeparatorValue = 40
+	// separatorQRWidth is the width of the QR code of a separator, 5cm
+	separatorQRWidth = 50 * pointsPerMM
+	// separatorBarHeight is the height of Code 128 bars, 2.5cm
+	separatorBarHeight = 25 * pointsPerMM
+	// separatorMargin keeps Code 128 bars clear of the page edges, 2.5cm
+	separatorMargin = 25 * pointsPerMM
+)
+
+// separatorValue returns the value of the separator in front of the n-th
+// merged document, from 1: value with n in place of {n}
+func separatorValue(value string, n int) string {
+	return strings.ReplaceAll(value, "{n}", strconv.Itoa(n))
+}
+
+// checkSeparatorValue checks that the separators of kind can hold value
+// for any document
+func checkSeparatorValue(kind, value string) error {
+	v := separatorValue(value, 99999)
+	if len(v) > maxSeparatorValue {
+		return fmt.Errorf("invalid separator_value: longer than %d characters", maxSeparatorValue)
+	}
+	if kind == SeparatorCode128 {
+		if _, err := encodeCode128(v); err != nil {
+			return fmt.Errorf("invalid separator_value: %v (expected printable ASCII)", err)
+		}
+	}
+	return nil
+}
+
+// separatorPages returns the pages of the merged PDF of a job that
+// documents after the first start on, before separators are inserted
+func separatorPages(job *Job) []int {
+	var starts []int
+	page := 1
+	for _, f := range job.Files {
+		if f.Error != "" || f.Pages == 0 {
+			continue
+		}
+		if page > 1 {
+			starts = append(starts, page)
+		}
+		page += f.Pages
+	}
+	return starts
+}
+
+// insertSeparators inserts a separator sheet in front of every document of
+// the merged PDF at path but the first: a page the size of the document's
+// first page with a barcode of its value and the value beneath it, for
+// scanners to split the bundle at. The pages are inserted into the page
+// tree, so bookmarks, links and structure tags keep to the documents.
+func insertSeparators(path string, job *Job) error {
+	starts := separatorPages(job)
+	if len(starts) == 0 {
+		return nil
+	}
+	return transformPDF(path, func(in, out string) error {
+		ctx, err := readContext(in)
+		if err != nil {
+			return err
+		}
+		if err := ctx.EnsurePageCount(); err != nil {
+			return err
+		}
+		selected := types.IntSet{}
+		for _, page := range starts {
+			selected[page] = true
+		}
+		if err := ctx.InsertBlankPages(selected, true); err != nil {
+			return err
+		}
+		ctx.PageCount += len(starts)
+
+		for i, page := range starts {
+			// Each separator moves the pages after it down by one
+			number := page + i
+			pageDict, _, inherited, err := ctx.PageDict(number, false)
+			if err != nil {
+				return err
+			}
+			content, err := drawSeparator(inherited.MediaBox, job.Options.Separators, separatorValue(job.Options.SeparatorValue, i+2))
+			if err != nil {
+				return err
+			}
+			sd, err := ctx.NewStreamDictForBuf(content)
+			if err != nil {
+				return err
+			}
+			if err := sd.Encode(); err != nil {
+				return err
+			}
+			ref, err := ctx.IndRefForNewObject(*sd)
+			if err != nil {
+				return err
+			}
+			pageDict["Contents"] = *ref
+			pageDict["Resources"] = types.Dict{"Font": types.Dict{"Helv": types.Dict{
+				"Type":     types.Name("Font"),
+				"Subtype":  types.Name("Type1"),
+				"BaseFont": types.Name("Helvetica"),
+				"Encoding": types.Name("WinAnsiEncoding"),
+			}}}
+		}
+		return api.WriteContextFile(ctx, out)
+	})
+}
+
+// drawSeparator returns the content stream of a separator page of box: the
+// barcode of value centred on it, and value beneath
+func drawSeparator(box *types.Rectangle, kind, value string) ([]byte, error) {
+	var b bytes.Buffer
+	cx, cy := box.LL.X+box.Width()/2, box.LL.Y+box.Height()/2
+	b.WriteString("q 0 g\n")
+	bottom := cy
+	switch kind {
+	case SeparatorQR:
+		qr, err := encodeQR([]byte(value))
+		if err != nil {
+			return nil, err
+		}
+		module := separatorQRWidth / float64(qr.size+2*qrQuietZone)
+		x0 := cx - float64(qr.size)*module/2
+		y0 := cy + float64(qr.size)*module/2
+		for y, row := range qr.modules {
+			for x, dark := range row {
+				if dark {
+					fmt.Fprintf(&b, "%.3f %.3f %.3f %.3f re\n", x0+float64(x)*module, y0-float64(y+1)*module, module, module)
+				}
+			}
+		}
+		bottom = y0 - float64(qr.size)*module
+	default:
+		widths, err := encodeCode128(value)
+		if err != nil {
+			return nil, err
+		}
+		modules := 2 * code128QuietZone
+		for _, w := range widths {
+			modules += w
+		}
+		// Bars are at most 1.5pt a module
+		module := min(1.5, (box.Width()-2*separatorMargin)/float64(modules))
+		x := cx - float64(modules-2*code128QuietZone)*module/2
+		y0 := cy - separatorBarHeight/2
+		for i, w := range widths {
+			if i%2 == 0 {
+				fmt.Fprintf(&b, "%.3f %.3f %.3f %.3f re\n", x, y0, float64(w)*module, separatorBarHeight)
+			}
+			x += float64(w) * module
+		}
+		bottom = y0
+	}
+	b.WriteString("f\n")
+
+	width := font.TextWidth(value, "Helvetica", 14)
+	fmt.Fprintf(&b, "BT /Helv 14 Tf %.2f %.2f Td (%s) Tj ET\nQ\n", cx-width/2, bottom-28, contentText(value))
+	return b.Bytes(), nil
+}
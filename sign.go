@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Bytes reserved in the PDF for the CMS signature, certificates included
+const signatureSize = 16384
+
+// pdfSigner signs merged PDFs with a key and certificate chain loaded from a
+// PKCS#12 file
+type pdfSigner struct {
+	key   crypto.Signer
+	certs []*x509.Certificate
+}
+
+// loadSigner reads the signing certificate, or returns nil when no path is
+// configured. Key stores and keys policy does not allow are refused.
+func loadSigner(path, password string, policy cryptoPolicy) (*pdfSigner, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, certs, err := decodePKCS12(data, password, policy)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return nil, errors.New("only RSA and ECDSA signing keys are supported")
+	}
+	if err := policy.allowSigningKey(key); err != nil {
+		return nil, err
+	}
+	return &pdfSigner{key: key, certs: certs}, nil
+}
+
+// signPDF adds a detached PKCS#7 signature over the PDF at path as an
+// incremental update. A visible signature shows the signer's name and the
+// date in the bottom right corner of the last page.
+func (s *pdfSigner) signPDF(path string, visible bool, reason string) error {
+	// Rewrite the file with a classic cross-reference table, which the
+	// update below extends
+	ctx, err := readContext(path)
+	if err != nil {
+		return err
+	}
+	ctx.Configuration.WriteObjectStream = false
+	ctx.Configuration.WriteXRefStream = false
+	err = transformPDF(path, func(in, out string) error {
+		return api.WriteContextFile(ctx, out)
+	})
+	if err != nil {
+		return err
+	}
+
+	if ctx, err = readContext(path); err != nil {
+		return err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+	original, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	prevXRef, err := lastStartXRef(original)
+	if err != nil {
+		return err
+	}
+
+	xRefTable := ctx.XRefTable
+	nextObj := *xRefTable.Size
+	sigNr, widgetNr, apNr := nextObj, nextObj+1, nextObj+2
+	size := apNr
+	if visible {
+		size++
+	}
+
+	// Objects of the update by number, each a full "n 0 obj ... endobj"
+	objects := make(map[int]string)
+	now := time.Now()
+	signer := s.certs[0].Subject.CommonName
+
+	objects[sigNr] = fmt.Sprintf("<</Type/Sig/Filter/Adobe.PPKLite/SubFilter/adbe.pkcs7.detached"+
+		"/ByteRange[0 %-10d %-10d %-10d]/Contents<%s>/M%s/Name%s/Reason%s>>",
+		0, 0, 0, strings.Repeat("0", signatureSize*2), pdfDate(now), pdfText(signer), pdfText(reason))
+
+	pageRef, err := xRefTable.PageDictIndRef(ctx.PageCount)
+	if err != nil {
+		return err
+	}
+	pageDict, _, inherited, err := xRefTable.PageDict(ctx.PageCount, false)
+	if err != nil {
+		return err
+	}
+
+	rect := "[0 0 0 0]"
+	widget := fmt.Sprintf("/Type/Annot/Subtype/Widget/FT/Sig/T%s/V %d 0 R/P %s/F 132",
+		pdfText(fmt.Sprintf("Signature%d", sigNr)), sigNr, pageRef.PDFString())
+	if visible {
+		box := inherited.MediaBox
+		if cropBox := inherited.CropBox; cropBox != nil {
+			box = cropBox
+		}
+		const w, h = 200.0, 48.0
+		x, y := box.UR.X-w-24, box.LL.Y+24
+		rect = fmt.Sprintf("[%.2f %.2f %.2f %.2f]", x, y, x+w, y+h)
+		widget += fmt.Sprintf("/AP<</N %d 0 R>>", apNr)
+
+		content := fmt.Sprintf("q 0.95 g 0 0 %.0f %.0f re f 0.5 G 0.5 w 0.25 0.25 %.1f %.1f re S Q\n"+
+			"BT /Helv 8 Tf 0 g 6 %.0f Td (Digitally signed by %s) Tj 0 -11 Td (Date: %s) Tj 0 -11 Td (%s) Tj ET",
+			w, h, w-0.5, h-0.5, h-14, contentText(signer), now.Format("2006-01-02 15:04:05 -07:00"), contentText(reason))
+		objects[apNr] = fmt.Sprintf("<</Type/XObject/Subtype/Form/BBox[0 0 %.0f %.0f]"+
+			"/Resources<</Font<</Helv<</Type/Font/Subtype/Type1/BaseFont/Helvetica/Encoding/WinAnsiEncoding>>>>>>"+
+			"/Length %d>>\nstream\n%s\nendstream", w, h, len(content)+1, content)
+	}
+	objects[widgetNr] = fmt.Sprintf("<<%s/Rect%s>>", widget, rect)
+
+	// Add the widget to the page and the signature field to the form
+	annots, err := xRefTable.DereferenceArray(pageDict["Annots"])
+	if err != nil {
+		return err
+	}
+	pageDict["Annots"] = append(annots, *types.NewIndirectRef(widgetNr, 0))
+	objects[pageRef.ObjectNumber.Value()] = pageDict.PDFString()
+
+	acroForm, err := xRefTable.DereferenceDict(xRefTable.RootDict["AcroForm"])
+	if err != nil {
+		return err
+	}
+	if acroForm == nil {
+		acroForm = types.Dict{}
+	}
+	fields, err := xRefTable.DereferenceArray(acroForm["Fields"])
+	if err != nil {
+		return err
+	}
+	acroForm["Fields"] = append(fields, *types.NewIndirectRef(widgetNr, 0))
+	acroForm["SigFlags"] = types.Integer(3)
+	if ref, ok := xRefTable.RootDict["AcroForm"].(types.IndirectRef); ok {
+		objects[ref.ObjectNumber.Value()] = acroForm.PDFString()
+	} else {
+		xRefTable.RootDict["AcroForm"] = acroForm
+		objects[xRefTable.Root.ObjectNumber.Value()] = xRefTable.RootDict.PDFString()
+	}
+
+	// Append the update: objects, cross-reference section and trailer
+	var buf bytes.Buffer
+	buf.Write(original)
+	if !bytes.HasSuffix(original, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	var nrs []int
+	for nr := range objects {
+		nrs = append(nrs, nr)
+	}
+	sort.Ints(nrs)
+	offsets := make(map[int]int)
+	for _, nr := range nrs {
+		offsets[nr] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", nr, objects[nr])
+	}
+
+	xrefOffset := buf.Len()
+	buf.WriteString("xref\n")
+	for _, nr := range nrs {
+		fmt.Fprintf(&buf, "%d 1\n%010d 00000 n \n", nr, offsets[nr])
+	}
+	trailer := fmt.Sprintf("/Size %d/Root %s/Prev %d", size, xRefTable.Root.PDFString(), prevXRef)
+	if xRefTable.Info != nil {
+		trailer += "/Info " + xRefTable.Info.PDFString()
+	}
+	if len(xRefTable.ID) > 0 {
+		trailer += "/ID" + xRefTable.ID.PDFString()
+	}
+	fmt.Fprintf(&buf, "trailer\n<<%s>>\nstartxref\n%d\n%%%%EOF\n", trailer, xrefOffset)
+
+	// Sign everything but the contents placeholder
+	out := buf.Bytes()
+	sigStart := offsets[sigNr]
+	contentsAt := bytes.Index(out[sigStart:], []byte("/Contents<")) + sigStart + len("/Contents")
+	contentsEnd := contentsAt + signatureSize*2 + 2
+	byteRange := fmt.Sprintf("[0 %-10d %-10d %-10d]", contentsAt, contentsEnd, len(out)-contentsEnd)
+	rangeAt := bytes.Index(out[sigStart:], []byte("/ByteRange[")) + sigStart + len("/ByteRange")
+	copy(out[rangeAt:], byteRange)
+
+	digest := sha256.New()
+	digest.Write(out[:contentsAt])
+	digest.Write(out[contentsEnd:])
+	signature, err := s.signDigest(digest.Sum(nil), now)
+	if err != nil {
+		return err
+	}
+	if len(signature) > signatureSize {
+		return fmt.Errorf("signature of %d bytes exceeds the reserved %d", len(signature), signatureSize)
+	}
+	copy(out[contentsAt+1:], hex.EncodeToString(signature))
+
+	return transformPDF(path, func(in, tmp string) error {
+		return os.WriteFile(tmp, out, 0644)
+	})
+}
+
+// lastStartXRef returns the offset of the last cross-reference section
+func lastStartXRef(data []byte) (int, error) {
+	i := bytes.LastIndex(data, []byte("startxref"))
+	if i < 0 {
+		return 0, errors.New("missing startxref")
+	}
+	fields := strings.Fields(string(data[i+len("startxref"):]))
+	if len(fields) == 0 {
+		return 0, errors.New("missing startxref offset")
+	}
+	return strconv.Atoi(fields[0])
+}
+
+func pdfDate(t time.Time) string {
+	_, offset := t.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	return fmt.Sprintf("(D:%s%c%02d'%02d')", t.Format("20060102150405"), sign, offset/3600, offset/60%60)
+}
+
+// pdfText encodes s as a PDF text string literal
+func pdfText(s string) string {
+	escaped, err := types.EscapeUTF16String(s)
+	if err != nil {
+		return "()"
+	}
+	return "(" + *escaped + ")"
+}
+
+// contentText escapes s for a string in a content stream with a standard
+// font, replacing characters outside ASCII
+func contentText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// CMS (RFC 5652) structures for a detached SignedData signature
+
+var (
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []algorithmIdentifier `asn1:"set"`
+	ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version            int
+	IssuerAndSerial    issuerAndSerial
+	DigestAlgorithm    algorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm algorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial asn1.RawValue
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// signDigest returns a DER encoded CMS SignedData over a SHA-256 digest
+func (s *pdfSigner) signDigest(digest []byte, signingTime time.Time) ([]byte, error) {
+	attrs := []cmsAttribute{
+		cmsAttr(oidContentType, oidData),
+		cmsAttr(oidSigningTime, signingTime.UTC()),
+		cmsAttr(oidMessageDigest, digest),
+	}
+	// The signature covers the attributes encoded as a SET OF
+	attrsDER, err := asn1.MarshalWithParams(attrs, "set")
+	if err != nil {
+		return nil, err
+	}
+	attrsHash := sha256.Sum256(attrsDER)
+	signature, err := s.key.Sign(rand.Reader, attrsHash[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("error signing: %v", err)
+	}
+
+	sigAlg := algorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	if _, ok := s.key.(*ecdsa.PrivateKey); ok {
+		sigAlg = algorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	}
+	sha256Alg := algorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+
+	var certs []byte
+	for _, cert := range s.certs {
+		certs = append(certs, cert.Raw...)
+	}
+	cert := s.certs[0]
+
+	// Signed attributes are stored as [0] IMPLICIT instead of a SET
+	implicitAttrs := append([]byte{0xa0}, attrsDER[1:]...)
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []algorithmIdentifier{sha256Alg},
+		ContentInfo:      struct{ ContentType asn1.ObjectIdentifier }{oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerial: issuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: cert.RawIssuer},
+				Serial: asn1.RawValue{FullBytes: mustMarshal(cert.SerialNumber)},
+			},
+			DigestAlgorithm:    sha256Alg,
+			SignedAttrs:        asn1.RawValue{FullBytes: implicitAttrs},
+			SignatureAlgorithm: sigAlg,
+			Signature:          signature,
+		}},
+	}
+	content, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	})
+}
+
+func cmsAttr(oid asn1.ObjectIdentifier, value any) cmsAttribute {
+	return cmsAttribute{Type: oid, Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: mustMarshal(value)}}
+}
+
+func mustMarshal(v any) []byte {
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
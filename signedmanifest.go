@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Suffixes of the signed manifest of a job and its signature, next to the
+// output they describe
+const (
+	manifestSuffix          = ".manifest.json"
+	manifestSignatureSuffix = ".manifest.json.p7s"
+)
+
+// processingManifest records what a job merged, how and into what, so
+// recipients can prove the output was not altered after it was assembled.
+// The server signs it with its signing certificate, in a detached CMS
+// signature next to it.
+type processingManifest struct {
+	JobID     string          `json:"jobId"`
+	Name      string          `json:"name,omitempty"`
+	User      string          `json:"user,omitempty"`
+	RequestID string          `json:"requestId,omitempty"`
+	Inputs    []manifestInput `json:"inputs"`
+	// Options has the files of overlay, icc_profile and cover_logo by name
+	Options    MergeOptions   `json:"options"`
+	Output     manifestOutput `json:"output"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	// SignedBy is the common name of the signing certificate
+	SignedBy string `json:"signedBy"`
+}
+
+type manifestInput struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	// Skipped is set for uploads left out with on_error=skip
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+type manifestOutput struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// hashInputs fills in the digests of the uploads of a job that came without
+// one, before their conversion replaces them
+func (fh *FileHandler) hashInputs(job *Job) error {
+	for i, f := range job.Files {
+		if f.SHA256 != "" {
+			continue
+		}
+		sum, err := fileSHA256(f.Path)
+		if err != nil {
+			return fmt.Errorf("error hashing %s: %v", f.Name, err)
+		}
+		job.Files[i].SHA256 = sum
+	}
+	return nil
+}
+
+// writeManifest writes the signed manifest of a job done merging into the
+// output at path, of size bytes with the given digest
+func (fh *FileHandler) writeManifest(job *Job, path string, size int64, sum string) error {
+	now := time.Now()
+	m := processingManifest{
+		JobID:      job.ID,
+		Name:       job.Name,
+		User:       job.User,
+		RequestID:  job.RequestID,
+		Inputs:     []manifestInput{},
+		Options:    job.Options,
+		Output:     manifestOutput{Name: filepath.Base(path), SHA256: sum, Size: size},
+		CreatedAt:  job.CreatedAt.UTC(),
+		FinishedAt: now.UTC(),
+		SignedBy:   fh.signer.certs[0].Subject.CommonName,
+	}
+	for _, f := range job.Files {
+		m.Inputs = append(m.Inputs, manifestInput{Name: f.Name, SHA256: f.SHA256, Skipped: f.Error != ""})
+	}
+	// Uploaded option files are stored under names of the server's own
+	for _, p := range []*string{&m.Options.Overlay, &m.Options.ICCProfile} {
+		if *p != "" {
+			*p = filepath.Base(*p)
+		}
+	}
+	if m.Options.Cover != nil && m.Options.Cover.Logo != "" {
+		cover := *m.Options.Cover
+		cover.Logo = filepath.Base(cover.Logo)
+		m.Options.Cover = &cover
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	digest := sha256.Sum256(data)
+	signature, err := fh.signer.signDigest(digest[:], now)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+manifestSuffix, data, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+manifestSignatureSuffix, signature, 0644); err != nil {
+		os.Remove(path + manifestSuffix)
+		return err
+	}
+	return nil
+}
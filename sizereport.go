@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// SizeReport compares the output of a job that optimizes images with the
+// uploads, and breaks the output down by what takes up its bytes
+type SizeReport struct {
+	// InputSize is the size of the uploads merged, and OutputSize that of
+	// the output
+	InputSize  int64 `json:"inputSize"`
+	OutputSize int64 `json:"outputSize"`
+	// Breakdown is left out for outputs that are not a single PDF
+	Breakdown *SizeBreakdown `json:"breakdown,omitempty"`
+}
+
+// SizeBreakdown divides the bytes of a PDF among the streams of its images,
+// embedded fonts and page content; Other is the rest, such as the objects
+// holding the document together, its metadata and color profiles
+type SizeBreakdown struct {
+	Images  int64 `json:"images"`
+	Fonts   int64 `json:"fonts"`
+	Content int64 `json:"content"`
+	Other   int64 `json:"other"`
+}
+
+// optimizes reports whether the options shrink the images of a job, which
+// makes the worker report on the sizes
+func optimizes(opts MergeOptions) bool {
+	return opts.ImageDPI > 0 || opts.ImageQuality > 0
+}
+
+// fileSize returns the size of the file at path, or 0 if it cannot be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// sizeReport reports on the output of a job at path, of size bytes. The
+// uploads left out of the job do not count towards its input.
+func sizeReport(job *Job, path string, size int64) *SizeReport {
+	report := &SizeReport{OutputSize: size}
+	for _, f := range job.Files {
+		if f.Error == "" && f.Report != nil {
+			report.InputSize += f.Report.Size
+		}
+	}
+	if strings.EqualFold(filepath.Ext(path), ".pdf") {
+		breakdown, err := sizeBreakdown(path, size)
+		if err != nil {
+			log.Printf("Error breaking down the size of job %s: %v", job.ID, err)
+		} else {
+			report.Breakdown = breakdown
+		}
+	}
+	return report
+}
+
+// sizeBreakdown breaks down the PDF at path, of size bytes. The objects are
+// read one at a time and stream data is left in the file, so outputs of
+// any size fit in memory.
+func sizeBreakdown(path string, size int64) (*SizeBreakdown, error) {
+	pr, err := openPDFReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.close()
+
+	// Font files and page contents are streams without a type of their
+	// own, found through the dictionaries that refer to them
+	streams := map[int]int64{}
+	fonts := map[int]bool{}
+	contents := map[int]bool{}
+	breakdown := &SizeBreakdown{}
+	for nr := range pr.xref {
+		o, err := pr.object(nr)
+		if err != nil {
+			return nil, err
+		}
+		var d types.Dict
+		switch o := o.(type) {
+		case types.StreamDict:
+			length, err := pr.streamLength(o)
+			if err != nil {
+				return nil, err
+			}
+			switch subtype := o.Dict.Subtype(); {
+			case subtype != nil && *subtype == "Image":
+				breakdown.Images += length
+			case subtype != nil && *subtype == "Form":
+				breakdown.Content += length
+			default:
+				streams[nr] = length
+			}
+			d = o.Dict
+		case types.Dict:
+			d = o
+		default:
+			continue
+		}
+
+		switch t := d.Type(); {
+		case t == nil:
+		case *t == "FontDescriptor":
+			for _, key := range []string{"FontFile", "FontFile2", "FontFile3"} {
+				if ref := d.IndirectRefEntry(key); ref != nil {
+					fonts[ref.ObjectNumber.Value()] = true
+				}
+			}
+		case *t == "Page":
+			c, err := pr.resolve(d["Contents"])
+			if err != nil {
+				return nil, err
+			}
+			if ref, ok := d["Contents"].(types.IndirectRef); ok {
+				contents[ref.ObjectNumber.Value()] = true
+			}
+			if a, ok := c.(types.Array); ok {
+				for _, o := range a {
+					if ref, ok := o.(types.IndirectRef); ok {
+						contents[ref.ObjectNumber.Value()] = true
+					}
+				}
+			}
+		}
+	}
+
+	for nr, length := range streams {
+		switch {
+		case fonts[nr]:
+			breakdown.Fonts += length
+		case contents[nr]:
+			breakdown.Content += length
+		}
+	}
+	breakdown.Other = max(size-breakdown.Images-breakdown.Fonts-breakdown.Content, 0)
+	return breakdown, nil
+}
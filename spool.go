@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Non-file fields of an upload form may take up this much in total, as with
+// http.Request.ParseMultipartForm
+const maxFormValues = 10 << 20
+
+// spooledFile is an uploaded file written to the uploads directory
+type spooledFile struct {
+	name   string
+	path   string
+	sha256 string
+	size   int64
+}
+
+// spooledForm is an upload form whose files were written straight to the
+// uploads directory as they arrived, so they are never held in memory or
+// copied through a temporary file
+type spooledForm struct {
+	// files are the parts of the "files" field, in order
+	files []spooledFile
+	// options are the overlay, icc_profile and cover_logo files
+	options map[string]spooledFile
+}
+
+// remove deletes the spooled files, for forms that are rejected
+func (sf *spooledForm) remove() {
+	for _, f := range sf.files {
+		os.Remove(f.path)
+	}
+	for _, f := range sf.options {
+		os.Remove(f.path)
+	}
+}
+
+// size returns the total size of the uploaded files
+func (sf *spooledForm) size() int64 {
+	var n int64
+	for _, f := range sf.files {
+		n += f.size
+	}
+	return n
+}
+
+// uploadCopies hands out the uploaded files of a form to the jobs or files
+// of a job that use them. Workers remove the files of a job once they are
+// done with them, so the first use takes an upload and every further one
+// gets a copy.
+type uploadCopies struct {
+	fh        *FileHandler
+	timestamp string
+	names     map[string]string
+	taken     map[string]bool
+	next      int
+	made      []string
+}
+
+// copies returns the handout of the uploads of sf, spooled at timestamp
+func (fh *FileHandler) copies(sf *spooledForm, timestamp string) *uploadCopies {
+	c := &uploadCopies{fh: fh, timestamp: timestamp, names: map[string]string{}, taken: map[string]bool{}, next: len(sf.files)}
+	for _, f := range sf.files {
+		c.names[f.path] = f.name
+	}
+	return c
+}
+
+// take replaces the upload at *path with the copy to use, if it was taken
+func (c *uploadCopies) take(path *string) error {
+	if !c.taken[*path] {
+		c.taken[*path] = true
+		return nil
+	}
+	copyPath := c.fh.uploadPath(c.timestamp, c.next, c.names[*path])
+	c.next++
+	if err := copyFile(*path, copyPath); err != nil {
+		os.Remove(copyPath)
+		return err
+	}
+	*path = copyPath
+	c.made = append(c.made, copyPath)
+	return nil
+}
+
+// remove deletes the copies made, for jobs that are not created
+func (c *uploadCopies) remove() {
+	for _, path := range c.made {
+		os.Remove(path)
+	}
+}
+
+// spoolForm reads the multipart form of an upload, writing its files to
+// the uploads directory and its other fields to r.Form and r.PostForm
+func (fh *FileHandler) spoolForm(w http.ResponseWriter, r *http.Request, timestamp string) (*spooledForm, error) {
+	if fh.uploads.maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, fh.uploads.maxSize)
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	sf := &spooledForm{options: map[string]spooledFile{}}
+	values := url.Values{}
+	budget := int64(maxFormValues)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sf.remove()
+			return nil, err
+		}
+
+		field, name := part.FormName(), part.FileName()
+		if name == "" {
+			value, err := io.ReadAll(io.LimitReader(part, budget+1))
+			if err != nil {
+				sf.remove()
+				return nil, err
+			}
+			if budget -= int64(len(value)); budget < 0 {
+				sf.remove()
+				return nil, errors.New("form values too large")
+			}
+			values.Add(field, string(value))
+			continue
+		}
+
+		var path string
+		switch field {
+		case "files":
+			path = fh.uploadPath(timestamp, len(sf.files), name)
+		case "overlay", "icc_profile", "cover_logo":
+			path = filepath.Join(fh.uploadsDir, fmt.Sprintf("%s_%s_%s_%s", timestamp, randomHex(4), field, filepath.Base(name)))
+		default:
+			continue
+		}
+		f := spooledFile{name: name, path: path}
+		if f.sha256, err = saveStream(part, path); err != nil {
+			os.Remove(path)
+			sf.remove()
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil {
+			f.size = info.Size()
+		}
+		if field == "files" {
+			sf.files = append(sf.files, f)
+		} else {
+			if prev, ok := sf.options[field]; ok {
+				os.Remove(prev.path)
+			}
+			sf.options[field] = f
+		}
+	}
+
+	// Form values come before those of the query, as ParseMultipartForm
+	// puts them
+	form := url.Values{}
+	for k, vs := range values {
+		form[k] = append([]string{}, vs...)
+	}
+	for k, vs := range r.Form {
+		form[k] = append(form[k], vs...)
+	}
+	r.Form, r.PostForm = form, values
+	return sf, nil
+}
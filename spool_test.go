@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// zeros reads as an endless run of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestSpoolFormOver2GB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes more than 2 GB")
+	}
+	dir := t.TempDir()
+	requireFreeSpace(t, dir, 3<<30)
+	fh := &FileHandler{uploadsDir: dir}
+
+	// The upload is generated as it is sent, hashing it on the way
+	const size = 1<<31 + 1<<20
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	h := sha256.New()
+	go func() {
+		if err := mw.WriteField("name", "big"); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		part, err := mw.CreateFormFile("files", "big.pdf")
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(io.MultiWriter(part, h), io.LimitReader(zeros{}, size)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	r := httptest.NewRequest("POST", "/upload", pr)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	// The heap is sampled while the part is spooled, to show it is not
+	// held in memory
+	var peak uint64
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			peak = max(peak, m.HeapAlloc)
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+	sf, err := fh.spoolForm(httptest.NewRecorder(), r, "20260101_000000")
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.remove()
+
+	if len(sf.files) != 1 {
+		t.Fatalf("%d files spooled, want 1", len(sf.files))
+	}
+	f := sf.files[0]
+	if f.size != size {
+		t.Errorf("spooled %d bytes, want %d", f.size, size)
+	}
+	if info, err := os.Stat(f.path); err != nil || info.Size() != size {
+		t.Errorf("file on disk: %v, %v", info, err)
+	}
+	if want := hex.EncodeToString(h.Sum(nil)); f.sha256 != want {
+		t.Errorf("SHA-256 %s, want %s", f.sha256, want)
+	}
+	if got := r.PostForm.Get("name"); got != "big" {
+		t.Errorf("name field %q, want big", got)
+	}
+	if peak > 64<<20 {
+		t.Errorf("heap reached %d MB while spooling", peak>>20)
+	}
+}
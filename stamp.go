@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Page corners for source stamps, in pdfcpu's anchor notation
+var stampPositions = map[string]string{
+	"top-left":     "tl",
+	"top-right":    "tr",
+	"bottom-left":  "bl",
+	"bottom-right": "br",
+}
+
+// stampSource writes a copy of the PDF at in to out with the source file
+// name, and optionally the page number within that file, in a corner of
+// every page. Names Helvetica lacks characters of are set in a font of
+// FONT_DIR, and right-to-left names are laid out right to left.
+func stampSource(in, out, name string, opts MergeOptions) error {
+	text := shapeArabic(strings.ReplaceAll(name, "%", ""))
+	text = visualOrder(text, rtlParagraph(text))
+	if opts.StampPageNumbers {
+		text += " - page %p of %P"
+	}
+
+	pos := stampPositions[opts.StampPosition]
+	if pos == "" {
+		pos = "br"
+	}
+
+	// Keep the stamp 10pt away from both edges of its corner
+	dx, dy := 10, 10
+	if pos[1] == 'r' {
+		dx = -10
+	}
+	if pos[0] == 't' {
+		dy = -10
+	}
+
+	fontName := "Helvetica"
+	if f := textFontFor(text); f != nil {
+		fontName = f.name
+	}
+	desc := fmt.Sprintf("font:%s, points:8, position:%s, offset:%d %d, scalefactor:1 abs, rotation:0, fillcolor:#000000, opacity:1", fontName, pos, dx, dy)
+	wm, err := api.TextWatermark(text, desc, true, false, types.POINTS)
+	if err != nil {
+		return fmt.Errorf("error creating stamp: %v", err)
+	}
+	return api.AddWatermarksFile(in, out, nil, wm, pdfConfig())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// errInsufficientStorage is returned when uploads are refused for lack of
+// disk space
+var errInsufficientStorage = errors.New("insufficient storage")
+
+// storageGuard refuses new uploads while the disk holding the working
+// directories runs low, or they use up their quota; zero disables a check
+type storageGuard struct {
+	dirs    []string
+	minFree int64
+	quota   int64
+}
+
+// loadStorageGuard reads the thresholds from MIN_FREE_DISK_MB and
+// STORAGE_QUOTA_MB
+func loadStorageGuard(dirs ...string) (*storageGuard, error) {
+	g := &storageGuard{dirs: dirs}
+	for _, v := range []struct {
+		name string
+		dst  *int64
+	}{{"MIN_FREE_DISK_MB", &g.minFree}, {"STORAGE_QUOTA_MB", &g.quota}} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		mb, err := strconv.ParseFloat(s, 64)
+		if err != nil || mb < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", v.name, s)
+		}
+		*v.dst = int64(mb * (1 << 20))
+	}
+	return g, nil
+}
+
+// check returns errInsufficientStorage, wrapped with the reason, when new
+// uploads should be refused. incoming is the size of the upload, when
+// known, which must fit as well.
+func (g *storageGuard) check(incoming int64) error {
+	if g.minFree > 0 {
+		for _, dir := range g.dirs {
+			free, err := freeSpace(dir)
+			if err != nil {
+				// Free space is unknown on some platforms
+				continue
+			}
+			if free-incoming < g.minFree {
+				return fmt.Errorf("%w: %.0f MB free in %s, %.0f MB required%s",
+					errInsufficientStorage, float64(free)/(1<<20), dir, float64(g.minFree)/(1<<20), incomingMB(incoming))
+			}
+		}
+	}
+	if g.quota > 0 {
+		var used int64
+		for _, dir := range g.dirs {
+			used += dirSize(dir)
+		}
+		if used >= g.quota || used+incoming > g.quota {
+			return withCode(CodeQuotaExceeded, fmt.Errorf("%w: %.1f MB of the %.1f MB quota used%s",
+				errInsufficientStorage, float64(used)/(1<<20), float64(g.quota)/(1<<20), incomingMB(incoming)))
+		}
+	}
+	return nil
+}
+
+// incomingMB describes the size of an upload for the errors of check
+func incomingMB(incoming int64) string {
+	if incoming <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(", for an upload of %.1f MB", float64(incoming)/(1<<20))
+}
+
+// dirSize returns the total size of the files under dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// requireStorage wraps a handler accepting uploads so it answers 507
+// Insufficient Storage instead of running out of space halfway
+func (fh *FileHandler) requireStorage(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			// The length of chunked requests is unknown
+			if err := fh.storage.check(max(r.ContentLength, 0)); err != nil {
+				writeError(w, "Upload refused: "+err.Error(), errorCode(err, CodeInsufficientStorage), http.StatusInsufficientStorage)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
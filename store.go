@@ -0,0 +1,584 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Job statuses
+const (
+	JobQueued     = "queued"
+	JobProcessing = "processing"
+	JobDone       = "done"
+	JobFailed     = "failed"
+	// JobDeleting marks a job whose data is being deleted, which workers
+	// no longer claim
+	JobDeleting = "deleting"
+)
+
+var (
+	ErrJobNotFound   = errors.New("job not found")
+	ErrJobProcessing = errors.New("job is being processed")
+)
+
+// Processing stages of a job, reported in its progress
+const (
+	StageConverting = "converting"
+	StageMerging    = "merging"
+	// StageFinishing covers the options applied to the merged PDF
+	StageFinishing = "finishing"
+	StageDone      = "done"
+)
+
+// JobProgress tells how far the worker has come with a job
+type JobProgress struct {
+	Stage          string `json:"stage,omitempty"`
+	FilesConverted int    `json:"filesConverted"`
+	FilesTotal     int    `json:"filesTotal"`
+	// Pages of the converted files, counted as each is converted; they
+	// are merged in one pass
+	PagesMerged int `json:"pagesMerged"`
+	PagesTotal  int `json:"pagesTotal"`
+	// Resumed counts the times the job was taken up again after its
+	// worker stopped
+	Resumed int `json:"resumed,omitempty"`
+}
+
+// JobFile is an uploaded input of a job
+type JobFile struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Untagged is set by the worker when the file converted to a PDF
+	// without structure tags
+	Untagged bool `json:"untagged,omitempty"`
+	// Converted is the PDF the worker made of the file and Pages its page
+	// count, kept so an interrupted job resumes without converting it again
+	Converted string `json:"converted,omitempty"`
+	Pages     int    `json:"pages,omitempty"`
+	// Error is why the worker left the file out of a job that skips the
+	// files it fails to convert
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+	// Report is what the worker found examining the file
+	Report *InputReport `json:"report,omitempty"`
+	// SourcePages are the pages of the upload in the converted file, when
+	// the manifest selects some
+	SourcePages []int `json:"sourcePages,omitempty"`
+	// PageRange, Rotate, Scale, Fit and Bookmark lay the file out as the
+	// upload manifest says: the pages merged, the clockwise turn in degrees,
+	// the factor pages are scaled by or the paper size they are fitted to,
+	// and the title of its bookmark
+	PageRange string  `json:"pageRange,omitempty"`
+	Rotate    int     `json:"rotate,omitempty"`
+	Scale     float64 `json:"scale,omitempty"`
+	Fit       string  `json:"fit,omitempty"`
+	Bookmark  string  `json:"bookmark,omitempty"`
+}
+
+// Job is the persisted record of a single merge request
+type Job struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	User string `json:"user,omitempty"`
+	// RequestID is the X-Request-ID of the request that queued the job
+	RequestID string `json:"requestId,omitempty"`
+	// Remote is the address of the client that queued the job, counted
+	// against MAX_ACTIVE_JOBS_PER_IP
+	Remote     string       `json:"-"`
+	Files      []JobFile    `json:"files"`
+	Options    MergeOptions `json:"options"`
+	Status     string       `json:"status"`
+	OutputPath string       `json:"outputPath,omitempty"`
+	// Size and SHA-256 hex digest of the finished output
+	OutputSize   int64       `json:"outputSize,omitempty"`
+	OutputSHA256 string      `json:"outputSha256,omitempty"`
+	Progress     JobProgress `json:"progress"`
+	// PageMap traces the pages of the finished output to their uploads
+	PageMap []PageRun `json:"pageMap,omitempty"`
+	// FailedVolumes are the volumes a split output goes without
+	FailedVolumes []VolumeError `json:"failedVolumes,omitempty"`
+	// SizeReport compares the finished output of an optimized job with
+	// its uploads
+	SizeReport *SizeReport `json:"sizeReport,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	// ErrorCode is the code of Error, one of the Code constants
+	ErrorCode string    `json:"errorCode,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// JobStore persists job records so history survives restarts
+type JobStore interface {
+	Create(job *Job) error
+	Get(id string) (*Job, error)
+	Update(job *Job) error
+	List() ([]*Job, error)
+	// Find returns the jobs f selects, newest first
+	Find(f JobFilter) ([]*Job, error)
+	Delete(id string) error
+	// ClaimNext marks the oldest queued job within l as processing and
+	// returns it, or ErrJobNotFound when no queued job is
+	ClaimNext(l ClaimLimits) (*Job, error)
+	// CountActive counts the jobs queued or processing of user and of the
+	// client address remote; empty ones are not counted
+	CountActive(user, remote string) (byUser, byRemote int, err error)
+	// Touch records that the job is still being processed
+	Touch(id string) error
+	// MarkDeleting sets the status of the job to JobDeleting unless it is
+	// processing, in which case it returns ErrJobProcessing
+	MarkDeleting(id string) error
+	// Requeue puts jobs still processing that were last updated before the
+	// given time back in the queue, and returns how many there were
+	Requeue(before time.Time) (int, error)
+	Close() error
+}
+
+// JobFilter selects jobs by user, status and creation time, a page at a
+// time; zero fields select everything
+type JobFilter struct {
+	// User is the user whose jobs are selected, unless AllUsers is set
+	User     string
+	AllUsers bool
+	Status   string
+	// Since and Until limit the creation time; zero times leave the range
+	// open
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+}
+
+// ClaimLimits keep ClaimNext from claiming jobs of users and client
+// addresses with as many jobs processing already; zero means no limit
+type ClaimLimits struct {
+	PerUser   int
+	PerRemote int
+}
+
+type sqlJobStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// openJobStore opens the store described by dsn. Postgres is used for
+// postgres:// URLs; anything else is treated as a SQLite file path.
+func openJobStore(dsn string) (JobStore, error) {
+	driver := "sqlite"
+	postgres := strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+	if postgres {
+		driver = "postgres"
+	} else {
+		dsn = strings.TrimPrefix(dsn, "sqlite://")
+		if dsn == "" {
+			dsn = "pdfmg.db"
+		}
+		// Let API and worker processes share the database file
+		if !strings.Contains(dsn, "?") {
+			dsn += "?_pragma=busy_timeout(5000)"
+		}
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening job store: %v", err)
+	}
+	if !postgres {
+		// SQLite only supports a single writer
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &sqlJobStore{db: db, postgres: postgres}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrations are applied in order; append new ones, never edit old ones
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS jobs (
+		id          TEXT PRIMARY KEY,
+		user_name   TEXT NOT NULL DEFAULT '',
+		files       TEXT NOT NULL,
+		status      TEXT NOT NULL,
+		output_path TEXT NOT NULL DEFAULT '',
+		error       TEXT NOT NULL DEFAULT '',
+		created_at  BIGINT NOT NULL,
+		updated_at  BIGINT NOT NULL
+	)`,
+	`ALTER TABLE jobs ADD COLUMN name TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE jobs ADD COLUMN options TEXT NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS audit_events (
+		time      BIGINT NOT NULL,
+		action    TEXT NOT NULL,
+		user_name TEXT NOT NULL DEFAULT '',
+		remote    TEXT NOT NULL DEFAULT '',
+		job_id    TEXT NOT NULL DEFAULT '',
+		file      TEXT NOT NULL DEFAULT '',
+		sha256    TEXT NOT NULL DEFAULT '',
+		size      BIGINT NOT NULL DEFAULT 0,
+		detail    TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_events_time ON audit_events (time)`,
+	`ALTER TABLE jobs ADD COLUMN output_size BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE jobs ADD COLUMN output_sha256 TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE jobs ADD COLUMN progress TEXT NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE jobs ADD COLUMN page_map TEXT NOT NULL DEFAULT 'null'`,
+	`ALTER TABLE jobs ADD COLUMN failed_volumes TEXT NOT NULL DEFAULT 'null'`,
+	`ALTER TABLE jobs ADD COLUMN request_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE jobs ADD COLUMN error_code TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS upload_sessions (
+		token      TEXT PRIMARY KEY,
+		user_name  TEXT NOT NULL DEFAULT '',
+		files      TEXT NOT NULL,
+		version    INTEGER NOT NULL DEFAULT 0,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`ALTER TABLE upload_sessions ADD COLUMN collect_token TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS jobs_user_created ON jobs (user_name, created_at)`,
+	`ALTER TABLE jobs ADD COLUMN size_report TEXT NOT NULL DEFAULT 'null'`,
+	`ALTER TABLE jobs ADD COLUMN remote TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS jobs_status ON jobs (status)`,
+}
+
+func (s *sqlJobStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("error creating schema_version table: %v", err)
+	}
+
+	var version int
+	err := s.db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = s.db.Exec(`INSERT INTO schema_version (version) VALUES (0)`)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		if _, err := s.db.Exec(migrations[version]); err != nil {
+			return fmt.Errorf("error applying migration %d: %v", version+1, err)
+		}
+		if _, err := s.db.Exec(s.rebind(`UPDATE schema_version SET version = ?`), version+1); err != nil {
+			return fmt.Errorf("error updating schema version: %v", err)
+		}
+	}
+	return nil
+}
+
+// rebind rewrites ? placeholders into $n for Postgres
+func (s *sqlJobStore) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlJobStore) Create(job *Job) error {
+	if job.ID == "" {
+		job.ID = newJobID()
+	}
+	now := time.Now().UTC()
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	files, err := json.Marshal(job.Files)
+	if err != nil {
+		return err
+	}
+	options, err := json.Marshal(job.Options)
+	if err != nil {
+		return err
+	}
+	progress, err := json.Marshal(job.Progress)
+	if err != nil {
+		return err
+	}
+	pageMap, err := json.Marshal(job.PageMap)
+	if err != nil {
+		return err
+	}
+	failedVolumes, err := json.Marshal(job.FailedVolumes)
+	if err != nil {
+		return err
+	}
+	sizeReport, err := json.Marshal(job.SizeReport)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.rebind(`INSERT INTO jobs
+		(id, name, user_name, request_id, remote, files, options, status, output_path, output_size, output_sha256, progress, page_map, failed_volumes, size_report, error, error_code, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		job.ID, job.Name, job.User, job.RequestID, job.Remote, string(files), string(options), job.Status, job.OutputPath, job.OutputSize, job.OutputSHA256,
+		string(progress), string(pageMap), string(failedVolumes), string(sizeReport), job.Error, job.ErrorCode, job.CreatedAt.UnixMilli(), job.UpdatedAt.UnixMilli())
+	return err
+}
+
+func (s *sqlJobStore) Get(id string) (*Job, error) {
+	row := s.db.QueryRow(s.rebind(`SELECT id, name, user_name, request_id, remote, files, options, status, output_path, output_size, output_sha256, progress, page_map, failed_volumes, size_report, error, error_code, created_at, updated_at
+		FROM jobs WHERE id = ?`), id)
+	job, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrJobNotFound
+	}
+	return job, err
+}
+
+func (s *sqlJobStore) Update(job *Job) error {
+	job.UpdatedAt = time.Now().UTC()
+
+	files, err := json.Marshal(job.Files)
+	if err != nil {
+		return err
+	}
+	options, err := json.Marshal(job.Options)
+	if err != nil {
+		return err
+	}
+	progress, err := json.Marshal(job.Progress)
+	if err != nil {
+		return err
+	}
+	pageMap, err := json.Marshal(job.PageMap)
+	if err != nil {
+		return err
+	}
+	failedVolumes, err := json.Marshal(job.FailedVolumes)
+	if err != nil {
+		return err
+	}
+	sizeReport, err := json.Marshal(job.SizeReport)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(s.rebind(`UPDATE jobs
+		SET name = ?, user_name = ?, request_id = ?, remote = ?, files = ?, options = ?, status = ?, output_path = ?, output_size = ?, output_sha256 = ?,
+			progress = ?, page_map = ?, failed_volumes = ?, size_report = ?, error = ?, error_code = ?, updated_at = ?
+		WHERE id = ?`),
+		job.Name, job.User, job.RequestID, job.Remote, string(files), string(options), job.Status, job.OutputPath, job.OutputSize, job.OutputSHA256,
+		string(progress), string(pageMap), string(failedVolumes), string(sizeReport), job.Error, job.ErrorCode, job.UpdatedAt.UnixMilli(), job.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+func (s *sqlJobStore) List() ([]*Job, error) {
+	rows, err := s.db.Query(`SELECT id, name, user_name, request_id, remote, files, options, status, output_path, output_size, output_sha256, progress, page_map, failed_volumes, size_report, error, error_code, created_at, updated_at
+		FROM jobs ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *sqlJobStore) Find(f JobFilter) ([]*Job, error) {
+	var where []string
+	var args []any
+	if !f.AllUsers {
+		where = append(where, "user_name = ?")
+		args = append(args, f.User)
+	}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	query := `SELECT id, name, user_name, request_id, remote, files, options, status, output_path, output_size, output_sha256, progress, page_map, failed_volumes, size_report, error, error_code, created_at, updated_at
+		FROM jobs`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// The ID breaks ties between jobs created the same millisecond, so
+	// pages neither repeat nor skip them
+	query += " ORDER BY created_at DESC, id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, f.Limit, f.Offset)
+	}
+
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *sqlJobStore) Delete(id string) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM jobs WHERE id = ?`), id)
+	return err
+}
+
+func (s *sqlJobStore) ClaimNext(l ClaimLimits) (*Job, error) {
+	for {
+		// Jobs of clients at their limits wait for their earlier jobs
+		var id string
+		err := s.db.QueryRow(s.rebind(`SELECT id FROM jobs j WHERE status = ?
+			AND (? = 0 OR user_name = '' OR (SELECT COUNT(*) FROM jobs p WHERE p.status = ? AND p.user_name = j.user_name) < ?)
+			AND (? = 0 OR remote = '' OR (SELECT COUNT(*) FROM jobs p WHERE p.status = ? AND p.remote = j.remote) < ?)
+			ORDER BY created_at LIMIT 1`),
+			JobQueued, l.PerUser, JobProcessing, l.PerUser, l.PerRemote, JobProcessing, l.PerRemote).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrJobNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Another worker may have claimed the job in the meantime
+		res, err := s.db.Exec(s.rebind(`UPDATE jobs SET status = ?, updated_at = ? WHERE id = ? AND status = ?`),
+			JobProcessing, time.Now().UTC().UnixMilli(), id, JobQueued)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			return s.Get(id)
+		}
+	}
+}
+
+func (s *sqlJobStore) MarkDeleting(id string) error {
+	// The status is checked and changed at once, so no worker claims the
+	// job in between
+	res, err := s.db.Exec(s.rebind(`UPDATE jobs SET status = ?, updated_at = ? WHERE id = ? AND status <> ?`),
+		JobDeleting, time.Now().UTC().UnixMilli(), id, JobProcessing)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil
+	}
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	return ErrJobProcessing
+}
+
+func (s *sqlJobStore) CountActive(user, remote string) (byUser, byRemote int, err error) {
+	err = s.db.QueryRow(s.rebind(`SELECT
+		COALESCE(SUM(CASE WHEN user_name = ? AND ? <> '' THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN remote = ? AND ? <> '' THEN 1 ELSE 0 END), 0)
+		FROM jobs WHERE status IN (?, ?)`),
+		user, user, remote, remote, JobQueued, JobProcessing).Scan(&byUser, &byRemote)
+	return byUser, byRemote, err
+}
+
+func (s *sqlJobStore) Touch(id string) error {
+	_, err := s.db.Exec(s.rebind(`UPDATE jobs SET updated_at = ? WHERE id = ? AND status = ?`),
+		time.Now().UTC().UnixMilli(), id, JobProcessing)
+	return err
+}
+
+func (s *sqlJobStore) Requeue(before time.Time) (int, error) {
+	res, err := s.db.Exec(s.rebind(`UPDATE jobs SET status = ?, updated_at = ? WHERE status = ? AND updated_at < ?`),
+		JobQueued, time.Now().UTC().UnixMilli(), JobProcessing, before.UTC().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (s *sqlJobStore) Close() error {
+	return s.db.Close()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row rowScanner) (*Job, error) {
+	var job Job
+	var files, options, progress, pageMap, failedVolumes, sizeReport string
+	var created, updated int64
+	err := row.Scan(&job.ID, &job.Name, &job.User, &job.RequestID, &job.Remote, &files, &options, &job.Status, &job.OutputPath, &job.OutputSize, &job.OutputSHA256,
+		&progress, &pageMap, &failedVolumes, &sizeReport, &job.Error, &job.ErrorCode, &created, &updated)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(files), &job.Files); err != nil {
+		return nil, fmt.Errorf("error decoding files of job %s: %v", job.ID, err)
+	}
+	if err := json.Unmarshal([]byte(options), &job.Options); err != nil {
+		return nil, fmt.Errorf("error decoding options of job %s: %v", job.ID, err)
+	}
+	if err := json.Unmarshal([]byte(progress), &job.Progress); err != nil {
+		return nil, fmt.Errorf("error decoding progress of job %s: %v", job.ID, err)
+	}
+	if err := json.Unmarshal([]byte(pageMap), &job.PageMap); err != nil {
+		return nil, fmt.Errorf("error decoding page map of job %s: %v", job.ID, err)
+	}
+	if err := json.Unmarshal([]byte(failedVolumes), &job.FailedVolumes); err != nil {
+		return nil, fmt.Errorf("error decoding failed volumes of job %s: %v", job.ID, err)
+	}
+	if err := json.Unmarshal([]byte(sizeReport), &job.SizeReport); err != nil {
+		return nil, fmt.Errorf("error decoding size report of job %s: %v", job.ID, err)
+	}
+	job.CreatedAt = time.UnixMilli(created).UTC()
+	job.UpdatedAt = time.UnixMilli(updated).UTC()
+	return &job, nil
+}
+
+func newJobID() string {
+	return randomHex(8)
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
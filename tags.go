@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// pdfcpu keeps only the catalog of the first document it merges, so the
+// structure trees of the others ride along under this name among the
+// property lists in the resources of their first page, and are joined into
+// one tree afterwards
+const stashedStructTree = "PdfmgStructTree"
+
+// isTagged reports whether the document has a structure tree
+func isTagged(ctx *model.Context) bool {
+	root, err := ctx.DereferenceDict(ctx.RootDict["StructTreeRoot"])
+	return err == nil && root != nil && root["K"] != nil
+}
+
+// hasTaggedFiles reports whether any file of a job converted to a tagged PDF
+func hasTaggedFiles(job *Job) bool {
+	for _, f := range job.Files {
+		if !f.Untagged && f.Error == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// untaggedFiles returns the names of the files of a job that converted to
+// PDFs without structure tags
+func untaggedFiles(job *Job) []string {
+	names := []string{}
+	for _, f := range job.Files {
+		if f.Untagged {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// tagFigure makes the PDF of a converted image at in a tagged PDF at out,
+// with the content of each page, one for most images and several for tall
+// ones split across pages, marked up as a figure described by alt
+func tagFigure(in, out, alt string) error {
+	ctx, err := readContext(in)
+	if err != nil {
+		return err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+
+	root := types.Dict{"Type": types.Name("StructTreeRoot"), "ParentTreeNextKey": types.Integer(ctx.PageCount)}
+	rootRef, err := ctx.IndRefForNewObject(root)
+	if err != nil {
+		return err
+	}
+	document := types.Dict{"Type": types.Name("StructElem"), "S": types.Name("Document"), "P": *rootRef}
+	documentRef, err := ctx.IndRefForNewObject(document)
+	if err != nil {
+		return err
+	}
+	alternate, err := types.EscapeUTF16String(alt)
+	if err != nil {
+		return err
+	}
+
+	var figures, nums types.Array
+	for page := 1; page <= ctx.PageCount; page++ {
+		pageDict, pageRef, _, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		if err := wrapContents(ctx.XRefTable, pageDict, []byte("/Figure <</MCID 0>> BDC\n"), []byte("\nEMC\n")); err != nil {
+			return err
+		}
+		figureRef, err := ctx.IndRefForNewObject(types.Dict{
+			"Type": types.Name("StructElem"),
+			"S":    types.Name("Figure"),
+			"P":    *documentRef,
+			"Pg":   *pageRef,
+			"K":    types.Integer(0),
+			"Alt":  types.StringLiteral(*alternate),
+		})
+		if err != nil {
+			return err
+		}
+		figures = append(figures, *figureRef)
+		nums = append(nums, types.Integer(page-1), types.Array{*figureRef})
+		pageDict["StructParents"] = types.Integer(page - 1)
+	}
+	document["K"] = figures
+	root["K"] = *documentRef
+	root["ParentTree"] = types.Dict{"Nums": nums}
+
+	ctx.RootDict["StructTreeRoot"] = *rootRef
+	ctx.RootDict["MarkInfo"] = types.Dict{"Marked": types.Boolean(true)}
+	return api.WriteContextFile(ctx, out)
+}
+
+// prepareStructTrees readies the tagged files of a job for merging: their
+// structure parent keys are shifted so they don't collide in the merged
+// parent tree, and their structure tree is stashed on their first page.
+// Changed files are written to the scratch directory and replace their
+// original in the returned paths.
+func (fh *FileHandler) prepareStructTrees(jobID string, paths []string) ([]string, error) {
+	result := make([]string, len(paths))
+	offset := 0
+	for i, path := range paths {
+		result[i] = path
+
+		ctx, err := readContext(path)
+		if err != nil {
+			return nil, err
+		}
+		if !isTagged(ctx) {
+			continue
+		}
+		if offset, err = stashStructTree(ctx, offset); err != nil {
+			return nil, err
+		}
+
+		out := filepath.Join(fh.scratchDir, fmt.Sprintf("%s_%d_tags.pdf", jobID, i))
+		if err := api.WriteContextFile(ctx, out); err != nil {
+			return nil, err
+		}
+		result[i] = out
+	}
+	return result, nil
+}
+
+// stashStructTree moves the structure tree of a tagged document to its first
+// page, with the structure parent keys starting at offset, and returns the
+// key following the last one used
+func stashStructTree(ctx *model.Context, offset int) (int, error) {
+	rootRef, ok := ctx.RootDict["StructTreeRoot"].(types.IndirectRef)
+	if !ok {
+		// Trees stored in the catalog itself are made an object of their own
+		root, err := ctx.DereferenceDict(ctx.RootDict["StructTreeRoot"])
+		if err != nil {
+			return offset, err
+		}
+		ref, err := ctx.IndRefForNewObject(root)
+		if err != nil {
+			return offset, err
+		}
+		rootRef = *ref
+	}
+	root, err := ctx.DereferenceDict(rootRef)
+	if err != nil {
+		return offset, err
+	}
+
+	nums, err := parentTreeNums(ctx, root["ParentTree"], map[int]bool{})
+	if err != nil {
+		return offset, err
+	}
+	next := 0
+	if n := root.IntEntry("ParentTreeNextKey"); n != nil {
+		next = *n
+	}
+	shifted := make(types.Array, 0, len(nums))
+	for i := 0; i+1 < len(nums); i += 2 {
+		key, ok := nums[i].(types.Integer)
+		if !ok {
+			continue
+		}
+		next = max(next, key.Value()+1)
+		shifted = append(shifted, types.Integer(key.Value()+offset), nums[i+1])
+	}
+	root["ParentTree"] = types.Dict{"Nums": shifted}
+	root.Delete("ParentTreeNextKey")
+
+	if offset > 0 {
+		for _, entry := range ctx.Table {
+			if entry == nil || entry.Free {
+				continue
+			}
+			switch o := entry.Object.(type) {
+			case types.Dict:
+				shiftStructParents(o, offset)
+			case types.StreamDict:
+				shiftStructParents(o.Dict, offset)
+			}
+		}
+	}
+
+	// The language of the document would go with its catalog
+	if lang, ok := ctx.RootDict["Lang"]; ok {
+		for _, kid := range structKids(ctx, root) {
+			if elem, err := ctx.DereferenceDict(kid); err == nil && elem != nil {
+				if _, ok := elem["Lang"]; !ok {
+					elem["Lang"] = lang
+				}
+			}
+		}
+	}
+
+	// Inherited resources are copied to the page
+	pageDict, _, _, err := ctx.PageDict(1, true)
+	if err != nil {
+		return offset, err
+	}
+	// The resources may be shared with other pages, so the page gets copies
+	resources, err := ctx.DereferenceDict(pageDict["Resources"])
+	if err != nil {
+		return offset, err
+	}
+	properties, err := ctx.DereferenceDict(resources["Properties"])
+	if err != nil {
+		return offset, err
+	}
+	resources, properties = resources.Clone().(types.Dict), properties.Clone().(types.Dict)
+	properties[stashedStructTree] = rootRef
+	resources["Properties"] = properties
+	pageDict["Resources"] = resources
+	ctx.RootDict.Delete("StructTreeRoot")
+	return offset + next, nil
+}
+
+// shiftStructParents adds offset to the parent tree key of a page,
+// annotation or XObject
+func shiftStructParents(d types.Dict, offset int) {
+	for _, key := range []string{"StructParents", "StructParent"} {
+		if n, ok := d[key].(types.Integer); ok {
+			d[key] = types.Integer(n.Value() + offset)
+		}
+	}
+}
+
+// parentTreeNums returns the key and value pairs of a parent tree, a number
+// tree that may be split into kids
+func parentTreeNums(ctx *model.Context, node types.Object, seen map[int]bool) (types.Array, error) {
+	if ref, ok := node.(types.IndirectRef); ok {
+		if seen[ref.ObjectNumber.Value()] {
+			return nil, nil
+		}
+		seen[ref.ObjectNumber.Value()] = true
+	}
+	d, err := ctx.DereferenceDict(node)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	nums, err := ctx.DereferenceArray(d["Nums"])
+	if err != nil {
+		return nil, err
+	}
+	nums = append(types.Array{}, nums...)
+	kids, err := ctx.DereferenceArray(d["Kids"])
+	if err != nil {
+		return nil, err
+	}
+	for _, kid := range kids {
+		more, err := parentTreeNums(ctx, kid, seen)
+		if err != nil {
+			return nil, err
+		}
+		nums = append(nums, more...)
+	}
+	return nums, nil
+}
+
+// structKids returns the children of a structure tree root or element
+func structKids(ctx *model.Context, d types.Dict) types.Array {
+	k, err := ctx.Dereference(d["K"])
+	if err != nil || k == nil {
+		return nil
+	}
+	if a, ok := k.(types.Array); ok {
+		return a
+	}
+	return types.Array{d["K"]}
+}
+
+type parentTreeEntry struct {
+	key   int
+	value types.Object
+}
+
+// joinStructTrees combines the structure trees stashed on the pages of a
+// merged PDF into one, in page order, making the PDF tagged
+func joinStructTrees(path string) error {
+	ctx, err := readContext(path)
+	if err != nil {
+		return err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+
+	var stashed []types.Dict
+	for page := 1; page <= ctx.PageCount; page++ {
+		pageDict, _, _, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		resources, err := ctx.DereferenceDict(pageDict["Resources"])
+		if err != nil || resources == nil {
+			continue
+		}
+		properties, err := ctx.DereferenceDict(resources["Properties"])
+		if err != nil || properties == nil {
+			continue
+		}
+		obj, ok := properties[stashedStructTree]
+		if !ok {
+			continue
+		}
+		properties.Delete(stashedStructTree)
+		if len(properties) == 0 {
+			resources.Delete("Properties")
+		}
+		if root, err := ctx.DereferenceDict(obj); err == nil && root != nil {
+			stashed = append(stashed, root)
+		}
+	}
+	if len(stashed) == 0 {
+		return nil
+	}
+
+	root := types.Dict{"Type": types.Name("StructTreeRoot")}
+	rootRef, err := ctx.IndRefForNewObject(root)
+	if err != nil {
+		return err
+	}
+	var kids types.Array
+	var pairs []parentTreeEntry
+	roleMap, classMap := types.Dict{}, types.Dict{}
+	for _, tree := range stashed {
+		for _, kid := range structKids(ctx, tree) {
+			if elem, err := ctx.DereferenceDict(kid); err == nil && elem != nil {
+				elem["P"] = *rootRef
+			}
+			kids = append(kids, kid)
+		}
+		treeNums, err := parentTreeNums(ctx, tree["ParentTree"], map[int]bool{})
+		if err != nil {
+			return err
+		}
+		for i := 0; i+1 < len(treeNums); i += 2 {
+			if key, ok := treeNums[i].(types.Integer); ok {
+				pairs = append(pairs, parentTreeEntry{key.Value(), treeNums[i+1]})
+			}
+		}
+		for _, m := range []struct {
+			key string
+			dst types.Dict
+		}{{"RoleMap", roleMap}, {"ClassMap", classMap}} {
+			if d, err := ctx.DereferenceDict(tree[m.key]); err == nil {
+				for name, v := range d {
+					if _, ok := m.dst[name]; !ok {
+						m.dst[name] = v
+					}
+				}
+			}
+		}
+	}
+
+	// Number tree keys must be in ascending order, which interleaved pages
+	// mix up
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+	nums := make(types.Array, 0, 2*len(pairs))
+	next := 0
+	for _, p := range pairs {
+		nums = append(nums, types.Integer(p.key), p.value)
+		next = p.key + 1
+	}
+	root["K"] = kids
+	root["ParentTree"] = types.Dict{"Nums": nums}
+	root["ParentTreeNextKey"] = types.Integer(next)
+	if len(roleMap) > 0 {
+		root["RoleMap"] = roleMap
+	}
+	if len(classMap) > 0 {
+		root["ClassMap"] = classMap
+	}
+
+	ctx.RootDict["StructTreeRoot"] = *rootRef
+	ctx.RootDict["MarkInfo"] = types.Dict{"Marked": types.Boolean(true)}
+	return transformPDF(path, func(in, out string) error {
+		return api.WriteContextFile(ctx, out)
+	})
+}
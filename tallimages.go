@@ -0,0 +1,37 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Most overlap between the slices of a tall image, in mm
+const maxSplitOverlap = 100
+
+// tallImage reports whether an image of width by height would be split
+// across pages of pageWidth by pageHeight: it is at least twice as tall
+// for its width as they are, so fitting it on one would shrink it to
+// less than half their width
+func tallImage(width, height, pageWidth, pageHeight float64) bool {
+	return height*pageWidth >= 2*width*pageHeight
+}
+
+// sliceImage cuts img from the top into slices of at most height pixels,
+// each repeating the last overlap pixels of the one before it, so a line
+// of text cut through on one page is whole on the next
+func sliceImage(img image.Image, height, overlap float64) []image.Image {
+	bounds := img.Bounds()
+	step := max(int(math.Floor(height-overlap)), 1)
+	h := max(int(math.Floor(height)), 1)
+
+	var slices []image.Image
+	for y := bounds.Min.Y; ; y += step {
+		bottom := min(y+h, bounds.Max.Y)
+		slices = append(slices, imaging.Crop(img, image.Rect(bounds.Min.X, y, bounds.Max.X, bottom)))
+		if bottom == bounds.Max.Y {
+			return slices
+		}
+	}
+}
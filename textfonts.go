@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/pdfcpu/pdfcpu/pkg/font"
+)
+
+// textFont is a TrueType font from FONT_DIR that generated text is set in
+// when Helvetica lacks its characters
+type textFont struct {
+	// name is the PostScript name pdfcpu knows the font by
+	name  string
+	data  []byte
+	chars map[uint32]uint16
+}
+
+// textFonts are the fonts of FONT_DIR, in the order of their file names
+var textFonts []*textFont
+
+// loadTextFonts installs the TrueType fonts in dir for the text of cover
+// pages, volume indexes and stamps: .ttf files and .otf files with
+// TrueType outlines, as both pdfcpu and gofpdf embed those
+func loadTextFonts(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// pdfcpu points its font dir at the user config dir when first
+	// configured, so that happens before fonts are installed there
+	pdfConfig()
+	var fonts []*textFont
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || (ext != ".ttf" && ext != ".otf") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(data, []byte("OTTO")) {
+			return fmt.Errorf("%s has PostScript outlines, only TrueType outlines are supported", e.Name())
+		}
+		name, err := installTextFont(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", e.Name(), err)
+		}
+		fonts = append(fonts, &textFont{name: name, data: data})
+	}
+	if err := font.LoadUserFonts(); err != nil {
+		return err
+	}
+	for _, f := range fonts {
+		f.chars = font.UserFontMetrics[f.name].Chars
+	}
+	textFonts = fonts
+	return nil
+}
+
+// installTextFont installs the font at path for pdfcpu, returning the name
+// it is installed under, which is its PostScript name as pdfcpu reads it
+func installTextFont(path string) (string, error) {
+	dir, err := os.MkdirTemp(font.UserFontDir, "install")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	if err := font.InstallTrueTypeFont(dir, path); err != nil {
+		return "", err
+	}
+	gobs, err := filepath.Glob(filepath.Join(dir, "*.gob"))
+	if err != nil || len(gobs) != 1 {
+		return "", fmt.Errorf("error installing font")
+	}
+	name := filepath.Base(gobs[0])
+	if err := os.Rename(gobs[0], filepath.Join(font.UserFontDir, name)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(name, ".gob"), nil
+}
+
+// textFontFor returns the font to set s in: nil, for Helvetica, when s is
+// Latin-1 text or no font is configured, otherwise the first font with all
+// of its characters, or the one with most of them
+func textFontFor(s string) *textFont {
+	latin := true
+	for _, r := range s {
+		if r > 0xff {
+			latin = false
+			break
+		}
+	}
+	if latin || len(textFonts) == 0 {
+		return nil
+	}
+
+	var best *textFont
+	bestCount := -1
+	for _, f := range textFonts {
+		count := 0
+		for _, r := range s {
+			if _, ok := f.chars[uint32(r)]; ok {
+				count++
+			}
+		}
+		if count == len([]rune(s)) {
+			return f
+		}
+		if count > bestCount {
+			best, bestCount = f, count
+		}
+	}
+	return best
+}
+
+// fpdfText sets the fonts of text written with gofpdf, embedding those of
+// FONT_DIR where Helvetica lacks its characters
+type fpdfText struct {
+	pdf   *gofpdf.Fpdf
+	tr    func(string) string
+	added map[string]bool
+}
+
+func newFpdfText(pdf *gofpdf.Fpdf) *fpdfText {
+	return &fpdfText{pdf: pdf, tr: pdf.UnicodeTranslatorFromDescriptor(""), added: map[string]bool{}}
+}
+
+// font sets the font s is to be written in, returning s as pdf takes it.
+// The fonts of FONT_DIR have a single face, so style only applies to
+// Helvetica.
+func (t *fpdfText) font(style string, size float64, s string) string {
+	f := textFontFor(s)
+	if f == nil {
+		t.pdf.SetFont("Helvetica", style, size)
+		return t.tr(s)
+	}
+	if !t.added[f.name] {
+		t.pdf.AddUTF8FontFromBytes(f.name, "", f.data)
+		t.added[f.name] = true
+	}
+	t.pdf.SetFont(f.name, "", size)
+	return s
+}
+
+// multiCell writes s as pdf.MultiCell does in a column w wide, or across
+// the page when w is 0, in the font font sets. Arabic letters are joined,
+// and right-to-left text is wrapped into lines laid out right to left,
+// aligned right rather than left.
+func (t *fpdfText) multiCell(w float64, style string, size, h float64, s, align string) {
+	s = shapeArabic(s)
+	rtl := rtlParagraph(s)
+	s = t.font(style, size, s)
+	if !rtl {
+		t.pdf.MultiCell(w, h, s, "", align, false)
+		return
+	}
+	if align == "L" {
+		align = "R"
+	}
+	x := t.pdf.GetX()
+	if w == 0 {
+		pageWidth, _ := t.pdf.GetPageSize()
+		_, _, right, _ := t.pdf.GetMargins()
+		w = pageWidth - right - x
+	}
+	for _, line := range t.pdf.SplitText(s, w) {
+		t.pdf.SetX(x)
+		t.pdf.MultiCell(w, h, visualOrder(line, true), "", align, false)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Files merged per batch by default when a job has more
+const defaultMergeBatch = 50
+
+// mergeTree merges the PDFs at paths into out as api.MergeCreateFile does,
+// but in batches of batch files merged threads at a time, whose results are
+// then merged in order. Reading and validating the files takes most of the
+// time of a merge, and is spread over the threads this way; the batches
+// are kept in memory, so the merged document is written only once.
+func mergeTree(paths []string, out string, batch, threads int) error {
+	batches := make([]*model.Context, (len(paths)+batch-1)/batch)
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, threads)
+	var wg sync.WaitGroup
+	for i := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			batches[i], errs[i] = mergeBatch(paths[i*batch:min((i+1)*batch, len(paths))], i > 0)
+		}(i)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	// Each batch already has a bookmark per file, which are appended to
+	// the first batch's instead of being nested under another bookmark for
+	// the batch
+	dest := batches[0]
+	dest.Configuration.CreateBookmarks = false
+	for _, ctx := range batches[1:] {
+		if err := pdfcpu.MergeXRefTables("", ctx, dest, false, false); err != nil {
+			return err
+		}
+		if err := appendOutlines(ctx, dest); err != nil {
+			return err
+		}
+	}
+
+	if err := api.OptimizeContext(dest); err != nil {
+		return err
+	}
+	if err := api.WriteContextFile(dest, out); err != nil {
+		os.Remove(out)
+		return err
+	}
+	return nil
+}
+
+// mergeBatch merges the PDFs at paths in memory as api.Merge does, with a
+// bookmark for each file. Batches after the first open the bookmarks of
+// their first file, which pdfcpu closes for the first file of a merge only.
+func mergeBatch(paths []string, later bool) (*model.Context, error) {
+	dest, err := readMergeContext(paths[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := pdfcpu.EnsureOutlines(dest, filepath.Base(paths[0]), false); err != nil {
+		return nil, err
+	}
+	if later {
+		if err := openFirstOutline(dest); err != nil {
+			return nil, err
+		}
+	}
+	dest.EnsureVersionForWriting()
+
+	// The form of the first file with one becomes that of the batch, and
+	// pdfcpu adds a group for those of every later file after its fields
+	own, err := topLevelFields(dest)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths[1:] {
+		ctx, err := readMergeContext(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := pdfcpu.MergeXRefTables(filepath.Base(path), ctx, dest, false, false); err != nil {
+			return nil, err
+		}
+		if len(own) == 0 {
+			if own, err = topLevelFields(dest); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The groups are undone, as the batches get a group each when they are
+	// merged
+	if _, err := ungroupFields(dest, len(own)); err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
+
+// readMergeContext reads and validates the PDF at path for merging, which
+// tolerates named destinations that are missing until the files are merged
+func readMergeContext(path string) (*model.Context, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	conf := pdfConfig()
+	conf.Cmd = model.MERGECREATE
+	ctx, err := api.ReadContext(f, conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := api.ValidateContext(ctx); err != nil {
+		return nil, err
+	}
+	if ctx.Version() == model.V20 {
+		return nil, pdfcpu.ErrUnsupportedVersion
+	}
+	return ctx, nil
+}
+
+// openFirstOutline opens the first top-level bookmark of ctx, showing the
+// bookmarks below it
+func openFirstOutline(ctx *model.Context) error {
+	outlines, err := ctx.DereferenceDict(ctx.RootDict["Outlines"])
+	if err != nil || outlines == nil {
+		return err
+	}
+	item, err := ctx.DereferenceDict(outlines["First"])
+	if err != nil || item == nil {
+		return err
+	}
+	n := item.IntEntry("Count")
+	if n == nil || *n >= 0 {
+		return nil
+	}
+	item["Count"] = types.Integer(-*n)
+	count := -*n
+	if total := outlines.IntEntry("Count"); total != nil {
+		count += *total
+	}
+	outlines["Count"] = types.Integer(count)
+	return nil
+}
+
+// appendOutlines appends the top-level bookmarks of src, which was merged
+// into dest, to those of dest
+func appendOutlines(src, dest *model.Context) error {
+	srcRoot, err := src.Catalog()
+	if err != nil {
+		return err
+	}
+	srcOutlines, err := dest.DereferenceDict(srcRoot["Outlines"])
+	if err != nil || srcOutlines == nil {
+		return err
+	}
+	first, last := srcOutlines.IndirectRefEntry("First"), srcOutlines.IndirectRefEntry("Last")
+	if first == nil || last == nil {
+		return nil
+	}
+
+	destOutlinesRef := dest.RootDict.IndirectRefEntry("Outlines")
+	if destOutlinesRef == nil {
+		return errors.New("missing bookmarks of the merged document")
+	}
+	destOutlines, err := dest.DereferenceDict(*destOutlinesRef)
+	if err != nil {
+		return err
+	}
+
+	for ref := first; ref != nil; {
+		item, err := dest.DereferenceDict(*ref)
+		if err != nil || item == nil {
+			return err
+		}
+		item["Parent"] = *destOutlinesRef
+		if *ref == *last {
+			break
+		}
+		ref = item.IndirectRefEntry("Next")
+	}
+
+	if prev := destOutlines.IndirectRefEntry("Last"); prev != nil {
+		prevItem, err := dest.DereferenceDict(*prev)
+		if err != nil {
+			return err
+		}
+		firstItem, err := dest.DereferenceDict(*first)
+		if err != nil {
+			return err
+		}
+		prevItem["Next"], firstItem["Prev"] = *first, *prev
+	} else {
+		destOutlines["First"] = *first
+	}
+	destOutlines["Last"] = *last
+
+	count := 0
+	if n := destOutlines.IntEntry("Count"); n != nil {
+		count += *n
+	}
+	if n := srcOutlines.IntEntry("Count"); n != nil {
+		count += *n
+	}
+	destOutlines["Count"] = types.Integer(count)
+	return nil
+}
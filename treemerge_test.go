@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// BenchmarkTreeMerge compares merging a few hundred files in batches on
+// every CPU with merging them in one pass, as the pdfcpu backend does with
+// one thread per job or lists up to MERGE_BATCH_SIZE files long
+func BenchmarkTreeMerge(b *testing.B) {
+	dir := b.TempDir()
+	paths := make([]string, 300)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("file_%03d.pdf", i))
+		writeTestPDF(b, paths[i], testPDFLayout{})
+	}
+	out := filepath.Join(dir, "merged.pdf")
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := api.MergeCreateFile(paths, out, false, pdfConfig()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run(fmt.Sprintf("tree_%d_threads", runtime.GOMAXPROCS(0)), func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := mergeTree(paths, out, defaultMergeBatch, runtime.GOMAXPROCS(0)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies whose X-Forwarded-User and
+// X-Remote-User headers are believed, from TRUSTED_PROXIES. Without any,
+// requests have no user, as anyone reaching the server directly could send
+// the headers.
+var trustedProxies proxyList
+
+// proxyList lists the addresses of trusted proxies
+type proxyList struct {
+	nets []*net.IPNet
+	// unix trusts the clients of a Unix socket, which only processes in
+	// the server's group can connect to
+	unix bool
+}
+
+// loadTrustedProxies reads TRUSTED_PROXIES, a comma-separated list of IP
+// addresses and CIDR ranges, and "unix" for clients of a Unix socket
+func loadTrustedProxies() error {
+	trustedProxies = proxyList{}
+	for _, entry := range splitList(os.Getenv("TRUSTED_PROXIES")) {
+		if strings.EqualFold(entry, "unix") {
+			trustedProxies.unix = true
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			trustedProxies.nets = append(trustedProxies.nets, cidr)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES entry %s: expected an IP address, a CIDR range or unix", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		trustedProxies.nets = append(trustedProxies.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nil
+}
+
+// trusts tells whether a client connected over network from remote is a
+// trusted proxy
+func (l proxyList) trusts(network, remote string) bool {
+	if network == "unix" {
+		return l.unix
+	}
+	ip := net.ParseIP(clientIP(remote))
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy tells whether r was sent by a trusted proxy
+func fromTrustedProxy(r *http.Request) bool {
+	network := "tcp"
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		network = local.Network()
+	}
+	return trustedProxies.trusts(network, r.RemoteAddr)
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultSessionTTL is how long an upload session is kept after it
+	// last changed
+	defaultSessionTTL = 24 * time.Hour
+	// maxSessionFiles is the most files an upload session holds
+	maxSessionFiles = 500
+	// maxContributorName is the longest name contributors to a collection
+	// give, in characters
+	maxContributorName = 100
+	// sessionRetries is how often a change to an upload session is retried
+	// when another request changed it first
+	sessionRetries = 5
+)
+
+var (
+	ErrSessionNotFound = errors.New("upload session not found")
+	ErrSessionChanged  = errors.New("upload session changed")
+)
+
+// UploadSession is a merge being put together on the server: files added
+// a few at a time and kept under a token, so the web interface can pick
+// them up again after a reload, reorder them and add more before merging
+// them with the session field of /upload
+type UploadSession struct {
+	Token string        `json:"token"`
+	User  string        `json:"user,omitempty"`
+	Files []SessionFile `json:"files"`
+	// CollectToken lets others add files to the session without seeing
+	// it, while the session collects files
+	CollectToken string    `json:"collectToken,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+	// version counts the changes to the session, so concurrent ones are
+	// not lost
+	version int
+}
+
+// SessionFile is a file of an upload session
+type SessionFile struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size"`
+	// Contributor is the name given by whoever sent the file to a
+	// collection
+	Contributor string `json:"contributor,omitempty"`
+}
+
+// sessionFilePath returns where the file f of the upload session with the
+// given token is kept
+func (fh *FileHandler) sessionFilePath(token string, f SessionFile) string {
+	return filepath.Join(fh.uploadsDir, fmt.Sprintf("session_%s_%s_%s", token, f.ID, filepath.Base(f.Name)))
+}
+
+// size returns the total size of the files of s, 0 for no session
+func (s *UploadSession) size() int64 {
+	if s == nil {
+		return 0
+	}
+	var n int64
+	for _, f := range s.Files {
+		n += f.Size
+	}
+	return n
+}
+
+// UploadSessionStore keeps upload sessions
+type UploadSessionStore interface {
+	CreateSession(s *UploadSession) error
+	// GetSession returns ErrSessionNotFound for unknown tokens
+	GetSession(token string) (*UploadSession, error)
+	// CollectingSession returns the session collecting files under the
+	// given collect token, or ErrSessionNotFound
+	CollectingSession(collectToken string) (*UploadSession, error)
+	// UpdateSession stores the files and collect token of s, or returns ErrSessionChanged
+	// when the session was changed since s was read
+	UpdateSession(s *UploadSession) error
+	DeleteSession(token string) error
+	ListSessions() ([]*UploadSession, error)
+}
+
+func (s *sqlJobStore) CreateSession(us *UploadSession) error {
+	if us.Token == "" {
+		us.Token = randomHex(16)
+	}
+	now := time.Now().UTC()
+	us.CreatedAt = now
+	us.UpdatedAt = now
+	files, err := json.Marshal(us.Files)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.rebind(`INSERT INTO upload_sessions (token, user_name, files, collect_token, version, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		us.Token, us.User, string(files), us.CollectToken, us.version, us.CreatedAt.UnixMilli(), us.UpdatedAt.UnixMilli())
+	return err
+}
+
+func (s *sqlJobStore) GetSession(token string) (*UploadSession, error) {
+	row := s.db.QueryRow(s.rebind(`SELECT token, user_name, files, collect_token, version, created_at, updated_at
+		FROM upload_sessions WHERE token = ?`), token)
+	us, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	return us, err
+}
+
+func (s *sqlJobStore) CollectingSession(collectToken string) (*UploadSession, error) {
+	if collectToken == "" {
+		return nil, ErrSessionNotFound
+	}
+	row := s.db.QueryRow(s.rebind(`SELECT token, user_name, files, collect_token, version, created_at, updated_at
+		FROM upload_sessions WHERE collect_token = ?`), collectToken)
+	us, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	return us, err
+}
+
+func (s *sqlJobStore) UpdateSession(us *UploadSession) error {
+	files, err := json.Marshal(us.Files)
+	if err != nil {
+		return err
+	}
+	updated := time.Now().UTC()
+	res, err := s.db.Exec(s.rebind(`UPDATE upload_sessions SET files = ?, collect_token = ?, version = ?, updated_at = ? WHERE token = ? AND version = ?`),
+		string(files), us.CollectToken, us.version+1, updated.UnixMilli(), us.Token, us.version)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionChanged
+	}
+	us.version++
+	us.UpdatedAt = updated
+	return nil
+}
+
+func (s *sqlJobStore) DeleteSession(token string) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM upload_sessions WHERE token = ?`), token)
+	return err
+}
+
+func (s *sqlJobStore) ListSessions() ([]*UploadSession, error) {
+	rows, err := s.db.Query(`SELECT token, user_name, files, collect_token, version, created_at, updated_at FROM upload_sessions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*UploadSession
+	for rows.Next() {
+		us, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, us)
+	}
+	return sessions, rows.Err()
+}
+
+func scanSession(row rowScanner) (*UploadSession, error) {
+	var us UploadSession
+	var files string
+	var created, updated int64
+	if err := row.Scan(&us.Token, &us.User, &files, &us.CollectToken, &us.version, &created, &updated); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(files), &us.Files); err != nil {
+		return nil, fmt.Errorf("error decoding files of upload session: %v", err)
+	}
+	us.CreatedAt = time.UnixMilli(created).UTC()
+	us.UpdatedAt = time.UnixMilli(updated).UTC()
+	return &us, nil
+}
+
+// sessionStatus is an upload session as the API returns it
+type sessionStatus struct {
+	*UploadSession
+	Size      int64     `json:"size"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// CollectURL is the page others send files to a collecting session on
+	CollectURL string `json:"collectUrl,omitempty"`
+}
+
+// handleUploadSessions serves the upload sessions API: POST
+// /api/v1/sessions creates a session, and under /api/v1/sessions/{token}
+// GET returns it, DELETE removes it, POST .../files adds the files of a
+// form, DELETE .../files/{id} removes one, PUT .../order reorders them and
+// POST or DELETE .../collect starts or stops collecting files from others
+func (fh *FileHandler) handleUploadSessions(w http.ResponseWriter, r *http.Request) {
+	if fh.uploadSessions == nil {
+		writeError(w, "Upload sessions not available", CodeNotFound, http.StatusNotFound)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/sessions"), "/")
+	if path == "" {
+		if r.Method != http.MethodPost {
+			writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+			return
+		}
+		fh.createUploadSession(w, r)
+		return
+	}
+
+	token, rest, _ := strings.Cut(path, "/")
+	var handle func(session *UploadSession)
+	switch id, isFile := strings.CutPrefix(rest, "files/"); {
+	case rest == "":
+		switch r.Method {
+		case http.MethodGet:
+			handle = func(session *UploadSession) { fh.writeSession(w, http.StatusOK, session) }
+		case http.MethodDelete:
+			handle = func(session *UploadSession) {
+				if err := fh.removeUploadSession(session); err != nil {
+					log.Print(err)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+	case rest == "files":
+		if r.Method == http.MethodPost {
+			handle = func(session *UploadSession) { fh.addSessionFiles(w, r, session, "") }
+		}
+	case isFile && id != "" && !strings.Contains(id, "/"):
+		if r.Method == http.MethodDelete {
+			handle = func(session *UploadSession) { fh.removeSessionFile(w, session, id) }
+		}
+	case rest == "collect":
+		switch r.Method {
+		case http.MethodPost:
+			handle = func(session *UploadSession) { fh.setCollecting(w, session, true) }
+		case http.MethodDelete:
+			handle = func(session *UploadSession) { fh.setCollecting(w, session, false) }
+		}
+	case rest == "order":
+		if r.Method == http.MethodPut {
+			handle = func(session *UploadSession) { fh.orderSessionFiles(w, r, session) }
+		}
+	default:
+		writeError(w, "Not found", CodeNotFound, http.StatusNotFound)
+		return
+	}
+	if handle == nil {
+		writeError(w, "Method not allowed", CodeMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := fh.uploadSession(token, requestUser(r))
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	handle(session)
+}
+
+// createUploadSession starts an empty upload session, and removes those
+// that expired
+func (fh *FileHandler) createUploadSession(w http.ResponseWriter, r *http.Request) {
+	fh.expireUploadSessions()
+	session := &UploadSession{User: requestUser(r), Files: []SessionFile{}}
+	if err := fh.uploadSessions.CreateSession(session); err != nil {
+		writeError(w, "Error creating upload session: "+err.Error(), CodeInternal, http.StatusInternalServerError)
+		return
+	}
+	fh.writeSession(w, http.StatusCreated, session)
+}
+
+// uploadSession returns the upload session of token, unless it expired or
+// belongs to another user
+func (fh *FileHandler) uploadSession(token, user string) (*UploadSession, error) {
+	session, err := fh.uploadSessions.GetSession(token)
+	if err != nil {
+		return nil, err
+	}
+	if session.User != user || time.Since(session.UpdatedAt) > fh.sessionTTL {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// changeSession applies change to the upload session and stores it, reading
+// it again and retrying when another request changed it in the meantime
+func (fh *FileHandler) changeSession(session *UploadSession, change func(s *UploadSession) error) error {
+	for i := 0; ; i++ {
+		if err := change(session); err != nil {
+			return err
+		}
+		err := fh.uploadSessions.UpdateSession(session)
+		if !errors.Is(err, ErrSessionChanged) || i == sessionRetries {
+			return err
+		}
+		fresh, err := fh.uploadSessions.GetSession(session.Token)
+		if err != nil {
+			return err
+		}
+		*session = *fresh
+	}
+}
+
+// addSessionFiles adds the files of the form of r, in order, to the end of
+// the upload session. Files sent to a collection under collectToken are
+// refused once the session stops collecting, and are acknowledged without
+// showing the session.
+func (fh *FileHandler) addSessionFiles(w http.ResponseWriter, r *http.Request, session *UploadSession, collectToken string) {
+	timestamp := time.Now().Format("20060102_150405")
+	sf, err := fh.spoolForm(w, r, timestamp)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, fmt.Sprintf("Upload too large: the limit is %.0f MB", float64(tooLarge.Limit)/(1<<20)), CodeTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeError(w, "Error parsing form: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	// Only the files are kept, under names of the session
+	var added []SessionFile
+	accepted := false
+	defer func() {
+		for _, f := range sf.options {
+			os.Remove(f.path)
+		}
+		if !accepted {
+			sf.remove()
+			for _, f := range added {
+				os.Remove(fh.sessionFilePath(session.Token, f))
+			}
+		}
+	}()
+
+	if len(sf.files) == 0 {
+		writeError(w, "No files uploaded", CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	checksums, err := parseChecksums(r.PostForm["checksums"], len(sf.files))
+	if err != nil {
+		writeError(w, err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	for i, f := range sf.files {
+		if checksums[i] != "" && checksums[i] != f.sha256 {
+			writeError(w, fmt.Sprintf("Checksum mismatch for %s: received SHA-256 %s, expected %s",
+				f.name, f.sha256, checksums[i]), CodeChecksumMismatch, http.StatusBadRequest)
+			return
+		}
+	}
+	contributor := strings.TrimSpace(r.FormValue("contributor"))
+	if utf8.RuneCountInString(contributor) > maxContributorName {
+		writeError(w, fmt.Sprintf("contributor is longer than %d characters", maxContributorName), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	for _, f := range sf.files {
+		file := SessionFile{ID: randomHex(8), Name: f.name, SHA256: f.sha256, Size: f.size, Contributor: contributor}
+		if err := os.Rename(f.path, fh.sessionFilePath(session.Token, file)); err != nil {
+			writeError(w, "Error storing "+f.name+": "+err.Error(), CodeInternal, http.StatusInternalServerError)
+			return
+		}
+		added = append(added, file)
+	}
+
+	err = fh.changeSession(session, func(s *UploadSession) error {
+		if collectToken != "" && s.CollectToken != collectToken {
+			return ErrSessionNotFound
+		}
+		if len(s.Files)+len(added) > maxSessionFiles {
+			return withCode(CodeInvalidRequest, fmt.Errorf("Too many files in upload session: the limit is %d", maxSessionFiles))
+		}
+		if limit := fh.uploads.maxSize; limit > 0 && s.size()+sf.size() > limit {
+			return withCode(CodeTooLarge, fmt.Errorf("Upload session too large: the limit is %.0f MB", float64(limit)/(1<<20)))
+		}
+		s.Files = append(s.Files, added...)
+		return nil
+	})
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	accepted = true
+	if collectToken != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"received": len(added)})
+		return
+	}
+	fh.writeSession(w, http.StatusOK, session)
+}
+
+// removeSessionFile removes the file with the given ID from the upload
+// session
+func (fh *FileHandler) removeSessionFile(w http.ResponseWriter, session *UploadSession, id string) {
+	var removed SessionFile
+	err := fh.changeSession(session, func(s *UploadSession) error {
+		for i, f := range s.Files {
+			if f.ID == id {
+				removed = f
+				s.Files = append(s.Files[:i:i], s.Files[i+1:]...)
+				return nil
+			}
+		}
+		return withCode(CodeNotFound, errors.New("File not found in upload session"))
+	})
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	os.Remove(fh.sessionFilePath(session.Token, removed))
+	fh.writeSession(w, http.StatusOK, session)
+}
+
+// setCollecting opens the upload session to files from others, who send
+// them to its collect URL, or closes it again. Opening a session that is
+// collecting keeps its URL.
+func (fh *FileHandler) setCollecting(w http.ResponseWriter, session *UploadSession, open bool) {
+	err := fh.changeSession(session, func(s *UploadSession) error {
+		switch {
+		case !open:
+			s.CollectToken = ""
+		case s.CollectToken == "":
+			s.CollectToken = randomHex(16)
+		}
+		return nil
+	})
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	fh.writeSession(w, http.StatusOK, session)
+}
+
+// orderSessionFiles puts the files of the upload session in the order of
+// the JSON array of their IDs in the body of r, which names each of them
+func (fh *FileHandler) orderSessionFiles(w http.ResponseWriter, r *http.Request, session *UploadSession) {
+	var ids []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormValues)).Decode(&ids); err != nil {
+		writeError(w, "Invalid order: "+err.Error(), CodeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	err := fh.changeSession(session, func(s *UploadSession) error {
+		byID := map[string]SessionFile{}
+		for _, f := range s.Files {
+			byID[f.ID] = f
+		}
+		if len(ids) != len(s.Files) {
+			return withCode(CodeInvalidRequest, fmt.Errorf("Invalid order: got %d files, the session has %d", len(ids), len(s.Files)))
+		}
+		files := make([]SessionFile, 0, len(ids))
+		for _, id := range ids {
+			f, ok := byID[id]
+			if !ok {
+				return withCode(CodeInvalidRequest, fmt.Errorf("Invalid order: no file %s in the session, or named twice", id))
+			}
+			delete(byID, id)
+			files = append(files, f)
+		}
+		s.Files = files
+		return nil
+	})
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	fh.writeSession(w, http.StatusOK, session)
+}
+
+// removeUploadSession deletes the upload session and its files
+func (fh *FileHandler) removeUploadSession(session *UploadSession) error {
+	if err := fh.uploadSessions.DeleteSession(session.Token); err != nil {
+		return fmt.Errorf("error deleting upload session: %v", err)
+	}
+	var errs []error
+	for _, f := range session.Files {
+		if err := os.Remove(fh.sessionFilePath(session.Token, f)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expireUploadSessions removes the upload sessions that have not changed
+// for longer than they are kept
+func (fh *FileHandler) expireUploadSessions() {
+	sessions, err := fh.uploadSessions.ListSessions()
+	if err != nil {
+		log.Printf("Error listing upload sessions: %v", err)
+		return
+	}
+	for _, session := range sessions {
+		if time.Since(session.UpdatedAt) > fh.sessionTTL {
+			if err := fh.removeUploadSession(session); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// copySessionFiles copies the files of the upload session for a job merging
+// them, which removes its files once done, named as uploads at timestamp
+// from index first on
+func (fh *FileHandler) copySessionFiles(session *UploadSession, timestamp string, first int) ([]JobFile, error) {
+	var files []JobFile
+	for i, f := range session.Files {
+		path := fh.uploadPath(timestamp, first+i, f.Name)
+		if err := copyFile(fh.sessionFilePath(session.Token, f), path); err != nil {
+			os.Remove(path)
+			for _, jf := range files {
+				os.Remove(jf.Path)
+			}
+			return nil, fmt.Errorf("error copying %s: %v", f.Name, err)
+		}
+		files = append(files, JobFile{Name: f.Name, Path: path, SHA256: f.SHA256})
+	}
+	return files, nil
+}
+
+func (fh *FileHandler) writeSession(w http.ResponseWriter, status int, session *UploadSession) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	resp := sessionStatus{
+		UploadSession: session,
+		Size:          session.size(),
+		ExpiresAt:     session.UpdatedAt.Add(fh.sessionTTL),
+	}
+	if session.CollectToken != "" {
+		resp.CollectURL = fh.basePath + "/collect/" + session.CollectToken
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeSessionError reports an error reading or changing an upload session
+func writeSessionError(w http.ResponseWriter, err error) {
+	switch code := errorCode(err, CodeInternal); {
+	case errors.Is(err, ErrSessionNotFound):
+		writeError(w, "Upload session not found", CodeNotFound, http.StatusNotFound)
+	case errors.Is(err, ErrSessionChanged):
+		writeError(w, "Upload session is being changed by another request; retry", CodeConflict, http.StatusConflict)
+	case code == CodeNotFound:
+		writeError(w, err.Error(), code, http.StatusNotFound)
+	case code == CodeTooLarge:
+		writeError(w, err.Error(), code, http.StatusRequestEntityTooLarge)
+	case code == CodeInternal:
+		writeError(w, "Error updating upload session: "+err.Error(), code, http.StatusInternalServerError)
+	default:
+		writeError(w, err.Error(), code, http.StatusBadRequest)
+	}
+}
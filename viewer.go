@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Page layouts viewers open the output with, by their PDF names
+var pageLayouts = map[string]types.Name{
+	"single":            "SinglePage",
+	"continuous":        "OneColumn",
+	"two-up":            "TwoPageLeft",
+	"two-up-continuous": "TwoColumnLeft",
+}
+
+// How viewers fit the page they open on to the window
+const (
+	ZoomFitPage  = "fit-page"
+	ZoomFitWidth = "fit-width"
+)
+
+// Whether viewers show the bookmarks of the output on opening it
+const (
+	BookmarksShow = "show"
+	BookmarksHide = "hide"
+)
+
+// Longest language tag taken for the output
+const maxLangLength = 35
+
+// validLang reports whether tag looks like a language tag, such as "en" or
+// "pt-BR": subtags of letters and digits joined by hyphens
+func validLang(tag string) bool {
+	if tag == "" || len(tag) > maxLangLength || tag[0] == '-' || tag[len(tag)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' && tag[i-1] != '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// hasViewerSettings reports whether a job sets the language of its output
+// or how viewers open it
+func hasViewerSettings(opts MergeOptions) bool {
+	return opts.Lang != "" || opts.PageLayout != "" || opts.Zoom != "" || opts.OpenPage > 0 || opts.BookmarksPanel != ""
+}
+
+// applyViewerSettings sets the language of the PDF at path and how viewers
+// open it, as the job says. The page opened on is the last one when the
+// PDF is shorter.
+func applyViewerSettings(job *Job, path string) error {
+	opts := job.Options
+	if !hasViewerSettings(opts) {
+		return nil
+	}
+	return transformPDF(path, func(in, out string) error {
+		ctx, err := readContext(in)
+		if err != nil {
+			return err
+		}
+		if err := ctx.EnsurePageCount(); err != nil {
+			return err
+		}
+		if opts.Lang != "" {
+			ctx.RootDict["Lang"] = types.StringLiteral(opts.Lang)
+		}
+		if opts.PageLayout != "" {
+			ctx.RootDict["PageLayout"] = pageLayouts[opts.PageLayout]
+		}
+		switch opts.BookmarksPanel {
+		case BookmarksShow:
+			ctx.RootDict["PageMode"] = types.Name("UseOutlines")
+		case BookmarksHide:
+			ctx.RootDict["PageMode"] = types.Name("UseNone")
+		}
+
+		if opts.Zoom != "" || opts.OpenPage > 0 {
+			page := min(max(opts.OpenPage, 1), ctx.PageCount)
+			_, ref, _, err := ctx.PageDict(page, false)
+			if err != nil {
+				return err
+			}
+			if ref == nil {
+				return fmt.Errorf("no page %d", page)
+			}
+			// The zoom of the viewer is kept unless one is given
+			dest := types.Array{*ref, types.Name("XYZ"), nil, nil, nil}
+			switch opts.Zoom {
+			case ZoomFitPage:
+				dest = types.Array{*ref, types.Name("Fit")}
+			case ZoomFitWidth:
+				dest = types.Array{*ref, types.Name("FitH"), nil}
+			}
+			ctx.RootDict["OpenAction"] = dest
+		}
+		return api.WriteContextFile(ctx, out)
+	})
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// volume is a part of a merged PDF split by page count
+type volume struct {
+	// first and last are pages of the merged PDF
+	first, last int
+	parts       []volumePart
+}
+
+// volumePart is the run of pages of one upload in a volume
+type volumePart struct {
+	file int
+	// first and last are pages of the upload, of pages in total
+	first, last, pages int
+}
+
+// planVolumes splits the total pages of a merged PDF into volumes of at most
+// maxPages. Uploads start a new volume when they fit in one but not in what
+// is left of the current one; longer uploads are spread over volumes.
+func planVolumes(files []JobFile, total, maxPages int) []volume {
+	var vols []volume
+	cur := volume{first: 1}
+	next := 1
+	closeVolume := func() {
+		cur.last = next - 1
+		vols = append(vols, cur)
+		cur = volume{first: next}
+	}
+	for i, f := range files {
+		// Pages cut off by the page limit are missing from the merged PDF
+		pages := min(f.Pages, total-next+1)
+		for done := 0; done < pages; {
+			room := cur.first + maxPages - next
+			rest := pages - done
+			if rest > room && rest <= maxPages && len(cur.parts) > 0 {
+				closeVolume()
+				continue
+			}
+			n := min(rest, room)
+			cur.parts = append(cur.parts, volumePart{file: i, first: done + 1, last: done + n, pages: f.Pages})
+			done += n
+			next += n
+			if next-cur.first == maxPages {
+				closeVolume()
+			}
+		}
+	}
+	if next > cur.first {
+		closeVolume()
+	}
+	return vols
+}
+
+// VolumeError is a volume of a split output that failed, which the archive
+// of volumes goes without
+type VolumeError struct {
+	Volume int    `json:"volume"`
+	Error  string `json:"error"`
+	Code   string `json:"code,omitempty"`
+}
+
+// splitVolumes splits the merged PDF at path into volumes of at most
+// MaxPagesPerFile pages, each finished like a merged PDF and led by an index
+// of the uploads in every volume, and replaces it with a ZIP archive of
+// them, whose path is returned. Volumes that fail are left out and listed
+// in the failed volumes of the job, unless all of them fail. The page map
+// of the job traces the pages of the volumes to pages, the sources of the
+// merged pages.
+func (fh *FileHandler) splitVolumes(job *Job, path string, sources []JobFile, size types.Dim, pages []pageOrigin) (string, error) {
+	total, err := api.PageCountFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error counting pages: %v", err)
+	}
+	vols := planVolumes(job.Files, total, job.Options.MaxPagesPerFile)
+
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	paths := make([]string, len(vols))
+	defer func() {
+		for _, p := range paths {
+			if p != "" {
+				os.Remove(p)
+			}
+		}
+	}()
+	var pageMap []PageRun
+	var failed []VolumeError
+	for i := range vols {
+		paths[i] = filepath.Join(fh.scratchDir, fmt.Sprintf("%s_volume_%d.pdf", job.ID, i+1))
+		lead, err := fh.finishVolume(job, path, vols, i, paths[i], sources, size, pages[vols[i].first-1:vols[i].last])
+		if err != nil {
+			log.Printf("Job %s leaves out volume %d: %v", job.ID, i+1, err)
+			failed = append(failed, VolumeError{Volume: i + 1, Error: err.Error(), Code: errorCode(err, CodeMergeFailed)})
+			os.Remove(paths[i])
+			paths[i] = ""
+			continue
+		}
+		pageMap = append(pageMap, pageRuns(job, pages[vols[i].first-1:vols[i].last], i+1, lead)...)
+	}
+	if len(failed) == len(vols) {
+		return "", fmt.Errorf("volume %d: %s", failed[0].Volume, failed[0].Error)
+	}
+
+	archive := filepath.Join(filepath.Dir(path), base+".zip")
+	if err := writeVolumes(archive, base, paths, job); err != nil {
+		return "", fmt.Errorf("error writing volumes: %v", err)
+	}
+	os.Remove(path)
+	job.PageMap = pageMap
+	job.FailedVolumes = failed
+	return archive, nil
+}
+
+// finishVolume writes the i-th of vols of the merged PDF at path, whose
+// sources are pages, to out, finished like a merged PDF and led by the index
+// of vols, and returns the pages in front of those of the uploads
+func (fh *FileHandler) finishVolume(job *Job, path string, vols []volume, i int, out string, sources []JobFile, size types.Dim, pages []pageOrigin) (int, error) {
+	v := vols[i]
+	kept := make([]int, 0, v.last-v.first+1)
+	for page := v.first; page <= v.last; page++ {
+		kept = append(kept, page)
+	}
+	if err := extractPages(path, out, kept); err != nil {
+		return 0, fmt.Errorf("error splitting: %v", err)
+	}
+
+	index := filepath.Join(fh.scratchDir, fmt.Sprintf("%s_index_%d.pdf", job.ID, i+1))
+	err := renderIndex(job, vols, i, index)
+	var indexPages int
+	if err == nil {
+		indexPages, err = api.PageCountFile(index)
+	}
+	if err == nil {
+		err = fh.prependPages(job, out, index, size)
+	}
+	os.Remove(index)
+	if err != nil {
+		return 0, fmt.Errorf("error adding index page: %v", err)
+	}
+	if err := addVolumeBookmarks(job, v, out, indexPages); err != nil {
+		return 0, fmt.Errorf("error adding bookmarks: %v", err)
+	}
+
+	// Volumes carry the originals of the uploads they hold
+	var own []JobFile
+	if len(sources) > 0 {
+		for j, p := range v.parts {
+			if j == 0 || v.parts[j-1].file != p.file {
+				own = append(own, sources[p.file])
+			}
+		}
+	}
+	// The cover of the first volume goes in front of its index
+	coverPages, err := fh.finishPDF(job, out, i == 0, own, size, pages)
+	if err != nil {
+		return 0, err
+	}
+	return indexPages + coverPages, nil
+}
+
+// extractPages writes the given pages of the PDF at path, in ascending
+// order, to out. Unlike api.TrimFile, which drops the structure tree and
+// keeps every form field, the form fields, structure elements and links of
+// the document are pruned to those of the pages kept, which would pull in
+// the others otherwise. Bookmarks, named destinations and page labels are
+// left out, as they are about the whole document.
+func extractPages(path, out string, pages []int) error {
+	ctx, err := readContext(path)
+	if err != nil {
+		return err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+
+	selected := map[int]bool{}
+	for _, page := range pages {
+		selected[page] = true
+	}
+	tree := types.Dict{"Type": types.Name("Pages"), "Count": types.Integer(len(pages))}
+	treeRef, err := ctx.IndRefForNewObject(tree)
+	if err != nil {
+		return err
+	}
+	// Widgets on the pages left out are removed from the form as redacted
+	// ones are
+	removed := map[int]bool{}
+	for page := 1; page <= ctx.PageCount; page++ {
+		if selected[page] {
+			continue
+		}
+		pageDict, _, _, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		annots, err := ctx.DereferenceArray(pageDict["Annots"])
+		if err != nil {
+			return err
+		}
+		for _, obj := range annots {
+			if ref, ok := obj.(types.IndirectRef); ok {
+				removed[ref.ObjectNumber.Value()] = true
+			}
+		}
+	}
+
+	var kids types.Array
+	kept := map[int]bool{}
+	for _, page := range pages {
+		pageDict, pageRef, _, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		if err := inheritPageAttrs(ctx, pageDict); err != nil {
+			return err
+		}
+		pageDict["Parent"] = *treeRef
+		kids = append(kids, *pageRef)
+		kept[pageRef.ObjectNumber.Value()] = true
+	}
+	tree["Kids"] = kids
+
+	for _, ref := range kids {
+		pageDict, err := ctx.DereferenceDict(ref)
+		if err != nil {
+			return err
+		}
+		if err := pruneLinks(ctx, pageDict, kept); err != nil {
+			return err
+		}
+	}
+	if err := pruneFields(ctx.XRefTable, removed); err != nil {
+		return err
+	}
+	if acroForm, err := ctx.DereferenceDict(ctx.RootDict["AcroForm"]); err != nil {
+		return err
+	} else if acroForm != nil {
+		if len(acroForm.ArrayEntry("Fields")) == 0 {
+			ctx.RootDict.Delete("AcroForm")
+		} else {
+			acroForm.Delete("CO")
+		}
+	}
+	if err := pruneStructTree(ctx, kept); err != nil {
+		return err
+	}
+
+	ctx.RootDict["Pages"] = *treeRef
+	for _, key := range []string{"Outlines", "Dests", "OpenAction", "PageLabels", "Threads"} {
+		ctx.RootDict.Delete(key)
+	}
+	// The name trees are written from those read, not the catalog
+	delete(ctx.Names, "Dests")
+	if names, err := ctx.DereferenceDict(ctx.RootDict["Names"]); err == nil && names != nil {
+		names.Delete("Dests")
+	}
+	return api.WriteContextFile(ctx, out)
+}
+
+// inheritPageAttrs copies the attributes pageDict inherits from the page
+// tree into it, as it is moved to another one
+func inheritPageAttrs(ctx *model.Context, pageDict types.Dict) error {
+	seen := map[int]bool{}
+	for parent := pageDict.IndirectRefEntry("Parent"); parent != nil && !seen[parent.ObjectNumber.Value()]; {
+		seen[parent.ObjectNumber.Value()] = true
+		node, err := ctx.DereferenceDict(*parent)
+		if err != nil || node == nil {
+			return err
+		}
+		for _, key := range []string{"Resources", "MediaBox", "CropBox", "Rotate"} {
+			if _, ok := pageDict[key]; !ok && node[key] != nil {
+				pageDict[key] = node[key]
+			}
+		}
+		parent = node.IndirectRefEntry("Parent")
+	}
+	return nil
+}
+
+// pruneLinks removes the links of pageDict to pages not kept
+func pruneLinks(ctx *model.Context, pageDict types.Dict, kept map[int]bool) error {
+	annots, err := ctx.DereferenceArray(pageDict["Annots"])
+	if err != nil || len(annots) == 0 {
+		return err
+	}
+	var own types.Array
+	for _, obj := range annots {
+		annot, err := ctx.DereferenceDict(obj)
+		if err != nil {
+			return err
+		}
+		if annot != nil && linksElsewhere(ctx, annot, kept) {
+			continue
+		}
+		own = append(own, obj)
+	}
+	if len(own) == 0 {
+		pageDict.Delete("Annots")
+	} else {
+		pageDict["Annots"] = own
+	}
+	return nil
+}
+
+// linksElsewhere reports whether annot is a link to a page not kept
+func linksElsewhere(ctx *model.Context, annot types.Dict, kept map[int]bool) bool {
+	dest := annot["Dest"]
+	if action, err := ctx.DereferenceDict(annot["A"]); err == nil && action != nil {
+		if s := action.NameEntry("S"); s != nil && *s == "GoTo" {
+			dest = action["D"]
+		}
+	}
+	arr, err := ctx.DereferenceArray(dest)
+	if err != nil || len(arr) == 0 {
+		return false
+	}
+	ref, ok := arr[0].(types.IndirectRef)
+	return ok && !kept[ref.ObjectNumber.Value()]
+}
+
+// pruneStructTree removes the structure elements without content on kept
+// pages, and the structure tree if none are left
+func pruneStructTree(ctx *model.Context, kept map[int]bool) error {
+	root, err := ctx.DereferenceDict(ctx.RootDict["StructTreeRoot"])
+	if err != nil || root == nil {
+		return err
+	}
+
+	onPage := func(d types.Dict, pg types.Object) types.Object {
+		if d["Pg"] != nil {
+			return d["Pg"]
+		}
+		return pg
+	}
+	keptPage := func(pg types.Object) bool {
+		ref, ok := pg.(types.IndirectRef)
+		return ok && kept[ref.ObjectNumber.Value()]
+	}
+	seen := map[int]bool{}
+	var prune func(k types.Object, pg types.Object) (types.Object, error)
+	prune = func(k types.Object, pg types.Object) (types.Object, error) {
+		if ref, ok := k.(types.IndirectRef); ok {
+			if seen[ref.ObjectNumber.Value()] {
+				return nil, nil
+			}
+			seen[ref.ObjectNumber.Value()] = true
+		}
+		obj, err := ctx.Dereference(k)
+		if err != nil {
+			return nil, err
+		}
+		switch obj := obj.(type) {
+		case types.Integer:
+			// Marked content on the page of the element
+			if keptPage(pg) {
+				return k, nil
+			}
+		case types.Array:
+			var own types.Array
+			for _, kid := range obj {
+				kid, err := prune(kid, pg)
+				if err != nil {
+					return nil, err
+				}
+				if kid != nil {
+					own = append(own, kid)
+				}
+			}
+			if len(own) > 0 {
+				return own, nil
+			}
+		case types.Dict:
+			if t := obj.NameEntry("Type"); t != nil && (*t == "MCR" || *t == "OBJR") {
+				if keptPage(onPage(obj, pg)) {
+					return k, nil
+				}
+				return nil, nil
+			}
+			kids, err := prune(obj["K"], onPage(obj, pg))
+			if err != nil {
+				return nil, err
+			}
+			if kids != nil {
+				obj["K"] = kids
+				return k, nil
+			}
+		}
+		return nil, nil
+	}
+
+	kids, err := prune(root["K"], nil)
+	if err != nil {
+		return err
+	}
+	if kids == nil {
+		ctx.RootDict.Delete("StructTreeRoot")
+		ctx.RootDict.Delete("MarkInfo")
+		return nil
+	}
+	root["K"] = kids
+	// Elements are found by ID and content by its key from anywhere in the
+	// document, so the keys of the pages and annotations kept are kept only
+	root.Delete("IDTree")
+	return pruneParentTree(ctx, root, kept)
+}
+
+// pruneParentTree removes the entries of the parent tree of root for content
+// outside the kept pages
+func pruneParentTree(ctx *model.Context, root types.Dict, kept map[int]bool) error {
+	keys := map[int]bool{}
+	for obj := range kept {
+		pageDict, err := ctx.DereferenceDict(*types.NewIndirectRef(obj, 0))
+		if err != nil || pageDict == nil {
+			return err
+		}
+		if n := pageDict.IntEntry("StructParents"); n != nil {
+			keys[*n] = true
+		}
+		annots, err := ctx.DereferenceArray(pageDict["Annots"])
+		if err != nil {
+			return err
+		}
+		for _, obj := range annots {
+			annot, err := ctx.DereferenceDict(obj)
+			if err != nil {
+				return err
+			}
+			if n := annot.IntEntry("StructParent"); n != nil {
+				keys[*n] = true
+			}
+		}
+	}
+
+	tree, err := ctx.DereferenceDict(root["ParentTree"])
+	if err != nil || tree == nil {
+		return err
+	}
+	var nums types.Array
+	var collect func(node types.Dict) error
+	collect = func(node types.Dict) error {
+		arr, err := ctx.DereferenceArray(node["Nums"])
+		if err != nil {
+			return err
+		}
+		for i := 0; i+1 < len(arr); i += 2 {
+			if n, ok := arr[i].(types.Integer); ok && keys[n.Value()] {
+				nums = append(nums, arr[i], arr[i+1])
+			}
+		}
+		kids, err := ctx.DereferenceArray(node["Kids"])
+		if err != nil {
+			return err
+		}
+		for _, kid := range kids {
+			d, err := ctx.DereferenceDict(kid)
+			if err != nil {
+				return err
+			}
+			if d != nil {
+				if err := collect(d); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := collect(tree); err != nil {
+		return err
+	}
+	root["ParentTree"] = types.Dict{"Nums": nums}
+	return nil
+}
+
+// addVolumeBookmarks replaces the bookmarks of the volume PDF at path, which
+// splitting drops, with one for its index of indexPages and one for each
+// upload in it
+func addVolumeBookmarks(job *Job, v volume, path string, indexPages int) error {
+	bookmarks := []pdfcpu.Bookmark{{Title: "Index", PageFrom: 1}}
+	page := indexPages + 1
+	for _, p := range v.parts {
+		bookmarks = append(bookmarks, pdfcpu.Bookmark{Title: fileTitle(job.Files[p.file]), PageFrom: page})
+		page += p.last - p.first + 1
+	}
+	return transformPDF(path, func(in, out string) error {
+		return api.AddBookmarksFile(in, out, bookmarks, true, pdfConfig())
+	})
+}
+
+// writeVolumes writes the volume PDFs at paths to a ZIP archive at out,
+// named after base and their number. PDFs are compressed already, so they
+// are stored as they are.
+func writeVolumes(out, base string, paths []string, job *Job) error {
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	zw := zip.NewWriter(f)
+	for i, path := range paths {
+		// Failed volumes are left out, and the others keep their numbers
+		if path == "" {
+			continue
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     fmt.Sprintf("%s_%d.pdf", base, i+1),
+			Method:   zip.Store,
+			Modified: job.CreatedAt,
+		})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if err := copyInto(w, path); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, out)
+}
+
+// copyInto copies the file at path to w
+func copyInto(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// renderIndex writes the index leading the n-th of vols to out: the uploads
+// in each volume, with the pages of those spread over several
+func renderIndex(job *Job, vols []volume, n int, out string) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	text := newFpdfText(pdf)
+	pdf.SetMargins(25, 25, 25)
+	pdf.SetAutoPageBreak(true, 25)
+	pdf.AddPage()
+
+	title := job.Name
+	if title == "" {
+		title = "Job " + job.ID
+	}
+	text.multiCell(0, "B", 18, 9, title, "L")
+	pdf.SetFont("Helvetica", "", 12)
+	pdf.MultiCell(0, 6, fmt.Sprintf("Volume %d of %d", n+1, len(vols)), "", "L", false)
+
+	for i, v := range vols {
+		pdf.Ln(6)
+		heading := fmt.Sprintf("Volume %d", i+1)
+		if i == n {
+			heading += " (this volume)"
+		}
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.MultiCell(0, 6, heading, "", "L", false)
+		for _, p := range v.parts {
+			line := fileTitle(job.Files[p.file])
+			if p.first > 1 || p.last < p.pages {
+				line += fmt.Sprintf(" (pages %d-%d of %d)", p.first, p.last, p.pages)
+			}
+			text.multiCell(0, "", 11, 5.5, line, "L")
+		}
+	}
+
+	if err := pdf.OutputFileAndClose(out); err != nil {
+		return fmt.Errorf("error rendering index page: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+//go:build js && wasm
+
+// Command wasm merges PDF, PNG and JPEG files in the browser, so small jobs
+// of the web interface never leave the user's device. It is the merge of
+// the server with the default options, built to WebAssembly:
+//
+//	GOOS=js GOARCH=wasm go build -o web/static/pdfmg.wasm ./wasm
+//	cp "$(go env GOROOT)/lib/wasm/wasm_exec.js" web/static/
+//
+// Loaded with wasm_exec.js, it defines pdfmgMerge(files), which takes an
+// array of {name, data} with the bytes of each file in a Uint8Array and
+// returns a promise of the merged PDF as a Uint8Array.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"path"
+	"strings"
+	"syscall/js"
+
+	"github.com/disintegration/imaging"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// The page images are centered on: A4 in points, with a margin of 10 mm
+const (
+	pointsPerMM = 72 / 25.4
+	pageWidth   = 190.0
+	pageHeight  = 277.0
+)
+
+var a4 = types.Dim{Width: 595.28, Height: 841.89}
+
+func main() {
+	api.DisableConfigDir()
+	js.Global().Set("pdfmgMerge", js.FuncOf(mergeFiles))
+	// The functions live as long as the program
+	select {}
+}
+
+// mergeFiles is pdfmgMerge. The merge runs in a goroutine, as the browser
+// must not be blocked waiting on it.
+func mergeFiles(this js.Value, args []js.Value) any {
+	promise := js.Global().Get("Promise")
+	return promise.New(js.FuncOf(func(_ js.Value, handlers []js.Value) any {
+		resolve, reject := handlers[0], handlers[1]
+		go func() {
+			out, err := merge(args)
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			data := js.Global().Get("Uint8Array").New(len(out))
+			js.CopyBytesToJS(data, out)
+			resolve.Invoke(data)
+		}()
+		return nil
+	}))
+}
+
+func merge(args []js.Value) ([]byte, error) {
+	if len(args) != 1 || args[0].Type() != js.TypeObject {
+		return nil, errors.New("expected an array of files")
+	}
+	files := args[0]
+	if files.Length() == 0 {
+		return nil, errors.New("no files to merge")
+	}
+	conf := pdfConfig()
+	var pdfs []io.ReadSeeker
+	for i := 0; i < files.Length(); i++ {
+		name := files.Index(i).Get("name").String()
+		data := make([]byte, files.Index(i).Get("data").Get("length").Int())
+		js.CopyBytesToGo(data, files.Index(i).Get("data"))
+
+		switch strings.ToLower(path.Ext(name)) {
+		case ".pdf":
+			pdfs = append(pdfs, bytes.NewReader(data))
+		case ".png", ".jpg", ".jpeg":
+			pdf, err := imageToPDF(data, conf)
+			if err != nil {
+				return nil, fmt.Errorf("error converting %s: %v", name, err)
+			}
+			pdfs = append(pdfs, bytes.NewReader(pdf))
+		default:
+			return nil, fmt.Errorf("unsupported file format: %s", name)
+		}
+	}
+
+	var out bytes.Buffer
+	if len(pdfs) == 1 {
+		_, err := io.Copy(&out, pdfs[0])
+		return out.Bytes(), err
+	}
+	if err := api.MergeRaw(pdfs, &out, false, conf); err != nil {
+		return nil, fmt.Errorf("error merging PDFs: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// imageToPDF puts an image on an A4 page as the server does: at a millimetre
+// a pixel, shrunk to fit within the margins, and centered. Plain JPEGs are
+// embedded as they are, other images losslessly with transparent areas
+// flattened onto white.
+func imageToPDF(data []byte, conf *model.Configuration) ([]byte, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error opening image: %v", err)
+	}
+	width, height := float64(img.Bounds().Dx()), float64(img.Bounds().Dy())
+	scale := 1.0
+	if width > pageWidth || height > pageHeight {
+		scale = min(pageWidth/width, pageHeight/height)
+	}
+
+	embedded := data
+	cm := img.ColorModel()
+	if format != "jpeg" || (cm != color.YCbCrModel && cm != color.GrayModel) {
+		flat := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+		flat = imaging.Overlay(flat, img, image.Pt(0, 0), 1)
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, flat, imaging.PNG); err != nil {
+			return nil, fmt.Errorf("error encoding image: %v", err)
+		}
+		embedded = buf.Bytes()
+	}
+
+	imp := pdfcpu.DefaultImportConfig()
+	imp.PageDim = &a4
+	imp.Pos = types.Center
+	imp.ScaleAbs = true
+	imp.Scale = scale * pointsPerMM
+	var out bytes.Buffer
+	if err := api.ImportImages(nil, &out, []io.Reader{bytes.NewReader(embedded)}, imp, conf); err != nil {
+		return nil, fmt.Errorf("error creating PDF: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// pdfConfig is the pdfcpu configuration of the server
+func pdfConfig() *model.Configuration {
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	return conf
+}
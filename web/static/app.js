@@ -0,0 +1,554 @@
+const basePath = document.body.dataset.basePath;
+
+// Selected files as {name, size, file, id, contributor}: file is the File
+// picked on this page, id the file in the upload session once stored there
+// and contributor who sent it to the collect link
+let selectedFiles = [];
+// Pre-flight checks of the selected files, by entry
+const fileChecks = new WeakMap();
+// Files are stored in an upload session on the server as they are added,
+// so a reload or a later visit picks them up again. Requests to the session
+// are made one at a time, in order.
+const sessionKey = 'uploadSession';
+let sessionToken = localStorage.getItem(sessionKey);
+let sessionQueue = Promise.resolve();
+const fileInput = document.getElementById('fileInput');
+const fileList = document.getElementById('fileList');
+const mergeBtn = document.getElementById('mergeBtn');
+const uploadArea = document.getElementById('uploadArea');
+const loading = document.getElementById('loading');
+const result = document.getElementById('result');
+const collectLink = document.getElementById('collectLink');
+const collectUrl = document.getElementById('collectUrl');
+// Small merges with the default options can run in this browser with the
+// WebAssembly build of the merge, so the files never leave the device.
+// Those are neither checked nor stored on the server.
+const localMerge = document.getElementById('localMerge');
+const localMergeKey = 'localMerge';
+const maxLocalMergeSize = 50 * 1024 * 1024;
+let mergerReady = null;
+if (localMerge) {
+    localMerge.checked = localStorage.getItem(localMergeKey) === 'true';
+    localMerge.addEventListener('change', () => localStorage.setItem(localMergeKey, localMerge.checked));
+}
+
+// Handle file selection
+fileInput.addEventListener('change', function(e) {
+    handleFiles(e.target.files);
+});
+
+// Handle drag and drop
+uploadArea.addEventListener('dragover', function(e) {
+    e.preventDefault();
+    uploadArea.classList.add('dragover');
+});
+
+uploadArea.addEventListener('dragleave', function(e) {
+    e.preventDefault();
+    uploadArea.classList.remove('dragover');
+});
+
+uploadArea.addEventListener('drop', function(e) {
+    e.preventDefault();
+    uploadArea.classList.remove('dragover');
+    handleFiles(e.dataTransfer.files);
+});
+
+function handleFiles(files) {
+    const added = [];
+    for (let file of files) {
+        // The file input accepts the extensions the server converts
+        if (file.type === 'application/pdf' || 
+            file.type.startsWith('image/png') || 
+            file.type.startsWith('image/jpeg') ||
+            fileInput.accept.split(',').some(ext => file.name.toLowerCase().endsWith(ext))) {
+            const entry = {name: file.name, size: file.size, file: file};
+            selectedFiles.push(entry);
+            added.push(entry);
+        }
+    }
+    updateFileList();
+    if (mergesLocally()) return;
+    added.forEach(checkFile);
+    inspectFiles();
+    if (added.length > 0) {
+        storeFiles(added);
+    }
+}
+
+function queueSession(request) {
+    sessionQueue = sessionQueue.then(request).catch(() => {});
+    return sessionQueue;
+}
+
+// Picks up the files of the upload session of an earlier visit
+async function restoreSession() {
+    if (!sessionToken) return;
+    const response = await fetch(basePath + '/api/v1/sessions/' + sessionToken);
+    if (!response.ok) {
+        localStorage.removeItem(sessionKey);
+        sessionToken = null;
+        return;
+    }
+    showSession(await response.json());
+}
+
+// Shows the files of the upload session in its order, with those not
+// stored yet after them, and its collect link
+function showSession(data) {
+    const stored = new Map(selectedFiles.filter(entry => entry.id).map(entry => [entry.id, entry]));
+    selectedFiles = data.files
+        .map(f => stored.get(f.id) || {name: f.name, size: f.size, id: f.id, contributor: f.contributor})
+        .concat(selectedFiles.filter(entry => !entry.id));
+    collectLink.hidden = !data.collectUrl;
+    collectUrl.value = data.collectUrl ? location.origin + data.collectUrl : '';
+    updateFileList();
+}
+
+// Starts an upload session unless there is one, reporting whether there is
+async function ensureSession() {
+    if (sessionToken) return true;
+    const response = await fetch(basePath + '/api/v1/sessions', {method: 'POST'});
+    if (!response.ok) return false;
+    sessionToken = (await response.json()).token;
+    localStorage.setItem(sessionKey, sessionToken);
+    return true;
+}
+
+// Stores the entries in the upload session, starting one if there is none.
+// Entries that fail to store are uploaded when merging instead.
+function storeFiles(entries) {
+    return queueSession(async () => {
+        if (!await ensureSession()) return;
+        const formData = new FormData();
+        entries.forEach(entry => formData.append('files', entry.file));
+        const response = await fetch(basePath + '/api/v1/sessions/' + sessionToken + '/files', {
+            method: 'POST',
+            body: formData
+        });
+        if (!response.ok) return;
+        const stored = (await response.json()).files.slice(-entries.length);
+        entries.forEach((entry, i) => entry.id = stored[i].id);
+        // Files removed while they were being stored
+        entries.filter(entry => !selectedFiles.includes(entry)).forEach(unstoreFile);
+        storeOrder();
+    });
+}
+
+function unstoreFile(entry) {
+    queueSession(() => fetch(basePath + '/api/v1/sessions/' + sessionToken + '/files/' + entry.id, {method: 'DELETE'}));
+}
+
+// Puts the files of the upload session in the order shown, once all are stored
+function storeOrder() {
+    if (!sessionToken || selectedFiles.some(entry => !entry.id)) return;
+    const ids = selectedFiles.map(entry => entry.id);
+    queueSession(() => fetch(basePath + '/api/v1/sessions/' + sessionToken + '/order', {
+        method: 'PUT',
+        body: JSON.stringify(ids)
+    }));
+}
+
+// Opens the upload session to files from others, showing the link to share
+function collectFiles() {
+    queueSession(async () => {
+        if (!await ensureSession()) return;
+        const response = await fetch(basePath + '/api/v1/sessions/' + sessionToken + '/collect', {method: 'POST'});
+        if (response.ok) showSession(await response.json());
+    });
+}
+
+function stopCollecting() {
+    queueSession(async () => {
+        const response = await fetch(basePath + '/api/v1/sessions/' + sessionToken + '/collect', {method: 'DELETE'});
+        if (response.ok) showSession(await response.json());
+    });
+}
+
+// Picks up the files others sent to the collect link since
+function refreshSession() {
+    queueSession(async () => {
+        const response = await fetch(basePath + '/api/v1/sessions/' + sessionToken);
+        if (response.ok) showSession(await response.json());
+    });
+}
+
+// Check each file as it is added, so one that needs a password, is damaged
+// or has no pages shows up before the upload
+async function checkFile(entry) {
+    const formData = new FormData();
+    formData.append('file', entry.file);
+    try {
+        const response = await fetch(basePath + '/api/v1/check', {
+            method: 'POST',
+            body: formData
+        });
+        if (!response.ok) return;
+        fileChecks.set(entry, await response.json());
+    } catch (error) {
+        return;
+    }
+    if (selectedFiles.includes(entry)) {
+        updateFileList();
+    }
+}
+
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+// Warn before merging signed PDFs, which invalidates their signatures
+async function inspectFiles() {
+    const warning = document.getElementById('signatureWarning');
+    const pdfs = selectedFiles.filter(entry => entry.file && entry.name.toLowerCase().endsWith('.pdf'))
+        .map(entry => entry.file);
+    if (pdfs.length === 0) {
+        warning.innerHTML = '';
+        return;
+    }
+
+    const formData = new FormData();
+    pdfs.forEach(file => formData.append('files', file));
+    try {
+        const response = await fetch(basePath + '/api/v1/inspect', {
+            method: 'POST',
+            body: formData
+        });
+        const data = await response.json();
+        if (!data.warning) {
+            warning.innerHTML = '';
+            return;
+        }
+        const signers = data.files.flatMap(file => (file.signatures || []).map(sig =>
+            `<li>${file.name}: signed by ${sig.signer || 'unknown signer'}${sig.intact ? '' : ' (signature already invalid)'}</li>`));
+        warning.innerHTML = `
+            <div class="result warning">
+                <strong>Warning:</strong> ${data.warning}.
+                <ul>${signers.join('')}</ul>
+            </div>
+        `;
+    } catch (error) {
+        warning.innerHTML = '';
+    }
+}
+
+function updateFileList() {
+    fileList.innerHTML = '';
+    selectedFiles.forEach((entry, index) => {
+        const fileItem = document.createElement('div');
+        fileItem.className = 'file-item';
+        fileItem.draggable = true;
+        fileItem.dataset.index = index;
+        const check = fileChecks.get(entry);
+        const problems = (check && check.problems || [])
+            .map(problem => `<div class="file-problem">${escapeHTML(problem.message)}</div>`);
+        const notes = (check && check.warnings || [])
+            .map(warning => `<div class="file-note">${escapeHTML(warning)}</div>`);
+        fileItem.classList.toggle('has-problem', problems.length > 0);
+        fileItem.innerHTML = `
+            <div>
+                <div style="display: flex; align-items: center;">
+                    <span class="drag-handle">⋮⋮</span>
+                    <span>${escapeHTML(entry.name)} (${(entry.size / 1024 / 1024).toFixed(2)} MB)${entry.contributor ? `, from ${escapeHTML(entry.contributor)}` : ''}${check && check.pages ? `, ${check.pages} page${check.pages === 1 ? '' : 's'}` : ''}</span>
+                </div>
+                ${problems.join('')}${notes.join('')}
+            </div>
+            <button class="remove-btn" onclick="removeFile(${index})">Remove</button>
+        `;
+
+        // Add drag event listeners
+        fileItem.addEventListener('dragstart', handleDragStart);
+        fileItem.addEventListener('dragover', handleDragOver);
+        fileItem.addEventListener('drop', handleDrop);
+        fileItem.addEventListener('dragend', handleDragEnd);
+        fileItem.addEventListener('dragenter', handleDragEnter);
+        fileItem.addEventListener('dragleave', handleDragLeave);
+
+        fileList.appendChild(fileItem);
+    });
+
+    updateMergeButton();
+}
+
+// Files picked from cloud storage count as input too
+function cloudInputs() {
+    return Array.from(document.querySelectorAll('.cloud-input'))
+        .filter(input => input.value.trim() !== '');
+}
+
+function updateMergeButton() {
+    mergeBtn.disabled = selectedFiles.length === 0 && cloudInputs().length === 0;
+}
+
+document.querySelectorAll('.cloud-input').forEach(input => {
+    input.addEventListener('input', updateMergeButton);
+});
+
+function removeFile(index) {
+    const [entry] = selectedFiles.splice(index, 1);
+    if (entry.id) {
+        unstoreFile(entry);
+    }
+    updateFileList();
+    inspectFiles();
+}
+
+// Drag and drop reordering functionality
+let draggedIndex = null;
+
+function handleDragStart(e) {
+    draggedIndex = parseInt(e.target.dataset.index);
+    e.target.classList.add('dragging');
+    e.dataTransfer.effectAllowed = 'move';
+}
+
+function handleDragEnd(e) {
+    e.target.classList.remove('dragging');
+    draggedIndex = null;
+
+    // Remove all drag-over classes
+    document.querySelectorAll('.file-item').forEach(item => {
+        item.classList.remove('drag-over');
+    });
+}
+
+function handleDragOver(e) {
+    e.preventDefault();
+    e.dataTransfer.dropEffect = 'move';
+}
+
+function handleDragEnter(e) {
+    e.preventDefault();
+    if (e.target.classList.contains('file-item') && draggedIndex !== null) {
+        const targetIndex = parseInt(e.target.dataset.index);
+        if (targetIndex !== draggedIndex) {
+            e.target.classList.add('drag-over');
+        }
+    }
+}
+
+function handleDragLeave(e) {
+    if (e.target.classList.contains('file-item')) {
+        e.target.classList.remove('drag-over');
+    }
+}
+
+function handleDrop(e) {
+    e.preventDefault();
+
+    if (draggedIndex === null) return;
+
+    const targetIndex = parseInt(e.target.dataset.index);
+
+    if (targetIndex !== draggedIndex) {
+        // Reorder the files array
+        const draggedFile = selectedFiles[draggedIndex];
+        selectedFiles.splice(draggedIndex, 1);
+        selectedFiles.splice(targetIndex, 0, draggedFile);
+
+        // Update the display
+        updateFileList();
+        storeOrder();
+    }
+
+    // Clean up
+    e.target.classList.remove('drag-over');
+}
+
+async function sha256Hex(file) {
+    const digest = await crypto.subtle.digest('SHA-256', await file.arrayBuffer());
+    return Array.from(new Uint8Array(digest), b => b.toString(16).padStart(2, '0')).join('');
+}
+
+function mergesLocally() {
+    return localMerge !== null && localMerge.checked;
+}
+
+// Why the selected files can't be merged in this browser, or '' when they
+// can
+function localMergeProblem() {
+    if (cloudInputs().length > 0) return 'they include files from cloud storage';
+    const stored = selectedFiles.find(entry => !entry.file);
+    if (stored) return `${stored.name} is stored on the server`;
+    const other = selectedFiles.find(entry => !/\.(pdf|png|jpe?g)$/i.test(entry.name));
+    if (other) return `${other.name} is converted on the server`;
+    if (selectedFiles.reduce((sum, entry) => sum + entry.size, 0) > maxLocalMergeSize) {
+        return 'they are larger than 50 MB';
+    }
+    const changed = Array.from(document.querySelectorAll('.option')).some(input => {
+        if (input.type === 'checkbox') return input.checked !== input.defaultChecked;
+        if (input.type === 'file') return input.files.length > 0;
+        if (input.tagName === 'SELECT') {
+            const initial = Array.from(input.options).findIndex(option => option.defaultSelected);
+            return input.selectedIndex !== Math.max(initial, 0);
+        }
+        return input.value !== input.defaultValue;
+    });
+    if (changed) return 'options are set';
+    return '';
+}
+
+// Loads the WebAssembly merge once, which defines pdfmgMerge
+function loadMerger() {
+    if (!mergerReady) {
+        mergerReady = new Promise((resolve, reject) => {
+            const script = document.createElement('script');
+            script.src = basePath + '/static/wasm_exec.js';
+            script.onload = resolve;
+            script.onerror = () => reject(new Error('the merger could not be loaded'));
+            document.head.appendChild(script);
+        }).then(async () => {
+            const go = new Go();
+            const {instance} = await WebAssembly.instantiateStreaming(
+                fetch(basePath + '/static/pdfmg.wasm'), go.importObject);
+            go.run(instance);
+        });
+        mergerReady.catch(() => { mergerReady = null; });
+    }
+    return mergerReady;
+}
+
+// Merges the files in this browser when it can, and asks before uploading
+// them when it can't. Returns whether the merge is done with, without the
+// server.
+async function mergeLocally() {
+    let problem = localMergeProblem();
+    if (!problem) {
+        loading.style.display = 'block';
+        result.innerHTML = '';
+        mergeBtn.disabled = true;
+        try {
+            await loadMerger();
+            const files = await Promise.all(selectedFiles.map(async entry =>
+                ({name: entry.name, data: new Uint8Array(await entry.file.arrayBuffer())})));
+            const pdf = await pdfmgMerge(files);
+            const url = URL.createObjectURL(new Blob([pdf], {type: 'application/pdf'}));
+            result.innerHTML = `
+                <div class="result success">
+                    <strong>Success!</strong> Your PDF has been merged in this browser, without uploading the files.
+                    <br>
+                    <a href="${url}" class="download-btn" download="merged.pdf">
+                        📥 Download merged.pdf
+                    </a>
+                </div>
+            `;
+            return true;
+        } catch (error) {
+            problem = `merging them in this browser failed: ${error.message}`;
+        } finally {
+            loading.style.display = 'none';
+            mergeBtn.disabled = false;
+        }
+    }
+    return !confirm(`These files need the server, as ${problem}. Upload them to merge them there?`);
+}
+
+async function mergePDFs() {
+    if (selectedFiles.length === 0 && cloudInputs().length === 0) return;
+    if (mergesLocally() && await mergeLocally()) return;
+
+    loading.style.display = 'block';
+    result.innerHTML = '';
+    mergeBtn.disabled = true;
+
+    // Files stored in the upload session are merged from it, ahead of any
+    // that could not be stored
+    await sessionQueue;
+    const formData = new FormData();
+    if (selectedFiles.some(entry => entry.id)) {
+        formData.append('session', sessionToken);
+    }
+    const uploads = selectedFiles.filter(entry => !entry.id).map(entry => entry.file);
+    // Checksums let the server reject files damaged on the way
+    const checksums = window.crypto && crypto.subtle
+        ? await Promise.all(uploads.map(sha256Hex)) : [];
+    uploads.forEach((file, i) => {
+        formData.append('files', file);
+        if (checksums.length > 0) {
+            formData.append('checksums', checksums[i]);
+        }
+    });
+    document.querySelectorAll('.option').forEach(input => {
+        if (input.type === 'checkbox') {
+            formData.append(input.name, input.checked);
+        } else if (input.type === 'file') {
+            if (input.files.length > 0) {
+                formData.append(input.name, input.files[0]);
+            }
+        } else if (input.value !== '') {
+            formData.append(input.name, input.value);
+        }
+    });
+    const driveIds = document.getElementById('driveIds');
+    if (driveIds && driveIds.value.trim() !== '') {
+        formData.append('drive_file_ids', driveIds.value);
+    }
+    const dropboxLinks = document.getElementById('dropboxLinks');
+    if (dropboxLinks && dropboxLinks.value.trim() !== '') {
+        formData.append('dropbox_links', dropboxLinks.value);
+    }
+    const dropboxPaths = document.getElementById('dropboxPaths');
+    if (dropboxPaths && dropboxPaths.value.trim() !== '') {
+        formData.append('dropbox_paths', dropboxPaths.value);
+    }
+
+    try {
+        const response = await fetch(basePath + '/upload', {
+            method: 'POST',
+            body: formData
+        });
+
+        const data = await response.json();
+
+        if (response.ok && (data.status === 'success' || data.status === 'partial')) {
+            result.innerHTML = `
+                <div class="result success">
+                    <strong>Success!</strong> Your PDF has been merged successfully.
+                    <br>
+                    <a href="${data.downloadUrl}" class="download-btn" download>
+                        📥 Download ${data.filename}
+                    </a>
+                </div>
+            `;
+            // Files left out with on_error=skip, named as uploaded
+            if (data.skipped && data.skipped.length > 0) {
+                const note = document.createElement('p');
+                note.textContent = 'Skipped files that could not be converted:';
+                const list = document.createElement('ul');
+                data.skipped.forEach(file => {
+                    const item = document.createElement('li');
+                    item.textContent = `${file.name}: ${file.error}`;
+                    list.appendChild(item);
+                });
+                result.firstElementChild.append(note, list);
+            }
+            // Volumes of a split merge that could not be written
+            if (data.failedVolumes && data.failedVolumes.length > 0) {
+                const note = document.createElement('p');
+                note.textContent = 'Volumes that could not be written:';
+                const list = document.createElement('ul');
+                data.failedVolumes.forEach(volume => {
+                    const item = document.createElement('li');
+                    item.textContent = `Volume ${volume.volume}: ${volume.error}`;
+                    list.appendChild(item);
+                });
+                result.firstElementChild.append(note, list);
+            }
+        } else {
+            throw new Error(data.error || 'Unknown error occurred');
+        }
+    } catch (error) {
+        result.innerHTML = `
+            <div class="result error">
+                <strong>Error:</strong> ${error.message}
+            </div>
+        `;
+    } finally {
+        loading.style.display = 'none';
+        mergeBtn.disabled = false;
+    }
+}
+
+restoreSession();
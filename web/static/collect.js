@@ -0,0 +1,102 @@
+const basePath = document.body.dataset.basePath;
+const collectToken = document.body.dataset.collectToken;
+
+// Files picked to send to the collect link
+let pickedFiles = [];
+const fileInput = document.getElementById('fileInput');
+const fileList = document.getElementById('fileList');
+const sendBtn = document.getElementById('sendBtn');
+const uploadArea = document.getElementById('uploadArea');
+const loading = document.getElementById('loading');
+const result = document.getElementById('result');
+
+fileInput.addEventListener('change', function(e) {
+    pickFiles(e.target.files);
+    fileInput.value = '';
+});
+
+uploadArea.addEventListener('dragover', function(e) {
+    e.preventDefault();
+    uploadArea.classList.add('dragover');
+});
+
+uploadArea.addEventListener('dragleave', function(e) {
+    e.preventDefault();
+    uploadArea.classList.remove('dragover');
+});
+
+uploadArea.addEventListener('drop', function(e) {
+    e.preventDefault();
+    uploadArea.classList.remove('dragover');
+    pickFiles(e.dataTransfer.files);
+});
+
+function pickFiles(files) {
+    for (let file of files) {
+        if (/\.(pdf|png|jpe?g)$/i.test(file.name)) {
+            pickedFiles.push(file);
+        }
+    }
+    updateFileList();
+}
+
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+function updateFileList() {
+    fileList.innerHTML = '';
+    pickedFiles.forEach((file, index) => {
+        const fileItem = document.createElement('div');
+        fileItem.className = 'file-item';
+        fileItem.innerHTML = `
+            <span>${escapeHTML(file.name)} (${(file.size / 1024 / 1024).toFixed(2)} MB)</span>
+            <button class="remove-btn" onclick="removeFile(${index})">Remove</button>
+        `;
+        fileList.appendChild(fileItem);
+    });
+    sendBtn.disabled = pickedFiles.length === 0;
+}
+
+function removeFile(index) {
+    pickedFiles.splice(index, 1);
+    updateFileList();
+}
+
+async function sendFiles() {
+    const formData = new FormData();
+    formData.append('contributor', document.getElementById('contributor').value);
+    pickedFiles.forEach(file => formData.append('files', file));
+
+    loading.style.display = 'block';
+    sendBtn.disabled = true;
+    result.innerHTML = '';
+    try {
+        const response = await fetch(basePath + '/collect/' + collectToken, {
+            method: 'POST',
+            body: formData
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            throw new Error(data.error || 'Unknown error occurred');
+        }
+        result.innerHTML = `
+            <div class="result success">
+                Sent ${data.received} file${data.received === 1 ? '' : 's'}. Thank you!
+            </div>
+        `;
+        pickedFiles = [];
+        updateFileList();
+    } catch (error) {
+        result.innerHTML = `
+            <div class="result error">
+                <strong>Error:</strong> ${escapeHTML(error.message)}
+            </div>
+        `;
+        sendBtn.disabled = pickedFiles.length === 0;
+    } finally {
+        loading.style.display = 'none';
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// workDirs are the directories files are kept in while jobs run
+type workDirs struct {
+	uploads string
+	output  string
+	cache   string
+	// scratch holds the intermediate files of conversions, which never
+	// outlive a job, so it may be a tmpfs such as /dev/shm
+	scratch string
+	mode    os.FileMode
+}
+
+// loadWorkDirs reads the directories from UPLOADS_DIR, OUTPUT_DIR,
+// CACHE_DIR and SCRATCH_DIR, and their permissions from DIR_MODE. The
+// scratch directory defaults to the uploads directory.
+func loadWorkDirs() (workDirs, error) {
+	dirs := workDirs{
+		uploads: envOr("UPLOADS_DIR", "uploads"),
+		output:  envOr("OUTPUT_DIR", "output"),
+		cache:   envOr("CACHE_DIR", "cache"),
+		mode:    0755,
+	}
+	dirs.scratch = envOr("SCRATCH_DIR", dirs.uploads)
+	if v := os.Getenv("DIR_MODE"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode > 0777 {
+			return dirs, fmt.Errorf("invalid DIR_MODE: %s (expected octal permissions like 0750)", v)
+		}
+		dirs.mode = os.FileMode(mode)
+	}
+	return dirs, nil
+}
+
+// create makes the directories that do not exist yet and gives them their
+// permissions, which the umask would otherwise narrow
+func (d workDirs) create() error {
+	for _, dir := range []string{d.uploads, d.output, d.cache, d.scratch} {
+		if err := os.MkdirAll(dir, d.mode); err != nil {
+			return err
+		}
+		if err := os.Chmod(dir, d.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,908 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Interval at which idle workers and waiting requests poll the job store
+const pollInterval = 250 * time.Millisecond
+
+// Interval at which workers touch the jobs they process, so jobs left alone
+// for much longer are known to have lost their worker
+const jobHeartbeat = time.Minute
+
+// Times a job is taken up again after its worker stopped before it fails,
+// as it may be what stops them
+const maxResumes = 3
+
+// runWorker claims queued jobs and processes as many at once as configured
+// until ctx is cancelled
+func (fh *FileHandler) runWorker(ctx context.Context) {
+	if fh.resources.jobMemory > 0 {
+		go fh.monitorMemory(ctx)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < fh.resources.concurrency; i++ {
+		wg.Add(1)
+		go func(first bool) {
+			defer wg.Done()
+			fh.workLoop(ctx, first)
+		}(i == 0)
+	}
+	wg.Wait()
+}
+
+// workLoop processes one job at a time; the first loop also prunes the
+// dedup cache and requeues the jobs of workers that stopped
+func (fh *FileHandler) workLoop(ctx context.Context, prune bool) {
+	lastPrune, lastRequeue := time.Now(), time.Now()
+	for {
+		if prune && time.Since(lastPrune) > time.Hour {
+			fh.pruneDedupCache()
+			lastPrune = time.Now()
+		}
+		if prune && time.Since(lastRequeue) > jobHeartbeat {
+			fh.requeueInterrupted(orphanGrace)
+			lastRequeue = time.Now()
+		}
+
+		job, err := fh.jobs.ClaimNext(fh.activeJobs.claimLimits())
+		if err == nil {
+			jobCtx, cancel := context.WithCancelCause(ctx)
+			run := &runningJob{id: job.ID, cancel: cancel}
+			fh.running.add(run)
+			go fh.heartbeat(jobCtx, job.ID)
+			fh.processJob(jobCtx, job)
+			fh.running.remove(run)
+			cancel(nil)
+			continue
+		}
+		if !errors.Is(err, ErrJobNotFound) {
+			log.Printf("Error claiming job: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// heartbeat touches a job until ctx is cancelled, so it is not requeued
+// while it is processed
+func (fh *FileHandler) heartbeat(ctx context.Context, id string) {
+	ticker := time.NewTicker(jobHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fh.jobs.Touch(id); err != nil {
+				log.Printf("Error touching job %s: %v", id, err)
+			}
+		}
+	}
+}
+
+// requeueInterrupted puts jobs whose worker stopped mid-job back in the
+// queue, to be resumed from the files they had converted. Jobs touched
+// within grace may still have a worker.
+func (fh *FileHandler) requeueInterrupted(grace time.Duration) {
+	n, err := fh.jobs.Requeue(time.Now().Add(-grace))
+	if err != nil {
+		log.Printf("Error requeuing interrupted jobs: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Requeued %d interrupted jobs", n)
+	}
+}
+
+// processJob converts and merges the files of a claimed job. It stops at the
+// next step once ctx is cancelled. Jobs that were interrupted before start
+// again, skipping the files they had converted.
+func (fh *FileHandler) processJob(ctx context.Context, job *Job) {
+	// Outputs are named after the creation time and job, as batches queue
+	// several jobs in the same second
+	timestamp := job.CreatedAt.Local().Format("20060102_150405") + "_" + job.ID[:min(8, len(job.ID))]
+	defer fh.dedupLeases.release(job.ID)
+	// The request ID ties the job's log lines to those of its request
+	if job.RequestID != "" {
+		log.Printf("Processing job %s of request %s", job.ID, job.RequestID)
+	}
+
+	// Jobs get a stage once they are first processed
+	resumes := job.Progress.Resumed
+	if job.Progress.Stage != "" {
+		if resumes++; resumes > maxResumes {
+			fh.failJob(job, CodeAborted, fmt.Sprintf("Interrupted %d times", resumes))
+			return
+		}
+		log.Printf("Resuming job %s", job.ID)
+	}
+
+	var sources []JobFile
+	if job.Options.AttachSources {
+		kept, err := fh.keepSources(job)
+		if err != nil {
+			fh.failJob(job, CodeInternal, "Error attaching original files: "+err.Error())
+			return
+		}
+		sources = kept
+		defer removeSources(sources)
+	}
+
+	cropFiles, err := api.PagesForPageSelection(len(job.Files), pageSelection(job.Options.CropFiles), true, false)
+	if err != nil {
+		fh.failJob(job, CodeInvalidOption, "Error selecting files to crop: "+err.Error())
+		return
+	}
+
+	// The manifest proves what was merged, so uploads are hashed before
+	// their conversion replaces them
+	if job.Options.SignedManifest {
+		if err := fh.hashInputs(job); err != nil {
+			fh.failJob(job, CodeInternal, err.Error())
+			return
+		}
+	}
+
+	job.Progress = JobProgress{Stage: StageConverting, FilesTotal: len(job.Files), Resumed: resumes}
+	fh.saveProgress(job)
+
+	convertedPDFs := make([]string, len(job.Files))
+	var mu sync.Mutex
+	var failure, failureCode string
+	sem := make(chan struct{}, fh.resources.jobThreads)
+	var wg sync.WaitGroup
+	for i := range job.Files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			mu.Lock()
+			stop := failure != "" || context.Cause(ctx) != nil
+			mu.Unlock()
+			if stop {
+				return
+			}
+
+			if pdfPath, pages, ok := fh.convertedBefore(job, i); ok {
+				mu.Lock()
+				defer mu.Unlock()
+				convertedPDFs[i] = pdfPath
+				job.Progress.FilesConverted++
+				job.Progress.PagesTotal += pages
+				return
+			}
+			file, err := fh.convertFile(job, i, cropFiles)
+			mu.Lock()
+			defer mu.Unlock()
+			code := ""
+			if err != nil {
+				code = inputErrorCode(job.Files[i], job.Options.LargeFiles, err)
+			}
+			if err != nil && job.Options.OnError == OnErrorSkip {
+				log.Printf("Job %s skips %s: %v", job.ID, job.Files[i].Name, err)
+				job.Files[i].Error = err.Error()
+				job.Files[i].ErrorCode = code
+				job.Files[i].Report = file.Report
+				job.Progress.FilesConverted++
+				fh.saveProgress(job)
+				return
+			}
+			if err != nil {
+				if failure == "" {
+					failure, failureCode = err.Error(), code
+				}
+				return
+			}
+			convertedPDFs[i] = file.Converted
+			file.Error, file.ErrorCode = "", ""
+			job.Files[i] = file
+			job.Progress.FilesConverted++
+			job.Progress.PagesTotal += file.Pages
+			fh.saveProgress(job)
+		}(i)
+	}
+	wg.Wait()
+	if failure != "" {
+		fh.failJob(job, failureCode, failure)
+		return
+	}
+	if fh.aborted(ctx, job) {
+		return
+	}
+
+	// Skipped files are left out of the merge
+	var merged []string
+	for i, path := range convertedPDFs {
+		if job.Files[i].Error == "" {
+			merged = append(merged, path)
+		}
+	}
+	if len(merged) == 0 {
+		fh.failJob(job, job.Files[0].ErrorCode, "No file could be merged: "+job.Files[0].Error)
+		return
+	}
+	convertedPDFs = merged
+
+	if err := fh.limits.checkPages(job.Progress.PagesTotal); err != nil {
+		fh.failJob(job, CodeTooManyPages, "Too many pages: "+err.Error())
+		return
+	}
+	// The documents of portfolios are kept whole, so they cannot be cut
+	// to the page limit
+	if job.Options.Portfolio && fh.limits.maxPages > 0 && job.Progress.PagesTotal > fh.limits.maxPages {
+		fh.failJob(job, CodeTooManyPages, fmt.Sprintf("Too many pages: the files have %d pages, more than the limit of %d", job.Progress.PagesTotal, fh.limits.maxPages))
+		return
+	}
+
+	// Large files are merged as they are, so links, forms and structure
+	// tags are left alone, and so are the documents of portfolios, which
+	// are embedded apart
+	large := job.Options.LargeFiles
+	whole := large || job.Options.Portfolio
+
+	// The files the steps before merging replace are kept until the job is
+	// done, so an interrupted job can start again from the converted files
+	var replaced []string
+	replace := func(paths []string) {
+		for i, path := range paths {
+			if path != convertedPDFs[i] {
+				replaced = append(replaced, convertedPDFs[i])
+			}
+		}
+		convertedPDFs = paths
+	}
+
+	// Keep links pointing at the right pages once the files are combined
+	if len(convertedPDFs) > 1 && !whole {
+		resolved, err := fh.resolveLinks(job.ID, convertedPDFs)
+		if err != nil {
+			fh.failJob(job, CodeMergeFailed, "Error resolving links: "+err.Error())
+			return
+		}
+		replace(resolved)
+	}
+
+	// Keep the fields of repeated forms apart in the merged form
+	mergeForms := len(convertedPDFs) > 1 && !job.Options.FlattenForms && !whole
+	if mergeForms {
+		renamed, err := fh.uniqueFormFields(job.ID, convertedPDFs)
+		if err != nil {
+			fh.failJob(job, CodeMergeFailed, "Error renaming form fields: "+err.Error())
+			return
+		}
+		replace(renamed)
+	}
+
+	// Keep the structure of tagged files, which pdfcpu drops for all but
+	// the first
+	joinTags := len(convertedPDFs) > 1 && hasTaggedFiles(job) && !whole
+	if joinTags {
+		prepared, err := fh.prepareStructTrees(job.ID, convertedPDFs)
+		if err != nil {
+			fh.failJob(job, CodeMergeFailed, "Error preparing structure tags: "+err.Error())
+			return
+		}
+		replace(prepared)
+	}
+
+	if fh.aborted(ctx, job) {
+		return
+	}
+	job.Progress.Stage = StageMerging
+	fh.saveProgress(job)
+
+	// Merge all PDFs
+	var mergedPath string
+	if job.Options.Portfolio {
+		mergedPath, err = fh.buildPortfolio(job, convertedPDFs, timestamp)
+	} else if large {
+		mergedPath, err = fh.mergeLargePDFs(convertedPDFs, timestamp)
+	} else if job.Options.Mode == ModeInterleave {
+		mergedPath, err = fh.interleavePDFs(convertedPDFs, timestamp, job.Options.ReverseSecond)
+	} else {
+		mergedPath, err = fh.mergePDFs(convertedPDFs, timestamp)
+	}
+	if err != nil {
+		fh.failJob(job, CodeMergeFailed, "Error merging PDFs: "+err.Error())
+		return
+	}
+	if mergeForms {
+		if err := ungroupMergedFields(mergedPath); err != nil {
+			fh.failJob(job, CodeMergeFailed, "Error merging form fields: "+err.Error())
+			return
+		}
+	}
+	if joinTags {
+		if err := joinStructTrees(mergedPath); err != nil {
+			fh.failJob(job, CodeMergeFailed, "Error merging structure tags: "+err.Error())
+			return
+		}
+	}
+	if !whole {
+		if err := titleBookmarks(mergedPath, job, convertedPDFs); err != nil {
+			fh.failJob(job, CodeMergeFailed, "Error naming bookmarks: "+err.Error())
+			return
+		}
+	}
+	if job.Options.Separators != "" {
+		if err := insertSeparators(mergedPath, job); err != nil {
+			fh.failJob(job, CodeMergeFailed, "Error inserting separator sheets: "+err.Error())
+			return
+		}
+	}
+
+	if fh.aborted(ctx, job) {
+		os.Remove(mergedPath)
+		return
+	}
+	job.Progress.Stage = StageFinishing
+	job.Progress.PagesMerged = job.Progress.PagesTotal
+	fh.saveProgress(job)
+
+	truncated := false
+	if large {
+		// Large merges stop at the page limit by themselves
+		truncated = fh.limits.truncate && fh.limits.maxPages > 0 && job.Progress.PagesTotal > fh.limits.maxPages
+	} else if truncated, err = fh.limits.truncatePages(mergedPath); err != nil {
+		fh.failJob(job, CodeMergeFailed, "Error truncating merged PDF: "+err.Error())
+		return
+	}
+	total := job.Progress.PagesTotal
+	if job.Options.Separators != "" {
+		total += len(separatorPages(job))
+	}
+	pages := mergedPages(job, total)
+	if truncated {
+		log.Printf("Job %s truncated to %d pages", job.ID, fh.limits.maxPages)
+		pages = mergedPages(job, fh.limits.maxPages)
+	}
+	for i := range job.Files {
+		if job.Files[i].Report != nil {
+			job.Files[i].Report.Pages = 0
+		}
+	}
+	for _, p := range pages {
+		if report := job.Files[p.file].Report; report != nil && p.page > 0 {
+			report.Pages++
+		}
+	}
+
+	if mergedPath, err = fh.postProcess(job, mergedPath, sources, pages); err != nil {
+		fh.failJob(job, CodeMergeFailed, "Error processing merged PDF: "+err.Error())
+		return
+	}
+	if fh.aborted(ctx, job) {
+		os.Remove(mergedPath)
+		return
+	}
+	if err := fh.limits.checkOutputSize(mergedPath); err != nil {
+		fh.auditFile(AuditEvent{Action: AuditDelete, User: job.User, JobID: job.ID, Detail: "output too large"}, mergedPath, false)
+		os.Remove(mergedPath)
+		fh.failJob(job, CodeOutputTooLarge, "Output too large: "+err.Error())
+		return
+	}
+	sum, err := fileSHA256(mergedPath)
+	if err != nil {
+		fh.failJob(job, CodeInternal, "Error hashing merged PDF: "+err.Error())
+		return
+	}
+	info, err := os.Stat(mergedPath)
+	if err != nil {
+		fh.failJob(job, CodeInternal, "Error reading merged PDF: "+err.Error())
+		return
+	}
+
+	// Clean up temporary files
+	for _, path := range append(replaced, convertedPDFs...) {
+		fh.removeTemp(path)
+	}
+
+	if job.Options.Overlay != "" {
+		os.Remove(job.Options.Overlay)
+	}
+	if job.Options.ICCProfile != "" {
+		os.Remove(job.Options.ICCProfile)
+	}
+	if job.Options.Cover != nil && job.Options.Cover.Logo != "" {
+		os.Remove(job.Options.Cover.Logo)
+	}
+
+	// Nothing is released that the release hook refuses or cannot check
+	if fh.releaseHook != nil {
+		if err := fh.releaseHook.check(job, mergedPath, sum); err != nil {
+			fh.auditFile(AuditEvent{Action: AuditDelete, User: job.User, JobID: job.ID, Detail: "release refused"}, mergedPath, false)
+			os.Remove(mergedPath)
+			var veto *vetoError
+			if errors.As(err, &veto) {
+				log.Printf("Release of job %s vetoed: %s", job.ID, veto.reason)
+				fh.failJob(job, CodeReleaseVetoed, "Release vetoed: "+veto.reason)
+			} else {
+				fh.failJob(job, CodeReleaseHookFailed, "Error checking output before release: "+err.Error())
+			}
+			return
+		}
+	}
+	if job.Options.SignedManifest && fh.signer != nil {
+		if err := fh.writeManifest(job, mergedPath, info.Size(), sum); err != nil {
+			fh.failJob(job, CodeInternal, "Error writing signed manifest: "+err.Error())
+			return
+		}
+	}
+
+	job.Status = JobDone
+	job.Progress.Stage = StageDone
+	job.OutputPath = mergedPath
+	job.OutputSize = info.Size()
+	job.OutputSHA256 = sum
+	if optimizes(job.Options) {
+		job.SizeReport = sizeReport(job, mergedPath, info.Size())
+	}
+	if err := fh.jobs.Update(job); err != nil {
+		log.Printf("Error updating job %s: %v", job.ID, err)
+	}
+	fh.audit(AuditEvent{Action: AuditMerge, User: job.User, JobID: job.ID, File: filepath.Base(mergedPath),
+		SHA256: sum, Size: info.Size(), Detail: fmt.Sprintf("inputs: %d", len(job.Files))})
+	for _, f := range job.Files {
+		if _, err := os.Stat(f.Path); os.IsNotExist(err) {
+			fh.audit(AuditEvent{Action: AuditDelete, User: job.User, JobID: job.ID, File: f.Name, SHA256: f.SHA256, Detail: "upload removed after merge"})
+		}
+	}
+	fh.notifier.JobFinished(job)
+}
+
+// convertedBefore returns the PDF an interrupted run of a job converted its
+// i-th file to and its page count, if it is still there
+func (fh *FileHandler) convertedBefore(job *Job, i int) (string, int, bool) {
+	file := job.Files[i]
+	if file.Converted == "" {
+		return "", 0, false
+	}
+	// Leased first, so the dedup cache cannot remove it once found
+	fh.dedupLeases.acquire(job.ID, file.Converted)
+	if _, err := os.Stat(file.Converted); err != nil {
+		return "", 0, false
+	}
+	return file.Converted, file.Pages, true
+}
+
+// convertFile examines the i-th file of a job, converts it to PDF and
+// applies the per-file options. It returns the file with the PDF, its page
+// count, the pages of the upload it holds when the manifest selects some,
+// whether it is tagged and the report on it, as far as it got. Errors read
+// as the reason the job failed.
+func (fh *FileHandler) convertFile(job *Job, i int, cropFiles types.IntSet) (JobFile, error) {
+	file := job.Files[i]
+	report, err := examineUpload(file, job.Options.LargeFiles)
+	if err != nil {
+		return file, errors.New("Error examining " + file.Name + ": " + err.Error())
+	}
+	if optimizes(job.Options) {
+		report.Size = fileSize(file.Path)
+	}
+	file.Report = report
+
+	// Convert to PDF if necessary, reusing earlier conversions of the same
+	// content
+	pdfPath, err := fh.convertDeduplicated(job.ID, file, job.Options, func() (string, error) {
+		if job.Options.Deskew && strings.EqualFold(filepath.Ext(file.Name), ".pdf") {
+			// Scanned pages are straightened before OCR reads them
+			if err := transformPDF(file.Path, straightenPDF); err != nil {
+				return "", errors.New("Error straightening " + file.Name + ": " + err.Error())
+			}
+		}
+		var path string
+		var err error
+		if job.Options.OCR && fh.ocr != nil {
+			path, err = fh.ocrFile(file, job.Options)
+		} else {
+			path, err = fh.convertToPDF(file.Path, file.Name, job.Options)
+		}
+		if err != nil {
+			return "", codeError(CodeConversionFailed, "Error converting file to PDF: "+err.Error(), err)
+		}
+		return path, nil
+	})
+	if err != nil {
+		return file, err
+	}
+
+	// Sanitizing comes first, so no other transform works on what it removes
+	if job.Options.Sanitize && strings.EqualFold(filepath.Ext(file.Name), ".pdf") {
+		var res sanitizeResult
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_sanitized.pdf", job.ID, i), func(in, out string) error {
+			var err error
+			res, err = sanitizePDF(in, out)
+			return err
+		})
+		if err != nil {
+			return file, codeError(CodeConversionFailed, "Error sanitizing "+file.Name+": "+err.Error(), err)
+		}
+		file.Report.Sanitized = res.describe()
+	}
+
+	// Images are tagged before other transforms add to their page
+	ext := strings.ToLower(filepath.Ext(file.Name))
+	if job.Options.TagImages && (ext == ".png" || ext == ".jpg" || ext == ".jpeg") {
+		alt := strings.TrimSuffix(file.Name, filepath.Ext(file.Name))
+		if i < len(job.Options.AltText) && job.Options.AltText[i] != "" {
+			alt = job.Options.AltText[i]
+		}
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_tagged.pdf", job.ID, i), func(in, out string) error {
+			return tagFigure(in, out, alt)
+		})
+		if err != nil {
+			return file, errors.New("Error tagging " + file.Name + ": " + err.Error())
+		}
+	}
+
+	// Per-file transforms work on copies so cached conversions stay untouched
+	if job.Options.RemoveAnnotations {
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_clean.pdf", job.ID, i), removeAnnotations)
+		if err != nil {
+			return file, errors.New("Error removing annotations of " + file.Name + ": " + err.Error())
+		}
+	}
+	if len(job.Options.FormValues) > 0 {
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_filled.pdf", job.ID, i), func(in, out string) error {
+			_, err := fillForm(in, out, job.Options.FormValues)
+			return err
+		})
+		if err != nil {
+			return file, errors.New("Error filling form of " + file.Name + ": " + err.Error())
+		}
+	}
+	if job.Options.FlattenForms {
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_flat.pdf", job.ID, i), flattenForms)
+		if err != nil {
+			return file, errors.New("Error flattening forms of " + file.Name + ": " + err.Error())
+		}
+	}
+	if job.Options.Crop != "" && cropFiles[i+1] {
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_cropped.pdf", job.ID, i), func(in, out string) error {
+			return cropPDF(in, out, job.Options.Crop, job.Options.CropPages)
+		})
+		if err != nil {
+			return file, errors.New("Error cropping " + file.Name + ": " + err.Error())
+		}
+	}
+	if job.Options.StampSource {
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_stamped.pdf", job.ID, i), func(in, out string) error {
+			return stampSource(in, out, file.Name, job.Options)
+		})
+		if err != nil {
+			return file, errors.New("Error stamping " + file.Name + ": " + err.Error())
+		}
+	}
+
+	// The layout of the manifest applies last, so the options above count
+	// the pages of the upload
+	if file.PageRange != "" {
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_pages.pdf", job.ID, i), func(in, out string) error {
+			var err error
+			file.SourcePages, err = selectPages(in, out, file.PageRange)
+			return err
+		})
+		if err != nil {
+			return file, errors.New("Error selecting pages of " + file.Name + ": " + err.Error())
+		}
+	}
+	if file.Rotate != 0 {
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_rotated.pdf", job.ID, i), func(in, out string) error {
+			return api.RotateFile(in, out, file.Rotate, nil, pdfConfig())
+		})
+		if err != nil {
+			return file, errors.New("Error rotating " + file.Name + ": " + err.Error())
+		}
+	}
+	if file.Scale != 0 {
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_scaled.pdf", job.ID, i), func(in, out string) error {
+			return scalePDF(in, out, file.Scale)
+		})
+		if err != nil {
+			return file, errors.New("Error scaling " + file.Name + ": " + err.Error())
+		}
+	}
+	if file.Fit != "" {
+		pdfPath, err = fh.transformCopy(pdfPath, fmt.Sprintf("%s_%d_fitted.pdf", job.ID, i), func(in, out string) error {
+			return normalizePDF(in, out, paperSizes[file.Fit], nil)
+		})
+		if err != nil {
+			return file, errors.New("Error fitting " + file.Name + ": " + err.Error())
+		}
+	}
+
+	// Large files are counted without reading them, and lose their tags
+	// in merging
+	if job.Options.LargeFiles {
+		pages, err := countPages(pdfPath)
+		if err != nil {
+			return file, errors.New("Error counting pages of " + file.Name + ": " + err.Error())
+		}
+		file.Converted, file.Pages, file.Untagged = pdfPath, pages, true
+		if optimizes(job.Options) {
+			file.Report.ConvertedSize = fileSize(pdfPath)
+		}
+		return file, nil
+	}
+
+	ctx, err := readContext(pdfPath)
+	if err == nil {
+		err = ctx.EnsurePageCount()
+	}
+	if err != nil {
+		return file, errors.New("Error counting pages of " + file.Name + ": " + err.Error())
+	}
+	file.Converted, file.Pages, file.Untagged = pdfPath, ctx.PageCount, !isTagged(ctx)
+	if optimizes(job.Options) {
+		file.Report.ConvertedSize = fileSize(pdfPath)
+	}
+	return file, nil
+}
+
+// transformCopy writes the result of fn for the PDF at path to name in the
+// scratch directory, and removes path if it was an intermediate file
+func (fh *FileHandler) transformCopy(path, name string, fn func(in, out string) error) (string, error) {
+	out := filepath.Join(fh.scratchDir, name)
+	if err := fn(path, out); err != nil {
+		os.Remove(out)
+		return "", err
+	}
+	fh.removeTemp(path)
+	return out, nil
+}
+
+// removeTemp removes an intermediate PDF unless it is an output or a cached
+// conversion
+func (fh *FileHandler) removeTemp(path string) {
+	if !strings.Contains(path, fh.outputDir) && !strings.HasPrefix(path, fh.cacheDir) {
+		os.Remove(path)
+	}
+}
+
+// postProcess applies the page-level options of a job to the merged PDF and
+// attaches sources, the kept originals of its uploads. Jobs with a page
+// limit per file are split into volumes, and the path of their archive is
+// returned in place of path. The page map of the job is made of pages, the
+// sources of the merged pages.
+func (fh *FileHandler) postProcess(job *Job, path string, sources []JobFile, pages []pageOrigin) (string, error) {
+	// Pages are resized first so the overlay and cover match them
+	var size types.Dim
+	if job.Options.Normalize != "" {
+		var err error
+		if size, err = normalizeSize(path, job.Options.Normalize); err != nil {
+			return "", fmt.Errorf("error normalizing page sizes: %v", err)
+		}
+		err = transformPDF(path, func(in, out string) error {
+			return normalizePDF(in, out, size, nil)
+		})
+		if err != nil {
+			return "", fmt.Errorf("error normalizing page sizes: %v", err)
+		}
+	}
+
+	if job.Options.Overlay != "" {
+		if err := applyOverlay(path, job.Options); err != nil {
+			return "", fmt.Errorf("error applying overlay: %v", err)
+		}
+	}
+
+	if job.Options.MaxPagesPerFile > 0 {
+		return fh.splitVolumes(job, path, sources, size, pages)
+	}
+	lead, err := fh.finishPDF(job, path, true, sources, size, pages)
+	if err != nil {
+		return "", err
+	}
+	// The pages of portfolios are those of their sheet
+	if !job.Options.Portfolio {
+		job.PageMap = pageRuns(job, pages, 0, lead)
+	}
+	return path, nil
+}
+
+// finishPDF adds the cover page of a job, if it has one and cover is set,
+// to the PDF at path, labels its pages, the last of which are pages, sets
+// its XMP metadata, language and viewer settings, attaches sources and
+// signs it. It returns the number of cover pages added, more than one when
+// the summary of the cover runs over.
+func (fh *FileHandler) finishPDF(job *Job, path string, cover bool, sources []JobFile, size types.Dim, pages []pageOrigin) (int, error) {
+	// The cover goes on last so page selections refer to the merged files
+	coverPages := 0
+	if cover && job.Options.Cover != nil {
+		page := filepath.Join(fh.scratchDir, job.ID+"_cover.pdf")
+		defer os.Remove(page)
+		n, err := renderCover(job.Options.Cover, job.CreatedAt.Local(), page)
+		if err != nil {
+			return 0, err
+		}
+		if err := fh.prependPages(job, path, page, size); err != nil {
+			return 0, fmt.Errorf("error adding cover page: %v", err)
+		}
+		coverPages = n
+	}
+
+	// Pages are imposed once the cover is among them
+	if job.Options.NUp > 0 {
+		err := transformPDF(path, func(in, out string) error {
+			return imposePDF(in, out, job.Options.NUp, job.Options.NUpSheet, job.Options.CutMarks)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("error imposing pages: %v", err)
+		}
+	}
+
+	// QR codes go on the pages as printed, the sheets when imposed
+	if job.Options.QRStamp != "" {
+		err := transformPDF(path, func(in, out string) error {
+			return stampQR(in, out, fh.verificationText(job), job.Options)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("error stamping QR code: %v", err)
+		}
+	}
+
+	// Print-ready output is converted before what the conversion might
+	// lose is added
+	pdfx := job.Options.PDFX != "" && fh.gs != nil
+	if (job.Options.CMYK || pdfx) && fh.gs != nil {
+		err := transformPDF(path, func(in, out string) error {
+			return fh.gs.convert(job, in, out)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("error converting for print: %v", err)
+		}
+	}
+
+	// Large files are not read into memory, and merge without labels or
+	// metadata
+	if !job.Options.LargeFiles {
+		if err := applyPageLabels(job, path, pages); err != nil {
+			return 0, fmt.Errorf("error labelling pages: %v", err)
+		}
+		if err := applyXMP(job, path, pages); err != nil {
+			return 0, fmt.Errorf("error setting XMP metadata: %v", err)
+		}
+		if err := applyViewerSettings(job, path); err != nil {
+			return 0, fmt.Errorf("error setting viewer preferences: %v", err)
+		}
+	}
+	if pdfx {
+		if err := fh.gs.mark(job, path, pages); err != nil {
+			return 0, fmt.Errorf("error marking PDF/X output: %v", err)
+		}
+	}
+
+	if len(sources) > 0 {
+		if err := attachSources(path, sources, job.CreatedAt); err != nil {
+			return 0, fmt.Errorf("error attaching original files: %v", err)
+		}
+	}
+
+	// Signing comes last as any later change would invalidate the signature
+	if job.Options.Sign && fh.signer != nil {
+		if err := fh.signer.signPDF(path, job.Options.SignVisible, job.Options.SignReason); err != nil {
+			return 0, fmt.Errorf("error signing: %v", err)
+		}
+	}
+	return coverPages, nil
+}
+
+// prependPages puts the pages of the generated PDF at pages in front of the
+// PDF at path, resized to size when the job normalizes page sizes
+func (fh *FileHandler) prependPages(job *Job, path, pages string, size types.Dim) error {
+	err := transformPDF(path, func(in, out string) error {
+		if !hasTaggedFiles(job) {
+			return api.MergeCreateFile([]string{pages, in}, out, false, pdfConfig())
+		}
+		// The merged PDF would lose its structure to the catalog of pages
+		paths, err := fh.prepareStructTrees(strings.TrimSuffix(filepath.Base(pages), ".pdf"), []string{pages, in})
+		if err != nil {
+			return err
+		}
+		defer fh.removeTemp(paths[1])
+		if err := api.MergeCreateFile(paths, out, false, pdfConfig()); err != nil {
+			return err
+		}
+		return joinStructTrees(out)
+	})
+	if err != nil || job.Options.Normalize == "" {
+		return err
+	}
+
+	n, err := api.PageCountFile(pages)
+	if err != nil {
+		return err
+	}
+	selected := types.IntSet{}
+	for i := 1; i <= n; i++ {
+		selected[i] = true
+	}
+	return transformPDF(path, func(in, out string) error {
+		return normalizePDF(in, out, size, selected)
+	})
+}
+
+// saveProgress stores the progress of a job being processed, so status
+// requests served by other processes see it
+func (fh *FileHandler) saveProgress(job *Job) {
+	if err := fh.jobs.Update(job); err != nil {
+		log.Printf("Error updating progress of job %s: %v", job.ID, err)
+	}
+}
+
+// failJob records a processing error on the job, with its code, and removes
+// its inputs
+func (fh *FileHandler) failJob(job *Job, code, msg string) {
+	job.Status = JobFailed
+	job.Error = msg
+	job.ErrorCode = code
+	if err := fh.jobs.Update(job); err != nil {
+		log.Printf("Error updating job %s: %v", job.ID, err)
+	}
+	fh.audit(AuditEvent{Action: AuditMerge, User: job.User, JobID: job.ID, Detail: "failed: " + msg})
+	fh.removeInputs(job)
+	fh.notifier.JobFinished(job)
+}
+
+// removeInputs removes the uploads of a failed job, the option files that
+// came with them and what the worker made of them, as a successful merge
+// does. Failed jobs are not taken up again.
+func (fh *FileHandler) removeInputs(job *Job) {
+	for _, f := range job.Files {
+		if f.Converted != "" {
+			fh.removeTemp(f.Converted)
+		}
+		if err := os.Remove(f.Path); err == nil {
+			fh.audit(AuditEvent{Action: AuditDelete, User: job.User, JobID: job.ID, File: f.Name, SHA256: f.SHA256, Detail: "upload removed after failure"})
+		}
+	}
+	if job.Options.Overlay != "" {
+		os.Remove(job.Options.Overlay)
+	}
+	if job.Options.ICCProfile != "" {
+		os.Remove(job.Options.ICCProfile)
+	}
+	if job.Options.Cover != nil && job.Options.Cover.Logo != "" {
+		os.Remove(job.Options.Cover.Logo)
+	}
+	matches, _ := filepath.Glob(filepath.Join(fh.scratchDir, job.ID+"_*"))
+	for _, m := range matches {
+		os.Remove(m)
+	}
+}
+
+// waitForJob blocks until the job is done or failed
+func (fh *FileHandler) waitForJob(ctx context.Context, id string) (*Job, error) {
+	for {
+		job, err := fh.jobs.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status == JobDone || job.Status == JobFailed {
+			return job, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// What becomes of the XMP metadata of the uploads
+const (
+	XMPDrop       = "drop"
+	XMPFirst      = "first"
+	XMPSynthesize = "synthesize"
+)
+
+// Namespace of the XMP media management properties
+const xmpMMNamespace = "http://ns.adobe.com/xap/1.0/mm/"
+
+// readXMP returns the XMP packet of the PDF at path, nil when it has none
+func readXMP(path string) ([]byte, error) {
+	ctx, err := readContext(path)
+	if err != nil {
+		return nil, err
+	}
+	sd, _, err := ctx.DereferenceStreamDict(ctx.RootDict["Metadata"])
+	if err != nil || sd == nil {
+		return nil, err
+	}
+	if err := sd.Decode(); err != nil {
+		return nil, err
+	}
+	return sd.Content, nil
+}
+
+// xmpDocumentID returns the xmpMM:DocumentID of an XMP packet, written as
+// an element or as an attribute of its description, if it has one
+func xmpDocumentID(packet []byte) string {
+	dec := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, a := range start.Attr {
+			if a.Name.Space == xmpMMNamespace && a.Name.Local == "DocumentID" {
+				return strings.TrimSpace(a.Value)
+			}
+		}
+		if start.Name.Space == xmpMMNamespace && start.Name.Local == "DocumentID" {
+			var id string
+			if dec.DecodeElement(&id, &start) != nil {
+				return ""
+			}
+			return strings.TrimSpace(id)
+		}
+	}
+}
+
+// newUUID returns a random UUID (version 4) as XMP identifiers use
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// xmpIngredient is an upload a synthesized packet lists as a source
+type xmpIngredient struct {
+	name, documentID string
+}
+
+// synthesizeXMP returns a new XMP packet for a merged PDF made of
+// ingredients, titled after the job when it is named. For PDF/X-4 output it
+// has the properties PDF/X requires, and it is always titled.
+func synthesizeXMP(job *Job, ingredients []xmpIngredient, now time.Time) []byte {
+	esc := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	date := func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	pdfx := job.Options.PDFX == PDFX4
+	title, created := job.Name, job.CreatedAt
+	if pdfx {
+		// The document information, which PDF/X wants the packet to match,
+		// is dated when the PDF is written
+		title, created = documentTitle(job), now
+	}
+
+	var b strings.Builder
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	b.WriteString("    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n")
+	b.WriteString("    xmlns:xmpMM=\"" + xmpMMNamespace + "\"\n")
+	if pdfx {
+		b.WriteString("    xmlns:pdf=\"http://ns.adobe.com/pdf/1.3/\"\n")
+		b.WriteString("    xmlns:pdfxid=\"http://www.npes.org/pdfx/ns/id/\"\n")
+	}
+	b.WriteString("    xmlns:stRef=\"http://ns.adobe.com/xap/1.0/sType/ResourceRef#\">\n")
+	b.WriteString("   <dc:format>application/pdf</dc:format>\n")
+	if title != "" {
+		b.WriteString("   <dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">" + esc(title) + "</rdf:li></rdf:Alt></dc:title>\n")
+	}
+	b.WriteString("   <xmp:CreateDate>" + date(created) + "</xmp:CreateDate>\n")
+	b.WriteString("   <xmp:ModifyDate>" + date(now) + "</xmp:ModifyDate>\n")
+	b.WriteString("   <xmp:MetadataDate>" + date(now) + "</xmp:MetadataDate>\n")
+	b.WriteString("   <xmpMM:DocumentID>" + newUUID() + "</xmpMM:DocumentID>\n")
+	b.WriteString("   <xmpMM:InstanceID>" + newUUID() + "</xmpMM:InstanceID>\n")
+	if pdfx {
+		b.WriteString("   <xmpMM:VersionID>1</xmpMM:VersionID>\n")
+		b.WriteString("   <xmpMM:RenditionClass>default</xmpMM:RenditionClass>\n")
+		b.WriteString("   <pdf:Trapped>False</pdf:Trapped>\n")
+		b.WriteString("   <pdfxid:GTS_PDFXVersion>" + pdfxVersions[PDFX4].name + "</pdfxid:GTS_PDFXVersion>\n")
+	}
+	if len(ingredients) > 0 {
+		b.WriteString("   <xmpMM:Ingredients>\n    <rdf:Bag>\n")
+		for _, in := range ingredients {
+			b.WriteString("     <rdf:li rdf:parseType=\"Resource\">\n")
+			b.WriteString("      <stRef:filePath>" + esc(in.name) + "</stRef:filePath>\n")
+			if in.documentID != "" {
+				b.WriteString("      <stRef:documentID>" + esc(in.documentID) + "</stRef:documentID>\n")
+			}
+			b.WriteString("     </rdf:li>\n")
+		}
+		b.WriteString("    </rdf:Bag>\n   </xmpMM:Ingredients>\n")
+	}
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n")
+	b.WriteString("<?xpacket end=\"w\"?>")
+	return []byte(b.String())
+}
+
+// xmpIngredients returns the uploads pages are of, in the order they first
+// appear
+func xmpIngredients(job *Job, pages []pageOrigin) []xmpIngredient {
+	var ingredients []xmpIngredient
+	seen := map[int]bool{}
+	for _, p := range pages {
+		if seen[p.file] {
+			continue
+		}
+		seen[p.file] = true
+		f := job.Files[p.file]
+		in := xmpIngredient{name: f.Name}
+		if strings.EqualFold(filepath.Ext(f.Name), ".pdf") {
+			if source, err := readXMP(f.Path); err == nil {
+				in.documentID = xmpDocumentID(source)
+			}
+		}
+		ingredients = append(ingredients, in)
+	}
+	return ingredients
+}
+
+// applyXMP sets the XMP metadata of the PDF at path, made of pages of the
+// uploads of a job, as the job says: none at all, that of the upload of
+// its first page, or a new packet listing the uploads it is made of. By
+// default it takes the first. Uploads removed by their conversion count as
+// having none. PDF/X-4 output is left to applyPDFX.
+func applyXMP(job *Job, path string, pages []pageOrigin) error {
+	// PDF/X-4 output gets its packet once it is print-ready
+	if job.Options.PDFX == PDFX4 {
+		return nil
+	}
+
+	var packet []byte
+	switch job.Options.XMP {
+	case XMPDrop:
+	case XMPSynthesize:
+		packet = synthesizeXMP(job, xmpIngredients(job, pages), time.Now())
+	default:
+		if len(pages) > 0 {
+			f := job.Files[pages[0].file]
+			if strings.EqualFold(filepath.Ext(f.Name), ".pdf") {
+				packet, _ = readXMP(f.Path)
+			}
+		}
+	}
+
+	return transformPDF(path, func(in, out string) error {
+		ctx, err := readContext(in)
+		if err != nil {
+			return err
+		}
+		// Merging leaves the packet of whichever PDF came first, or none
+		// once a cover is put in front
+		delete(ctx.RootDict, "Metadata")
+		if packet != nil {
+			ref, err := newMetadataStream(ctx, packet)
+			if err != nil {
+				return err
+			}
+			ctx.RootDict["Metadata"] = *ref
+		}
+		return api.WriteContextFile(ctx, out)
+	})
+}
+
+// documentTitle returns the title of the output of a job: its name, or a
+// generic title for unnamed jobs whose output must have one
+func documentTitle(job *Job) string {
+	if job.Name != "" {
+		return job.Name
+	}
+	return "Merged PDF"
+}
+
+// newMetadataStream adds an XMP packet to ctx as an uncompressed metadata
+// stream, so tools that don't parse PDF can still find it
+func newMetadataStream(ctx *model.Context, packet []byte) (*types.IndirectRef, error) {
+	sd := types.StreamDict{
+		Dict:    types.Dict{"Type": types.Name("Metadata"), "Subtype": types.Name("XML")},
+		Content: packet,
+	}
+	if err := sd.Encode(); err != nil {
+		return nil, err
+	}
+	return ctx.IndRefForNewObject(sd)
+}